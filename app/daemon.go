@@ -17,9 +17,8 @@ import (
 	"context"
 	"fmt"
 	"github.com/mendersoftware/mender-connect/limits/filetransfer"
-	"os/user"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -28,54 +27,88 @@ import (
 	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
 	"github.com/pkg/errors"
 
+	"github.com/mendersoftware/mender-connect/audit"
 	"github.com/mendersoftware/mender-connect/client/dbus"
+	"github.com/mendersoftware/mender-connect/client/https"
 	"github.com/mendersoftware/mender-connect/client/mender"
 	"github.com/mendersoftware/mender-connect/config"
 	"github.com/mendersoftware/mender-connect/connectionmanager"
+	"github.com/mendersoftware/mender-connect/logging"
+	"github.com/mendersoftware/mender-connect/metrics"
 	"github.com/mendersoftware/mender-connect/session"
 )
 
-var lastExpiredSessionSweep = time.Now()
 var expiredSessionsSweepFrequency = time.Second * 32
 
-const (
-	EventReconnect             = "reconnect"
-	EventReconnectRequest      = "reconnect-req"
-	EventConnectionEstablished = "connected"
-)
+// reconnectRetryInterval is the time waited before trying to reconnect again
+// once the connection manager gave up
+var reconnectRetryInterval = time.Second * 32
 
-type MenderShellDaemonEvent struct {
-	event string
-	data  string
-	id    string
-}
+// tokenRefreshTimeout is the time to wait for a new JWT token once requested
+var tokenRefreshTimeout = time.Second * 30
+
+// tokenStateQueueSize is the number of JwtTokenStateChange signals queued
+// for the main loop
+const tokenStateQueueSize = 16
 
 type MenderShellDaemon struct {
-	ctx                     context.Context
-	ctxCancel               context.CancelFunc
-	writeMutex              *sync.Mutex
-	eventChan               chan MenderShellDaemonEvent
-	connectionEstChan       chan MenderShellDaemonEvent
-	reconnectChan           chan MenderShellDaemonEvent
-	stop                    bool
+	ctx        context.Context
+	ctxCancel  context.CancelFunc
+	writeMutex *sync.Mutex
+	// statusChan requests the main loop to output the status
+	statusChan chan struct{}
+	// disconnectRequestChan requests the main loop to close the sessions
+	// and the connection, and not to reconnect
+	disconnectRequestChan chan struct{}
+	// disconnectedChan passes the read errors of the message loop to the
+	// main loop, which sends on connectedChan once reconnected
+	disconnectedChan chan error
+	connectedChan    chan struct{}
+	// tokenWatchOnce starts the relay of the JwtTokenStateChange signals
+	tokenWatchOnce          sync.Once
+	tokenWatch              *tokenWatch
 	authorized              bool
-	printStatus             bool
 	username                string
 	shell                   string
 	serverUrl               string
-	serverCertificate       string
-	skipVerify              bool
+	httpConfig              https.Config
+	dbusAPIName             string
+	authConfig              config.AuthConfig
 	deviceConnectUrl        string
 	expireSessionsAfter     time.Duration
 	expireSessionsAfterIdle time.Duration
+	reattachGracePeriod     time.Duration
+	scrollbackSize          int
+	shutdownTimeout         time.Duration
 	terminalString          string
 	uid                     uint64
 	gid                     uint64
 	homeDir                 string
 	shellsSpawned           uint
+	shellsSpawnedTotal      uint64
 	debug                   bool
 	trace                   bool
 	router                  session.Router
+	manager                 *connectionmanager.Manager
+	// shellSessions is the registry of the shell sessions of the daemon
+	shellSessions *session.MenderShellSessions
+	// audit records the events of the sessions to the audit log, once open
+	audit *audit.Recorder
+	// sessionsMutex serializes the operations on the shell sessions
+	sessionsMutex sync.Mutex
+	// shuttingDown is set once the shells are stopped on shutdown;
+	// protected by sessionsMutex
+	shuttingDown bool
+	// connectionState is the state returned by GetConnectionState
+	connectionState     atomic.Value
+	dbusService         *dbusService
+	dbusServiceConfig   config.DBusServiceConfig
+	controlSocketConfig config.ControlSocketConfig
+	metricsConfig       config.MetricsConfig
+	auditConfig         config.AuditConfig
+	// conf is the configuration in effect, which Reload compares the new
+	// one to; protected by sessionsMutex
+	conf *config.MenderShellConfig
 	config.TerminalConfig
 	config.FileTransferConfig
 	config.PortForwardConfig
@@ -83,46 +116,56 @@ type MenderShellDaemon struct {
 }
 
 func NewDaemon(conf *config.MenderShellConfig) *MenderShellDaemon {
+	manager := connectionmanager.NewManager(
+		time.Second * time.Duration(conf.Connection.PingWaitSeconds))
+	return NewDaemonWithManager(conf, manager)
+}
+
+// NewDaemonWithManager returns a new daemon using the given connection
+// manager, and its ping wait, to communicate with the server. The daemons
+// of a process have their own connections, shell sessions and audit log.
+func NewDaemonWithManager(
+	conf *config.MenderShellConfig,
+	manager *connectionmanager.Manager,
+) *MenderShellDaemon {
 	ctx, ctxCancel := context.WithCancel(context.Background())
 
-	// Setup ProtoMsg routes.
-	routes := make(session.ProtoRoutes)
-	if !conf.Terminal.Disable {
-		// Shell message is not handled by the Session, but the map
-		// entry must be set to give the correct 'accept' response.
-		routes[ws.ProtoTypeShell] = nil
-	}
-	if !conf.FileTransfer.Disable {
-		routes[ws.ProtoTypeFileTransfer] = session.FileTransfer(conf.Limits)
-	}
-	if !conf.PortForward.Disable {
-		routes[ws.ProtoTypePortForward] = session.PortForward()
-	}
-	if !conf.MenderClient.Disable {
-		routes[ws.ProtoTypeMenderClient] = session.MenderClient()
-	}
+	manager.SetMaxMessageSize(conf.Connection.MaxMessageSize)
+	manager.SetMaxOutboundMessageSize(conf.Connection.MaxOutboundMessageSize)
+	manager.SetWriteTimeout(time.Second * time.Duration(conf.Connection.WriteTimeoutSeconds))
+
+	service := &dbusService{}
+	recorder := &audit.Recorder{}
+	observer := session.Observers{service, auditObserver{recorder}}
 	router := session.NewRouter(
-		routes, session.Config{
-			IdleTimeout: connectionmanager.DefaultPingWait,
+		newProtoRoutes(conf, manager, recorder), session.Config{
+			IdleTimeout: manager.GetPingWait(),
+			Observer:    observer,
 		},
 	)
+	shellSessions := session.NewMenderShellSessions(observer, recorder)
+	shellSessions.SetMaxUserSessions(int(conf.Sessions.MaxPerUser))
 
 	daemon := MenderShellDaemon{
 		ctx:                     ctx,
 		ctxCancel:               ctxCancel,
 		writeMutex:              &sync.Mutex{},
-		eventChan:               make(chan MenderShellDaemonEvent),
-		connectionEstChan:       make(chan MenderShellDaemonEvent),
-		reconnectChan:           make(chan MenderShellDaemonEvent),
-		stop:                    false,
+		statusChan:              make(chan struct{}, 1),
+		disconnectRequestChan:   make(chan struct{}, 1),
+		disconnectedChan:        make(chan error),
+		connectedChan:           make(chan struct{}, 1),
 		authorized:              false,
 		username:                conf.User,
 		shell:                   conf.ShellCommand,
 		serverUrl:               conf.ServerURL,
-		serverCertificate:       conf.ServerCertificate,
-		skipVerify:              conf.SkipVerify,
+		httpConfig:              conf.GetHTTPConfig(),
+		dbusAPIName:             conf.DBusAPI,
+		authConfig:              conf.Authentication,
 		expireSessionsAfter:     time.Second * time.Duration(conf.Sessions.ExpireAfter),
 		expireSessionsAfterIdle: time.Second * time.Duration(conf.Sessions.ExpireAfterIdle),
+		reattachGracePeriod:     time.Second * time.Duration(conf.Sessions.ReattachGracePeriod),
+		scrollbackSize:          int(conf.Sessions.ScrollbackSize),
+		shutdownTimeout:         time.Second * time.Duration(conf.ShutdownTimeoutSeconds),
 		deviceConnectUrl:        config.DefaultDeviceConnectPath,
 		terminalString:          config.DefaultTerminalString,
 		TerminalConfig:          conf.Terminal,
@@ -133,116 +176,227 @@ func NewDaemon(conf *config.MenderShellConfig) *MenderShellDaemon {
 		debug:                   conf.Debug,
 		trace:                   conf.Trace,
 		router:                  router,
-	}
+		manager:                 manager,
+		shellSessions:           shellSessions,
+		audit:                   recorder,
+		dbusService:             service,
+		dbusServiceConfig:       conf.DBusService,
+		controlSocketConfig:     conf.ControlSocket,
+		metricsConfig:           conf.Metrics,
+		auditConfig:             conf.Audit,
+		conf:                    conf,
+	}
+
+	manager.SetReconnectIntervalSeconds(conf.ReconnectIntervalSeconds)
+	backoff := connectionmanager.BackoffConfig{
+		MaxInterval:             time.Second * time.Duration(conf.ReconnectBackoff.MaxIntervalSeconds),
+		Multiplier:              conf.ReconnectBackoff.Multiplier,
+		StablePeriod:            time.Second * time.Duration(conf.ReconnectBackoff.StablePeriodSeconds),
+		CircuitBreakerThreshold: uint(conf.ReconnectBackoff.CircuitBreakerThreshold),
+		CircuitBreakerCooldown:  time.Second * time.Duration(conf.ReconnectBackoff.CircuitBreakerCooldownSeconds),
+	}
+	manager.SetBackoffConfig(backoff)
+	servers := make([]string, 0, len(conf.Servers))
+	for _, server := range conf.Servers {
+		servers = append(servers, server.ServerURL)
+	}
+	manager.SetServers(servers)
+	return &daemon
+}
 
-	connectionmanager.SetReconnectIntervalSeconds(conf.ReconnectIntervalSeconds)
-	if conf.Sessions.MaxPerUser > 0 {
-		session.MaxUserSessions = int(conf.Sessions.MaxPerUser)
+// newProtoRoutes returns the routes of the sessions for the protocols
+// enabled in the configuration, recording their events with recorder
+func newProtoRoutes(
+	conf *config.MenderShellConfig,
+	manager *connectionmanager.Manager,
+	recorder *audit.Recorder,
+) session.ProtoRoutes {
+	chunkSize := session.ChunkSize(manager.GetMaxOutboundMessageSize())
+	routes := make(session.ProtoRoutes)
+	if !conf.Terminal.Disable {
+		// Shell message is not handled by the Session, but the map
+		// entry must be set to give the correct 'accept' response.
+		routes[ws.ProtoTypeShell] = nil
 	}
-	return &daemon
+	if !conf.FileTransfer.Disable {
+		routes[ws.ProtoTypeFileTransfer] = session.FileTransfer(conf.Limits, chunkSize, recorder)
+	}
+	if !conf.PortForward.Disable {
+		routes[ws.ProtoTypePortForward] = session.PortForward(chunkSize, recorder)
+	}
+	if !conf.MenderClient.Disable {
+		routes[ws.ProtoTypeMenderClient] = session.MenderClient(recorder)
+	}
+	return routes
 }
 
+// StopDaemon stops the daemon, which closes the sessions before exiting
 func (d *MenderShellDaemon) StopDaemon() {
-	d.stop = true
 	d.ctxCancel()
 }
 
+// PrintStatus requests the daemon to log its status
 func (d *MenderShellDaemon) PrintStatus() {
-	d.printStatus = true
+	select {
+	case d.statusChan <- struct{}{}:
+	default:
+		// already requested
+	}
+}
+
+// Disconnect requests the daemon to close the sessions and the connection
+// to the server, which is not reestablished until the daemon restarts
+func (d *MenderShellDaemon) Disconnect() {
+	select {
+	case d.disconnectRequestChan <- struct{}{}:
+	default:
+		// already requested
+	}
 }
 
 func (d *MenderShellDaemon) shouldStop() bool {
-	return d.stop
+	return d.ctx == nil || d.ctx.Err() != nil
 }
 
-func (d *MenderShellDaemon) shouldPrintStatus() bool {
-	return d.printStatus
+// sessionsExpire tells if the sessions expire, in which case the expired
+// ones are swept every expiredSessionsSweepFrequency; the caller holds
+// sessionsMutex
+func (d *MenderShellDaemon) sessionsExpire() bool {
+	return d.expireSessionsAfter != time.Duration(0) || d.expireSessionsAfterIdle != time.Duration(0)
 }
 
-func (d *MenderShellDaemon) timeToSweepSessions() bool {
-	if d.expireSessionsAfter == time.Duration(0) && d.expireSessionsAfterIdle == time.Duration(0) {
-		return false
+func (d *MenderShellDaemon) sweepExpiredSessions() {
+	d.sessionsMutex.Lock()
+	d.sweepDetachedSessions()
+	if !d.sessionsExpire() {
+		d.sessionsMutex.Unlock()
+		return
 	}
-
-	now := time.Now()
-	nextSweepAt := lastExpiredSessionSweep.Add(expiredSessionsSweepFrequency)
-	if now.After(nextSweepAt) {
-		lastExpiredSessionSweep = now
-		return true
-	} else {
-		return false
+	shellStoppedCount, sessionStoppedCount, totalExpiredLeft, err := d.shellSessions.TerminateExpired()
+	d.sessionsMutex.Unlock()
+	if err != nil {
+		d.logger().Errorf("main-loop: failed to terminate some expired sessions, left: %d",
+			totalExpiredLeft)
+	} else if sessionStoppedCount != 0 {
+		d.logger().Infof("main-loop: stopped %d sessions, %d shells, expired sessions left: %d",
+			shellStoppedCount, sessionStoppedCount, totalExpiredLeft)
 	}
 }
 
-func (d *MenderShellDaemon) wsReconnect(token string) (err error) {
-	err = connectionmanager.Reconnect(
-		ws.ProtoTypeShell, d.serverUrl,
-		d.deviceConnectUrl, token,
-		d.skipVerify, d.serverCertificate,
-		config.MaxReconnectAttempts, d.ctx,
-	)
-	if err != nil {
-		return errors.New("failed to reconnect after " + strconv.Itoa(int(config.MaxReconnectAttempts)) + " tries: " + err.Error())
-	} else {
-		return nil
+// sweepDetachedSessions closes the shell sessions detached for longer than
+// their reattach grace period; the caller holds sessionsMutex
+func (d *MenderShellDaemon) sweepDetachedSessions() {
+	for _, id := range d.shellSessions.GetSessionIds() {
+		s := d.shellSessions.GetById(id)
+		if s == nil || !s.IsDetachedExpired() {
+			continue
+		}
+		logger := d.logger().WithFields(
+			logging.SessionFields(id, s.Info().UserID, ws.ProtoTypeShell))
+		logger.Infof("closing the shell session %s: not reattached since %s",
+			id, s.DetachedAt().Format(time.RFC3339))
+		if err := d.closeShellSession(s, logger); err != nil {
+			logger.Errorf("failed to close the shell session %s: %s", id, err.Error())
+		}
 	}
 }
 
+// detachShellSessions marks the shell sessions as having lost their
+// client, on the loss of the connection
+func (d *MenderShellDaemon) detachShellSessions() {
+	d.sessionsMutex.Lock()
+	defer d.sessionsMutex.Unlock()
+	d.shellSessions.Detach()
+}
+
 func (d *MenderShellDaemon) outputStatus() {
-	log.Infof("mender-connect daemon v%s", config.VersionString())
-	log.Info(" status: ")
-	log.Infof("  sessions: %d", session.MenderShellSessionGetCount())
-	sessionIds := session.MenderShellSessionGetSessionIds()
+	logger := d.logger()
+	logger.Infof("mender-connect daemon v%s", config.VersionString())
+	logger.Info(" status: ")
+	logger.Infof("  server: %s", d.manager.GetActiveServerURL(ws.ProtoTypeShell))
+	reconnect := d.manager.GetReconnectStatus()
+	if reconnect.NextRetry.IsZero() {
+		logger.Infof("  reconnect: attempt:%d", reconnect.Attempt)
+	} else {
+		logger.Infof("  reconnect: attempt:%d next:%s circuit-open:%t", reconnect.Attempt,
+			reconnect.NextRetry.Format(time.RFC3339), reconnect.CircuitOpen)
+	}
+	counters := d.manager.GetCounters(ws.ProtoTypeShell)
+	logger.Infof("  compression: %t", counters.Compression)
+	logger.Infof("   tx: uncompressed/wire bytes %d/%d",
+		counters.TxMessageBytes, counters.TxWireBytes)
+	logger.Infof("   rx: uncompressed/wire bytes %d/%d",
+		counters.RxMessageBytes, counters.RxWireBytes)
+	logger.Info("  outbound queues:")
+	for _, q := range d.manager.GetQueueStats(ws.ProtoTypeShell) {
+		logger.Infof("   %s: depth:%d/%d sent:%d blocked:%d",
+			q.Priority, q.Depth, q.Capacity, q.Sent, q.Blocked)
+	}
+	d.sessionsMutex.Lock()
+	logger.Infof("  sessions: %d", d.shellSessions.GetCount())
+	sessionIds := d.shellSessions.GetSessionIds()
 	for _, id := range sessionIds {
-		s := session.MenderShellSessionGetById(id)
-		log.Infof("   id:%s status:%d started:%s", id, s.GetStatus(), s.GetStartedAtFmt())
-		log.Infof("   expires:%s active:%s", s.GetExpiresAtFmt(), s.GetActiveAtFmt())
-		log.Infof("   shell:%s", s.GetShellCommandPath())
-	}
-	log.Info("  file-transfer:")
+		s := d.shellSessions.GetById(id)
+		sessionLogger := logger.WithFields(
+			logging.SessionFields(id, s.Info().UserID, ws.ProtoTypeShell))
+		sessionLogger.Infof("   id:%s status:%d started:%s", id, s.GetStatus(),
+			s.GetStartedAtFmt())
+		sessionLogger.Infof("   expires:%s active:%s", s.GetExpiresAtFmt(), s.GetActiveAtFmt())
+		sessionLogger.Infof("   shell:%s", s.GetShellCommandPath())
+	}
+	d.sessionsMutex.Unlock()
+	logger.Info("  file-transfer:")
 	tx, rx, tx1m, rx1m := filetransfer.GetCounters()
-	log.Infof("   total: tx/rx %d/%d", tx, rx)
-	log.Infof("   1m: tx rx %.2f %.2f (w)", tx1m, rx1m)
-	d.printStatus = false
+	logger.Infof("   total: tx/rx %d/%d", tx, rx)
+	logger.Infof("   1m: tx rx %.2f %.2f (w)", tx1m, rx1m)
 }
 
+// messageLoop reads and routes the messages from the server until the
+// connection closes once the daemon stopped, so that the sessions keep
+// receiving messages while shutting down; on read errors, it waits for the
+// main loop to reconnect
 func (d *MenderShellDaemon) messageLoop() (err error) {
-	log.Trace("messageLoop: starting")
+	d.logger().Trace("messageLoop: starting")
 	for {
-		if d.shouldStop() {
-			log.Trace("messageLoop: returning")
-			break
-		}
-
-		log.Trace("messageLoop: calling readMessage")
+		d.logger().Trace("messageLoop: calling readMessage")
 		message, err := d.readMessage()
-		log.Tracef("messageLoop: called readMessage: %v,%v", message, err)
 		if err != nil {
-			log.Errorf("messageLoop: error on readMessage: %v; disconnecting, waiting for reconnect.", err)
-			connectionmanager.Close(ws.ProtoTypeShell)
-			e := MenderShellDaemonEvent{
-				event: EventReconnectRequest,
+			if d.shouldStop() {
+				break
+			}
+			d.logger().Errorf("messageLoop: error on readMessage: %s; disconnecting, "+
+				"waiting for reconnect.", err.Error())
+			d.manager.Close(ws.ProtoTypeShell)
+			d.setConnectionState(ConnectionStateDisconnected)
+			d.detachShellSessions()
+			select {
+			case d.disconnectedChan <- err:
+			case <-d.ctx.Done():
+				continue
+			}
+			d.logger().Trace("messageLoop: waiting for reconnect")
+			select {
+			case <-d.connectedChan:
+				d.logger().Trace("messageLoop: reconnected")
+			case <-d.ctx.Done():
 			}
-			log.Tracef("messageLoop: posting event: %s; waiting for response", e.event)
-			d.reconnectChan <- e
-			response := <-d.connectionEstChan
-			log.Tracef("messageLoop: got response: %+v", response)
 			continue
 		}
 
-		log.Tracef("got message: type:%s data length:%d", message.Header.MsgType, len(message.Body))
+		d.messageLogger(message).Tracef("got message: type:%s data length:%d",
+			message.Header.MsgType, len(message.Body))
 		err = d.routeMessage(message)
 		if err != nil {
-			log.Tracef("error routing message: %s", err.Error())
+			d.messageLogger(message).Tracef("error routing message: %s", err.Error())
 		}
 	}
 
-	log.Trace("messageLoop: returning")
+	d.logger().Trace("messageLoop: returning")
 	return err
 }
 
 func (d *MenderShellDaemon) waitForJWTToken(client mender.AuthClient) (string, error) {
-	tokenStateChange := client.GetJwtTokenStateChangeChannel()
+	tokenStateChange := d.tokenStateChange(client)
 	for {
 		select {
 		case p := <-tokenStateChange:
@@ -258,131 +412,341 @@ func (d *MenderShellDaemon) waitForJWTToken(client mender.AuthClient) (string, e
 	}
 }
 
-func (d *MenderShellDaemon) gotAuthToken(p []dbus.SignalParams, needsReconnect bool) string {
+// tokenWatch relays the JwtTokenStateChange signals of the authentication
+// client to the main loop, and wakes up the token refreshers waiting for a
+// new token on every signal
+type tokenWatch struct {
+	mutex sync.Mutex
+	// token is the one of the last signal, and changed closes on the next
+	// signal
+	token   string
+	changed chan struct{}
+	// states queues the signals for the main loop
+	states chan []dbus.SignalParams
+}
+
+// tokenStateChange returns the channel of the JwtTokenStateChange signals
+// of the client, relayed to let the token refreshers wait for them too
+func (d *MenderShellDaemon) tokenStateChange(client mender.AuthClient) <-chan []dbus.SignalParams {
+	d.tokenWatchOnce.Do(func() {
+		d.tokenWatch = &tokenWatch{
+			changed: make(chan struct{}),
+			states:  make(chan []dbus.SignalParams, tokenStateQueueSize),
+		}
+		go d.tokenWatch.relay(d.ctx, client.GetJwtTokenStateChangeChannel())
+	})
+	return d.tokenWatch.states
+}
+
+func (w *tokenWatch) relay(ctx context.Context, signals <-chan []dbus.SignalParams) {
+	for {
+		select {
+		case p := <-signals:
+			token := ""
+			if len(p) > 0 && p[0].ParamType == dbus.GDBusTypeString {
+				token, _ = p[0].ParamData.(string)
+			}
+			w.mutex.Lock()
+			w.token = token
+			close(w.changed)
+			w.changed = make(chan struct{})
+			w.mutex.Unlock()
+			select {
+			case w.states <- p:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// next returns the channel closing on the next signal
+func (w *tokenWatch) next() <-chan struct{} {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.changed
+}
+
+// lastToken returns the token of the last signal
+func (w *tokenWatch) lastToken() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.token
+}
+
+// jwtTokenRefresher returns the function the connection manager calls when
+// the server rejects the JWT token: it asks the Mender Authentication Manager
+// to fetch a new token, and waits for the JwtTokenStateChange signal with
+// it, which the main loop receives too
+func (d *MenderShellDaemon) jwtTokenRefresher(client mender.AuthClient) connectionmanager.TokenRefresher {
+	return func(rejectedToken string) (string, error) {
+		d.logger().Info("the JWT token was rejected, fetching a new one")
+		d.tokenStateChange(client)
+		changed := d.tokenWatch.next()
+		if _, err := client.FetchJWTToken(); err != nil {
+			return "", errors.Wrap(err, "failed to fetch a new JWT token")
+		}
+
+		timeout := time.After(tokenRefreshTimeout)
+		for {
+			select {
+			case <-changed:
+				changed = d.tokenWatch.next()
+				if token := d.tokenWatch.lastToken(); token != "" && token != rejectedToken {
+					return token, nil
+				}
+			case <-d.ctx.Done():
+				return "", errors.New("no new JWT token available")
+			case <-timeout:
+				return "", errors.New("no new JWT token available")
+			}
+		}
+	}
+}
+
+// gotAuthToken handles the JwtTokenStateChange signal, returning the token
+func (d *MenderShellDaemon) gotAuthToken(p []dbus.SignalParams) string {
 	jwtToken := p[0].ParamData.(string)
 	jwtTokenLength := len(jwtToken)
 	if jwtTokenLength > 0 {
 		if !d.authorized {
-			log.Tracef("dbusEventLoop: StateChanged from unauthorized"+
+			d.logger().Tracef("mainLoop: StateChanged from unauthorized"+
 				" to authorized, len(token)=%d", jwtTokenLength)
 			//in hereT technically it is possible we close a closed connection
 			//but it is not a critical error, the important thing is not to leave
 			//messageLoop waiting forever on readMessage
-			connectionmanager.Close(ws.ProtoTypeShell)
-			if needsReconnect {
-				e := MenderShellDaemonEvent{
-					event: EventReconnect,
-					data:  jwtToken,
-					id:    "(gotAuthToken)",
-				}
-				log.Tracef("(gotAuthToken) posting Event: %s", e.event)
-				d.postEvent(e)
-			}
+			d.manager.Close(ws.ProtoTypeShell)
+			d.setConnectionState(ConnectionStateDisconnected)
 		}
 		d.authorized = true
 	} else {
 		if d.authorized {
-			log.Tracef("dbusEventLoop: StateChanged from authorized to unauthorized." +
+			d.logger().Tracef("mainLoop: StateChanged from authorized to unauthorized." +
 				"terminating all sessions and disconnecting.")
-			shellsCount, sessionsCount, err := session.MenderSessionTerminateAll()
+			d.sessionsMutex.Lock()
+			shellsCount, sessionsCount, err := d.shellSessions.TerminateAll()
+			d.sessionsMutex.Unlock()
 			if err == nil {
-				log.Infof("dbusEventLoop terminated %d sessions, %d shells",
+				d.logger().Infof("mainLoop terminated %d sessions, %d shells",
 					shellsCount, sessionsCount)
 			} else {
-				log.Errorf("dbusEventLoop error terminating all sessions: %s",
+				d.logger().Errorf("mainLoop error terminating all sessions: %s",
 					err.Error())
 			}
 		}
-		connectionmanager.Close(ws.ProtoTypeShell)
+		d.manager.Close(ws.ProtoTypeShell)
+		d.setConnectionState(ConnectionStateUnauthorized)
 		d.authorized = false
 	}
 	return jwtToken
 }
 
-func (d *MenderShellDaemon) needsReconnect() bool {
-	select {
-	case e := <-d.reconnectChan:
-		log.Tracef("needsReconnect: got event: %s", e.event)
-		return true
-	case <-time.After(time.Second):
-		return false
-	}
+// reconnect connects again to the server in a new goroutine, sending the
+// result on the returned channel
+func (d *MenderShellDaemon) reconnect(serverURL, token string) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		d.logger().Trace("reconnect: reconnecting")
+		result <- d.manager.Reconnect(
+			ws.ProtoTypeShell, serverURL,
+			d.deviceConnectUrl, token,
+			d.httpConfig,
+			config.MaxReconnectAttempts, d.ctx,
+		)
+	}()
+	return result
 }
 
-func (d *MenderShellDaemon) dbusEventLoop(client mender.AuthClient) {
-	needsReconnect := false
+// mainLoop handles the events of the daemon until it stops: the changes of
+// the JWT token, the disconnections detected by the message loop, the
+// results of the reconnections, the sweeps of the expired sessions and the
+// requests of the status
+func (d *MenderShellDaemon) mainLoop(client mender.AuthClient, jwtToken string) {
+	tokenStateChange := d.tokenStateChange(client)
+	// the sessions may start expiring on reload, the sweep checks it
+	sweep := time.NewTicker(expiredSessionsSweepFrequency)
+	defer sweep.Stop()
+
+	serverURL := d.serverUrl
+	// disconnected is set while the message loop waits for a new connection
+	disconnected := false
+	// reconnected is set while reconnecting
+	var reconnected <-chan error
+	// retry is set while waiting to reconnect again
+	var retry <-chan time.Time
+	// offline is set once disconnected on request, not to reconnect
+	offline := false
+
+	d.logger().Trace("mender-connect entering main loop.")
 	for {
-		if d.shouldStop() {
-			break
-		}
+		select {
+		case <-d.ctx.Done():
+			d.logger().Trace("mainLoop: returning")
+			return
 
-		if d.needsReconnect() {
-			log.Trace("dbusEventLoop: daemon needs to reconnect")
-			needsReconnect = true
-		}
+		case <-d.statusChan:
+			d.outputStatus()
 
-		p, _ := client.WaitForJwtTokenStateChange()
-		if len(p) > 0 && p[0].ParamType == dbus.GDBusTypeString {
-			token := d.gotAuthToken(p, needsReconnect)
-			if len(token) > 0 {
-				log.Tracef("dbusEventLoop: got a token len=%d", len(token))
-				needsReconnect = false
+		case <-d.disconnectRequestChan:
+			if !offline {
+				offline = true
+				d.disconnect()
 			}
-		}
-		if needsReconnect && d.authorized {
-			jwtToken, serverURL, _ := client.GetJWTToken()
-			e := MenderShellDaemonEvent{
-				event: EventReconnect,
-				data:  jwtToken,
-				id:    "(dbusEventLoop)",
+
+		case <-sweep.C:
+			d.sweepExpiredSessions()
+
+		case p := <-tokenStateChange:
+			if len(p) == 0 || p[0].ParamType != dbus.GDBusTypeString {
+				break
+			}
+			if len(p) > 1 && p[1].ParamType == dbus.GDBusTypeString {
+				if url, _ := p[1].ParamData.(string); url != "" {
+					serverURL = url
+				}
 			}
-			log.Tracef("(dbusEventLoop) posting Event: %s", e.event)
-			d.serverUrl = serverURL
-			d.postEvent(e)
-			needsReconnect = false
+			jwtToken = d.gotAuthToken(p)
+			d.logger().Tracef("mainLoop: got a token len=%d", len(jwtToken))
+
+		case err := <-d.disconnectedChan:
+			d.logger().Tracef("mainLoop: disconnected: %s", err.Error())
+			disconnected = true
+
+		case err := <-reconnected:
+			reconnected = nil
+			if d.shouldStop() {
+				break
+			} else if offline {
+				if err == nil {
+					d.manager.Close(ws.ProtoTypeShell)
+				}
+				break
+			} else if err != nil {
+				d.logger().Errorf("mainLoop: error reconnecting: %s; retrying in %s",
+					err.Error(), reconnectRetryInterval)
+				retry = time.After(reconnectRetryInterval)
+				break
+			}
+			d.logger().Trace("mainLoop: reconnected")
+			d.setConnectionState(ConnectionStateConnected)
+			disconnected = false
+			d.connectedChan <- struct{}{}
+
+		case <-retry:
+			retry = nil
 		}
-	}
 
-	log.Trace("dbusEventLoop: returning")
+		if disconnected && d.authorized && !offline && reconnected == nil && retry == nil {
+			reconnected = d.reconnect(serverURL, jwtToken)
+		}
+	}
 }
 
-func (d *MenderShellDaemon) postEvent(event MenderShellDaemonEvent) {
-	d.eventChan <- event
+// disconnect closes the sessions, notifying the server, and the connection
+func (d *MenderShellDaemon) disconnect() {
+	d.logger().Info("disconnecting from the server on local request")
+	for _, info := range d.sessionInfos() {
+		err := d.terminateSession(info.ID)
+		if err != nil && err != session.ErrNoSession {
+			d.logger().WithFields(logging.SessionFields(info.ID, info.UserID, info.Proto)).
+				Errorf("failed to terminate the session %s: %s", info.ID, err.Error())
+		}
+	}
+	d.manager.Close(ws.ProtoTypeShell)
+	d.setConnectionState(ConnectionStateDisconnected)
 }
 
-func (d *MenderShellDaemon) readEvent() MenderShellDaemonEvent {
-	return <-d.eventChan
+// shutdown closes the sessions before the daemon exits: it stops the shells
+// and, concurrently, lets the other sessions complete their pending
+// operations until the shutdown timeout, notifying the server, then closes
+// the connection
+func (d *MenderShellDaemon) shutdown() {
+	d.sessionsMutex.Lock()
+	shutdownTimeout := d.shutdownTimeout
+	d.sessionsMutex.Unlock()
+	d.logger().Infof("shutting down, closing the sessions within %s", shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	routerShutdown := make(chan error, 1)
+	go func() {
+		routerShutdown <- d.router.Shutdown(ctx)
+	}()
+	d.stopShells()
+	if err := <-routerShutdown; err != nil {
+		d.logger().Warnf("terminated the sessions still open after %s", shutdownTimeout)
+	}
+
+	d.manager.Close(ws.ProtoTypeShell)
+	d.setConnectionState(ConnectionStateDisconnected)
 }
 
-func (d *MenderShellDaemon) eventLoop() {
-	var err error
-	for {
-		if d.shouldStop() {
-			break
+// stopShells notifies the server of the end of the shell sessions and
+// terminates the shells; no shells spawn from then on
+func (d *MenderShellDaemon) stopShells() {
+	var sessions []*session.MenderShellSession
+	d.sessionsMutex.Lock()
+	d.shuttingDown = true
+	for _, id := range d.shellSessions.GetSessionIds() {
+		s := d.shellSessions.GetById(id)
+		msg := &ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     ws.ProtoTypeShell,
+				MsgType:   wsshell.MessageTypeStopShell,
+				SessionID: id,
+				Properties: map[string]interface{}{
+					"status": wsshell.NormalMessage,
+				},
+			},
 		}
-
-		event := d.readEvent()
-		log.Tracef("eventLoop: got event: %s", event.event)
-		switch event.event {
-		case EventReconnect:
-			err = connectionmanager.Reconnect(
-				ws.ProtoTypeShell, d.serverUrl,
-				d.deviceConnectUrl, event.data,
-				d.skipVerify, d.serverCertificate,
-				config.MaxReconnectAttempts, d.ctx,
-			)
-			if err != nil {
-				log.Errorf("eventLoop: event: error reconnecting: %s", err.Error())
-			} else {
-				log.Trace("eventLoop: reconnected")
-				d.connectionEstChan <- MenderShellDaemonEvent{
-					event: EventConnectionEstablished,
-				}
-			}
+		if err := d.responseMessage(msg); err != nil {
+			d.messageLogger(msg).Errorf(
+				"failed to notify the server of the end of the session %s: %s",
+				id, err.Error())
 		}
+		_ = d.shellSessions.DeleteById(id)
+		sessions = append(sessions, s)
+	}
+	d.shellsSpawned = 0
+	d.sessionsMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range sessions {
+		wg.Add(1)
+		go func(s *session.MenderShellSession) {
+			defer wg.Done()
+			err := s.StopShell()
+			if err != nil && err != session.ErrSessionShellNotRunning {
+				info := s.Info()
+				d.logger().WithFields(logging.SessionFields(info.ID, info.UserID, info.Proto)).
+					Errorf("failed to stop the shell of the session %s: %s",
+						s.GetId(), err.Error())
+			}
+		}(s)
 	}
+	wg.Wait()
+}
 
-	log.Trace("eventLoop: returning")
+func (d *MenderShellDaemon) standaloneAuthConfig() mender.StandaloneAuthConfig {
+	return mender.StandaloneAuthConfig{
+		TokenFile:             d.authConfig.TokenFile,
+		TokenFilePollInterval: time.Second * time.Duration(d.authConfig.TokenFilePollIntervalSeconds),
+		TokenCommand:          d.authConfig.TokenCommand,
+		TokenCommandTimeout:   time.Second * time.Duration(d.authConfig.TokenCommandTimeoutSeconds),
+	}
+}
+
+func (d *MenderShellDaemon) setConnectionState(state string) {
+	d.connectionState.Store(state)
+}
+
+func (d *MenderShellDaemon) getConnectionState() string {
+	if state, ok := d.connectionState.Load().(string); ok {
+		return state
+	}
+	return ConnectionStateDisconnected
 }
 
 func (d *MenderShellDaemon) setupLogging() {
@@ -393,7 +757,7 @@ func (d *MenderShellDaemon) setupLogging() {
 	}
 }
 
-//starts all needed elements of the mender-connect daemon
+// starts all needed elements of the mender-connect daemon
 // * executes given shell (shell.ExecuteShell)
 // * get dbus API and starts the dbus main loop (dbus.GetDBusAPI(), go dbusAPI.MainLoopRun(loop))
 // * creates a new dbus client and connects to dbus (mender.NewAuthClient(dbusAPI), client.Connect(...))
@@ -403,62 +767,117 @@ func (d *MenderShellDaemon) setupLogging() {
 func (d *MenderShellDaemon) Run() error {
 	d.setupLogging()
 
-	log.Trace("daemon Run starting")
-	u, err := user.Lookup(d.username)
-	if err == nil && u == nil {
-		return errors.New("unknown error while getting a user id")
-	}
+	d.logger().Trace("daemon Run starting")
+	d.sessionsMutex.Lock()
+	err := d.setUser(d.username)
+	d.sessionsMutex.Unlock()
 	if err != nil {
 		return err
 	}
 
-	d.homeDir = u.HomeDir
-
-	d.uid, err = strconv.ParseUint(u.Uid, 10, 32)
-	if err != nil {
-		return err
+	if d.auditConfig.Enable {
+		auditLog, err := d.openAuditLog()
+		if err != nil {
+			d.logger().Errorf("failed to open the audit log %s: %s",
+				d.auditConfig.File, err.Error())
+			return err
+		}
+		defer auditLog.Close()
+		defer d.audit.SetLog(nil)
 	}
 
-	d.gid, err = strconv.ParseUint(u.Gid, 10, 32)
-	if err != nil {
-		return err
+	standalone := d.authConfig.Mode == config.AuthModeStandalone
+	var dbusAPI dbus.DBusAPI
+	if !standalone || !d.dbusServiceConfig.Disable {
+		d.logger().Trace("mender-connect connecting to dbus")
+
+		if d.dbusAPIName != "" {
+			if err := dbus.SelectDBusAPI(d.dbusAPIName); err != nil {
+				return err
+			}
+		}
+		dbusAPI, err = dbus.GetDBusAPI()
+		if err != nil && !standalone {
+			return err
+		} else if err != nil {
+			d.logger().Warnf("D-Bus is not available: %s", err.Error())
+		} else {
+			//dbus main loop, required.
+			loop := dbusAPI.MainLoopNew()
+			go dbusAPI.MainLoopRun(loop)
+			defer dbusAPI.MainLoopQuit(loop)
+		}
 	}
 
-	log.Trace("mender-connect connecting to dbus")
+	if dbusAPI != nil && d.dbusService != nil && !d.dbusServiceConfig.Disable {
+		err = d.dbusService.publish(dbusAPI, d.handleDBusServiceCall)
+		if err != nil {
+			d.logger().Errorf("failed to publish the D-Bus service %s: %s", DBusServiceName, err.Error())
+		} else {
+			defer d.dbusService.unpublish()
+		}
+	}
 
-	dbusAPI, err := dbus.GetDBusAPI()
-	if err != nil {
-		return err
+	if !d.controlSocketConfig.Disable {
+		server, err := d.listenControlSocket()
+		if err != nil {
+			d.logger().Errorf("failed to listen on the control socket %s: %s",
+				d.controlSocketConfig.Path, err.Error())
+		} else {
+			go server.Serve() //nolint:errcheck
+			defer server.Close()
+		}
 	}
 
-	//dbus main loop, required.
-	loop := dbusAPI.MainLoopNew()
-	go dbusAPI.MainLoopRun(loop)
-	defer dbusAPI.MainLoopQuit(loop)
+	if d.metricsConfig.Enable {
+		server, err := metrics.Listen(d.metricsConfig.Address, d.collectMetrics)
+		if err != nil {
+			d.logger().Errorf("failed to listen for the metrics on %s: %s",
+				d.metricsConfig.Address, err.Error())
+		} else {
+			go server.Serve() //nolint:errcheck
+			defer server.Close()
+		}
+	}
 
-	//new dbus client
-	client, err := mender.NewAuthClient(dbusAPI)
-	if err != nil {
-		log.Errorf("mender-shall dbus failed to create client, error: %s", err.Error())
-		return err
+	var client mender.AuthClient
+	if standalone {
+		d.logger().Trace("mender-connect using the standalone authentication")
+		client, err = mender.NewStandaloneAuthClient(d.ctx, d.standaloneAuthConfig())
+		if err != nil {
+			d.logger().Errorf("mender-connect failed to create the authentication client, error: %s",
+				err.Error())
+			return err
+		}
+	} else {
+		//new dbus client
+		client, err = mender.NewAuthClient(dbusAPI)
+		if err != nil {
+			d.logger().Errorf("mender-shall dbus failed to create client, error: %s", err.Error())
+			return err
+		}
 	}
 
 	//connection to dbus
 	err = client.Connect(mender.DBusObjectName, mender.DBusObjectPath, mender.DBusInterfaceName)
 	if err != nil {
-		log.Errorf("mender-shall dbus failed to connect, error: %s", err.Error())
+		d.logger().Errorf("mender-shall dbus failed to connect, error: %s", err.Error())
 		return err
 	}
 
+	d.manager.SetTokenRefresher(d.jwtTokenRefresher(client))
+	defer d.manager.SetTokenRefresher(nil)
+
 	jwtToken, serverURL, err := client.GetJWTToken()
 	if err != nil {
-		log.Warnf("call to GetJWTToken on the Mender D-Bus API failed: %v", err)
+		d.logger().Warnf("call to GetJWTToken on the Mender D-Bus API failed: %v", err)
 	}
 	d.serverUrl = serverURL
 
-	log.Tracef("GetJWTToken().len=%d", len(jwtToken))
+	d.logger().Tracef("GetJWTToken().len=%d", len(jwtToken))
 	if len(jwtToken) < 1 {
-		log.Info("waiting for JWT token (waitForJWTToken)")
+		d.setConnectionState(ConnectionStateUnauthorized)
+		d.logger().Info("waiting for JWT token (waitForJWTToken)")
 		jwtToken, err = d.waitForJWTToken(client)
 		if err != nil {
 			return err
@@ -467,57 +886,52 @@ func (d *MenderShellDaemon) Run() error {
 	} else {
 		d.authorized = true
 	}
-	log.Tracef("mender-connect got len(JWT)=%d", len(jwtToken))
+	d.logger().Tracef("mender-connect got len(JWT)=%d", len(jwtToken))
 
-	err = connectionmanager.Connect(ws.ProtoTypeShell,
+	err = d.manager.Connect(ws.ProtoTypeShell,
 		d.serverUrl,
 		d.deviceConnectUrl,
 		jwtToken,
-		d.skipVerify,
-		d.serverCertificate,
+		d.httpConfig,
 		0,
 		d.ctx,
 	)
 	if err != nil {
-		log.Errorf("error on connecting, probably interrupted: %s", err.Error())
+		d.logger().Errorf("error on connecting, probably interrupted: %s", err.Error())
 		return err
 	}
+	d.setConnectionState(ConnectionStateConnected)
 
-	go d.messageLoop()
-	go d.dbusEventLoop(client)
-	go d.eventLoop()
-
-	log.Trace("mender-connect entering main loop.")
-	for {
-		if d.shouldStop() {
-			break
-		}
-
-		if d.shouldPrintStatus() {
-			d.outputStatus()
-		}
-
-		if d.timeToSweepSessions() {
-			shellStoppedCount, sessionStoppedCount, totalExpiredLeft, err := session.MenderSessionTerminateExpired()
-			if err != nil {
-				log.Errorf("main-loop: failed to terminate some expired sessions, left: %d",
-					totalExpiredLeft)
-			} else if sessionStoppedCount != 0 {
-				log.Infof("main-loop: stopped %d sessions, %d shells, expired sessions left: %d",
-					shellStoppedCount, sessionStoppedCount, totalExpiredLeft)
-			}
-		}
+	messageLoopDone := make(chan struct{})
+	go func() {
+		defer close(messageLoopDone)
+		d.messageLoop() //nolint:errcheck
+	}()
+	d.mainLoop(client, jwtToken)
+	d.shutdown()
+	<-messageLoopDone
+	return nil
+}
 
-		time.Sleep(time.Second)
+// logger returns the entry the daemon logs with, carrying the ID of the
+// connection to the server while connected
+func (d *MenderShellDaemon) logger() *log.Entry {
+	if connectionID := d.manager.GetConnectionID(ws.ProtoTypeShell); connectionID != "" {
+		return log.WithField(logging.FieldConnectionID, connectionID)
 	}
+	return log.NewEntry(log.StandardLogger())
+}
 
-	log.Trace("mainLoop: returning")
-	return nil
+// messageLogger returns the entry logging about a message, carrying the
+// fields of its session and the ID of the connection
+func (d *MenderShellDaemon) messageLogger(msg *ws.ProtoMsg) *log.Entry {
+	return d.logger().WithFields(logging.MessageFields(&msg.Header))
 }
 
 func (d *MenderShellDaemon) responseMessage(msg *ws.ProtoMsg) (err error) {
-	log.Tracef("responseMessage: webSock.WriteMessage(%+v)", msg)
-	return connectionmanager.Write(ws.ProtoTypeShell, msg)
+	d.messageLogger(msg).Tracef("responseMessage: type:%s data length:%d",
+		msg.Header.MsgType, len(msg.Body))
+	return d.manager.Write(ws.ProtoTypeShell, msg)
 }
 
 func (d *MenderShellDaemon) routeMessage(msg *ws.ProtoMsg) error {
@@ -527,11 +941,15 @@ func (d *MenderShellDaemon) routeMessage(msg *ws.ProtoMsg) error {
 	//       Use the new API in sessions package (see filetransfer.go for an example)
 	switch msg.Header.Proto {
 	case ws.ProtoTypeShell:
-		if d.TerminalConfig.Disable {
-			break
-		}
+		d.sessionsMutex.Lock()
+		defer d.sessionsMutex.Unlock()
 		switch msg.Header.MsgType {
 		case wsshell.MessageTypeSpawnShell:
+			if d.TerminalConfig.Disable {
+				// the shells spawned before the terminal was
+				// disabled on reload are served until they stop
+				break
+			}
 			return d.routeMessageSpawnShell(msg)
 		case wsshell.MessageTypeStopShell:
 			return d.routeMessageStopShell(msg)
@@ -560,28 +978,30 @@ func (d *MenderShellDaemon) routeMessage(msg *ws.ProtoMsg) error {
 		Body: []byte(err.Error()),
 	}
 	if err := d.responseMessage(response); err != nil {
-		log.Errorf(errors.Wrap(err, "unable to send the response message").Error())
+		d.messageLogger(msg).Errorf(
+			errors.Wrap(err, "unable to send the response message").Error())
 	}
 	return err
 }
 
 func (d *MenderShellDaemon) routeMessageResponse(response *ws.ProtoMsg, err error) {
 	if err != nil {
-		log.Errorf(err.Error())
+		d.messageLogger(response).Errorf(err.Error())
 		response.Header.Properties["status"] = wsshell.ErrorMessage
 		response.Body = []byte(err.Error())
 	} else if response == nil {
 		return
 	}
 	if err := d.responseMessage(response); err != nil {
-		log.Errorf(errors.Wrap(err, "unable to send the response message").Error())
+		d.messageLogger(response).Errorf(
+			errors.Wrap(err, "unable to send the response message").Error())
 	}
 }
 
 func (d *MenderShellDaemon) readMessage() (*ws.ProtoMsg, error) {
-	msg, err := connectionmanager.Read(ws.ProtoTypeShell)
-	log.Tracef("webSock.ReadMessage()=%+v,%v", msg, err)
+	msg, err := d.manager.Read(ws.ProtoTypeShell)
 	if err != nil {
+		d.logger().Tracef("webSock.ReadMessage: %s", err.Error())
 		return nil, err
 	}
 
@@ -0,0 +1,55 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"github.com/mendersoftware/mender-connect/audit"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// auditObserver records the sessions opening and closing in the audit log
+type auditObserver struct {
+	recorder *audit.Recorder
+}
+
+func (o auditObserver) recordSession(eventType string, info session.Info) {
+	o.recorder.Record(audit.Event{
+		Type:      eventType,
+		SessionID: info.ID,
+		UserID:    info.UserID,
+		Proto:     protocolName(info.Proto),
+	})
+}
+
+// SessionOpened records the session_open event
+func (o auditObserver) SessionOpened(info session.Info) {
+	o.recordSession(audit.EventSessionOpen, info)
+}
+
+// SessionClosed records the session_close event
+func (o auditObserver) SessionClosed(info session.Info) {
+	o.recordSession(audit.EventSessionClose, info)
+}
+
+// openAuditLog opens the audit log and records the events to it
+func (d *MenderShellDaemon) openAuditLog() (*audit.Log, error) {
+	l, err := audit.Open(d.auditConfig.File,
+		int64(d.auditConfig.FileMaxSizeMB)*1024*1024, d.auditConfig.FileMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	d.audit.SetLog(l)
+	return l, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/audit"
+	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+func TestAuditObserver(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	d := &MenderShellDaemon{
+		audit: &audit.Recorder{},
+		auditConfig: config.AuditConfig{
+			Enable:         true,
+			File:           path.Join(tdir, "audit.log"),
+			FileMaxSizeMB:  1,
+			FileMaxBackups: 1,
+		},
+	}
+	auditLog, err := d.openAuditLog()
+	assert.NoError(t, err)
+
+	info := session.Info{
+		ID:     "session",
+		UserID: "user",
+		Proto:  ws.ProtoTypePortForward,
+	}
+	observer := auditObserver{d.audit}
+	observer.SessionOpened(info)
+	observer.SessionClosed(info)
+	assert.NoError(t, auditLog.Close())
+
+	b, err := ioutil.ReadFile(d.auditConfig.File)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[0], `"event":"session_open","session_id":"session",`+
+			`"user_id":"user","proto":"portforward"`)
+		assert.Contains(t, lines[1], `"event":"session_close","session_id":"session",`+
+			`"user_id":"user","proto":"portforward"`)
+	}
+	v, err := audit.Verify(d.auditConfig.File)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), v.Records)
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"os/user"
+	"strconv"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+
+	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/control"
+	"github.com/mendersoftware/mender-connect/limits/filetransfer"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// listenControlSocket creates the control socket, accessible to root and
+// the configured group
+func (d *MenderShellDaemon) listenControlSocket() (*control.Server, error) {
+	gid := -1
+	if d.controlSocketConfig.Group != "" {
+		group, err := user.LookupGroup(d.controlSocketConfig.Group)
+		if err != nil {
+			return nil, err
+		}
+		gid, err = strconv.Atoi(group.Gid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return control.Listen(d.controlSocketConfig.Path, gid, &controlHandler{d: d})
+}
+
+// controlHandler serves the control API
+type controlHandler struct {
+	d *MenderShellDaemon
+}
+
+func (h *controlHandler) Status() control.Status {
+	d := h.d
+	reconnect := d.manager.GetReconnectStatus()
+	counters := d.manager.GetCounters(ws.ProtoTypeShell)
+	tx, rx, tx1m, rx1m := filetransfer.GetCounters()
+	status := control.Status{
+		Version: config.VersionString(),
+		Connection: control.Connection{
+			State:            d.getConnectionState(),
+			ServerURL:        d.manager.GetActiveServerURL(ws.ProtoTypeShell),
+			ReconnectAttempt: reconnect.Attempt,
+			CircuitOpen:      reconnect.CircuitOpen,
+			Compression:      counters.Compression,
+			TxMessageBytes:   counters.TxMessageBytes,
+			TxWireBytes:      counters.TxWireBytes,
+			RxMessageBytes:   counters.RxMessageBytes,
+			RxWireBytes:      counters.RxWireBytes,
+		},
+		Sessions: len(d.sessionInfos()),
+		FileTransfer: control.FileTransferCounters{
+			TxBytes:     tx,
+			RxBytes:     rx,
+			TxAverage1m: tx1m,
+			RxAverage1m: rx1m,
+		},
+		PortForwards: []control.PortForward{},
+	}
+	if !reconnect.NextRetry.IsZero() {
+		status.Connection.NextRetry = &reconnect.NextRetry
+	}
+	for _, f := range session.PortForwards() {
+		status.PortForwards = append(status.PortForwards, control.PortForward{
+			SessionID:    f.SessionID,
+			ConnectionID: f.ConnectionID,
+			Protocol:     f.Protocol,
+			RemoteHost:   f.RemoteHost,
+			RemotePort:   f.RemotePort,
+			StartedAt:    f.StartedAt,
+		})
+	}
+	return status
+}
+
+func (h *controlHandler) Sessions() []control.Session {
+	sessions := []control.Session{}
+	for _, info := range h.d.sessionInfos() {
+		sessions = append(sessions, control.Session{
+			ID:        info.ID,
+			UserID:    info.UserID,
+			Protocol:  protocolName(info.Proto),
+			StartedAt: info.StartedAt,
+			ActiveAt:  info.ActiveAt,
+		})
+	}
+	return sessions
+}
+
+func (h *controlHandler) KillSession(sessionID string) error {
+	err := h.d.terminateSession(sessionID)
+	if err == session.ErrNoSession {
+		return control.ErrNoSession
+	}
+	return err
+}
+
+func (h *controlHandler) Disconnect() {
+	h.d.Disconnect()
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/connectionmanager"
+	"github.com/mendersoftware/mender-connect/control"
+	"github.com/mendersoftware/mender-connect/session"
+	sessmocks "github.com/mendersoftware/mender-connect/session/mocks"
+)
+
+func TestControlSocket(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mender-connect-control")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	startedAt := time.Now().Add(-time.Minute)
+	router := &sessmocks.Router{}
+	router.On("Sessions").Return([]session.Info{{
+		ID:        "ft-session",
+		UserID:    "user",
+		Proto:     ws.ProtoTypeFileTransfer,
+		StartedAt: startedAt,
+		ActiveAt:  startedAt,
+	}})
+	router.On("Terminate", "ft-session").Return(nil)
+	router.On("Terminate", "unknown").Return(session.ErrNoSession)
+	defer router.AssertExpectations(t)
+
+	d := &MenderShellDaemon{
+		manager:               connectionmanager.NewManager(testPingWait),
+		router:                router,
+		shellSessions:         session.NewMenderShellSessions(nil, nil),
+		disconnectRequestChan: make(chan struct{}, 1),
+		controlSocketConfig: config.ControlSocketConfig{
+			Path: path.Join(tdir, "control.sock"),
+		},
+	}
+	d.setConnectionState(ConnectionStateConnected)
+	server, err := d.listenControlSocket()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	go server.Serve() //nolint:errcheck
+	defer server.Close()
+	client := control.NewClient(d.controlSocketConfig.Path)
+
+	status, err := client.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, config.VersionString(), status.Version)
+	assert.Equal(t, ConnectionStateConnected, status.Connection.State)
+	assert.Equal(t, 1, status.Sessions)
+	assert.NotNil(t, status.PortForwards)
+
+	sessions, err := client.Sessions()
+	assert.NoError(t, err)
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, "ft-session", sessions[0].ID)
+		assert.Equal(t, "user", sessions[0].UserID)
+		assert.Equal(t, "filetransfer", sessions[0].Protocol)
+		assert.True(t, startedAt.Equal(sessions[0].StartedAt))
+	}
+
+	assert.NoError(t, client.KillSession("ft-session"))
+	assert.Equal(t, control.ErrNoSession, client.KillSession("unknown"))
+
+	assert.NoError(t, client.Disconnect())
+	select {
+	case <-d.disconnectRequestChan:
+	default:
+		t.Fatal("the disconnection was not requested")
+	}
+}
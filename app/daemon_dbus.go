@@ -0,0 +1,272 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/client/dbus"
+	"github.com/mendersoftware/mender-connect/logging"
+	"github.com/mendersoftware/mender-connect/procps"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// Names of the mender-connect D-Bus service
+const (
+	DBusServiceName          = "io.mender.Connect"
+	DBusServiceObjectPath    = "/io/mender/Connect"
+	DBusServiceInterfaceName = "io.mender.Connect1"
+)
+
+// Connection states returned by the GetConnectionState method
+const (
+	ConnectionStateConnected    = "connected"
+	ConnectionStateDisconnected = "disconnected"
+	ConnectionStateUnauthorized = "unauthorized"
+)
+
+// D-Bus error returned by TerminateSession for unknown sessions
+const dbusErrorNoSession = "io.mender.Connect1.Error.NoSuchSession"
+
+const dbusServiceIntrospection = `<node>
+  <interface name="io.mender.Connect1">
+    <method name="ListSessions">
+      <arg type="a(sssxx)" name="sessions" direction="out"/>
+    </method>
+    <method name="TerminateSession">
+      <arg type="s" name="session_id" direction="in"/>
+    </method>
+    <method name="GetConnectionState">
+      <arg type="s" name="state" direction="out"/>
+      <arg type="s" name="server_url" direction="out"/>
+    </method>
+    <signal name="SessionOpened">
+      <arg type="s" name="session_id"/>
+      <arg type="s" name="user_id"/>
+      <arg type="s" name="protocol"/>
+    </signal>
+    <signal name="SessionClosed">
+      <arg type="s" name="session_id"/>
+      <arg type="s" name="user_id"/>
+      <arg type="s" name="protocol"/>
+    </signal>
+  </interface>
+</node>`
+
+// protocolName returns the name of the protocol of a session, as reported
+// on D-Bus
+func protocolName(proto ws.ProtoType) string {
+	return logging.ProtoName(proto)
+}
+
+// dbusService publishes the io.mender.Connect1 interface on the system
+// bus; it observes the sessions to emit the SessionOpened and SessionClosed
+// signals once published
+type dbusService struct {
+	mutex          sync.Mutex
+	dbusAPI        dbus.DBusAPI
+	conn           dbus.Handle
+	registrationID uint
+	published      bool
+}
+
+// publish exports the D-Bus object, passing the method calls to handler,
+// and owns the name of the service
+func (s *dbusService) publish(dbusAPI dbus.DBusAPI, handler dbus.MethodHandler) error {
+	conn, err := dbusAPI.BusGet(dbus.GBusTypeSystem)
+	if err != nil {
+		return err
+	}
+	registrationID, err := dbusAPI.BusRegisterObject(conn, DBusServiceObjectPath,
+		dbusServiceIntrospection, handler)
+	if err != nil {
+		return err
+	}
+	if err := dbusAPI.BusOwnName(conn, DBusServiceName); err != nil {
+		_ = dbusAPI.BusUnregisterObject(conn, registrationID)
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dbusAPI = dbusAPI
+	s.conn = conn
+	s.registrationID = registrationID
+	s.published = true
+	return nil
+}
+
+// unpublish releases the name of the service and stops exporting the
+// D-Bus object
+func (s *dbusService) unpublish() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.published {
+		return
+	}
+	s.published = false
+	if err := s.dbusAPI.BusReleaseName(s.conn, DBusServiceName); err != nil {
+		log.Debugf("failed to release the D-Bus name %s: %s", DBusServiceName, err.Error())
+	}
+	if err := s.dbusAPI.BusUnregisterObject(s.conn, s.registrationID); err != nil {
+		log.Debugf("failed to unregister the D-Bus object %s: %s",
+			DBusServiceObjectPath, err.Error())
+	}
+}
+
+func (s *dbusService) emitSessionSignal(signalName string, info session.Info) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.published {
+		return
+	}
+	err := s.dbusAPI.BusEmitSignal(s.conn, DBusServiceObjectPath, DBusServiceInterfaceName,
+		signalName, []interface{}{info.ID, info.UserID, protocolName(info.Proto)})
+	if err != nil {
+		log.WithFields(logging.SessionFields(info.ID, info.UserID, info.Proto)).
+			Errorf("failed to emit the D-Bus signal %s: %s", signalName, err.Error())
+	}
+}
+
+// SessionOpened emits the SessionOpened signal
+func (s *dbusService) SessionOpened(info session.Info) {
+	s.emitSessionSignal("SessionOpened", info)
+}
+
+// SessionClosed emits the SessionClosed signal
+func (s *dbusService) SessionClosed(info session.Info) {
+	s.emitSessionSignal("SessionClosed", info)
+}
+
+// handleDBusServiceCall handles the calls of the methods of the
+// io.mender.Connect1 interface
+func (d *MenderShellDaemon) handleDBusServiceCall(
+	interfaceName string,
+	methodName string,
+	params []dbus.SignalParams,
+) ([]interface{}, error) {
+	switch methodName {
+	case "ListSessions":
+		return []interface{}{d.listSessions()}, nil
+	case "TerminateSession":
+		sessionID, _ := params[0].ParamData.(string)
+		err := d.terminateSession(sessionID)
+		if err == session.ErrNoSession {
+			return nil, &dbus.MethodError{
+				Name:    dbusErrorNoSession,
+				Message: "no session with the ID " + sessionID,
+			}
+		}
+		return nil, err
+	case "GetConnectionState":
+		return []interface{}{d.getConnectionState(),
+			d.manager.GetActiveServerURL(ws.ProtoTypeShell)}, nil
+	}
+	return nil, &dbus.MethodError{
+		Name:    "org.freedesktop.DBus.Error.UnknownMethod",
+		Message: "unknown method " + interfaceName + "." + methodName,
+	}
+}
+
+// sessionInfos returns the open shell sessions and the sessions of the
+// router
+func (d *MenderShellDaemon) sessionInfos() []session.Info {
+	var infos []session.Info
+	d.sessionsMutex.Lock()
+	for _, id := range d.shellSessions.GetSessionIds() {
+		if s := d.shellSessions.GetById(id); s != nil {
+			infos = append(infos, s.Info())
+		}
+	}
+	d.sessionsMutex.Unlock()
+	return append(infos, d.router.Sessions()...)
+}
+
+// listSessions returns the open sessions as the values of the D-Bus
+// a(sssxx) type: the ID, the user ID, the protocol, the start time as UNIX
+// time and the idle time in seconds of every session
+func (d *MenderShellDaemon) listSessions() []interface{} {
+	now := time.Now()
+	sessions := []interface{}{}
+	for _, info := range d.sessionInfos() {
+		sessions = append(sessions, []interface{}{
+			info.ID,
+			info.UserID,
+			protocolName(info.Proto),
+			info.StartedAt.Unix(),
+			int64(now.Sub(info.ActiveAt).Seconds()),
+		})
+	}
+	return sessions
+}
+
+// terminateSession closes the session with the given ID, stopping its
+// shell if it is a shell session, and notifies the server; it returns
+// session.ErrNoSession if there is no such session
+func (d *MenderShellDaemon) terminateSession(sessionID string) error {
+	d.sessionsMutex.Lock()
+	s := d.shellSessions.GetById(sessionID)
+	if s == nil {
+		d.sessionsMutex.Unlock()
+		return d.router.Terminate(sessionID)
+	}
+	defer d.sessionsMutex.Unlock()
+
+	logger := d.logger().WithFields(
+		logging.SessionFields(sessionID, s.Info().UserID, ws.ProtoTypeShell))
+	logger.Infof("terminating the shell session %s on local request", sessionID)
+	return d.closeShellSession(s, logger)
+}
+
+// closeShellSession stops the shell of the session, if running, deletes
+// the session and notifies the server; the caller holds sessionsMutex
+func (d *MenderShellDaemon) closeShellSession(s *session.MenderShellSession, logger *log.Entry) error {
+	sessionID := s.GetId()
+	// the shell shared with a peer session keeps running
+	peer := s.IsPeer()
+	if err := s.StopShell(); err != session.ErrSessionShellNotRunning && !peer {
+		if err != nil && procps.ProcessExists(s.GetShellPid()) {
+			return errors.Wrap(err, "failed to stop the shell")
+		}
+		if d.shellsSpawned > 0 {
+			d.shellsSpawned--
+		}
+	}
+	if err := d.shellSessions.DeleteById(sessionID); err != nil {
+		return err
+	}
+
+	msg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeStopShell,
+			SessionID: sessionID,
+			Properties: map[string]interface{}{
+				"status": wsshell.NormalMessage,
+			},
+		},
+	}
+	if err := d.responseMessage(msg); err != nil {
+		logger.Errorf("failed to notify the server of the termination of the session %s: %s",
+			sessionID, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/mender-connect/client/dbus"
+	dbusmocks "github.com/mendersoftware/mender-connect/client/dbus/mocks"
+	"github.com/mendersoftware/mender-connect/connectionmanager"
+	"github.com/mendersoftware/mender-connect/session"
+	sessmocks "github.com/mendersoftware/mender-connect/session/mocks"
+)
+
+func TestProtocolName(t *testing.T) {
+	assert.Equal(t, "shell", protocolName(ws.ProtoTypeShell))
+	assert.Equal(t, "filetransfer", protocolName(ws.ProtoTypeFileTransfer))
+	assert.Equal(t, "portforward", protocolName(ws.ProtoTypePortForward))
+	assert.Equal(t, "menderclient", protocolName(ws.ProtoTypeMenderClient))
+	assert.Equal(t, "0x00FF", protocolName(ws.ProtoType(0xff)))
+}
+
+func TestHandleDBusServiceCall(t *testing.T) {
+	startedAt := time.Now().Add(-time.Minute)
+	router := &sessmocks.Router{}
+	router.On("Sessions").Return([]session.Info{{
+		ID:        "ft-session",
+		UserID:    "user",
+		Proto:     ws.ProtoTypeFileTransfer,
+		StartedAt: startedAt,
+		ActiveAt:  startedAt.Add(30 * time.Second),
+	}})
+	router.On("Terminate", "ft-session").Return(nil)
+	router.On("Terminate", "unknown").Return(session.ErrNoSession)
+	defer router.AssertExpectations(t)
+
+	d := &MenderShellDaemon{
+		manager:       connectionmanager.NewManager(testPingWait),
+		router:        router,
+		shellSessions: session.NewMenderShellSessions(nil, nil),
+	}
+
+	values, err := d.handleDBusServiceCall(DBusServiceInterfaceName, "ListSessions", nil)
+	assert.NoError(t, err)
+	if assert.Len(t, values, 1) {
+		sessions := values[0].([]interface{})
+		if assert.Len(t, sessions, 1) {
+			fields := sessions[0].([]interface{})
+			assert.Equal(t, "ft-session", fields[0])
+			assert.Equal(t, "user", fields[1])
+			assert.Equal(t, "filetransfer", fields[2])
+			assert.Equal(t, startedAt.Unix(), fields[3])
+			assert.InDelta(t, 30, fields[4], 2)
+		}
+	}
+
+	_, err = d.handleDBusServiceCall(DBusServiceInterfaceName, "TerminateSession",
+		[]dbus.SignalParams{{ParamType: "s", ParamData: "ft-session"}})
+	assert.NoError(t, err)
+
+	_, err = d.handleDBusServiceCall(DBusServiceInterfaceName, "TerminateSession",
+		[]dbus.SignalParams{{ParamType: "s", ParamData: "unknown"}})
+	if assert.Error(t, err) {
+		methodErr, ok := err.(*dbus.MethodError)
+		if assert.True(t, ok) {
+			assert.Equal(t, dbusErrorNoSession, methodErr.Name)
+		}
+	}
+
+	values, err = d.handleDBusServiceCall(DBusServiceInterfaceName, "GetConnectionState", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{ConnectionStateDisconnected, ""}, values)
+
+	d.setConnectionState(ConnectionStateConnected)
+	values, err = d.handleDBusServiceCall(DBusServiceInterfaceName, "GetConnectionState", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{ConnectionStateConnected, ""}, values)
+
+	_, err = d.handleDBusServiceCall(DBusServiceInterfaceName, "Unknown", nil)
+	assert.Error(t, err)
+}
+
+func TestDBusService(t *testing.T) {
+	info := session.Info{
+		ID:     "session",
+		UserID: "user",
+		Proto:  ws.ProtoTypeShell,
+	}
+	service := &dbusService{}
+	// not published, no signals
+	service.SessionOpened(info)
+
+	dbusAPI := &dbusmocks.DBusAPI{}
+	defer dbusAPI.AssertExpectations(t)
+	conn := dbus.Handle(nil)
+	dbusAPI.On("BusGet", uint(dbus.GBusTypeSystem)).Return(conn, nil)
+	dbusAPI.On("BusRegisterObject", conn, DBusServiceObjectPath, dbusServiceIntrospection,
+		mock.AnythingOfType("dbus.MethodHandler")).Return(uint(1), nil)
+	dbusAPI.On("BusOwnName", conn, DBusServiceName).Return(nil)
+	dbusAPI.On("BusEmitSignal", conn, DBusServiceObjectPath, DBusServiceInterfaceName,
+		"SessionOpened", []interface{}{"session", "user", "shell"}).Return(nil)
+	dbusAPI.On("BusEmitSignal", conn, DBusServiceObjectPath, DBusServiceInterfaceName,
+		"SessionClosed", []interface{}{"session", "user", "shell"}).
+		Return(errors.New("error"))
+	dbusAPI.On("BusReleaseName", conn, DBusServiceName).Return(nil)
+	dbusAPI.On("BusUnregisterObject", conn, uint(1)).Return(nil)
+
+	handler := func(string, string, []dbus.SignalParams) ([]interface{}, error) {
+		return nil, nil
+	}
+	err := service.publish(dbusAPI, handler)
+	assert.NoError(t, err)
+	service.SessionOpened(info)
+	service.SessionClosed(info)
+	service.unpublish()
+	// unpublished, no more signals
+	service.SessionClosed(info)
+	service.unpublish()
+}
+
+func TestDBusServicePublishError(t *testing.T) {
+	dbusAPI := &dbusmocks.DBusAPI{}
+	defer dbusAPI.AssertExpectations(t)
+	conn := dbus.Handle(nil)
+	dbusAPI.On("BusGet", uint(dbus.GBusTypeSystem)).Return(conn, nil)
+	dbusAPI.On("BusRegisterObject", conn, DBusServiceObjectPath, dbusServiceIntrospection,
+		mock.AnythingOfType("dbus.MethodHandler")).Return(uint(1), nil)
+	dbusAPI.On("BusOwnName", conn, DBusServiceName).
+		Return(errors.New("the name is already owned"))
+	dbusAPI.On("BusUnregisterObject", conn, uint(1)).Return(nil)
+
+	service := &dbusService{}
+	err := service.publish(dbusAPI, func(string, string, []dbus.SignalParams) ([]interface{}, error) {
+		return nil, nil
+	})
+	assert.EqualError(t, err, "the name is already owned")
+	assert.False(t, service.published)
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"github.com/mendersoftware/go-lib-micro/ws"
+
+	"github.com/mendersoftware/mender-connect/limits/filetransfer"
+	"github.com/mendersoftware/mender-connect/metrics"
+	"github.com/mendersoftware/mender-connect/session"
+)
+
+// metric returns a metric with a single unlabelled sample
+func metric(name, help, metricType string, value float64) metrics.Metric {
+	return metrics.Metric{
+		Name:    name,
+		Help:    help,
+		Type:    metricType,
+		Samples: []metrics.Sample{{Value: value}},
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// collectMetrics returns the telemetry of the daemon
+func (d *MenderShellDaemon) collectMetrics() []metrics.Metric {
+	state := metrics.Metric{
+		Name: "mender_connect_connection_state",
+		Help: "State of the connection to the server",
+		Type: metrics.TypeGauge,
+	}
+	currentState := d.getConnectionState()
+	for _, s := range []string{
+		ConnectionStateConnected,
+		ConnectionStateDisconnected,
+		ConnectionStateUnauthorized,
+	} {
+		state.Samples = append(state.Samples, metrics.Sample{
+			Labels: []metrics.Label{{Name: "state", Value: s}},
+			Value:  boolValue(s == currentState),
+		})
+	}
+
+	sessionCounts := map[ws.ProtoType]int{}
+	for _, info := range d.sessionInfos() {
+		sessionCounts[info.Proto]++
+	}
+	sessions := metrics.Metric{
+		Name: "mender_connect_sessions",
+		Help: "Open sessions, by protocol",
+		Type: metrics.TypeGauge,
+	}
+	for _, proto := range []ws.ProtoType{
+		ws.ProtoTypeShell,
+		ws.ProtoTypeFileTransfer,
+		ws.ProtoTypePortForward,
+		ws.ProtoTypeMenderClient,
+	} {
+		sessions.Samples = append(sessions.Samples, metrics.Sample{
+			Labels: []metrics.Label{{Name: "protocol", Value: protocolName(proto)}},
+			Value:  float64(sessionCounts[proto]),
+		})
+	}
+
+	reconnect := d.manager.GetReconnectStatus()
+	ftTx, ftRx, ftTx1m, ftRx1m := filetransfer.GetCounters()
+	pfTx, pfRx := session.PortForwardCounters()
+	d.sessionsMutex.Lock()
+	shells, shellsSpawned := d.shellsSpawned, d.shellsSpawnedTotal
+	d.sessionsMutex.Unlock()
+
+	return []metrics.Metric{
+		state,
+		metric("mender_connect_connections",
+			"Connections established to the server",
+			metrics.TypeCounter, float64(reconnect.Connections)),
+		metric("mender_connect_connection_failures",
+			"Failed attempts to connect to the server",
+			metrics.TypeCounter, float64(reconnect.Failures)),
+		metric("mender_connect_reconnect_attempt",
+			"Consecutive failed attempts to reconnect to the server",
+			metrics.TypeGauge, float64(reconnect.Attempt)),
+		metric("mender_connect_circuit_breaker_open",
+			"Whether the reconnect circuit breaker is open",
+			metrics.TypeGauge, boolValue(reconnect.CircuitOpen)),
+		sessions,
+		metric("mender_connect_filetransfer_tx_bytes",
+			"Bytes transferred off the device",
+			metrics.TypeCounter, float64(ftTx)),
+		metric("mender_connect_filetransfer_rx_bytes",
+			"Bytes transferred onto the device",
+			metrics.TypeCounter, float64(ftRx)),
+		metric("mender_connect_filetransfer_tx_bytes_1m",
+			"Moving average of the bytes transferred off the device over the last minute",
+			metrics.TypeGauge, ftTx1m),
+		metric("mender_connect_filetransfer_rx_bytes_1m",
+			"Moving average of the bytes transferred onto the device over the last minute",
+			metrics.TypeGauge, ftRx1m),
+		metric("mender_connect_portforward_tx_bytes",
+			"Bytes sent to the server from the remote ends of the port forwards",
+			metrics.TypeCounter, float64(pfTx)),
+		metric("mender_connect_portforward_rx_bytes",
+			"Bytes written to the remote ends of the port forwards",
+			metrics.TypeCounter, float64(pfRx)),
+		metric("mender_connect_portforwards",
+			"Open port forwards",
+			metrics.TypeGauge, float64(len(session.PortForwards()))),
+		metric("mender_connect_shells",
+			"Running shells",
+			metrics.TypeGauge, float64(shells)),
+		metric("mender_connect_shells_spawned",
+			"Shells spawned",
+			metrics.TypeCounter, float64(shellsSpawned)),
+		metric("mender_connect_handler_panics",
+			"Panics of the session handlers recovered",
+			metrics.TypeCounter, float64(session.HandlerPanics())),
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/connectionmanager"
+	"github.com/mendersoftware/mender-connect/metrics"
+	"github.com/mendersoftware/mender-connect/session"
+	sessmocks "github.com/mendersoftware/mender-connect/session/mocks"
+)
+
+func TestCollectMetrics(t *testing.T) {
+	router := &sessmocks.Router{}
+	router.On("Sessions").Return([]session.Info{{
+		ID:     "ft-session",
+		UserID: "user",
+		Proto:  ws.ProtoTypeFileTransfer,
+	}})
+	defer router.AssertExpectations(t)
+
+	d := &MenderShellDaemon{
+		manager:            connectionmanager.NewManager(testPingWait),
+		router:             router,
+		shellSessions:      session.NewMenderShellSessions(nil, nil),
+		shellsSpawnedTotal: 3,
+	}
+	d.setConnectionState(ConnectionStateConnected)
+
+	var b bytes.Buffer
+	err := metrics.Write(&b, d.collectMetrics(), false)
+	assert.NoError(t, err)
+	out := b.String()
+	for _, sample := range []string{
+		"mender_connect_connection_state{state=\"connected\"} 1\n",
+		"mender_connect_connection_state{state=\"disconnected\"} 0\n",
+		"mender_connect_sessions{protocol=\"filetransfer\"} 1\n",
+		"mender_connect_sessions{protocol=\"shell\"} 0\n",
+		"mender_connect_shells 0\n",
+		"mender_connect_shells_spawned_total 3\n",
+		"# TYPE mender_connect_filetransfer_tx_bytes_total counter\n",
+		"# TYPE mender_connect_portforward_rx_bytes_total counter\n",
+		"# TYPE mender_connect_handler_panics_total counter\n",
+		"# TYPE mender_connect_connection_failures_total counter\n",
+	} {
+		assert.Contains(t, out, sample)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mender-connect/config"
+)
+
+// setUser looks up the user who owns the shell processes and sets it,
+// leaving the current one if the lookup fails; the caller holds
+// sessionsMutex
+func (d *MenderShellDaemon) setUser(username string) error {
+	u, err := user.Lookup(username)
+	if err == nil && u == nil {
+		return errors.New("unknown error while getting a user id")
+	}
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return err
+	}
+
+	d.username = username
+	d.homeDir = u.HomeDir
+	d.uid = uid
+	d.gid = gid
+	return nil
+}
+
+// Reload applies a new, validated, configuration and logs the settings
+// which changed. The shell, the user, the terminal, the sessions settings,
+// the limits, the enabled protocols and the shutdown timeout apply to the
+// new sessions, the open ones are kept; the other settings require a
+// restart. On error nothing changes.
+func (d *MenderShellDaemon) Reload(conf *config.MenderShellConfig) error {
+	d.sessionsMutex.Lock()
+	defer d.sessionsMutex.Unlock()
+
+	next := *d.conf
+	next.ShellCommand = conf.ShellCommand
+	next.User = conf.User
+	next.Terminal = conf.Terminal
+	next.Sessions = conf.Sessions
+	next.Limits = conf.Limits
+	next.ShutdownTimeoutSeconds = conf.ShutdownTimeoutSeconds
+	next.FileTransfer = conf.FileTransfer
+	next.PortForward = conf.PortForward
+	next.MenderClient = conf.MenderClient
+
+	applied := config.ChangedSettings(d.conf, &next)
+	ignored := config.ChangedSettings(&next, conf)
+	if len(applied) == 0 && len(ignored) == 0 {
+		d.logger().Info("reload: the configuration did not change")
+		return nil
+	}
+	if next.User != d.conf.User {
+		if err := d.setUser(next.User); err != nil {
+			return errors.Wrapf(err, "reload: failed to look up the user %q", next.User)
+		}
+	}
+
+	d.shell = next.ShellCommand
+	d.TerminalConfig = next.Terminal
+	d.expireSessionsAfter = time.Second * time.Duration(next.Sessions.ExpireAfter)
+	d.expireSessionsAfterIdle = time.Second * time.Duration(next.Sessions.ExpireAfterIdle)
+	d.reattachGracePeriod = time.Second * time.Duration(next.Sessions.ReattachGracePeriod)
+	d.scrollbackSize = int(next.Sessions.ScrollbackSize)
+	d.shellSessions.SetMaxUserSessions(int(next.Sessions.MaxPerUser))
+	d.shutdownTimeout = time.Second * time.Duration(next.ShutdownTimeoutSeconds)
+	d.FileTransferConfig = next.FileTransfer
+	d.PortForwardConfig = next.PortForward
+	d.MenderClientConfig = next.MenderClient
+	d.router.SetRoutes(newProtoRoutes(&next, d.manager, d.audit))
+	d.conf = &next
+
+	for _, name := range applied {
+		d.logger().Infof("reload: %s changed", name)
+	}
+	for _, name := range ignored {
+		d.logger().Warnf("reload: %s changed, it requires a restart to apply", name)
+	}
+	return nil
+}
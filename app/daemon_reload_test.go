@@ -0,0 +1,90 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package app
+
+import (
+	"os/user"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/session"
+	sessmocks "github.com/mendersoftware/mender-connect/session/mocks"
+)
+
+func TestReload(t *testing.T) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	conf := config.NewMenderShellConfig()
+	conf.ServerURL = "https://hosted.mender.io"
+	conf.User = currentUser.Username
+	conf.ShellCommand = "/bin/sh"
+	conf.Terminal.Width = 80
+	conf.Terminal.Height = 24
+	conf.ShutdownTimeoutSeconds = config.DefaultShutdownTimeoutSeconds
+	d := NewDaemon(conf)
+	router := &sessmocks.Router{}
+	defer router.AssertExpectations(t)
+	d.router = router
+
+	// unchanged: nothing to apply
+	unchanged := *conf
+	err = d.Reload(&unchanged)
+	assert.NoError(t, err)
+
+	router.On("SetRoutes", mock.MatchedBy(func(routes session.ProtoRoutes) bool {
+		_, fileTransfer := routes[ws.ProtoTypeFileTransfer]
+		_, portForward := routes[ws.ProtoTypePortForward]
+		return !fileTransfer && portForward
+	})).Return().Once()
+
+	changed := *conf
+	changed.ServerURL = "https://eu.hosted.mender.io"
+	changed.Terminal.Width = 100
+	changed.Sessions.MaxPerUser = 3
+	changed.Sessions.ExpireAfterIdle = 60
+	changed.Sessions.ReattachGracePeriod = 120
+	changed.ShutdownTimeoutSeconds = 5
+	changed.FileTransfer.Disable = true
+	err = d.Reload(&changed)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(100), d.TerminalConfig.Width)
+	assert.Equal(t, 3, d.shellSessions.GetMaxUserSessions())
+	assert.Equal(t, time.Minute, d.expireSessionsAfterIdle)
+	assert.Equal(t, 2*time.Minute, d.reattachGracePeriod)
+	assert.True(t, d.sessionsExpire())
+	assert.Equal(t, 5*time.Second, d.shutdownTimeout)
+	assert.True(t, d.FileTransferConfig.Disable)
+	// the server URL requires a restart
+	assert.Equal(t, "https://hosted.mender.io", d.conf.ServerURL)
+	assert.Equal(t, uint16(100), d.conf.Terminal.Width)
+
+	// unknown user: nothing changes
+	invalid := changed
+	invalid.User = "no-such-user-for-mender-connect"
+	invalid.Terminal.Width = 120
+	err = d.Reload(&invalid)
+	assert.Error(t, err)
+	assert.Equal(t, currentUser.Username, d.username)
+	assert.Equal(t, uint16(100), d.TerminalConfig.Width)
+	assert.Equal(t, currentUser.Username, d.conf.User)
+}
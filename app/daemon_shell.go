@@ -19,7 +19,6 @@ import (
 	"github.com/mendersoftware/go-lib-micro/ws"
 	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
 	"github.com/pkg/errors"
-	log "github.com/sirupsen/logrus"
 
 	"github.com/mendersoftware/mender-connect/config"
 	"github.com/mendersoftware/mender-connect/procps"
@@ -31,6 +30,8 @@ const (
 	propertyTerminalHeight = "terminal_height"
 	propertyTerminalWidth  = "terminal_width"
 	propertyUserID         = "user_id"
+	propertyAttachTo       = "attach_to"
+	propertyAttachMode     = "attach_mode"
 )
 
 func getUserIdFromMessage(message *ws.ProtoMsg) string {
@@ -51,19 +52,29 @@ func (d *MenderShellDaemon) routeMessageSpawnShell(message *ws.ProtoMsg) error {
 		},
 		Body: []byte{},
 	}
-	if d.shellsSpawned >= config.MaxShellsSpawned {
+	if d.shuttingDown {
+		err = session.ErrShutdown
+		d.routeMessageResponse(response, err)
+		return err
+	}
+	if sharedID, _ := message.Header.Properties[propertyAttachTo].(string); sharedID != "" {
+		return d.attachToShell(sharedID, message, response)
+	}
+	s := d.shellSessions.GetById(message.Header.SessionID)
+	if s != nil && s.GetStatus() == session.ActiveSession && d.reattachGracePeriod > 0 {
+		return d.reattachShell(s, message, response)
+	} else if d.shellsSpawned >= config.MaxShellsSpawned {
 		err = session.ErrSessionTooManyShellsAlreadyRunning
 		d.routeMessageResponse(response, err)
 		return err
 	}
-	s := session.MenderShellSessionGetById(message.Header.SessionID)
 	if s == nil {
 		userId := getUserIdFromMessage(message)
-		if s, err = session.NewMenderShellSession(message.Header.SessionID, userId, d.expireSessionsAfter, d.expireSessionsAfterIdle); err != nil {
+		if s, err = d.shellSessions.NewSession(d.manager, message.Header.SessionID, userId, d.expireSessionsAfter, d.expireSessionsAfterIdle); err != nil {
 			d.routeMessageResponse(response, err)
 			return err
 		}
-		log.Debugf("created a new session: %s", s.GetId())
+		d.messageLogger(message).Debugf("created a new session: %s", s.GetId())
 	}
 
 	response.Header.SessionID = s.GetId()
@@ -77,7 +88,13 @@ func (d *MenderShellDaemon) routeMessageSpawnShell(message *ws.ProtoMsg) error {
 		terminalWidth = requestedWidth
 	}
 
-	log.Debugf("starting shell session_id=%s", s.GetId())
+	// the output is kept to be replayed to the clients attaching to the shell
+	scrollbackSize := 0
+	if d.reattachGracePeriod > 0 || d.TerminalConfig.Sharing.Enable {
+		scrollbackSize = d.scrollbackSize
+	}
+
+	d.messageLogger(message).Debugf("starting shell session_id=%s", s.GetId())
 	if err = s.StartShell(s.GetId(), session.MenderShellTerminalSettings{
 		Uid:            uint32(d.uid),
 		Gid:            uint32(d.gid),
@@ -86,20 +103,120 @@ func (d *MenderShellDaemon) routeMessageSpawnShell(message *ws.ProtoMsg) error {
 		TerminalString: d.terminalString,
 		Height:         terminalHeight,
 		Width:          terminalWidth,
+		Recording:      d.TerminalConfig.Recording,
+
+		ReattachGracePeriod: d.reattachGracePeriod,
+		ScrollbackSize:      scrollbackSize,
 	}); err != nil {
 		err = errors.Wrap(err, "failed to start shell")
 		d.routeMessageResponse(response, err)
 		return err
 	}
 
-	log.Debug("Shell started")
+	d.messageLogger(message).Debug("Shell started")
 	d.shellsSpawned++
+	d.shellsSpawnedTotal++
 
 	response.Body = []byte("Shell started")
 	d.routeMessageResponse(response, err)
 	return nil
 }
 
+// reattachShell attaches the user back to the running shell of a session
+// spawned again, resizing its terminal as requested, and replays the recent
+// output of the shell
+func (d *MenderShellDaemon) reattachShell(
+	s *session.MenderShellSession,
+	message *ws.ProtoMsg,
+	response *ws.ProtoMsg,
+) error {
+	if err := s.Reattach(getUserIdFromMessage(message)); err != nil {
+		err = errors.Wrap(err, "failed to reattach to the shell")
+		d.routeMessageResponse(response, err)
+		return err
+	}
+	requestedHeight, requestedWidth := mapPropertiesToTerminalHeightAndWidth(message.Header.Properties)
+	if requestedHeight > 0 && requestedWidth > 0 {
+		s.ResizeShell(requestedHeight, requestedWidth)
+	}
+
+	response.Body = []byte("Shell reattached")
+	d.routeMessageResponse(response, nil)
+	if err := s.ReplayScrollback(); err != nil {
+		d.messageLogger(message).Errorf("failed to replay the output of the shell: %s",
+			err.Error())
+	}
+	return nil
+}
+
+// mayAttachTo returns true if the user can attach to the shell of the
+// session: users attach to their own shells, and to the ones of the others
+// if they are allowed to in the configuration
+func (d *MenderShellDaemon) mayAttachTo(userID string, shared *session.MenderShellSession) bool {
+	if userID == shared.Info().UserID {
+		return true
+	}
+	for _, allowed := range d.TerminalConfig.Sharing.AllowedUsers {
+		if userID == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// attachToShell attaches a new session to the running shell of another
+// session, as a read-only observer unless a writer is requested and
+// allowed, and replays the recent output of the shell
+func (d *MenderShellDaemon) attachToShell(
+	sharedID string,
+	message *ws.ProtoMsg,
+	response *ws.ProtoMsg,
+) error {
+	var (
+		err  error
+		peer *session.MenderShellSession
+	)
+	mode, _ := message.Header.Properties[propertyAttachMode].(string)
+	shared := d.shellSessions.GetById(sharedID)
+	if !d.TerminalConfig.Sharing.Enable {
+		err = session.ErrSessionSharingDisabled
+	} else if mode != "" && mode != session.PeerModeObserver && mode != session.PeerModeWriter {
+		err = errors.Errorf("unknown attach mode %q", mode)
+	} else if mode == session.PeerModeWriter && !d.TerminalConfig.Sharing.AllowWriters {
+		err = session.ErrSessionWritersNotAllowed
+	} else if shared == nil {
+		err = session.ErrSessionNotFound
+	} else if !d.mayAttachTo(getUserIdFromMessage(message), shared) {
+		err = session.ErrSessionUserMismatch
+	} else if d.shellSessions.GetById(message.Header.SessionID) != nil {
+		err = session.ErrSessionShellAlreadyRunning
+	}
+	if err == nil {
+		peer, err = d.shellSessions.NewPeerSession(d.manager, message.Header.SessionID,
+			getUserIdFromMessage(message), d.expireSessionsAfter, d.expireSessionsAfterIdle)
+		if err == nil {
+			err = shared.AttachPeer(peer, mode == session.PeerModeWriter,
+				int(d.TerminalConfig.Sharing.MaxPeers))
+			if err != nil {
+				_ = d.shellSessions.DeleteById(peer.GetId())
+			}
+		}
+	}
+	if err != nil {
+		err = errors.Wrap(err, "failed to attach to the shell")
+		d.routeMessageResponse(response, err)
+		return err
+	}
+
+	response.Body = []byte("Shell attached")
+	d.routeMessageResponse(response, nil)
+	if err := peer.ReplayScrollback(); err != nil {
+		d.messageLogger(message).Errorf("failed to replay the output of the shell: %s",
+			err.Error())
+	}
+	return nil
+}
+
 func (d *MenderShellDaemon) routeMessageStopShell(message *ws.ProtoMsg) error {
 	var err error
 	response := &ws.ProtoMsg{
@@ -121,7 +238,7 @@ func (d *MenderShellDaemon) routeMessageStopShell(message *ws.ProtoMsg) error {
 			d.routeMessageResponse(response, err)
 			return err
 		}
-		shellsStoppedCount, err := session.MenderShellStopByUserId(userId)
+		shellsStoppedCount, err := d.shellSessions.StopByUserId(userId)
 		if err == nil {
 			if shellsStoppedCount > d.shellsSpawned {
 				d.shellsSpawned = 0
@@ -131,7 +248,7 @@ func (d *MenderShellDaemon) routeMessageStopShell(message *ws.ProtoMsg) error {
 				d.routeMessageResponse(response, err)
 				return err
 			} else {
-				log.Debugf("StopByUserId: stopped %d shells.", shellsStoppedCount)
+				d.messageLogger(message).Debugf("StopByUserId: stopped %d shells.", shellsStoppedCount)
 				d.shellsSpawned -= shellsStoppedCount
 			}
 		}
@@ -139,17 +256,23 @@ func (d *MenderShellDaemon) routeMessageStopShell(message *ws.ProtoMsg) error {
 		return err
 	}
 
-	s := session.MenderShellSessionGetById(message.Header.SessionID)
+	s := d.shellSessions.GetById(message.Header.SessionID)
 	if s == nil {
 		err = errors.New(fmt.Sprintf("routeMessage: StopShellMessage: session not found for id %s", message.Header.SessionID))
 		d.routeMessageResponse(response, err)
 		return err
 	}
 
+	if s.IsPeer() {
+		// the shared shell keeps running
+		err = d.shellSessions.DeleteById(s.GetId())
+		d.routeMessageResponse(response, err)
+		return err
+	}
 	err = s.StopShell()
 	if err != nil {
 		if procps.ProcessExists(s.GetShellPid()) {
-			log.Errorf("could not terminate shell (pid %d) for session %s, user"+
+			d.messageLogger(message).Errorf("could not terminate shell (pid %d) for session %s, user"+
 				"will not be able to start another one if the limit is reached.",
 				s.GetShellPid(),
 				s.GetId())
@@ -157,15 +280,15 @@ func (d *MenderShellDaemon) routeMessageStopShell(message *ws.ProtoMsg) error {
 			d.routeMessageResponse(response, err)
 			return err
 		} else {
-			log.Errorf("process error on exit: %s", err.Error())
+			d.messageLogger(message).Errorf("process error on exit: %s", err.Error())
 		}
 	}
 	if d.shellsSpawned == 0 {
-		log.Warn("can't decrement shellsSpawned count: it is 0.")
+		d.messageLogger(message).Warn("can't decrement shellsSpawned count: it is 0.")
 	} else {
 		d.shellsSpawned--
 	}
-	err = session.MenderShellDeleteById(s.GetId())
+	err = d.shellSessions.DeleteById(s.GetId())
 	d.routeMessageResponse(response, err)
 	return err
 }
@@ -184,7 +307,7 @@ func (d *MenderShellDaemon) routeMessageShellCommand(message *ws.ProtoMsg) error
 		Body: []byte{},
 	}
 
-	s := session.MenderShellSessionGetById(message.Header.SessionID)
+	s := d.shellSessions.GetById(message.Header.SessionID)
 	if s == nil {
 		err = session.ErrSessionNotFound
 		d.routeMessageResponse(response, err)
@@ -217,10 +340,10 @@ func mapPropertiesToTerminalHeightAndWidth(properties map[string]interface{}) (u
 func (d *MenderShellDaemon) routeMessageShellResize(message *ws.ProtoMsg) error {
 	var err error
 
-	s := session.MenderShellSessionGetById(message.Header.SessionID)
+	s := d.shellSessions.GetById(message.Header.SessionID)
 	if s == nil {
 		err = session.ErrSessionNotFound
-		log.Errorf(err.Error())
+		d.messageLogger(message).Errorf(err.Error())
 		return err
 	}
 
@@ -234,10 +357,10 @@ func (d *MenderShellDaemon) routeMessageShellResize(message *ws.ProtoMsg) error
 func (d *MenderShellDaemon) routeMessagePongShell(message *ws.ProtoMsg) error {
 	var err error
 
-	s := session.MenderShellSessionGetById(message.Header.SessionID)
+	s := d.shellSessions.GetById(message.Header.SessionID)
 	if s == nil {
 		err = session.ErrSessionNotFound
-		log.Errorf(err.Error())
+		d.messageLogger(message).Errorf(err.Error())
 		return err
 	}
 
@@ -14,6 +14,8 @@
 package app
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -30,11 +32,13 @@ import (
 
 	"github.com/gorilla/websocket"
 	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/vmihailenco/msgpack/v5"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
+	wsft "github.com/mendersoftware/go-lib-micro/ws/filetransfer"
 	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
 
 	dbusmocks "github.com/mendersoftware/mender-connect/client/dbus/mocks"
@@ -42,10 +46,15 @@ import (
 	sessmocks "github.com/mendersoftware/mender-connect/session/mocks"
 
 	"github.com/mendersoftware/mender-connect/client/dbus"
+	"github.com/mendersoftware/mender-connect/client/https"
+	"github.com/mendersoftware/mender-connect/client/mender"
 	"github.com/mendersoftware/mender-connect/config"
 	"github.com/mendersoftware/mender-connect/connection"
 	"github.com/mendersoftware/mender-connect/connectionmanager"
+	"github.com/mendersoftware/mender-connect/logging"
+	"github.com/mendersoftware/mender-connect/procps"
 	"github.com/mendersoftware/mender-connect/session"
+	"github.com/mendersoftware/mender-connect/utils/wstest"
 )
 
 var (
@@ -53,9 +62,12 @@ var (
 	testData              string
 )
 
-func init() {
-	connectionmanager.DefaultPingWait = 10 * time.Second
-}
+// testPingWait is the ping wait of the connection managers of the tests
+const testPingWait = 10 * time.Second
+
+// testMaxUserSessions is the limit of sessions per user newShellMulti
+// spawns shells up to, and then beyond
+const testMaxUserSessions = 2
 
 func sendMessage(webSock *websocket.Conn, t string, sessionId string, userID string, data string) error {
 	m := &ws.ProtoMsg{
@@ -149,11 +161,11 @@ func TestMenderShellSessionStart(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Close(ws.ProtoTypeShell)
-	connectionmanager.SetReconnectIntervalSeconds(1)
-	connectionmanager.Reconnect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.SetReconnectIntervalSeconds(1)
+	manager.Reconnect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	d := NewDaemon(&config.MenderShellConfig{
+	d := NewDaemonWithManager(&config.MenderShellConfig{
 		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
 			ShellCommand: "/bin/sh",
 			User:         currentUser.Name,
@@ -162,7 +174,7 @@ func TestMenderShellSessionStart(t *testing.T) {
 				Height: 80,
 			},
 		},
-	})
+	}, manager)
 	message, err := d.readMessage()
 	t.Logf("read message: type, session_id, data %s, %s, %s", message.Header.MsgType, message.Header.SessionID, message.Body)
 	err = d.routeMessage(message)
@@ -260,11 +272,11 @@ func TestMenderShellStopByUserId(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Close(ws.ProtoTypeShell)
-	connectionmanager.SetReconnectIntervalSeconds(1)
-	connectionmanager.Reconnect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.SetReconnectIntervalSeconds(1)
+	manager.Reconnect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	d := NewDaemon(&config.MenderShellConfig{
+	d := NewDaemonWithManager(&config.MenderShellConfig{
 		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
 			ShellCommand: "/bin/sh",
 			User:         currentUser.Name,
@@ -273,7 +285,7 @@ func TestMenderShellStopByUserId(t *testing.T) {
 				Height: 80,
 			},
 		},
-	})
+	}, manager)
 	time.Sleep(time.Second * 2)
 	message, err := d.readMessage()
 	assert.NotNil(t, message)
@@ -283,7 +295,7 @@ func TestMenderShellStopByUserId(t *testing.T) {
 		t.Logf("route message error: %s", err.Error())
 	}
 
-	sessions := session.MenderShellSessionsGetByUserId("user-id-unit-tests-a00908-f6723467-561234ff")
+	sessions := d.shellSessions.GetByUserId("user-id-unit-tests-a00908-f6723467-561234ff")
 	assert.True(t, len(sessions) > 0)
 	assert.NotNil(t, sessions[0])
 	sessionsCount := d.shellsSpawned
@@ -340,11 +352,11 @@ func TestMenderShellUnknownMessage(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Close(ws.ProtoTypeShell)
-	connectionmanager.SetReconnectIntervalSeconds(1)
-	_ = connectionmanager.Reconnect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.SetReconnectIntervalSeconds(1)
+	_ = manager.Reconnect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	d := NewDaemon(&config.MenderShellConfig{
+	d := NewDaemonWithManager(&config.MenderShellConfig{
 		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
 			ShellCommand: "/bin/sh",
 			User:         currentUser.Name,
@@ -353,7 +365,7 @@ func TestMenderShellUnknownMessage(t *testing.T) {
 				Height: 80,
 			},
 		},
-	})
+	}, manager)
 	time.Sleep(time.Second * 2)
 	message, err := d.readMessage()
 	assert.NotNil(t, message)
@@ -372,7 +384,7 @@ func newShellMulti(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer c.Close()
-	for i := 0; i < session.MaxUserSessions; i++ {
+	for i := 0; i < testMaxUserSessions; i++ {
 		sendMessage(c, wsshell.MessageTypeSpawnShell, uuid.NewV4().String(), "user-id-unit-tests-7f00f6723467-561234ff", "")
 	}
 	sendMessage(c, wsshell.MessageTypeSpawnShell, uuid.NewV4().String(), "user-id-unit-tests-7f00f6723467-561234ff", "")
@@ -384,7 +396,6 @@ func newShellMulti(w http.ResponseWriter, r *http.Request) {
 
 //maxUserSessions controls how many sessions user can have.
 func TestMenderShellSessionLimitPerUser(t *testing.T) {
-	session.MaxUserSessions = 2
 	currentUser, err := user.Current()
 	if err != nil {
 		t.Errorf("cant get current user: %s", err.Error())
@@ -400,11 +411,11 @@ func TestMenderShellSessionLimitPerUser(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Close(ws.ProtoTypeShell)
-	connectionmanager.SetReconnectIntervalSeconds(1)
-	connectionmanager.Reconnect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.SetReconnectIntervalSeconds(1)
+	manager.Reconnect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	d := NewDaemon(&config.MenderShellConfig{
+	d := NewDaemonWithManager(&config.MenderShellConfig{
 		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
 			ShellCommand: "/bin/sh",
 			User:         currentUser.Name,
@@ -416,12 +427,12 @@ func TestMenderShellSessionLimitPerUser(t *testing.T) {
 				StopExpired:     true,
 				ExpireAfter:     128,
 				ExpireAfterIdle: 32,
-				MaxPerUser:      2,
+				MaxPerUser:      testMaxUserSessions,
 			},
 		},
-	})
+	}, manager)
 
-	for i := 0; i < session.MaxUserSessions; i++ {
+	for i := 0; i < testMaxUserSessions; i++ {
 		message, err := d.readMessage()
 		assert.NoError(t, err)
 		assert.NotNil(t, message)
@@ -440,7 +451,7 @@ func TestMenderShellSessionLimitPerUser(t *testing.T) {
 		t.Logf("route message error: %s", err.Error())
 	}
 	assert.Error(t, err)
-	connectionmanager.Close(ws.ProtoTypeShell)
+	manager.Close(ws.ProtoTypeShell)
 }
 
 func TestMenderShellStopDaemon(t *testing.T) {
@@ -512,11 +523,11 @@ func TestMenderShellReadMessage(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Close(ws.ProtoTypeShell)
-	connectionmanager.SetReconnectIntervalSeconds(1)
-	connectionmanager.Reconnect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.SetReconnectIntervalSeconds(1)
+	manager.Reconnect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	d := NewDaemon(&config.MenderShellConfig{
+	d := NewDaemonWithManager(&config.MenderShellConfig{
 		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
 			ShellCommand: "/bin/sh",
 			User:         currentUser.Name,
@@ -525,7 +536,7 @@ func TestMenderShellReadMessage(t *testing.T) {
 				Height: 80,
 			},
 		},
-	})
+	}, manager)
 
 	time.Sleep(2 * time.Second)
 	m, err := d.readMessage()
@@ -539,14 +550,15 @@ func TestMenderShellReadMessage(t *testing.T) {
 	assert.Nil(t, m)
 }
 
-func TestMenderShellWsReconnect(t *testing.T) {
+func TestMenderShellReconnect(t *testing.T) {
 	currentUser, err := user.Current()
 	if err != nil {
 		t.Errorf("cant get current user: %s", err.Error())
 		return
 	}
 
-	d := NewDaemon(&config.MenderShellConfig{
+	manager := connectionmanager.NewManager(testPingWait)
+	d := NewDaemonWithManager(&config.MenderShellConfig{
 		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
 			ShellCommand: "/bin/sh",
 			User:         currentUser.Name,
@@ -555,7 +567,7 @@ func TestMenderShellWsReconnect(t *testing.T) {
 				Height: 80,
 			},
 		},
-	})
+	}, manager)
 
 	t.Log("starting mock httpd with websockets")
 	s := httptest.NewServer(http.HandlerFunc(oneMsgMainServerLoop))
@@ -566,25 +578,30 @@ func TestMenderShellWsReconnect(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Close(ws.ProtoTypeShell)
-	connectionmanager.SetReconnectIntervalSeconds(1)
-	connectionmanager.Reconnect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager.Close(ws.ProtoTypeShell)
+	manager.SetReconnectIntervalSeconds(1)
+	manager.Reconnect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
 	t.Log("attempting reconnect")
-	d.serverUrl = u
-	connectionmanager.SetReconnectIntervalSeconds(1)
-	err = d.wsReconnect("atoken")
-	assert.NoError(t, err)
+	manager.SetReconnectIntervalSeconds(1)
+	select {
+	case err = <-d.reconnect(u, "atoken"):
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the reconnection")
+	}
+	manager.Close(ws.ProtoTypeShell)
 }
 
-func TestMenderShellWsReconnectError(t *testing.T) {
+func TestMenderShellReconnectError(t *testing.T) {
 	currentUser, err := user.Current()
 	if err != nil {
 		t.Errorf("cant get current user: %s", err.Error())
 		return
 	}
 
-	d := NewDaemon(&config.MenderShellConfig{
+	manager := connectionmanager.NewManager(testPingWait)
+	d := NewDaemonWithManager(&config.MenderShellConfig{
 		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
 			ShellCommand: "/bin/sh",
 			User:         currentUser.Name,
@@ -593,7 +610,7 @@ func TestMenderShellWsReconnectError(t *testing.T) {
 				Height: 80,
 			},
 		},
-	})
+	}, manager)
 
 	t.Log("starting mock httpd with websockets")
 	s := httptest.NewServer(http.HandlerFunc(oneMsgMainServerLoop))
@@ -604,20 +621,19 @@ func TestMenderShellWsReconnectError(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Close(ws.ProtoTypeShell)
-	connectionmanager.SetReconnectIntervalSeconds(1)
-	connectionmanager.Reconnect(ws.ProtoTypeShell, "this"+u+"wontwork", "/", "token", true, "", 8, nil)
-	config.MaxReconnectAttempts = 8
-	err = d.wsReconnect("atoken")
-	assert.Error(t, err)
-
-	d.serverUrl = "this" + u + "wontwork"
-	err = d.wsReconnect("atoken")
-	assert.Error(t, err)
+	manager.Close(ws.ProtoTypeShell)
+	manager.SetReconnectIntervalSeconds(1)
+	manager.Reconnect(ws.ProtoTypeShell, "this"+u+"wontwork", "/", "token", https.Config{NoVerify: true}, 8, nil)
+	config.MaxReconnectAttempts = 2
+	select {
+	case err = <-d.reconnect("this"+u+"wontwork", "atoken"):
+		assert.Error(t, err)
+	case <-time.After(30 * time.Second):
+		t.Fatal("timeout waiting for the reconnection to fail")
+	}
 }
 
 func TestMenderShellMaxShellsLimit(t *testing.T) {
-	session.MaxUserSessions = 4
 	config.MaxShellsSpawned = 2
 	currentUser, err := user.Current()
 	if err != nil {
@@ -634,15 +650,15 @@ func TestMenderShellMaxShellsLimit(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Close(ws.ProtoTypeShell)
-	connectionmanager.SetReconnectIntervalSeconds(1)
-	connectionmanager.Reconnect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.SetReconnectIntervalSeconds(1)
+	manager.Reconnect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 526, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 526, 16*time.Second, https.Config{NoVerify: true})
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
-	d := NewDaemon(&config.MenderShellConfig{
+	d := NewDaemonWithManager(&config.MenderShellConfig{
 		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
 			ShellCommand: "/bin/sh",
 			User:         currentUser.Name,
@@ -650,8 +666,11 @@ func TestMenderShellMaxShellsLimit(t *testing.T) {
 				Width:  24,
 				Height: 80,
 			},
+			Sessions: config.SessionsConfig{
+				MaxPerUser: 4,
+			},
 		},
-	})
+	}, manager)
 
 	for i := 0; i < int(config.MaxShellsSpawned); i++ {
 		time.Sleep(time.Second)
@@ -694,39 +713,10 @@ func TestMenderShellGotAuthToken(t *testing.T) {
 	})
 
 	testCases := map[string]struct {
-		params         []dbus.SignalParams
-		needsReconnect bool
-		token          string
+		params []dbus.SignalParams
+		token  string
 	}{
-		"non-zero-length-params-and-needs-false": {
-			params: []dbus.SignalParams{
-				{
-					ParamType: "any",
-					ParamData: "anyAny",
-				},
-				{
-					ParamType: "some",
-					ParamData: "someSome",
-				},
-			},
-			needsReconnect: false,
-			token:          "anyAny",
-		},
-		"empty-data-params-and-needs-false": {
-			params: []dbus.SignalParams{
-				{
-					ParamType: "any",
-					ParamData: "",
-				},
-				{
-					ParamType: "some",
-					ParamData: "someSome",
-				},
-			},
-			needsReconnect: false,
-			token:          "",
-		},
-		"non-zero-length-params-and-needs-true": {
+		"non-zero-length-params": {
 			params: []dbus.SignalParams{
 				{
 					ParamType: "any",
@@ -737,10 +727,9 @@ func TestMenderShellGotAuthToken(t *testing.T) {
 					ParamData: "someSome",
 				},
 			},
-			needsReconnect: true,
-			token:          "anyAny",
+			token: "anyAny",
 		},
-		"empty-data-params-and-needs-true": {
+		"empty-data-params": {
 			params: []dbus.SignalParams{
 				{
 					ParamType: "any",
@@ -751,124 +740,19 @@ func TestMenderShellGotAuthToken(t *testing.T) {
 					ParamData: "someSome",
 				},
 			},
-			needsReconnect: true,
-			token:          "",
+			token: "",
 		},
 	}
 
-	go func() {
-		for {
-			<-d.eventChan
-			time.Sleep(time.Second)
-		}
-	}()
-
 	for name, tc := range testCases {
 		t.Run(name, func(t *testing.T) {
-			c := make(chan string)
-			go func() {
-				s := d.gotAuthToken(tc.params, tc.needsReconnect)
-				c <- s
-			}()
-			s := <-c
+			s := d.gotAuthToken(tc.params)
 			assert.Equal(t, tc.token, s)
+			assert.Equal(t, tc.token != "", d.authorized)
 		})
 	}
 }
 
-func TestMenderShellNeedsReconnect(t *testing.T) {
-	currentUser, err := user.Current()
-	if err != nil {
-		t.Errorf("cant get current user: %s", err.Error())
-		return
-	}
-
-	d := NewDaemon(&config.MenderShellConfig{
-		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
-			ShellCommand: "/bin/sh",
-			User:         currentUser.Name,
-			Terminal: config.TerminalConfig{
-				Width:  24,
-				Height: 80,
-			},
-		},
-	})
-
-	assert.False(t, d.needsReconnect())
-
-	go func() {
-		d.reconnectChan <- MenderShellDaemonEvent{
-			event: "any",
-			data:  "anyAny",
-			id:    "some",
-		}
-	}()
-
-	assert.True(t, d.needsReconnect())
-}
-
-func TestMenderShellPostEvent(t *testing.T) {
-	currentUser, err := user.Current()
-	if err != nil {
-		t.Errorf("cant get current user: %s", err.Error())
-		return
-	}
-
-	d := NewDaemon(&config.MenderShellConfig{
-		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
-			ShellCommand: "/bin/sh",
-			User:         currentUser.Name,
-			Terminal: config.TerminalConfig{
-				Width:  24,
-				Height: 80,
-			},
-		},
-	})
-
-	event := MenderShellDaemonEvent{
-		event: "this event",
-		data:  "event data",
-		id:    "id of the data",
-	}
-	go func() {
-		d.postEvent(event)
-	}()
-
-	e := <-d.eventChan
-	assert.Equal(t, event, e)
-}
-
-func TestMenderShellReadEvent(t *testing.T) {
-	currentUser, err := user.Current()
-	if err != nil {
-		t.Errorf("cant get current user: %s", err.Error())
-		return
-	}
-
-	d := NewDaemon(&config.MenderShellConfig{
-		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
-			ShellCommand: "/bin/sh",
-			User:         currentUser.Name,
-			Terminal: config.TerminalConfig{
-				Width:  24,
-				Height: 80,
-			},
-		},
-	})
-
-	event := MenderShellDaemonEvent{
-		event: "this event",
-		data:  "event data",
-		id:    "id of the data",
-	}
-	go func() {
-		d.postEvent(event)
-	}()
-
-	e := d.readEvent()
-	assert.Equal(t, event, e)
-}
-
 func TestOutputStatus(t *testing.T) {
 	d := NewDaemon(&config.MenderShellConfig{
 		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
@@ -882,15 +766,13 @@ func TestOutputStatus(t *testing.T) {
 	})
 	assert.NotNil(t, d)
 
-	assert.False(t, d.printStatus)
 	d.PrintStatus()
-	assert.True(t, d.printStatus)
-	assert.True(t, d.shouldPrintStatus())
+	d.PrintStatus()
+	assert.Len(t, d.statusChan, 1)
 	d.outputStatus()
-	assert.False(t, d.printStatus)
 }
 
-func TestTimeToSweepSessions(t *testing.T) {
+func TestSessionsExpire(t *testing.T) {
 	d := NewDaemon(&config.MenderShellConfig{
 		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
 			ShellCommand: "/bin/sh",
@@ -902,22 +784,18 @@ func TestTimeToSweepSessions(t *testing.T) {
 		},
 	})
 	assert.NotNil(t, d)
-	assert.False(t, d.timeToSweepSessions())
 
-	//if both expire timeout and idle expire timeout are not set it is never time to sweep
+	//if both expire timeout and idle expire timeout are not set the sessions never expire
 	d.expireSessionsAfter = time.Duration(0)
 	d.expireSessionsAfterIdle = time.Duration(0)
-	assert.False(t, d.timeToSweepSessions())
+	assert.False(t, d.sessionsExpire())
 
-	//on the other hand when both are set it maybe time to sweep
 	d.expireSessionsAfter = 32 * time.Second
-	d.expireSessionsAfterIdle = 8 * time.Second
-	lastExpiredSessionSweep = time.Now()
-	assert.False(t, d.timeToSweepSessions())
+	assert.True(t, d.sessionsExpire())
 
-	expiredSessionsSweepFrequency = 2 * time.Second
-	time.Sleep(2 * expiredSessionsSweepFrequency)
-	assert.True(t, d.timeToSweepSessions())
+	d.expireSessionsAfter = time.Duration(0)
+	d.expireSessionsAfterIdle = 8 * time.Second
+	assert.True(t, d.sessionsExpire())
 }
 
 func TestWaitForJWTToken(t *testing.T) {
@@ -1019,174 +897,187 @@ func TestWaitForJWTToken(t *testing.T) {
 	}
 }
 
-func TestDBusEventLoop(t *testing.T) {
-	currentUser, err := user.Current()
-	if err != nil {
-		t.Errorf("cant get current user: %s", err.Error())
-		return
-	}
+func TestJWTTokenRefresher(t *testing.T) {
+	defer func(timeout time.Duration) {
+		tokenRefreshTimeout = timeout
+	}(tokenRefreshTimeout)
+	tokenRefreshTimeout = 100 * time.Millisecond
 
-	testCases := []struct {
-		name    string
-		err     error
-		token   string
-		timeout time.Duration
+	testCases := map[string]struct {
+		fetchErr error
+		// tokens of the signals following the fetch
+		tokens []string
+		res    string
+		err    string
 	}{
-		{
-			name:  "stopped-gracefully",
-			token: "the-token",
+		"ok": {
+			tokens: []string{"new-token"},
+			res:    "new-token",
 		},
-		{
-			name:    "token_not_returned_wait_forever",
-			token:   "",
-			timeout: 15 * time.Second,
+		"ok, token fetched after a while": {
+			tokens: []string{"rejected-token", "", "new-token"},
+			res:    "new-token",
+		},
+		"error, fetch failed": {
+			fetchErr: errors.New("no D-Bus"),
+			err:      "failed to fetch a new JWT token",
+		},
+		"error, no new token": {
+			tokens: []string{"rejected-token"},
+			err:    "no new JWT token available",
 		},
 	}
 
-	for _, tc := range testCases {
-		if tc.name == "token_not_returned_wait_forever" {
-			timeout := time.After(tc.timeout)
-			done := make(chan bool)
-			go func() {
-				t.Run(tc.name, func(t *testing.T) {
-					d := NewDaemon(&config.MenderShellConfig{
-						MenderShellConfigFromFile: config.MenderShellConfigFromFile{
-							ShellCommand: "/bin/sh",
-							User:         currentUser.Name,
-							Terminal: config.TerminalConfig{
-								Width:  24,
-								Height: 80,
-							},
-						},
-					})
-
-					dbusAPI := &dbusmocks.DBusAPI{}
-					defer dbusAPI.AssertExpectations(t)
-					client := &authmocks.AuthClient{}
-					client.On("WaitForJwtTokenStateChange").Return([]dbus.SignalParams{
-						{
-							ParamType: "s",
-							ParamData: tc.token,
-						},
-					}, tc.err)
-					client.On("GetJWTToken").Return(tc.token, "", tc.err)
-					d.dbusEventLoop(client)
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{})
+			defer d.StopDaemon()
+			client := &authmocks.AuthClient{}
+			defer client.AssertExpectations(t)
+
+			tokenStateChange := make(chan []dbus.SignalParams, len(tc.tokens))
+			client.On("GetJwtTokenStateChangeChannel").Return(tokenStateChange)
+			client.On("FetchJWTToken").Return(tc.fetchErr == nil, tc.fetchErr).
+				Run(func(args mock.Arguments) {
+					for _, token := range tc.tokens {
+						tokenStateChange <- []dbus.SignalParams{
+							{ParamType: "s", ParamData: token},
+						}
+					}
 				})
-				done <- true
-			}()
 
-			select {
-			case <-timeout:
-				t.Logf("ok: expected to run forever")
-			case <-done:
+			token, err := d.jwtTokenRefresher(client)("rejected-token")
+			if tc.err != "" {
+				assert.Error(t, err)
+				if err != nil {
+					assert.Contains(t, err.Error(), tc.err)
+				}
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.res, token)
 			}
-		} else {
-			t.Run(tc.name, func(t *testing.T) {
-				d := NewDaemon(&config.MenderShellConfig{
-					MenderShellConfigFromFile: config.MenderShellConfigFromFile{
-						ShellCommand: "/bin/sh",
-						User:         currentUser.Name,
-						Terminal: config.TerminalConfig{
-							Width:  24,
-							Height: 80,
-						},
-					},
-				})
-
-				dbusAPI := &dbusmocks.DBusAPI{}
-				defer dbusAPI.AssertExpectations(t)
-				client := &authmocks.AuthClient{}
-				client.On("WaitForJwtTokenStateChange").Return([]dbus.SignalParams{
-					{
-						ParamType: "s",
-						ParamData: tc.token,
-					},
-				}, tc.err)
-				client.On("GetJWTToken").Return(tc.token, "", tc.err)
-				go func() {
-					time.Sleep(time.Second)
-					d.stop = true
-				}()
-				d.dbusEventLoop(client)
-			})
-		}
+			// the main loop gets all the signals
+			states := d.tokenStateChange(client)
+			for _, token := range tc.tokens {
+				select {
+				case p := <-states:
+					assert.Equal(t, token, p[0].ParamData)
+				case <-time.After(5 * time.Second):
+					t.Fatal("the signal was not relayed")
+				}
+			}
+		})
 	}
 }
 
-func TestEventLoop(t *testing.T) {
+func TestMainLoop(t *testing.T) {
 	currentUser, err := user.Current()
 	if err != nil {
 		t.Errorf("cant get current user: %s", err.Error())
 		return
 	}
 
-	testCases := []struct {
-		name    string
-		err     error
-		timeout time.Duration
-	}{
-		{
-			name: "stopped-gracefully",
-		},
-		{
-			name:    "run_forever",
-			timeout: 15 * time.Second,
+	authorization := make(chan string, 8)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization <- r.Header.Get("Authorization")
+		oneMsgMainServerLoop(w, r)
+	}))
+	defer s.Close()
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.SetReconnectIntervalSeconds(1)
+	d := NewDaemonWithManager(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         currentUser.Name,
+			Terminal: config.TerminalConfig{
+				Width:  24,
+				Height: 80,
+			},
+			Sessions: config.SessionsConfig{
+				ExpireAfterIdle: 8,
+			},
 		},
+	}, manager)
+	d.serverUrl = u
+	d.authorized = true
+
+	client := &authmocks.AuthClient{}
+	defer client.AssertExpectations(t)
+	tokenStateChange := make(chan []dbus.SignalParams, 1)
+	client.On("GetJwtTokenStateChangeChannel").Return(tokenStateChange)
+
+	done := make(chan struct{})
+	go func() {
+		d.mainLoop(client, "token")
+		close(done)
+	}()
+
+	waitForReconnect := func() {
+		select {
+		case <-d.connectedChan:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for the reconnection")
+		}
+		assert.Equal(t, ConnectionStateConnected, d.getConnectionState())
 	}
 
-	connectionmanager.SetReconnectIntervalSeconds(1)
-	for _, tc := range testCases {
-		if tc.name == "run_forever" {
-			timeout := time.After(tc.timeout)
-			done := make(chan bool)
-			go func() {
-				t.Run(tc.name, func(t *testing.T) {
-					d := NewDaemon(&config.MenderShellConfig{
-						MenderShellConfigFromFile: config.MenderShellConfigFromFile{
-							ShellCommand: "/bin/sh",
-							User:         currentUser.Name,
-							Terminal: config.TerminalConfig{
-								Width:  24,
-								Height: 80,
-							},
-						},
-					})
+	// the message loop lost the connection
+	d.disconnectedChan <- errors.New("read error")
+	waitForReconnect()
+	d.PrintStatus()
 
-					d.eventLoop()
-				})
-				done <- true
-			}()
+	// the device is no longer authorized: no reconnection until a new
+	// token is received
+	tokenStateChange <- []dbus.SignalParams{{ParamType: "s", ParamData: ""}}
+	assert.Eventually(t, func() bool {
+		return d.getConnectionState() == ConnectionStateUnauthorized
+	}, 5*time.Second, 10*time.Millisecond)
+	d.disconnectedChan <- errors.New("read error")
+	select {
+	case <-d.connectedChan:
+		t.Fatal("unexpected reconnection")
+	case <-time.After(100 * time.Millisecond):
+	}
+	tokenStateChange <- []dbus.SignalParams{
+		{ParamType: "s", ParamData: "new-token"},
+		{ParamType: "s", ParamData: u},
+	}
+	waitForReconnect()
 
-			select {
-			case <-timeout:
-				t.Logf("ok: expected to run forever")
-			case <-done:
-			}
-		} else {
-			t.Run(tc.name, func(t *testing.T) {
-				d := NewDaemon(&config.MenderShellConfig{
-					MenderShellConfigFromFile: config.MenderShellConfigFromFile{
-						ShellCommand: "/bin/sh",
-						User:         currentUser.Name,
-						Terminal: config.TerminalConfig{
-							Width:  24,
-							Height: 80,
-						},
-					},
-				})
+	// the main loop reconnects with the token fetched when the server
+	// rejected the previous one
+	client.On("FetchJWTToken").Return(true, nil).Run(func(args mock.Arguments) {
+		tokenStateChange <- []dbus.SignalParams{{ParamType: "s", ParamData: "refreshed-token"}}
+	})
+	token, err := d.jwtTokenRefresher(client)("new-token")
+	assert.NoError(t, err)
+	assert.Equal(t, "refreshed-token", token)
+	d.disconnectedChan <- errors.New("read error")
+	waitForReconnect()
+	assert.Equal(t, "Bearer token", <-authorization)
+	assert.Equal(t, "Bearer new-token", <-authorization)
+	assert.Equal(t, "Bearer refreshed-token", <-authorization)
+
+	// disconnected on request: no more reconnections
+	d.Disconnect()
+	assert.Eventually(t, func() bool {
+		return d.getConnectionState() == ConnectionStateDisconnected
+	}, 5*time.Second, 10*time.Millisecond)
+	d.disconnectedChan <- errors.New("read error")
+	select {
+	case <-d.connectedChan:
+		t.Fatal("unexpected reconnection")
+	case <-time.After(100 * time.Millisecond):
+	}
 
-				go func() {
-					time.Sleep(time.Second)
-					d.postEvent(MenderShellDaemonEvent{
-						event: "event",
-						data:  "data",
-						id:    "id",
-					})
-					d.stop = true
-				}()
-				d.eventLoop()
-			})
-		}
+	// stopping is immediate
+	d.StopDaemon()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the main loop did not stop")
 	}
 }
 
@@ -1208,81 +1099,545 @@ func TestMessageMainLoop(t *testing.T) {
 	t.Log("starting mock httpd with websockets")
 	s := httptest.NewServer(http.HandlerFunc(everySecondMessage))
 	defer s.Close()
-
 	u := "ws" + strings.TrimPrefix(s.URL, "http")
-	urlString, err := url.Parse(u)
-	assert.NoError(t, err)
-	assert.NotNil(t, urlString)
-
-	connectionmanager.Close(ws.ProtoTypeShell)
-	connectionmanager.SetReconnectIntervalSeconds(1)
-	connectionmanager.Reconnect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
-
-	webSock, err := connection.NewConnection(*urlString, "token", 8*time.Second, 526, 8*time.Second, true, "")
-	assert.NoError(t, err)
-	assert.NotNil(t, webSock)
 
 	testCases := []struct {
 		name       string
-		ws         *connection.Connection
-		token      string
+		connect    bool
 		shouldStop bool
-		err        error
 	}{
 		{
 			name:       "normal-exit",
 			shouldStop: true,
 		},
 		{
-			name: "route-a-message",
-			ws:   webSock,
+			name:    "route-a-message",
+			connect: true,
 		},
 		{
-			name: "ws-nil-error",
-			err:  errors.New("error connecting"),
+			name: "read-error",
 		},
 	}
 
-	config.MaxReconnectAttempts = 2
-	timeout := 15 * time.Second
 	for _, tc := range testCases {
-		timeout := time.After(timeout)
-		done := make(chan bool)
-		go func() {
-			t.Run(tc.name, func(t *testing.T) {
-				d := &MenderShellDaemon{}
-				d.stop = tc.shouldStop
-				d.printStatus = true
-				if tc.ws != nil {
-					go func() {
-						time.Sleep(4 * time.Second)
-						d.stop = true
-					}()
+		t.Run(tc.name, func(t *testing.T) {
+			manager := connectionmanager.NewManager(testPingWait)
+			if tc.connect {
+				err := manager.Connect(ws.ProtoTypeShell, u, "/", "token",
+					https.Config{NoVerify: true}, 1, nil)
+				assert.NoError(t, err)
+				defer manager.Close(ws.ProtoTypeShell)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			d := &MenderShellDaemon{
+				ctx:              ctx,
+				ctxCancel:        cancel,
+				manager:          manager,
+				shellSessions:    session.NewMenderShellSessions(nil, nil),
+				disconnectedChan: make(chan error),
+				connectedChan:    make(chan struct{}, 1),
+			}
+			if tc.shouldStop {
+				d.StopDaemon()
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- d.messageLoop()
+			}()
+
+			if tc.connect {
+				// the loop reads and routes the messages of the server
+				assert.Eventually(t, func() bool {
+					return manager.GetCounters(ws.ProtoTypeShell).RxMessageBytes > 0
+				}, 5*time.Second, 10*time.Millisecond)
+			} else if !tc.shouldStop {
+				// the loop reports the read error and waits to reconnect
+				select {
+				case err := <-d.disconnectedChan:
+					assert.Equal(t, connectionmanager.ErrHandlerNotRegistered, err)
+				case <-time.After(5 * time.Second):
+					t.Fatal("the message loop did not report the read error")
 				}
-				err = d.messageLoop()
-				if tc.err != nil {
-					assert.Error(t, err)
-				} else {
-					if err != nil && err.Error() == session.ErrSessionNotFound.Error() {
-						assert.Equal(t, session.ErrSessionNotFound.Error(), err.Error())
-					} else {
-						assert.NoError(t, err)
-					}
+				assert.Equal(t, ConnectionStateDisconnected, d.getConnectionState())
+			}
+
+			// the loop returns once the daemon stops
+			d.StopDaemon()
+			manager.Close(ws.ProtoTypeShell)
+			select {
+			case err := <-done:
+				if err != nil {
+					assert.Equal(t, session.ErrSessionNotFound.Error(), err.Error())
 				}
-				done <- true
-			})
-		}()
+			case <-time.After(5 * time.Second):
+				t.Fatal("the message loop did not return")
+			}
+		})
+	}
+}
 
+func TestShutdown(t *testing.T) {
+	const sessionID = "shutdown-session-id"
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan *ws.ProtoMsg, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrader = websocket.Upgrader{}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_ = sendMessage(c, wsshell.MessageTypeSpawnShell, sessionID, "shutdown-user-id", "")
+		for {
+			msg, err := readMessage(c)
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}))
+	defer s.Close()
+
+	manager := connectionmanager.NewManager(testPingWait)
+	err = manager.Connect(ws.ProtoTypeShell, "ws"+strings.TrimPrefix(s.URL, "http"), "/",
+		"token", https.Config{}, 1, context.Background())
+	assert.NoError(t, err)
+
+	d := NewDaemonWithManager(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand:           "/bin/sh",
+			User:                   currentUser.Username,
+			ShutdownTimeoutSeconds: 5,
+		},
+	}, manager)
+	router := &sessmocks.Router{}
+	router.On("Shutdown", mock.MatchedBy(func(ctx context.Context) bool {
+		_, ok := ctx.Deadline()
+		return ok
+	})).Return(nil)
+	defer router.AssertExpectations(t)
+	d.router = router
+	d.uid, _ = strconv.ParseUint(currentUser.Uid, 10, 32)
+	d.gid, _ = strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	message, err := d.readMessage()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = d.routeMessage(message)
+	assert.NoError(t, err)
+	s1 := d.shellSessions.GetById(sessionID)
+	if !assert.NotNil(t, s1) {
+		t.FailNow()
+	}
+	pid := s1.GetShellPid()
+	rsp := <-received
+	assert.Equal(t, wsshell.MessageTypeSpawnShell, rsp.Header.MsgType)
+
+	d.shutdown()
+	timeout := time.After(5 * time.Second)
+	for rsp.Header.MsgType != wsshell.MessageTypeStopShell {
 		select {
+		case rsp = <-received:
+			// skip the output of the shell
 		case <-timeout:
-			t.Logf("ok: expected to run forever")
-		case <-done:
+			t.Fatal("the server was not notified of the end of the shell session")
 		}
 	}
+	assert.Equal(t, sessionID, rsp.Header.SessionID)
+	assert.Nil(t, d.shellSessions.GetById(sessionID))
+	assert.False(t, procps.ProcessExists(pid))
+	assert.Equal(t, ConnectionStateDisconnected, d.getConnectionState())
+
+	// no more shells
+	err = d.routeMessageSpawnShell(message)
+	assert.Equal(t, session.ErrShutdown, err)
+}
+
+func TestShutdownDownload(t *testing.T) {
+	const sessionID = "shutdown-download-session-id"
+	content := make([]byte, 4*1024*1024)
+	rand.Read(content)
+	f, err := ioutil.TempFile("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(content)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	// the server downloads the file, acknowledging every chunk
+	received := make(chan *ws.ProtoMsg, 1000)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrader = websocket.Upgrader{}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		filePath := f.Name()
+		body, _ := msgpack.Marshal(wsft.GetFile{Path: &filePath})
+		write := func(msg *ws.ProtoMsg) error {
+			b, _ := msgpack.Marshal(msg)
+			return c.WriteMessage(websocket.BinaryMessage, b)
+		}
+		err = write(&ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     ws.ProtoTypeFileTransfer,
+				MsgType:   wsft.MessageTypeGet,
+				SessionID: sessionID,
+			},
+			Body: body,
+		})
+		if err != nil {
+			return
+		}
+		for {
+			msg, err := readMessage(c)
+			if err != nil {
+				return
+			}
+			received <- msg
+			if msg.Header.MsgType == wsft.MessageTypeChunk && len(msg.Body) > 0 {
+				offset, _ := msg.Header.Properties["offset"].(int64)
+				_ = write(&ws.ProtoMsg{
+					Header: ws.ProtoHdr{
+						Proto:     ws.ProtoTypeFileTransfer,
+						MsgType:   wsft.MessageTypeACK,
+						SessionID: sessionID,
+						Properties: map[string]interface{}{
+							"offset": offset + int64(len(msg.Body)),
+						},
+					},
+				})
+			}
+		}
+	}))
+	defer s.Close()
+
+	manager := connectionmanager.NewManager(testPingWait)
+	err = manager.Connect(ws.ProtoTypeShell, "ws"+strings.TrimPrefix(s.URL, "http"), "/",
+		"token", https.Config{}, 1, context.Background())
+	assert.NoError(t, err)
+
+	d := NewDaemonWithManager(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShutdownTimeoutSeconds: 10,
+		},
+	}, manager)
+	loopDone := make(chan struct{})
+	go func() {
+		defer close(loopDone)
+		for {
+			msg, err := d.readMessage()
+			if err != nil {
+				return
+			}
+			_ = d.routeMessage(msg)
+		}
+	}()
+
+	// shut down while the download is in progress
+	isChunk := func(msg *ws.ProtoMsg) bool {
+		return msg.Header.Proto == ws.ProtoTypeFileTransfer &&
+			msg.Header.MsgType == wsft.MessageTypeChunk
+	}
+	msg := wstest.WaitForMessage(t, received, isChunk)
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		d.shutdown()
+	}()
+
+	// the server gets the whole file, then the end of the session
+	data := bytes.NewBuffer(nil)
+	eof := false
+	for {
+		if isChunk(msg) {
+			assert.False(t, eof, "chunk after the end of the file")
+			assert.Equal(t, int64(data.Len()), msg.Header.Properties["offset"])
+			data.Write(msg.Body)
+			eof = len(msg.Body) == 0
+		} else if msg.Header.Proto == ws.ProtoTypeControl &&
+			msg.Header.MsgType == ws.MessageTypeClose {
+			break
+		}
+		msg = wstest.WaitForMessage(t, received, func(msg *ws.ProtoMsg) bool {
+			return msg.Header.SessionID == sessionID
+		})
+	}
+	assert.True(t, eof, "the session closed before the end of the file")
+	assert.True(t, bytes.Equal(content, data.Bytes()), "the file downloaded differs")
+
+	select {
+	case <-shutdownDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the shutdown did not complete")
+	}
+	select {
+	case <-loopDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message loop did not return")
+	}
+}
+
+func TestReattachShell(t *testing.T) {
+	const (
+		sessionID = "reattach-session-id"
+		userID    = "reattach-user-id"
+	)
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan *ws.ProtoMsg, 100)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrader = websocket.Upgrader{}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_ = sendMessage(c, wsshell.MessageTypeSpawnShell, sessionID, userID, "")
+		_ = sendMessage(c, wsshell.MessageTypeShellCommand, sessionID, userID, "echo out$((40+2))\n")
+		_ = sendMessage(c, wsshell.MessageTypeSpawnShell, sessionID, "another-user-id", "")
+		_ = sendMessage(c, wsshell.MessageTypeSpawnShell, sessionID, userID, "")
+		for {
+			msg, err := readMessage(c)
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}))
+	defer s.Close()
+	isOutput := func(msg *ws.ProtoMsg) bool {
+		return msg.Header.MsgType == wsshell.MessageTypeShellCommand &&
+			strings.Contains(string(msg.Body), "out42")
+	}
+	isSpawnResponse := func(msg *ws.ProtoMsg) bool {
+		return msg.Header.MsgType == wsshell.MessageTypeSpawnShell
+	}
+
+	manager := connectionmanager.NewManager(testPingWait)
+	err = manager.Connect(ws.ProtoTypeShell, "ws"+strings.TrimPrefix(s.URL, "http"), "/",
+		"token", https.Config{}, 1, context.Background())
+	assert.NoError(t, err)
+
+	d := NewDaemonWithManager(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         currentUser.Username,
+			Sessions: config.SessionsConfig{
+				ReattachGracePeriod: 1,
+				ScrollbackSize:      1024,
+			},
+		},
+	}, manager)
+	d.uid, _ = strconv.ParseUint(currentUser.Uid, 10, 32)
+	d.gid, _ = strconv.ParseUint(currentUser.Gid, 10, 32)
+	routeNext := func() error {
+		message, err := d.readMessage()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return d.routeMessage(message)
+	}
+
+	// spawn the shell and wait for its output
+	assert.NoError(t, routeNext())
+	sess := d.shellSessions.GetById(sessionID)
+	if !assert.NotNil(t, sess) {
+		t.FailNow()
+	}
+	defer d.terminateSession(sessionID) //nolint:errcheck
+	pid := sess.GetShellPid()
+	assert.Equal(t, "Shell started", string(wstest.WaitForMessage(t, received, isSpawnResponse).Body))
+	assert.NoError(t, routeNext())
+	wstest.WaitForMessage(t, received, isOutput)
+
+	d.detachShellSessions()
+	assert.False(t, sess.DetachedAt().IsZero())
+
+	// another user cannot reattach
+	assert.Error(t, routeNext())
+	rsp := wstest.WaitForMessage(t, received, isSpawnResponse)
+	assert.EqualValues(t, wsshell.ErrorMessage, rsp.Header.Properties["status"])
+	assert.False(t, sess.DetachedAt().IsZero())
+
+	// the user reattaches to the same shell and gets its output replayed
+	assert.NoError(t, routeNext())
+	assert.Equal(t, "Shell reattached", string(wstest.WaitForMessage(t, received, isSpawnResponse).Body))
+	wstest.WaitForMessage(t, received, isOutput)
+	assert.True(t, sess.DetachedAt().IsZero())
+	assert.Equal(t, sess, d.shellSessions.GetById(sessionID))
+	assert.Equal(t, pid, sess.GetShellPid())
+	assert.Equal(t, uint(1), d.shellsSpawned)
+
+	// the session is closed once detached for longer than the grace period
+	d.detachShellSessions()
+	d.sweepExpiredSessions()
+	assert.NotNil(t, d.shellSessions.GetById(sessionID))
+	time.Sleep(1100 * time.Millisecond)
+	d.sweepExpiredSessions()
+	assert.Nil(t, d.shellSessions.GetById(sessionID))
+	assert.False(t, procps.ProcessExists(pid))
+	assert.Equal(t, uint(0), d.shellsSpawned)
+	rsp = wstest.WaitForMessage(t, received, func(msg *ws.ProtoMsg) bool {
+		return msg.Header.MsgType == wsshell.MessageTypeStopShell
+	})
+	assert.Equal(t, sessionID, rsp.Header.SessionID)
+}
+
+func TestAttachToShell(t *testing.T) {
+	const (
+		sessionID  = "shared-session-id"
+		observerID = "observer-session-id"
+		writerID   = "writer-session-id"
+		strangerID = "stranger-session-id"
+		supportID  = "support-session-id"
+	)
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *ws.ProtoMsg, 100)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrader = websocket.Upgrader{}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		sendAttach := func(peerID, userID, mode string) {
+			data, _ := msgpack.Marshal(&ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:     ws.ProtoTypeShell,
+					MsgType:   wsshell.MessageTypeSpawnShell,
+					SessionID: peerID,
+					Properties: map[string]interface{}{
+						propertyUserID:     userID,
+						propertyAttachTo:   sessionID,
+						propertyAttachMode: mode,
+					},
+				},
+			})
+			_ = c.WriteMessage(websocket.BinaryMessage, data)
+		}
+		_ = sendMessage(c, wsshell.MessageTypeSpawnShell, sessionID, "owner-user-id", "")
+		sendAttach(writerID, "owner-user-id", session.PeerModeWriter)
+		sendAttach(strangerID, "stranger-user-id", session.PeerModeObserver)
+		sendAttach(observerID, "owner-user-id", session.PeerModeObserver)
+		sendAttach(supportID, "support-user-id", session.PeerModeObserver)
+		_ = sendMessage(c, wsshell.MessageTypeShellCommand, observerID, "", "echo no\n")
+		_ = sendMessage(c, wsshell.MessageTypeStopShell, observerID, "", "")
+		for {
+			msg, err := readMessage(c)
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}))
+	defer s.Close()
+	isResponse := func(sessionID string, msgType string) func(msg *ws.ProtoMsg) bool {
+		return func(msg *ws.ProtoMsg) bool {
+			return msg.Header.SessionID == sessionID && msg.Header.MsgType == msgType &&
+				msg.Header.Properties["event"] == nil
+		}
+	}
+
+	manager := connectionmanager.NewManager(testPingWait)
+	err = manager.Connect(ws.ProtoTypeShell, "ws"+strings.TrimPrefix(s.URL, "http"), "/",
+		"token", https.Config{}, 1, context.Background())
+	assert.NoError(t, err)
+
+	d := NewDaemonWithManager(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         currentUser.Username,
+			Terminal: config.TerminalConfig{
+				Sharing: config.SharingConfig{
+					Enable:       true,
+					MaxPeers:     2,
+					AllowedUsers: []string{"support-user-id"},
+				},
+			},
+			// the peers do not count in the limit of sessions per user
+			Sessions: config.SessionsConfig{
+				MaxPerUser: 1,
+			},
+		},
+	}, manager)
+	d.uid, _ = strconv.ParseUint(currentUser.Uid, 10, 32)
+	d.gid, _ = strconv.ParseUint(currentUser.Gid, 10, 32)
+	routeNext := func() error {
+		message, err := d.readMessage()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return d.routeMessage(message)
+	}
+
+	assert.NoError(t, routeNext())
+	defer d.terminateSession(sessionID) //nolint:errcheck
+	wstest.WaitForMessage(t, received, isResponse(sessionID, wsshell.MessageTypeSpawnShell))
+
+	// the writers are not allowed
+	err = routeNext()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), session.ErrSessionWritersNotAllowed.Error())
+	rsp := wstest.WaitForMessage(t, received, isResponse(writerID, wsshell.MessageTypeSpawnShell))
+	assert.EqualValues(t, wsshell.ErrorMessage, rsp.Header.Properties["status"])
+	assert.Nil(t, d.shellSessions.GetById(writerID))
+
+	// the users attach to their own shells only, unless allowed
+	err = routeNext()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), session.ErrSessionUserMismatch.Error())
+	rsp = wstest.WaitForMessage(t, received, isResponse(strangerID, wsshell.MessageTypeSpawnShell))
+	assert.EqualValues(t, wsshell.ErrorMessage, rsp.Header.Properties["status"])
+	assert.Nil(t, d.shellSessions.GetById(strangerID))
+
+	assert.NoError(t, routeNext())
+	rsp = wstest.WaitForMessage(t, received, isResponse(observerID, wsshell.MessageTypeSpawnShell))
+	assert.Equal(t, "Shell attached", string(rsp.Body))
+	assert.NoError(t, routeNext())
+	defer d.terminateSession(supportID) //nolint:errcheck
+	rsp = wstest.WaitForMessage(t, received, isResponse(supportID, wsshell.MessageTypeSpawnShell))
+	assert.Equal(t, "Shell attached", string(rsp.Body))
+	observer := d.shellSessions.GetById(observerID)
+	if !assert.NotNil(t, observer) {
+		t.FailNow()
+	}
+	assert.True(t, observer.IsPeer())
+	assert.Equal(t, uint(1), d.shellsSpawned)
+
+	err = routeNext()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), session.ErrSessionReadOnly.Error())
+
+	// the observer leaves, the shell keeps running
+	assert.NoError(t, routeNext())
+	assert.Nil(t, d.shellSessions.GetById(observerID))
+	owner := d.shellSessions.GetById(sessionID)
+	if assert.NotNil(t, owner) {
+		assert.Equal(t, session.ActiveSession, owner.GetStatus())
+		assert.Len(t, owner.Peers(), 1)
+	}
+	assert.Equal(t, uint(1), d.shellsSpawned)
 }
 
 func TestRun(t *testing.T) {
-	d := &MenderShellDaemon{}
+	d := &MenderShellDaemon{manager: connectionmanager.NewManager(testPingWait)}
 	d.debug = true
 	to := 15 * time.Second
 	timeout := time.After(to)
@@ -1300,6 +1655,35 @@ func TestRun(t *testing.T) {
 	}
 }
 
+func TestRunUnavailableDBusAPI(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &MenderShellDaemon{
+		manager:     connectionmanager.NewManager(testPingWait),
+		username:    u.Username,
+		dbusAPIName: "dummy",
+	}
+	err = d.Run()
+	assert.EqualError(t, err, `the D-Bus API "dummy" is not available in this build`)
+}
+
+func TestRunStandaloneAuthNoTokenSource(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &MenderShellDaemon{
+		ctx:        context.Background(),
+		manager:    connectionmanager.NewManager(testPingWait),
+		username:   u.Username,
+		authConfig: config.AuthConfig{Mode: config.AuthModeStandalone},
+	}
+	err = d.Run()
+	assert.Equal(t, mender.ErrNoTokenSource, err)
+}
+
 func TestRouteMessage(t *testing.T) {
 	t.Parallel()
 	testCases := []struct {
@@ -1375,3 +1759,51 @@ func TestRouteMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestMessageLogger(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(everySecondMessage))
+	defer s.Close()
+
+	d := &MenderShellDaemon{manager: connectionmanager.NewManager(testPingWait)}
+	msg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeSpawnShell,
+			SessionID: "session-id",
+			Properties: map[string]interface{}{
+				propertyUserID: "user-id",
+			},
+		},
+	}
+	assert.Equal(t, log.Fields{
+		logging.FieldSessionID: "session-id",
+		logging.FieldUserID:    "user-id",
+		logging.FieldProto:     "shell",
+	}, d.messageLogger(msg).Data)
+
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	err := d.manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true},
+		1, context.Background())
+	assert.NoError(t, err)
+	defer d.manager.Close(ws.ProtoTypeShell)
+	connectionID := d.manager.GetConnectionID(ws.ProtoTypeShell)
+	assert.NotEmpty(t, connectionID)
+	assert.Equal(t, connectionID, d.logger().Data[logging.FieldConnectionID])
+	assert.Equal(t, connectionID, d.messageLogger(msg).Data[logging.FieldConnectionID])
+}
+
+func TestDaemonsShellSessions(t *testing.T) {
+	// the daemons of a process keep their shell sessions apart
+	d1 := NewDaemon(&config.MenderShellConfig{})
+	d2 := NewDaemon(&config.MenderShellConfig{})
+	s, err := d1.shellSessions.NewSession(d1.manager, "session-id", "user-id",
+		session.NoExpirationTimeout, session.NoExpirationTimeout)
+	assert.NoError(t, err)
+	assert.Nil(t, d2.shellSessions.GetById(s.GetId()))
+	assert.Empty(t, d2.shellSessions.GetSessionIds())
+
+	d2.stopShells()
+	assert.Equal(t, s, d1.shellSessions.GetById(s.GetId()))
+	d1.stopShells()
+	assert.Nil(t, d1.shellSessions.GetById(s.GetId()))
+}
@@ -0,0 +1,315 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/utils"
+)
+
+// Types of the audited events
+const (
+	EventSessionOpen     = "session_open"
+	EventSessionClose    = "session_close"
+	EventShellSpawn      = "shell_spawn"
+	EventShellStop       = "shell_stop"
+	EventShellReattach   = "shell_reattach"
+	EventShellAttach     = "shell_attach"
+	EventShellDetach     = "shell_detach"
+	EventFileStat        = "stat"
+	EventFileGet         = "get_file"
+	EventFilePut         = "put_file"
+	EventPortForwardNew  = "portforward_new"
+	EventPortForwardStop = "portforward_stop"
+	EventMenderClient    = "menderclient"
+	// EventRecovered follows a record torn by a crash, left in the log
+	EventRecovered = "recovered"
+)
+
+// Results of the audited operations
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// Event is an audited remote access activity; the fields not relevant to
+// the type of the event are left empty
+type Event struct {
+	Type      string `json:"event"`
+	SessionID string `json:"session_id,omitempty"`
+	UserID    string `json:"user_id,omitempty"`
+	// Proto is the protocol of the session
+	Proto string `json:"proto,omitempty"`
+	// Path and Size of the transferred file
+	Path string `json:"path,omitempty"`
+	Size *int64 `json:"size,omitempty"`
+	// Protocol, Host and Port of the remote end of a port forward
+	Protocol string `json:"protocol,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Port     uint16 `json:"port,omitempty"`
+	// SharedSessionID is the session owning the shell a session attached
+	// to, in the Mode of the session
+	SharedSessionID string `json:"shared_session_id,omitempty"`
+	Mode            string `json:"mode,omitempty"`
+	// Command run, the shell or the mender client command
+	Command string `json:"command,omitempty"`
+	Result  string `json:"result,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// WithResult returns the event with the result of the operation that
+// returned err
+func (e Event) WithResult(err error) Event {
+	if err != nil {
+		e.Result = ResultFailure
+		e.Error = err.Error()
+	} else {
+		e.Result = ResultSuccess
+		e.Error = ""
+	}
+	return e
+}
+
+// WithSize returns the event with the size of the transferred file
+func (e Event) WithSize(size int64) Event {
+	e.Size = &size
+	return e
+}
+
+// Entry is a record of the audit log: the event, numbered and chained to
+// the previous record by its hash
+type Entry struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Event
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// computeHash returns the SHA-256 hash of the JSON encoding of the record
+// without its hash
+func (r Entry) computeHash() (string, error) {
+	r.Hash = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Log is an append-only audit log. Every record holds the hash of the
+// previous one, so that removing or altering a record breaks the chain.
+type Log struct {
+	mutex    sync.Mutex
+	file     *utils.RotatingFile
+	seq      uint64
+	prevHash string
+	// users maps the IDs of the open sessions to the IDs of their users
+	users map[string]string
+}
+
+// Open opens the audit log at path, resuming the chain of its last record;
+// the log is rotated once it reaches maxSize bytes, keeping maxBackups
+// rotated files. A last record torn by a crash is kept, for Verify to
+// report it, and the chain resumes from the record before it with a
+// recovered event.
+func Open(path string, maxSize int64, maxBackups int) (*Log, error) {
+	l := &Log{users: make(map[string]string)}
+	tail, err := readTail(path)
+	if err == nil && tail.last == nil {
+		// the log may have been rotated right before a crash
+		var backup *logTail
+		backup, err = readTail(utils.RotatedFilePath(path, 1))
+		if err == nil {
+			tail.last = backup.last
+		}
+	}
+	if err != nil {
+		return nil, err
+	} else if tail.last != nil {
+		l.seq = tail.last.Seq
+		l.prevHash = tail.last.Hash
+	}
+	l.file, err = utils.OpenRotatingFile(path, maxSize, maxBackups, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.recover(path, tail); err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// logTail is the end of an audit log file
+type logTail struct {
+	// last valid record, nil if there is none
+	last *Entry
+	// torn is the last line, if it is not a valid record
+	torn []byte
+	// unterminated is set if the last line misses its new line
+	unterminated bool
+}
+
+// readTail returns the end of the file, empty if the file does not exist
+func readTail(path string) (*logTail, error) {
+	tail := &logTail{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return tail, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			record := &Entry{}
+			if json.Unmarshal(line, record) == nil && record.Hash != "" {
+				tail.last, tail.torn = record, nil
+			} else {
+				tail.torn = line
+			}
+			tail.unterminated = line[len(line)-1] != '\n'
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return tail, nil
+}
+
+// recover terminates the last line of the log if a crash cut it, and
+// appends a recovered event after a torn record
+func (l *Log) recover(path string, tail *logTail) error {
+	if tail.unterminated {
+		if _, err := l.file.Write([]byte{'\n'}); err != nil {
+			return errors.Wrap(err, "failed to write to the audit log")
+		}
+	}
+	if tail.torn == nil {
+		return nil
+	}
+	log.Errorf("the audit log %s ends with a torn record, resuming after the record %d",
+		path, l.seq)
+	return l.Append(Event{
+		Type:   EventRecovered,
+		Result: ResultFailure,
+		Error: fmt.Sprintf("torn record of %d bytes after the record %d",
+			len(tail.torn), l.seq),
+	})
+}
+
+// Append writes the event to the log. The events of a session missing the
+// ID of the user get the one of the session_open event.
+func (l *Log) Append(event Event) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if event.SessionID != "" {
+		switch {
+		case event.Type == EventSessionOpen:
+			l.users[event.SessionID] = event.UserID
+		case event.UserID == "":
+			event.UserID = l.users[event.SessionID]
+		}
+		if event.Type == EventSessionClose {
+			delete(l.users, event.SessionID)
+		}
+	}
+
+	record := Entry{
+		Seq:      l.seq + 1,
+		Time:     time.Now().UTC(),
+		Event:    event,
+		PrevHash: l.prevHash,
+	}
+	// hash the record as it reads back, so that the hash verifies even
+	// if the encoding altered some of its values, as invalid UTF-8
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	record = Entry{}
+	if err := json.Unmarshal(b, &record); err != nil {
+		return err
+	}
+	if record.Hash, err = record.computeHash(); err != nil {
+		return err
+	}
+	b, err = json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "failed to write to the audit log")
+	}
+	l.seq = record.Seq
+	l.prevHash = record.Hash
+	return nil
+}
+
+// Close closes the log
+func (l *Log) Close() error {
+	return l.file.Close()
+}
+
+// Recorder records the events of a daemon to its log, once opened; a nil
+// Recorder records nothing
+type Recorder struct {
+	mutex sync.Mutex
+	log   *Log
+}
+
+// SetLog sets the log the events are recorded to; nil disables the auditing
+func (r *Recorder) SetLog(l *Log) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.log = l
+}
+
+// Record appends the event to the log set by SetLog, if any; the failures
+// are logged
+func (r *Recorder) Record(event Event) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	l := r.log
+	r.mutex.Unlock()
+	if l == nil {
+		return
+	}
+	if err := l.Append(event); err != nil {
+		log.Errorf("failed to record the %s event: %s", event.Type, err.Error())
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readEntries(t *testing.T, path string) []Entry {
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	var entries []Entry
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		entry := Entry{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestLog(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	logPath := path.Join(tdir, "audit.log")
+
+	l, err := Open(logPath, 1024*1024, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Append(Event{
+		Type:      EventSessionOpen,
+		SessionID: "session",
+		UserID:    "user",
+		Proto:     "filetransfer",
+	}))
+	assert.NoError(t, l.Append(Event{
+		Type:      EventFilePut,
+		SessionID: "session",
+		Path:      "/etc/passwd",
+	}.WithSize(0).WithResult(errors.New("access denied"))))
+	assert.NoError(t, l.Append(Event{Type: EventSessionClose, SessionID: "session"}))
+	assert.NoError(t, l.Close())
+
+	info, err := os.Stat(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// the chain resumes from the last record
+	l, err = Open(logPath, 1024*1024, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Append(Event{
+		Type:      EventFileStat,
+		SessionID: "session",
+		Path:      "/tmp/invalid-\xff",
+	}))
+	assert.NoError(t, l.Close())
+	_, err = Verify(logPath)
+	assert.NoError(t, err)
+
+	entries := readEntries(t, logPath)
+	if assert.Len(t, entries, 4) {
+		for i, entry := range entries {
+			assert.Equal(t, uint64(i+1), entry.Seq)
+			if i > 0 {
+				assert.Equal(t, entries[i-1].Hash, entry.PrevHash)
+			}
+		}
+		assert.Equal(t, "", entries[0].PrevHash)
+		assert.Equal(t, "user", entries[1].UserID)
+		assert.Equal(t, int64(0), *entries[1].Size)
+		assert.Equal(t, ResultFailure, entries[1].Result)
+		assert.Equal(t, "access denied", entries[1].Error)
+		assert.Equal(t, "user", entries[2].UserID)
+		// the session closed, the user is no longer known
+		assert.Equal(t, "", entries[3].UserID)
+	}
+}
+
+func TestLogRotation(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	logPath := path.Join(tdir, "audit.log")
+
+	l, err := Open(logPath, 512, 2)
+	assert.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, l.Append(Event{
+			Type:    EventMenderClient,
+			Command: "check-update",
+		}.WithResult(nil)))
+	}
+	assert.NoError(t, l.Close())
+
+	// the rotated log was emptied by a crash: resume from the backup
+	backup := readEntries(t, logPath+".1")
+	assert.NoError(t, os.Truncate(logPath, 0))
+	l, err = Open(logPath, 512, 2)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Append(Event{Type: EventMenderClient}))
+	assert.NoError(t, l.Close())
+	entries := readEntries(t, logPath)
+	assert.Equal(t, backup[len(backup)-1].Seq+1, entries[0].Seq)
+	assert.Equal(t, backup[len(backup)-1].Hash, entries[0].PrevHash)
+}
+
+func TestOpenTornLog(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	logPath := path.Join(tdir, "audit.log")
+
+	l, err := Open(logPath, 1024*1024, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Append(Event{Type: EventShellSpawn, SessionID: "session"}))
+	assert.NoError(t, l.Append(Event{Type: EventShellStop, SessionID: "session"}))
+	assert.NoError(t, l.Close())
+	entries := readEntries(t, logPath)
+
+	// a crash tore the last record
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte(`{"seq":3,"time":"2021-`))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	// the chain resumes after the last valid record
+	l, err = Open(logPath, 1024*1024, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Append(Event{Type: EventShellSpawn, SessionID: "session"}))
+	assert.NoError(t, l.Close())
+
+	b, err := ioutil.ReadFile(logPath)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if assert.Len(t, lines, 5) {
+		assert.Equal(t, `{"seq":3,"time":"2021-`, lines[2])
+		recovered := Entry{}
+		assert.NoError(t, json.Unmarshal([]byte(lines[3]), &recovered))
+		assert.Equal(t, EventRecovered, recovered.Type)
+		assert.Equal(t, uint64(3), recovered.Seq)
+		assert.Equal(t, entries[1].Hash, recovered.PrevHash)
+		next := Entry{}
+		assert.NoError(t, json.Unmarshal([]byte(lines[4]), &next))
+		assert.Equal(t, uint64(4), next.Seq)
+		assert.Equal(t, recovered.Hash, next.PrevHash)
+	}
+
+	// the torn record is still reported
+	_, err = Verify(logPath)
+	assert.True(t, errors.Is(err, ErrChainBroken))
+	assert.Contains(t, err.Error(), logPath+":3: malformed record")
+}
+
+func TestOpenUnterminatedLog(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	logPath := path.Join(tdir, "audit.log")
+
+	l, err := Open(logPath, 1024*1024, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Append(Event{Type: EventShellSpawn, SessionID: "session"}))
+	assert.NoError(t, l.Close())
+
+	// a crash cut the new line of the last record only
+	b, err := ioutil.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(logPath, b[:len(b)-1], 0600))
+
+	l, err = Open(logPath, 1024*1024, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Append(Event{Type: EventShellStop, SessionID: "session"}))
+	assert.NoError(t, l.Close())
+
+	entries := readEntries(t, logPath)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, EventShellStop, entries[1].Type)
+	}
+	_, err = Verify(logPath)
+	assert.NoError(t, err)
+}
+
+func TestRecord(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	logPath := path.Join(tdir, "audit.log")
+
+	// no recorder or no log, nothing recorded
+	var none *Recorder
+	none.Record(Event{Type: EventShellSpawn})
+	recorder := &Recorder{}
+	recorder.Record(Event{Type: EventShellSpawn})
+
+	l, err := Open(logPath, 1024, 1)
+	assert.NoError(t, err)
+	recorder.SetLog(l)
+	recorder.Record(Event{Type: EventShellSpawn, SessionID: "session", Command: "/bin/sh"})
+	recorder.SetLog(nil)
+	recorder.Record(Event{Type: EventShellStop, SessionID: "session"})
+	assert.NoError(t, l.Close())
+
+	entries := readEntries(t, logPath)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, EventShellSpawn, entries[0].Type)
+		assert.Equal(t, "/bin/sh", entries[0].Command)
+	}
+}
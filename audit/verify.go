@@ -0,0 +1,131 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mender-connect/utils"
+)
+
+var (
+	ErrChainBroken = errors.New("the audit log chain is broken")
+)
+
+// Verification is the outcome of a successful verification of an audit log
+type Verification struct {
+	// Files verified, the oldest first
+	Files []string `json:"files"`
+	// Records verified
+	Records uint64 `json:"records"`
+	// FirstSeq and LastSeq are the sequence numbers of the first and the
+	// last record; the records before FirstSeq were rotated out
+	FirstSeq uint64 `json:"first_seq"`
+	LastSeq  uint64 `json:"last_seq"`
+}
+
+// Verify checks the hash chain of the audit log at path and of its rotated
+// files: every record must hold its own hash and the one of the record
+// before it, with consecutive sequence numbers. The chain of the oldest
+// record kept can only be verified if it is the first of the log.
+func Verify(path string) (*Verification, error) {
+	var files []string
+	for n := 1; ; n++ {
+		backup := utils.RotatedFilePath(path, n)
+		if _, err := os.Stat(backup); err != nil {
+			break
+		}
+		files = append([]string{backup}, files...)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	files = append(files, path)
+
+	v := &Verification{Files: files}
+	var prev *Entry
+	for _, file := range files {
+		if err := v.verifyFile(file, &prev); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+func (v *Verification) verifyFile(path string, prev **Entry) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		record, err := verifyRecord(line, *prev)
+		if err != nil {
+			return errors.Wrapf(err, "%s:%d", path, lineNumber)
+		}
+		if *prev == nil {
+			v.FirstSeq = record.Seq
+		}
+		v.LastSeq = record.Seq
+		v.Records++
+		*prev = record
+	}
+}
+
+// verifyRecord parses the line and checks its record against the previous
+// one, nil if it is the first record kept
+func verifyRecord(line []byte, prev *Entry) (*Entry, error) {
+	record := &Entry{}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(record); err != nil {
+		return nil, errors.Wrap(ErrChainBroken, "malformed record")
+	}
+	hash, err := record.computeHash()
+	if err != nil {
+		return nil, err
+	} else if hash != record.Hash {
+		return nil, errors.Wrapf(ErrChainBroken,
+			"the hash of the record %d does not match its content", record.Seq)
+	}
+	switch {
+	case prev == nil && record.Seq == 1 && record.PrevHash != "":
+		return nil, errors.Wrap(ErrChainBroken,
+			"the first record refers to a previous one")
+	case prev == nil:
+	case record.Seq != prev.Seq+1:
+		return nil, errors.Wrapf(ErrChainBroken,
+			"the record %d follows the record %d", record.Seq, prev.Seq)
+	case record.PrevHash != prev.Hash:
+		return nil, errors.Wrapf(ErrChainBroken,
+			"the record %d does not refer to the hash of the record %d",
+			record.Seq, prev.Seq)
+	}
+	return record, nil
+}
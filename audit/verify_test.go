@@ -0,0 +1,123 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeLog(t *testing.T, logPath string, maxSize int64, events int) {
+	l, err := Open(logPath, maxSize, 10)
+	assert.NoError(t, err)
+	for i := 0; i < events; i++ {
+		assert.NoError(t, l.Append(Event{
+			Type:      EventPortForwardNew,
+			SessionID: "session",
+			Protocol:  "tcp",
+			Host:      "localhost",
+			Port:      22,
+		}.WithResult(nil)))
+	}
+	assert.NoError(t, l.Close())
+}
+
+func TestVerify(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	logPath := path.Join(tdir, "audit.log")
+
+	writeLog(t, logPath, 1024, 20)
+	v, err := Verify(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(20), v.Records)
+	assert.Equal(t, uint64(1), v.FirstSeq)
+	assert.Equal(t, uint64(20), v.LastSeq)
+	assert.True(t, len(v.Files) > 1)
+	assert.Equal(t, logPath, v.Files[len(v.Files)-1])
+
+	// the oldest rotated file is removed
+	assert.NoError(t, os.Remove(v.Files[0]))
+	v, err = Verify(logPath)
+	assert.NoError(t, err)
+	assert.True(t, v.FirstSeq > 1)
+	assert.Equal(t, uint64(20), v.LastSeq)
+
+	_, err = Verify(path.Join(tdir, "does-not-exist.log"))
+	assert.Error(t, err)
+}
+
+func TestVerifyTampered(t *testing.T) {
+	testCases := map[string]struct {
+		tamper func(lines []string) []string
+		err    string
+	}{
+		"altered record": {
+			tamper: func(lines []string) []string {
+				lines[1] = strings.Replace(lines[1], `"port":22`, `"port":23`, 1)
+				return lines
+			},
+			err: "audit.log:2: the hash of the record 2 does not match its content: " +
+				"the audit log chain is broken",
+		},
+		"removed record": {
+			tamper: func(lines []string) []string {
+				return append(lines[:2], lines[3:]...)
+			},
+			err: "audit.log:3: the record 4 follows the record 2: " +
+				"the audit log chain is broken",
+		},
+		"added field": {
+			tamper: func(lines []string) []string {
+				lines[0] = strings.Replace(lines[0], `{`, `{"note":"x",`, 1)
+				return lines
+			},
+			err: "audit.log:1: malformed record: the audit log chain is broken",
+		},
+		"first record removed": {
+			tamper: func(lines []string) []string {
+				return lines[1:]
+			},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tdir, err := ioutil.TempDir("", "audit")
+			assert.NoError(t, err)
+			defer os.RemoveAll(tdir)
+			logPath := path.Join(tdir, "audit.log")
+
+			writeLog(t, logPath, 1024*1024, 4)
+			b, err := ioutil.ReadFile(logPath)
+			assert.NoError(t, err)
+			lines := tc.tamper(strings.Split(strings.TrimSpace(string(b)), "\n"))
+			err = ioutil.WriteFile(logPath, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+			assert.NoError(t, err)
+
+			_, err = Verify(logPath)
+			if tc.err != "" {
+				assert.EqualError(t, err, path.Join(tdir, tc.err))
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
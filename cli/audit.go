@@ -0,0 +1,66 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/mendersoftware/mender-connect/audit"
+	"github.com/mendersoftware/mender-connect/config"
+)
+
+// auditLogPath returns the path of the audit log given on the command line,
+// or the configured one
+func (runOptions *runOptionsType) auditLogPath(ctx *cli.Context) string {
+	if path := ctx.String("file"); path != "" {
+		return path
+	}
+	if !runOptions.debug && !runOptions.trace {
+		// keep the output of the command free of the configuration logs
+		log.SetLevel(log.WarnLevel)
+	}
+	conf, err := config.LoadConfig(runOptions.config, runOptions.fallbackConfig)
+	if err == nil && conf.Audit.File != "" {
+		return conf.Audit.File
+	}
+	return config.DefaultAuditFile
+}
+
+func (runOptions *runOptionsType) verifyAuditLog(ctx *cli.Context) error {
+	path := runOptions.auditLogPath(ctx)
+	v, err := audit.Verify(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to verify the audit log %s", path)
+	}
+	if ctx.Bool("json") {
+		return writeJSON(ctx.App.Writer, v)
+	}
+
+	w := ctx.App.Writer
+	fmt.Fprintf(w, "audit log %s: OK\n", path)
+	fmt.Fprintf(w, "  files: %d\n", len(v.Files))
+	fmt.Fprintf(w, "  records: %d\n", v.Records)
+	if v.Records > 0 {
+		fmt.Fprintf(w, "  sequence: %d to %d\n", v.FirstSeq, v.LastSeq)
+	}
+	if v.FirstSeq > 1 {
+		fmt.Fprintf(w, "  the records before %d were rotated out\n", v.FirstSeq)
+	}
+	return nil
+}
@@ -17,10 +17,15 @@ import (
 	"github.com/urfave/cli/v2"
 
 	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/logging"
 )
 
 func SetupCLI(args []string) error {
 	runOptions := &runOptionsType{}
+	jsonFlag := &cli.BoolFlag{
+		Name:  "json",
+		Usage: "Output JSON",
+	}
 	app := &cli.App{
 		Description: "",
 		Name:        "mender-connect",
@@ -32,6 +37,54 @@ func SetupCLI(args []string) error {
 				Usage:  "Start the client as a background service.",
 				Action: runOptions.handleCLIOptions,
 			},
+			{
+				Name:   "status",
+				Usage:  "Show the status of the running daemon",
+				Flags:  []cli.Flag{jsonFlag},
+				Action: runOptions.showStatus,
+			},
+			{
+				Name:  "sessions",
+				Usage: "Manage the remote sessions of the running daemon",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "List the open sessions",
+						Flags:  []cli.Flag{jsonFlag},
+						Action: runOptions.listSessions,
+					},
+					{
+						Name:      "kill",
+						Usage:     "Close a session, notifying the server",
+						ArgsUsage: "SESSION_ID",
+						Action:    runOptions.killSession,
+					},
+				},
+			},
+			{
+				Name: "disconnect",
+				Usage: "Close the sessions and the connection to the server; " +
+					"the daemon reconnects once restarted",
+				Action: runOptions.disconnect,
+			},
+			{
+				Name:  "audit",
+				Usage: "Inspect the audit log of the remote access activity",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "verify",
+						Usage: "Verify the hash chain of the audit log and of its rotated files",
+						Flags: []cli.Flag{
+							jsonFlag,
+							&cli.StringFlag{
+								Name:  "file",
+								Usage: "Audit log `FILE` path; defaults to the configured one",
+							},
+						},
+						Action: runOptions.verifyAuditLog,
+					},
+				},
+			},
 			{
 				Name:   "version",
 				Usage:  "Show the version and runtime information of the binary build",
@@ -75,26 +128,21 @@ func SetupCLI(args []string) error {
 
 func (runOptions *runOptionsType) handleCLIOptions(ctx *cli.Context) error {
 	// Handle config flags
-	config, err := config.LoadConfig(runOptions.config, runOptions.fallbackConfig)
-	if err != nil {
-		return err
-	}
-
-	config.Debug = runOptions.debug
-	config.Trace = runOptions.trace
-
-	err = config.Validate()
+	config, err := runOptions.loadConfig()
 	if err != nil {
 		return err
 	}
 
 	switch ctx.Command.Name {
 	case "daemon":
+		if err := logging.Setup(config.Log); err != nil {
+			return err
+		}
 		d, err := initDaemon(config)
 		if err != nil {
 			return err
 		}
-		return runDaemon(d)
+		return runOptions.runDaemon(d)
 	default:
 		cli.ShowAppHelpAndExit(ctx, 1)
 	}
@@ -18,6 +18,8 @@ import (
 	"os/signal"
 	"syscall"
 
+	log "github.com/sirupsen/logrus"
+
 	"github.com/mendersoftware/mender-connect/app"
 	"github.com/mendersoftware/mender-connect/config"
 )
@@ -34,12 +36,44 @@ func initDaemon(config *config.MenderShellConfig) (*app.MenderShellDaemon, error
 	return daemon, nil
 }
 
-func runDaemon(d *app.MenderShellDaemon) error {
+// loadConfig loads and validates the configuration
+func (runOptions *runOptionsType) loadConfig() (*config.MenderShellConfig, error) {
+	conf, err := config.LoadConfig(runOptions.config, runOptions.fallbackConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.Debug = runOptions.debug
+	conf.Trace = runOptions.trace
+
+	err = conf.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// reloadConfig loads the configuration again and applies it to the daemon;
+// an invalid configuration changes nothing
+func (runOptions *runOptionsType) reloadConfig(d *app.MenderShellDaemon) {
+	log.Info("reloading the configuration")
+	conf, err := runOptions.loadConfig()
+	if err == nil {
+		err = d.Reload(conf)
+	}
+	if err != nil {
+		log.Errorf("failed to reload the configuration, keeping the current one: %s",
+			err.Error())
+	}
+}
+
+func (runOptions *runOptionsType) runDaemon(d *app.MenderShellDaemon) error {
 	// Handle user forcing update check.
 	go func() {
 		c := make(chan os.Signal, 2)
 		signal.Notify(c, syscall.SIGTERM)
 		signal.Notify(c, syscall.SIGUSR1)
+		signal.Notify(c, syscall.SIGHUP)
 		defer signal.Stop(c)
 
 		for {
@@ -49,6 +83,8 @@ func runDaemon(d *app.MenderShellDaemon) error {
 				d.StopDaemon()
 			case syscall.SIGUSR1:
 				d.PrintStatus()
+			case syscall.SIGHUP:
+				runOptions.reloadConfig(d)
 			}
 		}
 	}()
@@ -0,0 +1,125 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/control"
+)
+
+// controlClient returns a client of the control socket of the running
+// daemon, as configured
+func (runOptions *runOptionsType) controlClient() *control.Client {
+	if !runOptions.debug && !runOptions.trace {
+		// keep the output of the commands free of the configuration logs
+		log.SetLevel(log.WarnLevel)
+	}
+	path := config.DefaultControlSocketPath
+	conf, err := config.LoadConfig(runOptions.config, runOptions.fallbackConfig)
+	if err == nil && conf.ControlSocket.Path != "" {
+		path = conf.ControlSocket.Path
+	}
+	return control.NewClient(path)
+}
+
+func (runOptions *runOptionsType) showStatus(ctx *cli.Context) error {
+	status, err := runOptions.controlClient().Status()
+	if err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return writeJSON(ctx.App.Writer, status)
+	}
+
+	w := ctx.App.Writer
+	conn := status.Connection
+	fmt.Fprintf(w, "mender-connect %s\n", status.Version)
+	fmt.Fprintf(w, "connection: %s\n", conn.State)
+	fmt.Fprintf(w, "  server: %s\n", conn.ServerURL)
+	if conn.NextRetry != nil {
+		fmt.Fprintf(w, "  reconnect: attempt %d, next %s, circuit open: %t\n",
+			conn.ReconnectAttempt, conn.NextRetry.Format(time.RFC3339), conn.CircuitOpen)
+	}
+	fmt.Fprintf(w, "  compression: %t\n", conn.Compression)
+	fmt.Fprintf(w, "  tx: %d bytes, %d on the wire\n", conn.TxMessageBytes, conn.TxWireBytes)
+	fmt.Fprintf(w, "  rx: %d bytes, %d on the wire\n", conn.RxMessageBytes, conn.RxWireBytes)
+	fmt.Fprintf(w, "sessions: %d\n", status.Sessions)
+	fmt.Fprintf(w, "file transfer:\n")
+	fmt.Fprintf(w, "  total: tx %d bytes, rx %d bytes\n",
+		status.FileTransfer.TxBytes, status.FileTransfer.RxBytes)
+	fmt.Fprintf(w, "  1m: tx %.2f, rx %.2f\n",
+		status.FileTransfer.TxAverage1m, status.FileTransfer.RxAverage1m)
+	fmt.Fprintf(w, "port forwards: %d\n", len(status.PortForwards))
+	if len(status.PortForwards) > 0 {
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "  SESSION\tCONNECTION\tREMOTE\tSTARTED")
+		for _, f := range status.PortForwards {
+			fmt.Fprintf(tw, "  %s\t%s\t%s/%s:%d\t%s\n", f.SessionID, f.ConnectionID,
+				f.Protocol, f.RemoteHost, f.RemotePort, f.StartedAt.Format(time.RFC3339))
+		}
+		return tw.Flush()
+	}
+	return nil
+}
+
+func (runOptions *runOptionsType) listSessions(ctx *cli.Context) error {
+	sessions, err := runOptions.controlClient().Sessions()
+	if err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return writeJSON(ctx.App.Writer, sessions)
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(ctx.App.Writer, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSER\tPROTOCOL\tSTARTED\tIDLE")
+	for _, s := range sessions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.ID, s.UserID, s.Protocol,
+			s.StartedAt.Format(time.RFC3339), now.Sub(s.ActiveAt).Truncate(time.Second))
+	}
+	return tw.Flush()
+}
+
+func (runOptions *runOptionsType) killSession(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("usage: mender-connect sessions kill SESSION_ID")
+	}
+	sessionID := ctx.Args().First()
+	if err := runOptions.controlClient().KillSession(sessionID); err != nil {
+		return errors.Wrapf(err, "session %s", sessionID)
+	}
+	return nil
+}
+
+func (runOptions *runOptionsType) disconnect(ctx *cli.Context) error {
+	return runOptions.controlClient().Disconnect()
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
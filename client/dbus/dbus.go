@@ -15,17 +15,39 @@
 package dbus
 
 import (
-	"errors"
 	"time"
 	"unsafe"
+
+	"github.com/pkg/errors"
 )
 
 // These are unsafe pointers, only prettier :)
 type Handle unsafe.Pointer
 type MainLoop unsafe.Pointer
 
+// Names of the DBusAPI implementations
+const (
+	// DBusAPILibGio is the implementation based on libgio, available in the
+	// builds with cgo and without the nodbus build tag
+	DBusAPILibGio = "libgio"
+	// DBusAPINative is the pure Go implementation of the D-Bus protocol,
+	// always available and used by default in the builds without libgio
+	DBusAPINative = "native"
+)
+
+const (
+	GDBusTypeString = "s"
+)
+
+// DBusErrorFailed is the name of the error returned to the callers of the
+// exported methods when the MethodHandler fails without a MethodError
+const DBusErrorFailed = "org.freedesktop.DBus.Error.Failed"
+
 var dbusAPI DBusAPI = nil
 
+// dbusAPIs holds the constructors of the available DBusAPI implementations
+var dbusAPIs = map[string]func() DBusAPI{}
+
 // DBusCallResponse stores the response of a method invocation
 type DBusCallResponse interface {
 	// GetString returns a string stored in the response object
@@ -41,6 +63,26 @@ type SignalParams struct {
 	ParamData interface{}
 }
 
+// MethodHandler handles the calls of the methods of an exported object; it
+// returns the values of the out arguments of the method, in the order in
+// which they are declared by the introspection data of the object
+type MethodHandler func(interfaceName, methodName string, params []SignalParams) ([]interface{}, error)
+
+// NameOwnerHandler is called when the owner of a watched name changes; the
+// owner is empty when the name is not owned. It is called from the goroutine
+// dispatching the messages of the connection, so it must not block
+type NameOwnerHandler func(name, owner string)
+
+// MethodError is an error returned by a MethodHandler with a D-Bus error name
+type MethodError struct {
+	Name    string
+	Message string
+}
+
+func (e *MethodError) Error() string {
+	return e.Name + ": " + e.Message
+}
+
 // DBusAPI is the interface which describes a DBus API
 type DBusAPI interface {
 	// BusGet synchronously connects to the message bus specified by bus_type
@@ -61,6 +103,24 @@ type DBusAPI interface {
 	GetChannelForSignal(signalName string) chan []SignalParams
 	// WaitForSignal waits for a DBus signal
 	WaitForSignal(signalName string, timeout time.Duration) ([]SignalParams, error)
+	// BusOwnName requests the ownership of a well-known name on the bus
+	BusOwnName(conn Handle, name string) error
+	// BusReleaseName releases the ownership of a well-known name on the bus
+	BusReleaseName(conn Handle, name string) error
+	// BusRegisterObject exports an object implementing the interfaces
+	// described by the introspection XML; the calls of their methods are
+	// passed to the handler
+	BusRegisterObject(conn Handle, objectPath string, introspectionXML string, handler MethodHandler) (uint, error)
+	// BusUnregisterObject stops exporting a registered object
+	BusUnregisterObject(conn Handle, registrationID uint) error
+	// BusEmitSignal emits a signal of an exported object, with the values
+	// of the arguments declared by its introspection data
+	BusEmitSignal(conn Handle, objectPath, interfaceName, signalName string, values []interface{}) error
+	// BusWatchName watches the owner of a name on the bus; the handler is
+	// called with the current owner, and then every time it changes
+	BusWatchName(conn Handle, name string, handler NameOwnerHandler) (uint, error)
+	// BusUnwatchName stops watching the owner of a name
+	BusUnwatchName(conn Handle, watchID uint) error
 }
 
 // GetDBusAPI returns the global DBusAPI object
@@ -71,6 +131,21 @@ func GetDBusAPI() (DBusAPI, error) {
 	return nil, errors.New("no D-Bus interface available")
 }
 
+// SelectDBusAPI replaces the global DBusAPI object with a new instance of
+// the named implementation
+func SelectDBusAPI(name string) error {
+	newDBusAPI, ok := dbusAPIs[name]
+	if !ok {
+		return errors.Errorf("the D-Bus API %q is not available in this build", name)
+	}
+	setDBusAPI(newDBusAPI())
+	return nil
+}
+
+func registerDBusAPI(name string, newDBusAPI func() DBusAPI) {
+	dbusAPIs[name] = newDBusAPI
+}
+
 func setDBusAPI(api DBusAPI) {
 	dbusAPI = api
 }
@@ -0,0 +1,215 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package dbus
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// formatGVariantTuple formats the values as a GVariant tuple of the types
+// of the signature, in the GVariant text format parsed by g_variant_parse;
+// the values are the same as the ones marshalled by the native
+// implementation
+func formatGVariantTuple(sig string, values []interface{}) (string, error) {
+	types, err := splitSignature(sig)
+	if err != nil {
+		return "", err
+	} else if len(types) != len(values) {
+		return "", typeMismatch("("+sig+")", values)
+	}
+	var b strings.Builder
+	b.WriteByte('(')
+	for i, t := range types {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		if err := formatGVariant(&b, t, values[i], 0); err != nil {
+			return "", err
+		}
+	}
+	if len(types) == 1 {
+		b.WriteByte(',')
+	}
+	b.WriteByte(')')
+	return b.String(), nil
+}
+
+// formatGVariant formats the value of a single complete type
+func formatGVariant(b *strings.Builder, sig string, v interface{}, depth int) error {
+	if depth > maxNesting {
+		return errInvalidSignature
+	}
+	switch sig[0] {
+	case 'y':
+		val, ok := v.(byte)
+		if !ok {
+			return typeMismatch(sig, v)
+		}
+		b.WriteString(strconv.FormatUint(uint64(val), 10))
+	case 'b':
+		val, ok := v.(bool)
+		if !ok {
+			return typeMismatch(sig, v)
+		}
+		b.WriteString(strconv.FormatBool(val))
+	case 'n', 'q', 'i', 'u', 'h', 'x', 't':
+		switch val := v.(type) {
+		case int16, uint16, int32, uint32, int64, uint64:
+			fmt.Fprintf(b, "%d", val)
+		default:
+			return typeMismatch(sig, v)
+		}
+	case 'd':
+		val, ok := v.(float64)
+		if !ok || math.IsNaN(val) || math.IsInf(val, 0) {
+			return typeMismatch(sig, v)
+		}
+		s := strconv.FormatFloat(val, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		b.WriteString(s)
+	case 's', 'o', 'g':
+		switch val := v.(type) {
+		case string:
+			formatGVariantString(b, val)
+		case ObjectPath:
+			formatGVariantString(b, string(val))
+		case Signature:
+			formatGVariantString(b, string(val))
+		default:
+			return typeMismatch(sig, v)
+		}
+	case 'v':
+		variant, ok := v.(Variant)
+		if !ok {
+			return typeMismatch(sig, v)
+		}
+		t, rest, err := nextType(string(variant.Signature), depth+1)
+		if err != nil || rest != "" {
+			return errInvalidSignature
+		}
+		b.WriteString("<@" + t + " ")
+		if err := formatGVariant(b, t, variant.Value, depth+1); err != nil {
+			return err
+		}
+		b.WriteByte('>')
+	case 'a':
+		return formatGVariantArray(b, sig, v, depth)
+	case '(':
+		fields, ok := v.([]interface{})
+		if !ok {
+			return typeMismatch(sig, v)
+		}
+		types, err := splitSignature(sig[1 : len(sig)-1])
+		if err != nil {
+			return err
+		} else if len(types) != len(fields) {
+			return typeMismatch(sig, v)
+		}
+		b.WriteByte('(')
+		for i, t := range types {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			if err := formatGVariant(b, t, fields[i], depth+1); err != nil {
+				return err
+			}
+		}
+		if len(types) == 1 {
+			b.WriteByte(',')
+		}
+		b.WriteByte(')')
+	default:
+		return errInvalidSignature
+	}
+	return nil
+}
+
+func formatGVariantArray(b *strings.Builder, sig string, v interface{}, depth int) error {
+	elem := sig[1:]
+	if elem[0] == '{' {
+		entries, ok := v.([]DictEntry)
+		if !ok {
+			return typeMismatch(sig, v)
+		}
+		key, rest, _ := nextType(elem[1:], depth+1)
+		value, _, _ := nextType(rest, depth+1)
+		b.WriteByte('{')
+		for i, entry := range entries {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			if err := formatGVariant(b, key, entry.Key, depth+1); err != nil {
+				return err
+			}
+			b.WriteString(": ")
+			if err := formatGVariant(b, value, entry.Value, depth+1); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('}')
+		return nil
+	}
+
+	var elems []interface{}
+	switch v := v.(type) {
+	case []interface{}:
+		elems = v
+	case []string:
+		for _, s := range v {
+			elems = append(elems, s)
+		}
+	case []byte:
+		for _, c := range v {
+			elems = append(elems, c)
+		}
+	default:
+		return typeMismatch(sig, v)
+	}
+	b.WriteByte('[')
+	for i, value := range elems {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		if err := formatGVariant(b, elem, value, depth+1); err != nil {
+			return err
+		}
+	}
+	b.WriteByte(']')
+	return nil
+}
+
+// formatGVariantString formats a string literal, escaping the quotes, the
+// backslashes and the non-printable characters
+func formatGVariantString(b *strings.Builder, s string) {
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == utf8.RuneError || r < 0x20 || r == 0x7f:
+			fmt.Fprintf(b, "\\u%04x", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+}
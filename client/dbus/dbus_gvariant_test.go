@@ -0,0 +1,91 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package dbus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatGVariantTuple(t *testing.T) {
+	testCases := map[string]struct {
+		sig    string
+		values []interface{}
+		text   string
+		err    bool
+	}{
+		"empty": {
+			text: "()",
+		},
+		"single value": {
+			sig:    "s",
+			values: []interface{}{"string"},
+			text:   `("string",)`,
+		},
+		"basic types": {
+			sig: "ybnqiuxtdogs",
+			values: []interface{}{
+				byte(1), true, int16(-2), uint16(3), int32(-4), uint32(5),
+				int64(-6), uint64(7), 8.0, ObjectPath("/io/mender"), Signature("as"),
+				"quote \" backslash \\ newline \n",
+			},
+			text: `(1, true, -2, 3, -4, 5, -6, 7, 8.0, "/io/mender", "as", ` +
+				`"quote \" backslash \\ newline \u000a")`,
+		},
+		"containers": {
+			sig: "a(sx)asaya{sv}v",
+			values: []interface{}{
+				[]interface{}{
+					[]interface{}{"id", int64(1)},
+				},
+				[]string{},
+				[]byte{1, 2},
+				[]DictEntry{
+					{Key: "key", Value: Variant{Signature: "u", Value: uint32(3)}},
+				},
+				Variant{Signature: "(s)", Value: []interface{}{"struct"}},
+			},
+			text: `([("id", 1)], [], [1, 2], {"key": <@u 3>}, <@(s) ("struct",)>)`,
+		},
+		"error, signature mismatch": {
+			sig:    "ss",
+			values: []interface{}{"string"},
+			err:    true,
+		},
+		"error, type mismatch": {
+			sig:    "x",
+			values: []interface{}{"string"},
+			err:    true,
+		},
+		"error, invalid signature": {
+			sig:    "a",
+			values: []interface{}{[]string{}},
+			err:    true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			text, err := formatGVariantTuple(tc.sig, tc.values)
+			if tc.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.text, text)
+			}
+		})
+	}
+}
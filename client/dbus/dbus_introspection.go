@@ -0,0 +1,132 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package dbus
+
+import (
+	"encoding/xml"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Names of the standard interfaces implemented by the exported objects
+const (
+	introspectableInterfaceName = "org.freedesktop.DBus.Introspectable"
+	peerInterfaceName           = "org.freedesktop.DBus.Peer"
+)
+
+// introspectionNode is the introspection data of an exported object, as
+// defined by the D-Bus specification
+type introspectionNode struct {
+	XMLName    xml.Name                 `xml:"node"`
+	Interfaces []introspectionInterface `xml:"interface"`
+}
+
+type introspectionInterface struct {
+	Name    string                `xml:"name,attr"`
+	Methods []introspectionMember `xml:"method"`
+	Signals []introspectionMember `xml:"signal"`
+}
+
+type introspectionMember struct {
+	Name string             `xml:"name,attr"`
+	Args []introspectionArg `xml:"arg"`
+}
+
+type introspectionArg struct {
+	Name      string `xml:"name,attr"`
+	Type      string `xml:"type,attr"`
+	Direction string `xml:"direction,attr"`
+}
+
+// parseIntrospection parses and validates the introspection XML
+func parseIntrospection(introspectionXML string) (*introspectionNode, error) {
+	node := &introspectionNode{}
+	if err := xml.Unmarshal([]byte(introspectionXML), node); err != nil {
+		return nil, errors.Wrap(err, "invalid D-Bus introspection data")
+	} else if len(node.Interfaces) == 0 {
+		return nil, errors.New("invalid D-Bus introspection data: no interfaces")
+	}
+	for _, iface := range node.Interfaces {
+		if iface.Name == "" {
+			return nil, errors.New("invalid D-Bus introspection data: unnamed interface")
+		}
+		for _, member := range append(iface.Methods, iface.Signals...) {
+			if member.Name == "" {
+				return nil, errors.Errorf(
+					"invalid D-Bus introspection data: unnamed member of %s", iface.Name)
+			}
+			for _, arg := range member.Args {
+				if t, rest, err := nextType(arg.Type, 0); err != nil || rest != "" || t[0] == '{' {
+					return nil, errors.Errorf(
+						"invalid D-Bus introspection data: invalid type %q of %s.%s",
+						arg.Type, iface.Name, member.Name)
+				}
+			}
+		}
+	}
+	return node, nil
+}
+
+func (n *introspectionNode) findInterface(interfaceName string) *introspectionInterface {
+	for i := range n.Interfaces {
+		if n.Interfaces[i].Name == interfaceName {
+			return &n.Interfaces[i]
+		}
+	}
+	return nil
+}
+
+// method returns the method of the interface, if declared
+func (n *introspectionNode) method(interfaceName, methodName string) *introspectionMember {
+	if iface := n.findInterface(interfaceName); iface != nil {
+		for i := range iface.Methods {
+			if iface.Methods[i].Name == methodName {
+				return &iface.Methods[i]
+			}
+		}
+	}
+	return nil
+}
+
+// signal returns the signal of the interface, if declared
+func (n *introspectionNode) signal(interfaceName, signalName string) *introspectionMember {
+	if iface := n.findInterface(interfaceName); iface != nil {
+		for i := range iface.Signals {
+			if iface.Signals[i].Name == signalName {
+				return &iface.Signals[i]
+			}
+		}
+	}
+	return nil
+}
+
+// signature returns the signature of the arguments of the member in the
+// given direction, "in" or "out", or of all of them if direction is empty,
+// as for the signals; the arguments of the methods are in arguments unless
+// specified
+func (m *introspectionMember) signature(direction string) string {
+	var sig strings.Builder
+	for _, arg := range m.Args {
+		argDirection := arg.Direction
+		if argDirection == "" {
+			argDirection = "in"
+		}
+		if direction == "" || argDirection == direction {
+			sig.WriteString(arg.Type)
+		}
+	}
+	return sig.String()
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package dbus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testIntrospection = `<node>
+  <interface name="io.mender.Test1">
+    <method name="Echo">
+      <arg type="s" name="text" direction="in"/>
+      <arg type="x" name="count"/>
+      <arg type="s" name="echo" direction="out"/>
+    </method>
+    <method name="Fail"/>
+    <signal name="Echoed">
+      <arg type="s" name="text"/>
+      <arg type="as" name="values"/>
+    </signal>
+  </interface>
+</node>`
+
+func TestParseIntrospection(t *testing.T) {
+	node, err := parseIntrospection(testIntrospection)
+	assert.NoError(t, err)
+
+	method := node.method("io.mender.Test1", "Echo")
+	if assert.NotNil(t, method) {
+		assert.Equal(t, "sx", method.signature("in"))
+		assert.Equal(t, "s", method.signature("out"))
+	}
+	method = node.method("io.mender.Test1", "Fail")
+	if assert.NotNil(t, method) {
+		assert.Equal(t, "", method.signature("in"))
+	}
+	signal := node.signal("io.mender.Test1", "Echoed")
+	if assert.NotNil(t, signal) {
+		assert.Equal(t, "sas", signal.signature(""))
+	}
+
+	assert.Nil(t, node.method("io.mender.Test1", "Echoed"))
+	assert.Nil(t, node.method("io.mender.Test2", "Echo"))
+	assert.Nil(t, node.signal("io.mender.Test1", "Echo"))
+}
+
+func TestParseIntrospectionErrors(t *testing.T) {
+	testCases := map[string]string{
+		"invalid XML":       `<node>`,
+		"no interfaces":     `<node></node>`,
+		"unnamed interface": `<node><interface/></node>`,
+		"unnamed member":    `<node><interface name="a.b"><method/></interface></node>`,
+		"invalid type":      `<node><interface name="a.b"><method name="M"><arg type="a"/></method></interface></node>`,
+		"two types":         `<node><interface name="a.b"><signal name="S"><arg type="ss"/></signal></interface></node>`,
+		"dictionary entry":  `<node><interface name="a.b"><signal name="S"><arg type="{sv}"/></signal></interface></node>`,
+	}
+
+	for name, introspectionXML := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseIntrospection(introspectionXML)
+			assert.Error(t, err)
+		})
+	}
+}
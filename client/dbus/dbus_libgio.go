@@ -26,6 +26,7 @@ import (
 	"unsafe"
 
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 )
 
 type dbusAPILibGio struct {
@@ -49,10 +50,6 @@ const (
 	GDBusCallFlagsAllowInteractiveAuthorization = (1 << 1)
 )
 
-const (
-	GDBusTypeString = "s"
-)
-
 // BusGet synchronously connects to the message bus specified by bus_type
 // https://developer.gnome.org/gio/stable/GDBusConnection.html#g-bus-get-sync
 func (d *dbusAPILibGio) BusGet(busType uint) (Handle, error) {
@@ -151,6 +148,8 @@ func (d *dbusAPILibGio) HandleSignal(signalName string, params []SignalParams) {
 	select {
 	case channel <- params:
 	default:
+		log.Warnf("dropped the D-Bus signal %s: the previous one was not handled yet",
+			signalName)
 	}
 }
 
@@ -169,26 +168,7 @@ func (d *dbusAPILibGio) WaitForSignal(signalName string, timeout time.Duration)
 func handle_on_signal_callback(proxy *C.GDBusProxy, senderName *C.gchar, signalName *C.gchar, params *C.GVariant, userData C.gpointer) {
 	goSignalName := C.GoString(signalName)
 	api, _ := GetDBusAPI()
-	var goParams []SignalParams
-	i := C.g_variant_iter_new(params)
-	defer C.g_variant_iter_free(i)
-	for {
-		p := C.g_variant_iter_next_value(i)
-		if p == nil {
-			break
-		}
-		typeString := C.GoString(C.g_variant_get_type_string(p))
-		var goParam SignalParams
-		switch typeString {
-		case GDBusTypeString:
-			goParam = SignalParams{
-				ParamType: typeString,
-				ParamData: C.GoString(C.g_variant_get_string(p, nil)),
-			}
-			goParams = append(goParams, goParam)
-		}
-	}
-	api.HandleSignal(goSignalName, goParams)
+	api.HandleSignal(goSignalName, signalParamsFromGVariant(params))
 }
 
 func newDBusAPILibGio() *dbusAPILibGio {
@@ -198,5 +178,8 @@ func newDBusAPILibGio() *dbusAPILibGio {
 }
 
 func init() {
+	registerDBusAPI(DBusAPILibGio, func() DBusAPI {
+		return newDBusAPILibGio()
+	})
 	dbusAPI = newDBusAPILibGio()
 }
@@ -81,3 +81,116 @@ static void g_signal_connect_on_proxy(GDBusProxy *proxy)
 {
     g_signal_connect(proxy, "g-signal", G_CALLBACK(on_signal), NULL);
 }
+
+// creates a new uint32 from a GVariant
+static guint32 uint32_from_g_variant(GVariant *value)
+{
+    guint32 u;
+    g_variant_get(value, "(u)", &u);
+    return u;
+}
+
+// creates the parameters of the RequestName method of the message bus
+static GVariant *request_name_parameters(gchar *name, guint32 flags)
+{
+    return g_variant_new("(su)", name, flags);
+}
+
+// creates the parameters of the ReleaseName method of the message bus
+static GVariant *release_name_parameters(gchar *name)
+{
+    return g_variant_new("(s)", name);
+}
+
+// exported by golang, see dbus_libgio_object.go
+void handle_method_call_callback(
+    GDBusConnection *connection,
+    gchar *sender,
+    gchar *object_path,
+    gchar *interface_name,
+    gchar *method_name,
+    GVariant *parameters,
+    GDBusMethodInvocation *invocation,
+    gpointer user_data);
+
+// method_call function of the vtable of the exported interfaces
+static void on_method_call(
+    GDBusConnection *connection,
+    const gchar *sender,
+    const gchar *object_path,
+    const gchar *interface_name,
+    const gchar *method_name,
+    GVariant *parameters,
+    GDBusMethodInvocation *invocation,
+    gpointer user_data)
+{
+    handle_method_call_callback(
+        connection,
+        (gchar *)sender,
+        (gchar *)object_path,
+        (gchar *)interface_name,
+        (gchar *)method_name,
+        parameters,
+        invocation,
+        user_data);
+}
+
+// vtable of the exported interfaces
+static const GDBusInterfaceVTable interface_vtable = {on_method_call, NULL, NULL};
+
+// calls g_dbus_connection_register_object passing the registration ID as
+// the user data
+static guint g_dbus_connection_register_object_with_id(
+    GDBusConnection *connection,
+    gchar *object_path,
+    GDBusInterfaceInfo *interface_info,
+    guint registration_id,
+    GError **error)
+{
+    return g_dbus_connection_register_object(
+        connection,
+        object_path,
+        interface_info,
+        &interface_vtable,
+        GUINT_TO_POINTER(registration_id),
+        NULL,
+        error);
+}
+
+// exported by golang, see dbus_libgio_watch.go
+void handle_name_owner_callback(gchar *name, gchar *name_owner, gpointer user_data);
+
+// name_appeared_handler of the watched names
+static void on_name_appeared(
+    GDBusConnection *connection,
+    const gchar *name,
+    const gchar *name_owner,
+    gpointer user_data)
+{
+    handle_name_owner_callback((gchar *)name, (gchar *)name_owner, user_data);
+}
+
+// name_vanished_handler of the watched names
+static void on_name_vanished(
+    GDBusConnection *connection,
+    const gchar *name,
+    gpointer user_data)
+{
+    handle_name_owner_callback((gchar *)name, NULL, user_data);
+}
+
+// calls g_bus_watch_name_on_connection passing the watch ID as the user data
+static guint g_bus_watch_name_on_connection_with_id(
+    GDBusConnection *connection,
+    gchar *name,
+    guint watch_id)
+{
+    return g_bus_watch_name_on_connection(
+        connection,
+        name,
+        G_BUS_NAME_WATCHER_FLAGS_NONE,
+        on_name_appeared,
+        on_name_vanished,
+        GUINT_TO_POINTER(watch_id),
+        NULL);
+}
@@ -0,0 +1,345 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+// +build !nodbus,cgo
+
+package dbus
+
+// #cgo pkg-config: gio-2.0
+// #include <stdlib.h>
+// #include <gio/gio.h>
+// #include "dbus_libgio.go.h"
+import "C"
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// libgioObject is an object exported on a connection
+type libgioObject struct {
+	conn       Handle
+	objectPath string
+	node       *introspectionNode
+	nodeInfo   *C.GDBusNodeInfo
+	handler    MethodHandler
+	// IDs returned by g_dbus_connection_register_object, one per interface
+	ids []C.guint
+}
+
+// libgioObjects holds the exported objects by registration ID, which is
+// passed to the C callbacks as user data
+var libgioObjects = struct {
+	sync.Mutex
+	objects          map[uint]*libgioObject
+	lastRegistration uint
+}{
+	objects: make(map[uint]*libgioObject),
+}
+
+func findLibgioObject(conn Handle, objectPath string) *libgioObject {
+	libgioObjects.Lock()
+	defer libgioObjects.Unlock()
+	for _, object := range libgioObjects.objects {
+		if object.conn == conn && object.objectPath == objectPath {
+			return object
+		}
+	}
+	return nil
+}
+
+// BusOwnName requests the ownership of a well-known name on the bus; it
+// fails if the name is already owned by another connection
+// https://dbus.freedesktop.org/doc/dbus-specification.html#bus-messages-request-name
+func (d *dbusAPILibGio) BusOwnName(conn Handle, name string) error {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	params := C.request_name_parameters(cname, C.guint32(requestNameFlagDoNotQueue))
+	result, err := callBus(conn, "RequestName", params)
+	if err != nil {
+		return errors.Wrapf(err, "failed to own the D-Bus name %s", name)
+	}
+	defer C.g_variant_unref(result)
+	switch C.uint32_from_g_variant(result) {
+	case requestNameReplyPrimaryOwner, requestNameReplyAlreadyOwner:
+		return nil
+	}
+	return errors.Errorf("failed to own the D-Bus name %s: the name is already owned", name)
+}
+
+// BusReleaseName releases the ownership of a well-known name on the bus
+// https://dbus.freedesktop.org/doc/dbus-specification.html#bus-messages-release-name
+func (d *dbusAPILibGio) BusReleaseName(conn Handle, name string) error {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	result, err := callBus(conn, "ReleaseName", C.release_name_parameters(cname))
+	if err != nil {
+		return errors.Wrapf(err, "failed to release the D-Bus name %s", name)
+	}
+	C.g_variant_unref(result)
+	return nil
+}
+
+// callBus synchronously calls a method of the message bus itself
+// https://developer.gnome.org/gio/stable/GDBusConnection.html#g-dbus-connection-call-sync
+func callBus(conn Handle, methodName string, params *C.GVariant) (*C.GVariant, error) {
+	var gerror *C.GError
+	gconn := C.to_gdbusconnection(unsafe.Pointer(conn))
+	cname := C.CString(busName)
+	defer C.free(unsafe.Pointer(cname))
+	cobjectPath := C.CString(busObjectPath)
+	defer C.free(unsafe.Pointer(cobjectPath))
+	cinterfaceName := C.CString(busInterfaceName)
+	defer C.free(unsafe.Pointer(cinterfaceName))
+	cmethodName := C.CString(methodName)
+	defer C.free(unsafe.Pointer(cmethodName))
+	flags := C.GDBusCallFlags(GDBusCallFlagsNone)
+	result := C.g_dbus_connection_call_sync(gconn, cname, cobjectPath, cinterfaceName,
+		cmethodName, params, nil, flags, -1, nil, &gerror)
+	if Handle(gerror) != nil {
+		return nil, ErrorFromNative(Handle(gerror))
+	}
+	return result, nil
+}
+
+// BusRegisterObject exports an object implementing the interfaces described
+// by the introspection XML; the calls of their methods are passed to the
+// handler
+// https://developer.gnome.org/gio/stable/GDBusConnection.html#g-dbus-connection-register-object
+func (d *dbusAPILibGio) BusRegisterObject(
+	conn Handle,
+	objectPath string,
+	introspectionXML string,
+	handler MethodHandler,
+) (uint, error) {
+	node, err := parseIntrospection(introspectionXML)
+	if err != nil {
+		return 0, err
+	}
+	var gerror *C.GError
+	cxml := C.CString(introspectionXML)
+	defer C.free(unsafe.Pointer(cxml))
+	nodeInfo := C.g_dbus_node_info_new_for_xml(cxml, &gerror)
+	if Handle(gerror) != nil {
+		return 0, ErrorFromNative(Handle(gerror))
+	}
+
+	object := &libgioObject{
+		conn:       conn,
+		objectPath: objectPath,
+		node:       node,
+		nodeInfo:   nodeInfo,
+		handler:    handler,
+	}
+	libgioObjects.Lock()
+	libgioObjects.lastRegistration++
+	registrationID := libgioObjects.lastRegistration
+	libgioObjects.objects[registrationID] = object
+	libgioObjects.Unlock()
+
+	gconn := C.to_gdbusconnection(unsafe.Pointer(conn))
+	cobjectPath := C.CString(objectPath)
+	defer C.free(unsafe.Pointer(cobjectPath))
+	for _, iface := range node.Interfaces {
+		cinterfaceName := C.CString(iface.Name)
+		interfaceInfo := C.g_dbus_node_info_lookup_interface(nodeInfo, cinterfaceName)
+		C.free(unsafe.Pointer(cinterfaceName))
+		id := C.g_dbus_connection_register_object_with_id(gconn, cobjectPath, interfaceInfo,
+			C.guint(registrationID), &gerror)
+		if Handle(gerror) != nil {
+			err := ErrorFromNative(Handle(gerror))
+			_ = d.BusUnregisterObject(conn, registrationID)
+			return 0, err
+		}
+		object.ids = append(object.ids, id)
+	}
+	return registrationID, nil
+}
+
+// BusUnregisterObject stops exporting a registered object
+// https://developer.gnome.org/gio/stable/GDBusConnection.html#g-dbus-connection-unregister-object
+func (d *dbusAPILibGio) BusUnregisterObject(conn Handle, registrationID uint) error {
+	libgioObjects.Lock()
+	object, ok := libgioObjects.objects[registrationID]
+	if ok && object.conn == conn {
+		delete(libgioObjects.objects, registrationID)
+	}
+	libgioObjects.Unlock()
+	if !ok || object.conn != conn {
+		return errors.Errorf("no object is registered with the ID %d", registrationID)
+	}
+
+	gconn := C.to_gdbusconnection(unsafe.Pointer(conn))
+	for _, id := range object.ids {
+		C.g_dbus_connection_unregister_object(gconn, id)
+	}
+	C.g_dbus_node_info_unref(object.nodeInfo)
+	return nil
+}
+
+// BusEmitSignal emits a signal of an exported object, with the values of
+// the arguments declared by its introspection data
+// https://developer.gnome.org/gio/stable/GDBusConnection.html#g-dbus-connection-emit-signal
+func (d *dbusAPILibGio) BusEmitSignal(
+	conn Handle,
+	objectPath string,
+	interfaceName string,
+	signalName string,
+	values []interface{},
+) error {
+	object := findLibgioObject(conn, objectPath)
+	if object == nil {
+		return errors.Errorf("no object is exported at the path %s", objectPath)
+	}
+	signal := object.node.signal(interfaceName, signalName)
+	if signal == nil {
+		return errors.Errorf("the signal %s.%s is not declared by the object %s",
+			interfaceName, signalName, objectPath)
+	}
+	params, err := newGVariantTuple(signal.signature(""), values)
+	if err != nil {
+		return err
+	}
+	defer C.g_variant_unref(params)
+
+	var gerror *C.GError
+	gconn := C.to_gdbusconnection(unsafe.Pointer(conn))
+	cobjectPath := C.CString(objectPath)
+	defer C.free(unsafe.Pointer(cobjectPath))
+	cinterfaceName := C.CString(interfaceName)
+	defer C.free(unsafe.Pointer(cinterfaceName))
+	csignalName := C.CString(signalName)
+	defer C.free(unsafe.Pointer(csignalName))
+	C.g_dbus_connection_emit_signal(gconn, nil, cobjectPath, cinterfaceName, csignalName,
+		params, &gerror)
+	if Handle(gerror) != nil {
+		return ErrorFromNative(Handle(gerror))
+	}
+	return nil
+}
+
+// newGVariantTuple creates a new GVariant tuple of the types of the
+// signature, holding the values
+// https://developer.gnome.org/glib/stable/glib-GVariant.html#g-variant-parse
+func newGVariantTuple(sig string, values []interface{}) (*C.GVariant, error) {
+	text, err := formatGVariantTuple(sig, values)
+	if err != nil {
+		return nil, err
+	}
+	var gerror *C.GError
+	csig := C.CString("(" + sig + ")")
+	defer C.free(unsafe.Pointer(csig))
+	gtype := C.g_variant_type_new(csig)
+	defer C.g_variant_type_free(gtype)
+	ctext := C.CString(text)
+	defer C.free(unsafe.Pointer(ctext))
+	value := C.g_variant_parse(gtype, ctext, nil, nil, &gerror)
+	if Handle(gerror) != nil {
+		return nil, ErrorFromNative(Handle(gerror))
+	}
+	return value, nil
+}
+
+// signalParamsFromGVariant returns the values of the GVariant tuple; the
+// values of the basic types are decoded, and the ones of the container
+// types are left nil
+func signalParamsFromGVariant(tuple *C.GVariant) []SignalParams {
+	var params []SignalParams
+	i := C.g_variant_iter_new(tuple)
+	defer C.g_variant_iter_free(i)
+	for {
+		p := C.g_variant_iter_next_value(i)
+		if p == nil {
+			break
+		}
+		params = append(params, signalParamFromGVariant(p))
+		C.g_variant_unref(p)
+	}
+	return params
+}
+
+func signalParamFromGVariant(value *C.GVariant) SignalParams {
+	typeString := C.GoString(C.g_variant_get_type_string(value))
+	param := SignalParams{ParamType: typeString}
+	switch typeString {
+	case "s", "o", "g":
+		param.ParamData = C.GoString(C.g_variant_get_string(value, nil))
+	case "b":
+		param.ParamData = goBool(C.g_variant_get_boolean(value))
+	case "y":
+		param.ParamData = byte(C.g_variant_get_byte(value))
+	case "n":
+		param.ParamData = int16(C.g_variant_get_int16(value))
+	case "q":
+		param.ParamData = uint16(C.g_variant_get_uint16(value))
+	case "i":
+		param.ParamData = int32(C.g_variant_get_int32(value))
+	case "u":
+		param.ParamData = uint32(C.g_variant_get_uint32(value))
+	case "h":
+		param.ParamData = int32(C.g_variant_get_handle(value))
+	case "x":
+		param.ParamData = int64(C.g_variant_get_int64(value))
+	case "t":
+		param.ParamData = uint64(C.g_variant_get_uint64(value))
+	case "d":
+		param.ParamData = float64(C.g_variant_get_double(value))
+	}
+	return param
+}
+
+func returnDBusError(invocation *C.GDBusMethodInvocation, name, message string) {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	cmessage := C.CString(message)
+	defer C.free(unsafe.Pointer(cmessage))
+	C.g_dbus_method_invocation_return_dbus_error(invocation, cname, cmessage)
+}
+
+//export handle_method_call_callback
+func handle_method_call_callback(conn *C.GDBusConnection, sender *C.gchar, objectPath *C.gchar, interfaceName *C.gchar, methodName *C.gchar, params *C.GVariant, invocation *C.GDBusMethodInvocation, userData C.gpointer) {
+	libgioObjects.Lock()
+	object, ok := libgioObjects.objects[uint(uintptr(userData))]
+	libgioObjects.Unlock()
+	goInterfaceName := goString(interfaceName)
+	goMethodName := goString(methodName)
+	if !ok {
+		returnDBusError(invocation, "org.freedesktop.DBus.Error.UnknownObject",
+			"No such object path '"+goString(objectPath)+"'")
+		return
+	}
+
+	values, err := object.handler(goInterfaceName, goMethodName, signalParamsFromGVariant(params))
+	if err != nil {
+		if e, ok := err.(*MethodError); ok {
+			returnDBusError(invocation, e.Name, e.Message)
+		} else {
+			returnDBusError(invocation, DBusErrorFailed, err.Error())
+		}
+		return
+	}
+	method := object.node.method(goInterfaceName, goMethodName)
+	if method == nil {
+		returnDBusError(invocation, "org.freedesktop.DBus.Error.UnknownMethod",
+			"No such method '"+goMethodName+"'")
+		return
+	}
+	reply, err := newGVariantTuple(method.signature("out"), values)
+	if err != nil {
+		returnDBusError(invocation, DBusErrorFailed, err.Error())
+		return
+	}
+	C.g_dbus_method_invocation_return_value(invocation, reply)
+	C.g_variant_unref(reply)
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+// +build !nodbus,cgo
+
+package dbus
+
+// #cgo pkg-config: gio-2.0
+// #include <stdlib.h>
+// #include <gio/gio.h>
+// #include "dbus_libgio.go.h"
+import "C"
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// libgioWatcher watches the owner of a name on a connection
+type libgioWatcher struct {
+	conn    Handle
+	handler NameOwnerHandler
+	// ID returned by g_bus_watch_name_on_connection
+	id C.guint
+}
+
+// libgioWatchers holds the watched names by watch ID, which is passed to the
+// C callbacks as user data
+var libgioWatchers = struct {
+	sync.Mutex
+	watchers  map[uint]*libgioWatcher
+	lastWatch uint
+}{
+	watchers: make(map[uint]*libgioWatcher),
+}
+
+// BusWatchName watches the owner of a name on the bus; the handler is
+// called with the current owner, and then every time it changes
+// https://developer.gnome.org/gio/stable/gio-Watching-Bus-Names.html#g-bus-watch-name-on-connection
+func (d *dbusAPILibGio) BusWatchName(conn Handle, name string, handler NameOwnerHandler) (uint, error) {
+	if conn == nil {
+		return 0, errors.New("invalid D-Bus connection")
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+
+	// the callbacks run in the main loop, after the watcher is registered
+	libgioWatchers.Lock()
+	defer libgioWatchers.Unlock()
+	libgioWatchers.lastWatch++
+	watchID := libgioWatchers.lastWatch
+	watcher := &libgioWatcher{
+		conn:    conn,
+		handler: handler,
+	}
+	watcher.id = C.g_bus_watch_name_on_connection_with_id(
+		C.to_gdbusconnection(unsafe.Pointer(conn)), cname, C.guint(watchID))
+	libgioWatchers.watchers[watchID] = watcher
+	return watchID, nil
+}
+
+// BusUnwatchName stops watching the owner of a name
+// https://developer.gnome.org/gio/stable/gio-Watching-Bus-Names.html#g-bus-unwatch-name
+func (d *dbusAPILibGio) BusUnwatchName(conn Handle, watchID uint) error {
+	libgioWatchers.Lock()
+	watcher, ok := libgioWatchers.watchers[watchID]
+	if !ok || watcher.conn != conn {
+		libgioWatchers.Unlock()
+		return errors.Errorf("no name is watched with the ID %d", watchID)
+	}
+	delete(libgioWatchers.watchers, watchID)
+	libgioWatchers.Unlock()
+
+	C.g_bus_unwatch_name(watcher.id)
+	return nil
+}
+
+//export handle_name_owner_callback
+func handle_name_owner_callback(name *C.gchar, nameOwner *C.gchar, userData C.gpointer) {
+	libgioWatchers.Lock()
+	watcher, ok := libgioWatchers.watchers[uint(uintptr(userData))]
+	libgioWatchers.Unlock()
+	if ok {
+		watcher.handler(goString(name), goString(nameOwner))
+	}
+}
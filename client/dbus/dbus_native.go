@@ -0,0 +1,583 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package dbus
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// dbusAPINative implements DBusAPI in pure Go, speaking the D-Bus wire
+// protocol directly instead of going through libgio
+type dbusAPINative struct {
+	mutex   sync.Mutex
+	signals map[string]chan []SignalParams
+	// connections shared by all the callers, one per bus type, like the
+	// ones returned by g_bus_get_sync
+	conns   map[uint]*nativeConn
+	proxies []*nativeProxy
+	// exported objects, by registration ID
+	objects          map[uint]*nativeObject
+	lastRegistration uint
+	// watched names, by watch ID
+	watchers  map[uint]*nativeWatcher
+	lastWatch uint
+}
+
+// nativeProxy is a proxy for an interface of a remote object
+type nativeProxy struct {
+	conn          *nativeConn
+	name          string
+	objectPath    string
+	interfaceName string
+}
+
+// nativeObject is an object exported on a connection
+type nativeObject struct {
+	conn             *nativeConn
+	objectPath       string
+	introspectionXML string
+	node             *introspectionNode
+	handler          MethodHandler
+}
+
+// nativeWatcher watches the owner of a name on a connection
+type nativeWatcher struct {
+	conn    *nativeConn
+	name    string
+	rule    string
+	handler NameOwnerHandler
+}
+
+type nativeMainLoop struct {
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+func newDBusAPINative() *dbusAPINative {
+	return &dbusAPINative{
+		signals:  make(map[string]chan []SignalParams),
+		conns:    make(map[uint]*nativeConn),
+		objects:  make(map[uint]*nativeObject),
+		watchers: make(map[uint]*nativeWatcher),
+	}
+}
+
+// BusGet synchronously connects to the message bus specified by bus_type
+func (d *dbusAPINative) BusGet(busType uint) (Handle, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if conn, ok := d.conns[busType]; ok && !conn.closed() {
+		return Handle(unsafe.Pointer(conn)), nil
+	}
+	address, err := busAddress(busType)
+	if err != nil {
+		return Handle(nil), err
+	}
+	conn, err := newNativeConn(address, d.handleSignalMessage, d.handleMethodCallMessage)
+	if err != nil {
+		return Handle(nil), err
+	}
+	d.conns[busType] = conn
+	return Handle(unsafe.Pointer(conn)), nil
+}
+
+// BusProxyNew creates a proxy for accessing an interface over DBus
+func (d *dbusAPINative) BusProxyNew(conn Handle, name string, objectPath string, interfaceName string) (Handle, error) {
+	if conn == nil {
+		return Handle(nil), errors.New("invalid D-Bus connection")
+	} else if !validObjectPath(objectPath) {
+		return Handle(nil), errors.Errorf("invalid D-Bus object path %q", objectPath)
+	}
+	proxy := &nativeProxy{
+		conn:          (*nativeConn)(unsafe.Pointer(conn)),
+		name:          name,
+		objectPath:    objectPath,
+		interfaceName: interfaceName,
+	}
+
+	// subscribe to the signals of the proxied interface; the bus resolves
+	// the well-known name to its current owner
+	rule := "type='signal',sender='" + name + "',path='" + objectPath +
+		"',interface='" + interfaceName + "'"
+	if _, err := proxy.conn.callBus("AddMatch", "s", rule); err != nil {
+		return Handle(nil), err
+	}
+
+	d.mutex.Lock()
+	d.proxies = append(d.proxies, proxy)
+	d.mutex.Unlock()
+	return Handle(unsafe.Pointer(proxy)), nil
+}
+
+// BusProxyCall synchronously invokes a method method on a proxy; params is
+// either nil or a []interface{} with the arguments of the method
+func (d *dbusAPINative) BusProxyCall(proxy Handle, methodName string, params interface{}, timeout int) (DBusCallResponse, error) {
+	if proxy == nil {
+		return nil, errors.New("invalid D-Bus proxy")
+	}
+	p := (*nativeProxy)(unsafe.Pointer(proxy))
+
+	msg := &message{
+		Type:        messageTypeMethodCall,
+		Path:        ObjectPath(p.objectPath),
+		Interface:   p.interfaceName,
+		Member:      methodName,
+		Destination: p.name,
+	}
+	if params != nil {
+		args, ok := params.([]interface{})
+		if !ok {
+			return nil, errors.Errorf("unsupported D-Bus method parameters of type %T", params)
+		}
+		var signature strings.Builder
+		for _, arg := range args {
+			s, err := signatureOf(arg)
+			if err != nil {
+				return nil, err
+			}
+			signature.WriteString(s)
+		}
+		msg.Signature = Signature(signature.String())
+		msg.Body = args
+	}
+
+	callTimeout := defaultCallTimeout
+	if timeout > 0 {
+		callTimeout = time.Duration(timeout) * time.Millisecond
+	}
+	reply, err := p.conn.call(msg, callTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &dbusCallResponseNative{body: reply.Body}, nil
+}
+
+// MainLoopNew creates a new main loop; the native implementation does not
+// need one to receive signals, so it only blocks MainLoopRun until quit
+func (d *dbusAPINative) MainLoopNew() MainLoop {
+	return MainLoop(unsafe.Pointer(&nativeMainLoop{quit: make(chan struct{})}))
+}
+
+// MainLoopRun runs a main loop until MainLoopQuit() is called
+func (d *dbusAPINative) MainLoopRun(loop MainLoop) {
+	<-(*nativeMainLoop)(unsafe.Pointer(loop)).quit
+}
+
+// MainLoopQuit stops a main loop from running
+func (d *dbusAPINative) MainLoopQuit(loop MainLoop) {
+	l := (*nativeMainLoop)(unsafe.Pointer(loop))
+	l.quitOnce.Do(func() {
+		close(l.quit)
+	})
+}
+
+// GetChannelForSignal returns a channel that can be used to wait for signals
+func (d *dbusAPINative) GetChannelForSignal(signalName string) chan []SignalParams {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	channel, ok := d.signals[signalName]
+	if !ok {
+		channel = make(chan []SignalParams, 1)
+		d.signals[signalName] = channel
+	}
+	return channel
+}
+
+// DrainSignal drains the channel used to wait for signals
+func (d *dbusAPINative) DrainSignal(signalName string) {
+	channel := d.GetChannelForSignal(signalName)
+	select {
+	case <-channel:
+	default:
+	}
+}
+
+// HandleSignal handles a DBus signal
+func (d *dbusAPINative) HandleSignal(signalName string, params []SignalParams) {
+	channel := d.GetChannelForSignal(signalName)
+	select {
+	case channel <- params:
+	default:
+		log.Warnf("dropped the D-Bus signal %s: the previous one was not handled yet",
+			signalName)
+	}
+}
+
+// WaitForSignal waits for a DBus signal
+func (d *dbusAPINative) WaitForSignal(signalName string, timeout time.Duration) ([]SignalParams, error) {
+	channel := d.GetChannelForSignal(signalName)
+	select {
+	case p := <-channel:
+		return p, nil
+	case <-time.After(timeout):
+		return []SignalParams{}, errors.New("timeout waiting for signal " + signalName)
+	}
+}
+
+// handleSignalMessage passes the signals emitted on the proxied interfaces
+// to HandleSignal, and the changes of the owners of the watched names to
+// their handlers
+func (d *dbusAPINative) handleSignalMessage(conn *nativeConn, msg *message) {
+	if msg.Sender == busName && msg.Interface == busInterfaceName &&
+		msg.Member == "NameOwnerChanged" {
+		d.handleNameOwnerChanged(conn, msg)
+		return
+	}
+
+	d.mutex.Lock()
+	proxied := false
+	for _, proxy := range d.proxies {
+		if string(msg.Path) == proxy.objectPath && msg.Interface == proxy.interfaceName {
+			proxied = true
+			break
+		}
+	}
+	d.mutex.Unlock()
+	if !proxied {
+		return
+	}
+
+	d.HandleSignal(msg.Member, signalParams(msg))
+}
+
+// signalParams returns the parameters of the signal; like in the libgio
+// implementation, the values of the basic types are kept, and the ones of
+// the container types are left nil
+func signalParams(msg *message) []SignalParams {
+	types, err := splitSignature(string(msg.Signature))
+	if err != nil || len(types) != len(msg.Body) {
+		return nil
+	}
+	params := make([]SignalParams, len(types))
+	for i, t := range types {
+		params[i].ParamType = t
+		switch t[0] {
+		case 'v', 'a', '(':
+		default:
+			params[i].ParamData = msg.Body[i]
+		}
+	}
+	return params
+}
+
+// handleNameOwnerChanged passes the new owner of a watched name to the
+// handlers watching it on the connection
+func (d *dbusAPINative) handleNameOwnerChanged(conn *nativeConn, msg *message) {
+	if msg.Signature != "sss" || len(msg.Body) != 3 {
+		return
+	}
+	name, _ := msg.Body[0].(string)
+	owner, _ := msg.Body[2].(string)
+	var handlers []NameOwnerHandler
+	d.mutex.Lock()
+	for _, watcher := range d.watchers {
+		if watcher.conn == conn && watcher.name == name {
+			handlers = append(handlers, watcher.handler)
+		}
+	}
+	d.mutex.Unlock()
+	for _, handler := range handlers {
+		handler(name, owner)
+	}
+}
+
+// Replies of the message bus to RequestName
+const (
+	requestNameReplyPrimaryOwner = 1
+	requestNameReplyAlreadyOwner = 4
+	// DBUS_NAME_FLAG_DO_NOT_QUEUE
+	requestNameFlagDoNotQueue = 4
+)
+
+// BusOwnName requests the ownership of a well-known name on the bus; it
+// fails if the name is already owned by another connection
+func (d *dbusAPINative) BusOwnName(conn Handle, name string) error {
+	if conn == nil {
+		return errors.New("invalid D-Bus connection")
+	}
+	c := (*nativeConn)(unsafe.Pointer(conn))
+	reply, err := c.callBus("RequestName", "su", name, uint32(requestNameFlagDoNotQueue))
+	if err != nil {
+		return errors.Wrapf(err, "failed to own the D-Bus name %s", name)
+	}
+	if len(reply.Body) > 0 {
+		switch reply.Body[0] {
+		case uint32(requestNameReplyPrimaryOwner), uint32(requestNameReplyAlreadyOwner):
+			return nil
+		}
+	}
+	return errors.Errorf("failed to own the D-Bus name %s: the name is already owned", name)
+}
+
+// BusReleaseName releases the ownership of a well-known name on the bus
+func (d *dbusAPINative) BusReleaseName(conn Handle, name string) error {
+	if conn == nil {
+		return errors.New("invalid D-Bus connection")
+	}
+	c := (*nativeConn)(unsafe.Pointer(conn))
+	if _, err := c.callBus("ReleaseName", "s", name); err != nil {
+		return errors.Wrapf(err, "failed to release the D-Bus name %s", name)
+	}
+	return nil
+}
+
+// BusRegisterObject exports an object implementing the interfaces
+// described by the introspection XML; the calls of their methods are
+// passed to the handler
+func (d *dbusAPINative) BusRegisterObject(
+	conn Handle,
+	objectPath string,
+	introspectionXML string,
+	handler MethodHandler,
+) (uint, error) {
+	if conn == nil {
+		return 0, errors.New("invalid D-Bus connection")
+	} else if !validObjectPath(objectPath) {
+		return 0, errors.Errorf("invalid D-Bus object path %q", objectPath)
+	}
+	node, err := parseIntrospection(introspectionXML)
+	if err != nil {
+		return 0, err
+	}
+	c := (*nativeConn)(unsafe.Pointer(conn))
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, object := range d.objects {
+		if object.conn == c && object.objectPath == objectPath {
+			return 0, errors.Errorf("an object is already exported at the path %s", objectPath)
+		}
+	}
+	d.lastRegistration++
+	d.objects[d.lastRegistration] = &nativeObject{
+		conn:             c,
+		objectPath:       objectPath,
+		introspectionXML: introspectionXML,
+		node:             node,
+		handler:          handler,
+	}
+	return d.lastRegistration, nil
+}
+
+// BusUnregisterObject stops exporting a registered object
+func (d *dbusAPINative) BusUnregisterObject(conn Handle, registrationID uint) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	object, ok := d.objects[registrationID]
+	if !ok || Handle(unsafe.Pointer(object.conn)) != conn {
+		return errors.Errorf("no object is registered with the ID %d", registrationID)
+	}
+	delete(d.objects, registrationID)
+	return nil
+}
+
+// BusEmitSignal emits a signal of an exported object, with the values of
+// the arguments declared by its introspection data
+func (d *dbusAPINative) BusEmitSignal(
+	conn Handle,
+	objectPath string,
+	interfaceName string,
+	signalName string,
+	values []interface{},
+) error {
+	object := d.findObject((*nativeConn)(unsafe.Pointer(conn)), objectPath)
+	if object == nil {
+		return errors.Errorf("no object is exported at the path %s", objectPath)
+	}
+	signal := object.node.signal(interfaceName, signalName)
+	if signal == nil {
+		return errors.Errorf("the signal %s.%s is not declared by the object %s",
+			interfaceName, signalName, objectPath)
+	}
+	return object.conn.send(&message{
+		Type:      messageTypeSignal,
+		Path:      ObjectPath(objectPath),
+		Interface: interfaceName,
+		Member:    signalName,
+		Signature: Signature(signal.signature("")),
+		Body:      values,
+	})
+}
+
+// BusWatchName watches the owner of a name on the bus; the handler is
+// called with the current owner, and then every time it changes
+func (d *dbusAPINative) BusWatchName(conn Handle, name string, handler NameOwnerHandler) (uint, error) {
+	if conn == nil {
+		return 0, errors.New("invalid D-Bus connection")
+	}
+	c := (*nativeConn)(unsafe.Pointer(conn))
+	rule := "type='signal',sender='" + busName + "',path='" + busObjectPath +
+		"',interface='" + busInterfaceName + "',member='NameOwnerChanged',arg0='" + name + "'"
+	if _, err := c.callBus("AddMatch", "s", rule); err != nil {
+		return 0, errors.Wrapf(err, "failed to watch the D-Bus name %s", name)
+	}
+
+	d.mutex.Lock()
+	d.lastWatch++
+	watchID := d.lastWatch
+	d.watchers[watchID] = &nativeWatcher{
+		conn:    c,
+		name:    name,
+		rule:    rule,
+		handler: handler,
+	}
+	d.mutex.Unlock()
+
+	// GetNameOwner fails with NameHasNoOwner if the name is not owned
+	owner := ""
+	if reply, err := c.callBus("GetNameOwner", "s", name); err == nil && len(reply.Body) > 0 {
+		owner, _ = reply.Body[0].(string)
+	}
+	handler(name, owner)
+	return watchID, nil
+}
+
+// BusUnwatchName stops watching the owner of a name
+func (d *dbusAPINative) BusUnwatchName(conn Handle, watchID uint) error {
+	d.mutex.Lock()
+	watcher, ok := d.watchers[watchID]
+	if !ok || Handle(unsafe.Pointer(watcher.conn)) != conn {
+		d.mutex.Unlock()
+		return errors.Errorf("no name is watched with the ID %d", watchID)
+	}
+	delete(d.watchers, watchID)
+	d.mutex.Unlock()
+
+	if _, err := watcher.conn.callBus("RemoveMatch", "s", watcher.rule); err != nil &&
+		!watcher.conn.closed() {
+		return errors.Wrapf(err, "failed to stop watching the D-Bus name %s", watcher.name)
+	}
+	return nil
+}
+
+func (d *dbusAPINative) findObject(conn *nativeConn, objectPath string) *nativeObject {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, object := range d.objects {
+		if object.conn == conn && object.objectPath == objectPath {
+			return object
+		}
+	}
+	return nil
+}
+
+// handleMethodCallMessage dispatches the method calls to the handlers of the
+// exported objects, answering the calls of the standard Introspectable and
+// Peer interfaces as GDBus does
+func (d *dbusAPINative) handleMethodCallMessage(conn *nativeConn, call *message) *message {
+	object := d.findObject(conn, string(call.Path))
+	if object == nil {
+		return errorMessage("org.freedesktop.DBus.Error.UnknownObject",
+			"No such object path '"+string(call.Path)+"'")
+	}
+
+	switch {
+	case call.Interface == introspectableInterfaceName && call.Member == "Introspect":
+		return &message{
+			Type:      messageTypeMethodReturn,
+			Signature: "s",
+			Body:      []interface{}{object.introspectionXML},
+		}
+	case call.Interface == peerInterfaceName && call.Member == "Ping":
+		return &message{Type: messageTypeMethodReturn}
+	}
+
+	method := object.node.method(call.Interface, call.Member)
+	if method == nil {
+		return errorMessage("org.freedesktop.DBus.Error.UnknownMethod",
+			"No such method '"+call.Member+"' in interface '"+call.Interface+
+				"' at object path '"+string(call.Path)+"'")
+	}
+	if inSignature := method.signature("in"); string(call.Signature) != inSignature {
+		return errorMessage("org.freedesktop.DBus.Error.InvalidArgs",
+			"Type of message, '("+string(call.Signature)+")', does not match expected type '("+
+				inSignature+")'")
+	}
+
+	types, _ := splitSignature(string(call.Signature))
+	params := make([]SignalParams, len(types))
+	for i, t := range types {
+		params[i] = SignalParams{ParamType: t, ParamData: call.Body[i]}
+	}
+	values, err := object.handler(call.Interface, call.Member, params)
+	if err != nil {
+		if e, ok := err.(*MethodError); ok {
+			return errorMessage(e.Name, e.Message)
+		}
+		return errorMessage(DBusErrorFailed, err.Error())
+	}
+	reply := &message{
+		Type:      messageTypeMethodReturn,
+		Signature: Signature(method.signature("out")),
+		Body:      values,
+	}
+	if _, err := reply.marshal(); err != nil {
+		return errorMessage(DBusErrorFailed, err.Error())
+	}
+	return reply
+}
+
+func errorMessage(name, text string) *message {
+	return &message{
+		Type:      messageTypeError,
+		ErrorName: name,
+		Signature: "s",
+		Body:      []interface{}{text},
+	}
+}
+
+// dbusCallResponseNative stores the decoded body of a method return
+type dbusCallResponseNative struct {
+	body []interface{}
+}
+
+func (r *dbusCallResponseNative) stringAt(i int) string {
+	if i < len(r.body) {
+		s, _ := r.body[i].(string)
+		return s
+	}
+	return ""
+}
+
+// GetString returns a string stored in the response object
+func (r *dbusCallResponseNative) GetString() string {
+	return r.stringAt(0)
+}
+
+// GetTwoStrings returns two string stored in the response object
+func (r *dbusCallResponseNative) GetTwoStrings() (string, string) {
+	return r.stringAt(0), r.stringAt(1)
+}
+
+// GetBoolean returns a boolean stored in the response object
+func (r *dbusCallResponseNative) GetBoolean() bool {
+	if len(r.body) > 0 {
+		b, _ := r.body[0].(bool)
+		return b
+	}
+	return false
+}
+
+func init() {
+	registerDBusAPI(DBusAPINative, func() DBusAPI {
+		return newDBusAPINative()
+	})
+}
@@ -0,0 +1,389 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package dbus
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Well-known names of the message bus
+const (
+	busName          = "org.freedesktop.DBus"
+	busObjectPath    = "/org/freedesktop/DBus"
+	busInterfaceName = "org.freedesktop.DBus"
+)
+
+const (
+	// default address of the system bus, as defined by the specification
+	defaultSystemBusAddress = "unix:path=/var/run/dbus/system_bus_socket"
+	// timeout for connecting and authenticating to the bus
+	busConnectTimeout = 10 * time.Second
+	// timeout of the method calls, if not specified; same as the GDBus one
+	defaultCallTimeout = 25 * time.Second
+)
+
+var errBusConnectionClosed = errors.New("the D-Bus connection is closed")
+
+// remoteError is an error returned by the remote peer of a method call
+type remoteError struct {
+	name    string
+	message string
+}
+
+// Error returns the error formatted in the same way as GDBus does
+func (e *remoteError) Error() string {
+	return "GDBus.Error:" + e.name + ": " + e.message
+}
+
+// busAddress returns the address of the message bus of the given type
+func busAddress(busType uint) (string, error) {
+	switch busType {
+	case GBusTypeSystem:
+		if address := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS"); address != "" {
+			return address, nil
+		}
+		return defaultSystemBusAddress, nil
+	case GBusTypeSession:
+		if address := os.Getenv("DBUS_SESSION_BUS_ADDRESS"); address != "" {
+			return address, nil
+		}
+		return "", errors.New("cannot determine the session bus address: " +
+			"DBUS_SESSION_BUS_ADDRESS is not set")
+	}
+	return "", errors.Errorf("unsupported bus type %d", busType)
+}
+
+// unescapeAddressValue decodes the %-escaped bytes of a D-Bus address value
+func unescapeAddressValue(value string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+2 >= len(value) {
+			return "", errors.Errorf("invalid D-Bus address value %q", value)
+		}
+		c, err := strconv.ParseUint(value[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.Errorf("invalid D-Bus address value %q", value)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// parseAddress splits a D-Bus server address in its transport and its
+// key/value parameters
+func parseAddress(address string) (string, map[string]string, error) {
+	i := strings.Index(address, ":")
+	if i < 0 {
+		return "", nil, errors.Errorf("invalid D-Bus address %q", address)
+	}
+	params := map[string]string{}
+	for _, param := range strings.Split(address[i+1:], ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value, err := unescapeAddressValue(kv[1])
+		if err != nil {
+			return "", nil, err
+		}
+		params[kv[0]] = value
+	}
+	return address[:i], params, nil
+}
+
+// dialAddress connects to the first reachable of the semicolon-separated
+// D-Bus server addresses; only the unix and tcp transports are supported
+func dialAddress(addresses string) (net.Conn, error) {
+	var err error
+	for _, address := range strings.Split(addresses, ";") {
+		transport, params, e := parseAddress(address)
+		if e != nil {
+			err = e
+			continue
+		}
+
+		var network, target string
+		switch {
+		case transport == "unix" && params["path"] != "":
+			network, target = "unix", params["path"]
+		case transport == "unix" && params["abstract"] != "":
+			network, target = "unix", "@"+params["abstract"]
+		case transport == "tcp" && params["port"] != "":
+			network, target = "tcp", net.JoinHostPort(params["host"], params["port"])
+		default:
+			err = errors.Errorf("unsupported D-Bus address %q", address)
+			continue
+		}
+		conn, e := net.DialTimeout(network, target, busConnectTimeout)
+		if e == nil {
+			return conn, nil
+		}
+		err = errors.Wrapf(e, "failed to connect to the D-Bus address %q", address)
+	}
+	return nil, err
+}
+
+// nativeConn is a connection to a message bus speaking the D-Bus wire
+// protocol; a goroutine reads the incoming messages and dispatches them
+type nativeConn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	writeMutex sync.Mutex
+	serial     uint32
+	uniqueName string
+
+	mutex sync.Mutex
+	calls map[uint32]chan *message
+	err   error
+	done  chan struct{}
+
+	// handleSignal is called from the reading goroutine for every signal
+	handleSignal func(*nativeConn, *message)
+	// handleMethodCall is called from a new goroutine for every method call
+	// addressed to the connection and returns the reply; if it is not set,
+	// the calls are answered with an UnknownMethod error
+	handleMethodCall func(*nativeConn, *message) *message
+}
+
+// newNativeConn connects and authenticates to the message bus at the given
+// address, and registers the connection on the bus
+func newNativeConn(
+	address string,
+	handleSignal func(*nativeConn, *message),
+	handleMethodCall func(*nativeConn, *message) *message,
+) (*nativeConn, error) {
+	conn, err := dialAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	c := &nativeConn{
+		conn:             conn,
+		reader:           bufio.NewReader(conn),
+		calls:            make(map[uint32]chan *message),
+		done:             make(chan struct{}),
+		handleSignal:     handleSignal,
+		handleMethodCall: handleMethodCall,
+	}
+	if err := c.authenticate(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+
+	reply, err := c.call(&message{
+		Type:        messageTypeMethodCall,
+		Path:        busObjectPath,
+		Interface:   busInterfaceName,
+		Member:      "Hello",
+		Destination: busName,
+	}, busConnectTimeout)
+	if err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "failed to register on the D-Bus message bus")
+	}
+	if len(reply.Body) > 0 {
+		c.uniqueName, _ = reply.Body[0].(string)
+	}
+	return c, nil
+}
+
+// authenticate runs the SASL EXTERNAL authentication, which relies on the
+// credentials of the process passed over the unix socket
+func (c *nativeConn) authenticate() error {
+	_ = c.conn.SetDeadline(time.Now().Add(busConnectTimeout))
+	defer func() {
+		_ = c.conn.SetDeadline(time.Time{})
+	}()
+
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := c.conn.Write([]byte("\x00AUTH EXTERNAL " + uid + "\r\n")); err != nil {
+		return errors.Wrap(err, "D-Bus authentication failed")
+	}
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return errors.Wrap(err, "D-Bus authentication failed")
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return errors.Errorf("D-Bus authentication failed: %s", strings.TrimSpace(line))
+	}
+	if _, err := c.conn.Write([]byte("BEGIN\r\n")); err != nil {
+		return errors.Wrap(err, "D-Bus authentication failed")
+	}
+	return nil
+}
+
+func (c *nativeConn) readLoop() {
+	for {
+		msg, err := readMessage(c.reader)
+		if err != nil {
+			c.closeWithError(errors.Wrap(err, "failed to read from the D-Bus connection"))
+			return
+		}
+		switch msg.Type {
+		case messageTypeMethodReturn, messageTypeError:
+			c.mutex.Lock()
+			reply, ok := c.calls[msg.ReplySerial]
+			delete(c.calls, msg.ReplySerial)
+			c.mutex.Unlock()
+			if ok {
+				reply <- msg
+			}
+		case messageTypeSignal:
+			if c.handleSignal != nil {
+				c.handleSignal(c, msg)
+			}
+		case messageTypeMethodCall:
+			// the handler may call methods in turn, whose replies are
+			// read by this goroutine
+			go c.replyTo(msg)
+		}
+	}
+}
+
+func (c *nativeConn) replyTo(call *message) {
+	var reply *message
+	if c.handleMethodCall != nil {
+		reply = c.handleMethodCall(c, call)
+	} else {
+		reply = errorMessage("org.freedesktop.DBus.Error.UnknownMethod",
+			"No such interface '"+call.Interface+"' on object at path "+string(call.Path))
+	}
+	if reply == nil || call.Flags&messageFlagNoReplyExpected != 0 {
+		return
+	}
+	reply.ReplySerial = call.Serial
+	reply.Destination = call.Sender
+	if err := c.send(reply); err != nil {
+		log.Debugf("failed to reply to the D-Bus method call %s: %s", call.Member, err.Error())
+	}
+}
+
+// send writes the message to the bus, assigning it a serial number
+func (c *nativeConn) send(msg *message) error {
+	msg.Serial = atomic.AddUint32(&c.serial, 1)
+	data, err := msg.marshal()
+	if err != nil {
+		return err
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err = c.conn.Write(data)
+	return err
+}
+
+// call sends the method call and waits for its reply; an error reply is
+// returned as a remoteError
+func (c *nativeConn) call(msg *message, timeout time.Duration) (*message, error) {
+	reply := make(chan *message, 1)
+	msg.Serial = atomic.AddUint32(&c.serial, 1)
+	data, err := msg.marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return nil, c.err
+	}
+	c.calls[msg.Serial] = reply
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.calls, msg.Serial)
+		c.mutex.Unlock()
+	}()
+
+	c.writeMutex.Lock()
+	_, err = c.conn.Write(data)
+	c.writeMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-reply:
+		if r.Type == messageTypeError {
+			e := &remoteError{name: r.ErrorName}
+			if len(r.Body) > 0 {
+				e.message, _ = r.Body[0].(string)
+			}
+			return nil, e
+		}
+		return r, nil
+	case <-c.done:
+		return nil, c.err
+	case <-timer.C:
+		return nil, errors.Errorf("timeout waiting for the reply to the D-Bus method call %s",
+			msg.Member)
+	}
+}
+
+// callBus calls a method of the message bus itself
+func (c *nativeConn) callBus(method string, signature Signature, args ...interface{}) (*message, error) {
+	return c.call(&message{
+		Type:        messageTypeMethodCall,
+		Path:        busObjectPath,
+		Interface:   busInterfaceName,
+		Member:      method,
+		Destination: busName,
+		Signature:   signature,
+		Body:        args,
+	}, defaultCallTimeout)
+}
+
+func (c *nativeConn) closeWithError(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
+
+// Close closes the connection to the bus
+func (c *nativeConn) Close() {
+	c.closeWithError(errBusConnectionClosed)
+}
+
+// closed reports whether the connection is closed
+func (c *nativeConn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
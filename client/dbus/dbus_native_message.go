@@ -0,0 +1,797 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package dbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// D-Bus message types
+const (
+	messageTypeMethodCall   = 1
+	messageTypeMethodReturn = 2
+	messageTypeError        = 3
+	messageTypeSignal       = 4
+)
+
+// D-Bus message flags
+const (
+	messageFlagNoReplyExpected = 0x1
+)
+
+// D-Bus header field codes
+const (
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSender      = 7
+	fieldSignature   = 8
+)
+
+const (
+	protocolVersion = 1
+	// maximum length of a message, as defined by the specification
+	maxMessageLength = 1 << 27
+	// maximum nesting of containers, as defined by the specification
+	maxNesting = 64
+)
+
+var (
+	errInvalidSignature = errors.New("invalid D-Bus signature")
+	errInvalidMessage   = errors.New("invalid D-Bus message")
+)
+
+// ObjectPath is a D-Bus object path, marshalled with the "o" type
+type ObjectPath string
+
+// Signature is a D-Bus type signature, marshalled with the "g" type
+type Signature string
+
+// Variant is a D-Bus value together with its type signature
+type Variant struct {
+	Signature Signature
+	Value     interface{}
+}
+
+// DictEntry is an entry of a D-Bus dictionary; dictionaries are decoded as
+// slices of entries to preserve their order
+type DictEntry struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// message is a D-Bus message, with the body already decoded
+type message struct {
+	Type        byte
+	Flags       byte
+	Serial      uint32
+	Path        ObjectPath
+	Interface   string
+	Member      string
+	ErrorName   string
+	ReplySerial uint32
+	Destination string
+	Sender      string
+	Signature   Signature
+	Body        []interface{}
+}
+
+// validObjectPath reports whether path is a valid D-Bus object path
+func validObjectPath(path string) bool {
+	if path == "/" {
+		return true
+	}
+	if !strings.HasPrefix(path, "/") || strings.HasSuffix(path, "/") {
+		return false
+	}
+	for _, element := range strings.Split(path[1:], "/") {
+		if element == "" {
+			return false
+		}
+		for _, c := range element {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+				c >= '0' && c <= '9' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// nextType splits the first complete type from the signature
+func nextType(sig string, depth int) (string, string, error) {
+	if sig == "" || depth > maxNesting {
+		return "", "", errInvalidSignature
+	}
+	switch sig[0] {
+	case 'y', 'b', 'n', 'q', 'i', 'u', 'x', 't', 'd', 's', 'o', 'g', 'h', 'v':
+		return sig[:1], sig[1:], nil
+	case 'a':
+		elem, rest, err := nextType(sig[1:], depth+1)
+		if err != nil {
+			return "", "", err
+		}
+		return "a" + elem, rest, nil
+	case '(':
+		rest := sig[1:]
+		for rest != "" && rest[0] != ')' {
+			var err error
+			var field string
+			field, rest, err = nextType(rest, depth+1)
+			if err != nil || field[0] == '{' {
+				return "", "", errInvalidSignature
+			}
+		}
+		if rest == "" || len(sig)-len(rest) == 1 {
+			return "", "", errInvalidSignature
+		}
+		return sig[:len(sig)-len(rest)+1], rest[1:], nil
+	case '{':
+		key, rest, err := nextType(sig[1:], depth+1)
+		if err != nil || len(key) != 1 || key == "v" {
+			return "", "", errInvalidSignature
+		}
+		value, rest, err := nextType(rest, depth+1)
+		if err != nil || value[0] == '{' || rest == "" || rest[0] != '}' {
+			return "", "", errInvalidSignature
+		}
+		return "{" + key + value + "}", rest[1:], nil
+	}
+	return "", "", errInvalidSignature
+}
+
+// splitSignature returns the complete types of the signature
+func splitSignature(sig string) ([]string, error) {
+	var types []string
+	for sig != "" {
+		t, rest, err := nextType(sig, 0)
+		if err != nil {
+			return nil, err
+		} else if t[0] == '{' {
+			// dictionary entries are only valid as array elements
+			return nil, errInvalidSignature
+		}
+		types = append(types, t)
+		sig = rest
+	}
+	return types, nil
+}
+
+// alignment returns the alignment of the values of the given type
+func alignment(t byte) int {
+	switch t {
+	case 'n', 'q':
+		return 2
+	case 'b', 'i', 'u', 'h', 's', 'o', 'a':
+		return 4
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	}
+	return 1
+}
+
+// signatureOf returns the D-Bus signature of a Go value
+func signatureOf(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case byte:
+		return "y", nil
+	case bool:
+		return "b", nil
+	case int16:
+		return "n", nil
+	case uint16:
+		return "q", nil
+	case int32:
+		return "i", nil
+	case uint32:
+		return "u", nil
+	case int64:
+		return "x", nil
+	case uint64:
+		return "t", nil
+	case float64:
+		return "d", nil
+	case string:
+		return "s", nil
+	case ObjectPath:
+		return "o", nil
+	case Signature:
+		return "g", nil
+	case Variant:
+		return "v", nil
+	case []string:
+		return "as", nil
+	case []interface{}:
+		sig := "("
+		for _, field := range v {
+			s, err := signatureOf(field)
+			if err != nil {
+				return "", err
+			}
+			sig += s
+		}
+		return sig + ")", nil
+	}
+	return "", errors.Errorf("unsupported D-Bus value of type %T", v)
+}
+
+// encoder marshals D-Bus values
+type encoder struct {
+	buf   bytes.Buffer
+	order binary.ByteOrder
+}
+
+func (e *encoder) align(n int) {
+	for e.buf.Len()%n != 0 {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.align(4)
+	var b [4]byte
+	e.order.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) string(s string) {
+	e.uint32(uint32(len(s)))
+	e.buf.WriteString(s)
+	e.buf.WriteByte(0)
+}
+
+func (e *encoder) signature(s string) {
+	e.buf.WriteByte(byte(len(s)))
+	e.buf.WriteString(s)
+	e.buf.WriteByte(0)
+}
+
+func typeMismatch(sig string, v interface{}) error {
+	return errors.Errorf("cannot marshal a value of type %T as D-Bus type %q", v, sig)
+}
+
+// encode marshals the value of a single complete type
+func (e *encoder) encode(sig string, v interface{}, depth int) error {
+	if depth > maxNesting {
+		return errInvalidSignature
+	}
+	e.align(alignment(sig[0]))
+	var b [8]byte
+	switch sig[0] {
+	case 'y':
+		val, ok := v.(byte)
+		if !ok {
+			return typeMismatch(sig, v)
+		}
+		e.buf.WriteByte(val)
+	case 'b':
+		val, ok := v.(bool)
+		if !ok {
+			return typeMismatch(sig, v)
+		}
+		if val {
+			e.uint32(1)
+		} else {
+			e.uint32(0)
+		}
+	case 'n', 'q':
+		var val uint16
+		switch v := v.(type) {
+		case int16:
+			val = uint16(v)
+		case uint16:
+			val = v
+		default:
+			return typeMismatch(sig, v)
+		}
+		e.order.PutUint16(b[:2], val)
+		e.buf.Write(b[:2])
+	case 'i', 'u', 'h':
+		var val uint32
+		switch v := v.(type) {
+		case int32:
+			val = uint32(v)
+		case uint32:
+			val = v
+		default:
+			return typeMismatch(sig, v)
+		}
+		e.uint32(val)
+	case 'x', 't', 'd':
+		var val uint64
+		switch v := v.(type) {
+		case int64:
+			val = uint64(v)
+		case uint64:
+			val = v
+		case float64:
+			val = math.Float64bits(v)
+		default:
+			return typeMismatch(sig, v)
+		}
+		e.order.PutUint64(b[:], val)
+		e.buf.Write(b[:])
+	case 's', 'o':
+		var val string
+		switch v := v.(type) {
+		case string:
+			val = v
+		case ObjectPath:
+			val = string(v)
+		default:
+			return typeMismatch(sig, v)
+		}
+		e.string(val)
+	case 'g':
+		var val string
+		switch v := v.(type) {
+		case string:
+			val = v
+		case Signature:
+			val = string(v)
+		default:
+			return typeMismatch(sig, v)
+		}
+		e.signature(val)
+	case 'v':
+		variant, ok := v.(Variant)
+		if !ok {
+			return typeMismatch(sig, v)
+		}
+		t, rest, err := nextType(string(variant.Signature), depth+1)
+		if err != nil || rest != "" {
+			return errInvalidSignature
+		}
+		e.signature(t)
+		return e.encode(t, variant.Value, depth+1)
+	case 'a':
+		return e.encodeArray(sig, v, depth)
+	case '(', '{':
+		var fields []interface{}
+		switch v := v.(type) {
+		case []interface{}:
+			fields = v
+		case DictEntry:
+			fields = []interface{}{v.Key, v.Value}
+		default:
+			return typeMismatch(sig, v)
+		}
+		types, err := splitSignature(sig[1 : len(sig)-1])
+		if err != nil {
+			return err
+		} else if len(types) != len(fields) {
+			return typeMismatch(sig, v)
+		}
+		for i, t := range types {
+			if err := e.encode(t, fields[i], depth+1); err != nil {
+				return err
+			}
+		}
+	default:
+		return errInvalidSignature
+	}
+	return nil
+}
+
+func (e *encoder) encodeArray(sig string, v interface{}, depth int) error {
+	elem := sig[1:]
+	var elems []interface{}
+	switch v := v.(type) {
+	case []interface{}:
+		elems = v
+	case []string:
+		for _, s := range v {
+			elems = append(elems, s)
+		}
+	case []DictEntry:
+		for _, entry := range v {
+			elems = append(elems, entry)
+		}
+	case []byte:
+		for _, b := range v {
+			elems = append(elems, b)
+		}
+	default:
+		return typeMismatch(sig, v)
+	}
+
+	e.uint32(0)
+	lengthAt := e.buf.Len() - 4
+	// the padding to the first element is not part of the array length
+	e.align(alignment(elem[0]))
+	start := e.buf.Len()
+	for _, value := range elems {
+		if err := e.encode(elem, value, depth+1); err != nil {
+			return err
+		}
+	}
+	e.order.PutUint32(e.buf.Bytes()[lengthAt:], uint32(e.buf.Len()-start))
+	return nil
+}
+
+// decoder unmarshals D-Bus values
+type decoder struct {
+	data  []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+func (d *decoder) align(n int) error {
+	for d.pos%n != 0 {
+		if d.pos >= len(d.data) {
+			return io.ErrUnexpectedEOF
+		}
+		d.pos++
+	}
+	return nil
+}
+
+func (d *decoder) read(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	if err := d.align(4); err != nil {
+		return 0, err
+	}
+	b, err := d.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint32(b), nil
+}
+
+func (d *decoder) string(length int) (string, error) {
+	b, err := d.read(length + 1)
+	if err != nil {
+		return "", err
+	} else if b[length] != 0 {
+		return "", errInvalidMessage
+	}
+	return string(b[:length]), nil
+}
+
+func (d *decoder) signature() (string, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return "", err
+	}
+	return d.string(int(b[0]))
+}
+
+// decode unmarshals the value of a single complete type
+func (d *decoder) decode(sig string, depth int) (interface{}, error) {
+	if depth > maxNesting {
+		return nil, errInvalidSignature
+	}
+	if err := d.align(alignment(sig[0])); err != nil {
+		return nil, err
+	}
+	switch sig[0] {
+	case 'y':
+		b, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0], nil
+	case 'b':
+		v, err := d.uint32()
+		if err != nil {
+			return nil, err
+		} else if v > 1 {
+			return nil, errInvalidMessage
+		}
+		return v == 1, nil
+	case 'n', 'q':
+		b, err := d.read(2)
+		if err != nil {
+			return nil, err
+		}
+		if sig[0] == 'n' {
+			return int16(d.order.Uint16(b)), nil
+		}
+		return d.order.Uint16(b), nil
+	case 'i', 'u', 'h':
+		v, err := d.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if sig[0] == 'i' {
+			return int32(v), nil
+		}
+		return v, nil
+	case 'x', 't', 'd':
+		b, err := d.read(8)
+		if err != nil {
+			return nil, err
+		}
+		v := d.order.Uint64(b)
+		switch sig[0] {
+		case 'x':
+			return int64(v), nil
+		case 'd':
+			return math.Float64frombits(v), nil
+		}
+		return v, nil
+	case 's', 'o':
+		length, err := d.uint32()
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.string(int(length))
+		if err != nil {
+			return nil, err
+		}
+		if sig[0] == 'o' {
+			return ObjectPath(s), nil
+		}
+		return s, nil
+	case 'g':
+		s, err := d.signature()
+		if err != nil {
+			return nil, err
+		}
+		return Signature(s), nil
+	case 'v':
+		s, err := d.signature()
+		if err != nil {
+			return nil, err
+		}
+		t, rest, err := nextType(s, depth+1)
+		if err != nil || rest != "" {
+			return nil, errInvalidSignature
+		}
+		v, err := d.decode(t, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return Variant{Signature: Signature(t), Value: v}, nil
+	case 'a':
+		return d.decodeArray(sig, depth)
+	case '(', '{':
+		types, err := splitSignature(sig[1 : len(sig)-1])
+		if err != nil {
+			return nil, err
+		}
+		fields := make([]interface{}, 0, len(types))
+		for _, t := range types {
+			v, err := d.decode(t, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, v)
+		}
+		if sig[0] == '{' {
+			return DictEntry{Key: fields[0], Value: fields[1]}, nil
+		}
+		return fields, nil
+	}
+	return nil, errInvalidSignature
+}
+
+func (d *decoder) decodeArray(sig string, depth int) (interface{}, error) {
+	length, err := d.uint32()
+	if err != nil {
+		return nil, err
+	} else if length > maxMessageLength {
+		return nil, errInvalidMessage
+	}
+	elem := sig[1:]
+	if err := d.align(alignment(elem[0])); err != nil {
+		return nil, err
+	}
+	end := d.pos + int(length)
+	if end > len(d.data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var result interface{}
+	switch {
+	case elem == "y":
+		b, _ := d.read(int(length))
+		return append([]byte(nil), b...), nil
+	case elem == "s":
+		strs := []string{}
+		for d.pos < end {
+			v, err := d.decode(elem, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			strs = append(strs, v.(string))
+		}
+		result = strs
+	case elem[0] == '{':
+		entries := []DictEntry{}
+		for d.pos < end {
+			v, err := d.decode(elem, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, v.(DictEntry))
+		}
+		result = entries
+	default:
+		elems := []interface{}{}
+		for d.pos < end {
+			v, err := d.decode(elem, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, v)
+		}
+		result = elems
+	}
+	if d.pos != end {
+		return nil, errInvalidMessage
+	}
+	return result, nil
+}
+
+// marshal returns the wire representation of the message
+func (m *message) marshal() ([]byte, error) {
+	body := &encoder{order: binary.LittleEndian}
+	types, err := splitSignature(string(m.Signature))
+	if err != nil {
+		return nil, err
+	} else if len(types) != len(m.Body) {
+		return nil, errors.Errorf("the D-Bus signature %q does not match %d values",
+			m.Signature, len(m.Body))
+	}
+	for i, t := range types {
+		if err := body.encode(t, m.Body[i], 0); err != nil {
+			return nil, err
+		}
+	}
+
+	var fields []interface{}
+	field := func(code byte, sig Signature, value interface{}) {
+		fields = append(fields, []interface{}{code, Variant{Signature: sig, Value: value}})
+	}
+	if m.Path != "" {
+		field(fieldPath, "o", m.Path)
+	}
+	if m.Interface != "" {
+		field(fieldInterface, "s", m.Interface)
+	}
+	if m.Member != "" {
+		field(fieldMember, "s", m.Member)
+	}
+	if m.ErrorName != "" {
+		field(fieldErrorName, "s", m.ErrorName)
+	}
+	if m.ReplySerial != 0 {
+		field(fieldReplySerial, "u", m.ReplySerial)
+	}
+	if m.Destination != "" {
+		field(fieldDestination, "s", m.Destination)
+	}
+	if m.Signature != "" {
+		field(fieldSignature, "g", m.Signature)
+	}
+
+	header := &encoder{order: binary.LittleEndian}
+	header.buf.Write([]byte{'l', m.Type, m.Flags, protocolVersion})
+	header.uint32(uint32(body.buf.Len()))
+	header.uint32(m.Serial)
+	if err := header.encode("a(yv)", fields, 0); err != nil {
+		return nil, err
+	}
+	header.align(8)
+	if header.buf.Len()+body.buf.Len() > maxMessageLength {
+		return nil, errors.New("the D-Bus message is too long")
+	}
+	return append(header.buf.Bytes(), body.buf.Bytes()...), nil
+}
+
+// readMessage reads and decodes a message from r
+func readMessage(r io.Reader) (*message, error) {
+	// fixed part of the header, and the length of the header fields array
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, errInvalidMessage
+	}
+	if fixed[3] != protocolVersion {
+		return nil, errInvalidMessage
+	}
+	bodyLength := order.Uint32(fixed[4:])
+	fieldsLength := order.Uint32(fixed[12:])
+	if uint64(bodyLength)+uint64(fieldsLength) > maxMessageLength {
+		return nil, errInvalidMessage
+	}
+	headerLength := 16 + int(fieldsLength)
+	padding := (8 - headerLength%8) % 8
+	data := make([]byte, headerLength+padding+int(bodyLength))
+	copy(data, fixed)
+	if _, err := io.ReadFull(r, data[16:]); err != nil {
+		return nil, err
+	}
+
+	m := &message{
+		Type:   fixed[1],
+		Flags:  fixed[2],
+		Serial: order.Uint32(fixed[8:]),
+	}
+	header := &decoder{data: data[:headerLength], pos: 12, order: order}
+	fields, err := header.decode("a(yv)", 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields.([]interface{}) {
+		f := f.([]interface{})
+		value := f[1].(Variant).Value
+		var ok bool
+		switch f[0].(byte) {
+		case fieldPath:
+			m.Path, ok = value.(ObjectPath)
+		case fieldInterface:
+			m.Interface, ok = value.(string)
+		case fieldMember:
+			m.Member, ok = value.(string)
+		case fieldErrorName:
+			m.ErrorName, ok = value.(string)
+		case fieldReplySerial:
+			m.ReplySerial, ok = value.(uint32)
+		case fieldDestination:
+			m.Destination, ok = value.(string)
+		case fieldSender:
+			m.Sender, ok = value.(string)
+		case fieldSignature:
+			m.Signature, ok = value.(Signature)
+		default:
+			// unknown header fields must be ignored
+			ok = true
+		}
+		if !ok {
+			return nil, errInvalidMessage
+		}
+	}
+
+	types, err := splitSignature(string(m.Signature))
+	if err != nil {
+		return nil, err
+	}
+	body := &decoder{data: data[headerLength+padding:], order: order}
+	for _, t := range types {
+		v, err := body.decode(t, 0)
+		if err != nil {
+			return nil, err
+		}
+		m.Body = append(m.Body, v)
+	}
+	return m, nil
+}
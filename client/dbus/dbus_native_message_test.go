@@ -0,0 +1,171 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package dbus
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msg := &message{
+		Type:        messageTypeSignal,
+		Serial:      42,
+		Path:        "/io/mender/AuthenticationManager",
+		Interface:   "io.mender.Authentication1",
+		Member:      "JwtTokenStateChange",
+		Destination: ":1.1",
+		Signature:   "ybnqiuxtdsogvasaya{sv}(si)",
+		Body: []interface{}{
+			byte(1),
+			true,
+			int16(-2),
+			uint16(3),
+			int32(-4),
+			uint32(5),
+			int64(-6),
+			uint64(7),
+			8.5,
+			"string",
+			ObjectPath("/object"),
+			Signature("a{sv}"),
+			Variant{Signature: "s", Value: "variant"},
+			[]string{"a", "b"},
+			[]byte{9, 10},
+			[]DictEntry{
+				{Key: "key", Value: Variant{Signature: "u", Value: uint32(11)}},
+			},
+			[]interface{}{"struct", int32(12)},
+		},
+	}
+	data, err := msg.marshal()
+	assert.NoError(t, err)
+
+	decoded, err := readMessage(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, msg, decoded)
+}
+
+func TestMessageMarshalErrors(t *testing.T) {
+	testCases := map[string]*message{
+		"invalid signature": {
+			Signature: "a",
+			Body:      []interface{}{[]string{}},
+		},
+		"dictionary entry out of an array": {
+			Signature: "{sv}",
+			Body:      []interface{}{DictEntry{}},
+		},
+		"signature mismatch": {
+			Signature: "ss",
+			Body:      []interface{}{"string"},
+		},
+		"type mismatch": {
+			Signature: "u",
+			Body:      []interface{}{"string"},
+		},
+		"struct mismatch": {
+			Signature: "(ss)",
+			Body:      []interface{}{[]interface{}{"string"}},
+		},
+	}
+
+	for name, msg := range testCases {
+		t.Run(name, func(t *testing.T) {
+			msg.Type = messageTypeSignal
+			_, err := msg.marshal()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	msg := &message{
+		Type:      messageTypeSignal,
+		Path:      "/",
+		Member:    "Test",
+		Signature: "s",
+		Body:      []interface{}{"string"},
+	}
+	data, err := msg.marshal()
+	assert.NoError(t, err)
+
+	// truncated
+	_, err = readMessage(bytes.NewReader(data[:len(data)-1]))
+	assert.Error(t, err)
+
+	// invalid endianness
+	invalid := append([]byte(nil), data...)
+	invalid[0] = 'x'
+	_, err = readMessage(bytes.NewReader(invalid))
+	assert.Error(t, err)
+
+	// invalid protocol version
+	invalid = append([]byte(nil), data...)
+	invalid[3] = 2
+	_, err = readMessage(bytes.NewReader(invalid))
+	assert.Error(t, err)
+}
+
+func TestReadMessageBigEndian(t *testing.T) {
+	// signal "/" "Test" with the body "ok", marshalled in big endian
+	data := []byte{
+		'B', messageTypeSignal, 0, 1, 0, 0, 0, 7, 0, 0, 0, 1, 0, 0, 0, 0x27,
+		fieldPath, 1, 'o', 0, 0, 0, 0, 1, '/', 0, 0, 0, 0, 0, 0, 0,
+		fieldMember, 1, 's', 0, 0, 0, 0, 4, 'T', 'e', 's', 't', 0, 0, 0, 0,
+		fieldSignature, 1, 'g', 0, 1, 's', 0, 0,
+		0, 0, 0, 2, 'o', 'k', 0,
+	}
+	msg, err := readMessage(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, &message{
+		Type:      messageTypeSignal,
+		Serial:    1,
+		Path:      "/",
+		Member:    "Test",
+		Signature: "s",
+		Body:      []interface{}{"ok"},
+	}, msg)
+}
+
+func TestSignatureOf(t *testing.T) {
+	sig, err := signatureOf([]interface{}{"s", uint32(1), []string{}, Variant{}})
+	assert.NoError(t, err)
+	assert.Equal(t, "(suasv)", sig)
+
+	_, err = signatureOf(1)
+	assert.Error(t, err)
+}
+
+func TestValidObjectPath(t *testing.T) {
+	testCases := map[string]bool{
+		"/":                      true,
+		"/io/mender/Connect_1":   true,
+		"":                       false,
+		"dummy":                  false,
+		"/io/mender/":            false,
+		"/io//mender":            false,
+		"/io/mender/Connect-1":   false,
+		"/io/mender/Connect.one": false,
+	}
+
+	for path, valid := range testCases {
+		t.Run(path, func(t *testing.T) {
+			assert.Equal(t, valid, validObjectPath(path))
+		})
+	}
+}
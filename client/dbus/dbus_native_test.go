@@ -0,0 +1,548 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package dbus
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testAuthManagerName          = "io.mender.AuthenticationManager"
+	testAuthManagerObjectPath    = "/io/mender/AuthenticationManager"
+	testAuthManagerInterfaceName = "io.mender.Authentication1"
+)
+
+// startSessionBus starts a private session bus for the duration of the test
+// and points DBUS_SESSION_BUS_ADDRESS to it
+func startSessionBus(t *testing.T) string {
+	path, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon is not available")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	cmd := exec.Command(path, "--session", "--nofork", "--print-address=3")
+	cmd.ExtraFiles = []*os.File{w}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	addressChan := make(chan string, 1)
+	go func() {
+		address, _ := bufio.NewReader(r).ReadString('\n')
+		addressChan <- strings.TrimSpace(address)
+	}()
+	var address string
+	select {
+	case address = <-addressChan:
+	case <-time.After(10 * time.Second):
+	}
+	if address == "" {
+		t.Fatal("failed to start dbus-daemon")
+	}
+
+	oldAddress, set := os.LookupEnv("DBUS_SESSION_BUS_ADDRESS")
+	os.Setenv("DBUS_SESSION_BUS_ADDRESS", address)
+	t.Cleanup(func() {
+		if set {
+			os.Setenv("DBUS_SESSION_BUS_ADDRESS", oldAddress)
+		} else {
+			os.Unsetenv("DBUS_SESSION_BUS_ADDRESS")
+		}
+	})
+	return address
+}
+
+// startAuthManager owns the name of the Mender Authentication Manager on
+// the bus and answers its methods
+func startAuthManager(t *testing.T, address, token, serverURL string) *nativeConn {
+	conn, err := newNativeConn(address, nil, func(_ *nativeConn, call *message) *message {
+		switch call.Member {
+		case "GetJwtToken":
+			return &message{
+				Type:      messageTypeMethodReturn,
+				Signature: "ss",
+				Body:      []interface{}{token, serverURL},
+			}
+		case "FetchJwtToken":
+			return &message{
+				Type:      messageTypeMethodReturn,
+				Signature: "b",
+				Body:      []interface{}{true},
+			}
+		}
+		return &message{
+			Type:      messageTypeError,
+			ErrorName: "org.freedesktop.DBus.Error.UnknownMethod",
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	reply, err := conn.callBus("RequestName", "su", testAuthManagerName, uint32(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// DBUS_REQUEST_NAME_REPLY_PRIMARY_OWNER
+	assert.Equal(t, []interface{}{uint32(1)}, reply.Body)
+	return conn
+}
+
+func emitSignal(t *testing.T, conn *nativeConn, path, member string, signature Signature, body ...interface{}) {
+	err := conn.send(&message{
+		Type:      messageTypeSignal,
+		Path:      ObjectPath(path),
+		Interface: testAuthManagerInterfaceName,
+		Member:    member,
+		Signature: signature,
+		Body:      body,
+	})
+	assert.NoError(t, err)
+}
+
+func TestNativeBusGet(t *testing.T) {
+	startSessionBus(t)
+	native := newDBusAPINative()
+
+	conn, err := native.BusGet(GBusTypeSession)
+	assert.NoError(t, err)
+	assert.NotEqual(t, Handle(nil), conn)
+	assert.True(t, strings.HasPrefix((*nativeConn)(unsafe.Pointer(conn)).uniqueName, ":"))
+
+	// the connection is shared
+	other, err := native.BusGet(GBusTypeSession)
+	assert.NoError(t, err)
+	assert.Equal(t, conn, other)
+
+	// and re-established once closed
+	(*nativeConn)(unsafe.Pointer(conn)).Close()
+	other, err = native.BusGet(GBusTypeSession)
+	assert.NoError(t, err)
+	assert.NotEqual(t, conn, other)
+
+	_, err = native.BusGet(0)
+	assert.Error(t, err)
+}
+
+func TestNativeBusGetFailure(t *testing.T) {
+	oldAddress, set := os.LookupEnv("DBUS_SESSION_BUS_ADDRESS")
+	defer func() {
+		if set {
+			os.Setenv("DBUS_SESSION_BUS_ADDRESS", oldAddress)
+		} else {
+			os.Unsetenv("DBUS_SESSION_BUS_ADDRESS")
+		}
+	}()
+
+	native := newDBusAPINative()
+	os.Unsetenv("DBUS_SESSION_BUS_ADDRESS")
+	conn, err := native.BusGet(GBusTypeSession)
+	assert.Error(t, err)
+	assert.Equal(t, Handle(nil), conn)
+
+	os.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path=/nonexistent/bus")
+	conn, err = native.BusGet(GBusTypeSession)
+	assert.Error(t, err)
+	assert.Equal(t, Handle(nil), conn)
+}
+
+func TestNativeBusProxyNew(t *testing.T) {
+	testCases := map[string]struct {
+		name          string
+		objectPath    string
+		interfaceName string
+		err           bool
+	}{
+		"ok": {
+			name:          "org.freedesktop.DBus",
+			objectPath:    "/org/freedesktop/DBus",
+			interfaceName: "org.freedesktop.DBus",
+			err:           false,
+		},
+		"ko, wrong path": {
+			name:          "org.freedesktop.DBus",
+			objectPath:    "dummy",
+			interfaceName: "org.freedesktop.DBus",
+			err:           true,
+		},
+	}
+
+	startSessionBus(t)
+	native := newDBusAPINative()
+	conn, err := native.BusGet(GBusTypeSession)
+	assert.NoError(t, err)
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			proxy, err := native.BusProxyNew(conn, tc.name, tc.objectPath, tc.interfaceName)
+			if tc.err {
+				assert.Error(t, err)
+				assert.Equal(t, Handle(nil), proxy)
+			} else {
+				assert.NoError(t, err)
+				assert.NotEqual(t, Handle(nil), proxy)
+			}
+		})
+	}
+}
+
+func TestNativeBusProxyCall(t *testing.T) {
+	testCases := map[string]struct {
+		methodName string
+		params     interface{}
+		err        bool
+	}{
+		"ok": {
+			methodName: "ListNames",
+		},
+		"ok, with parameters": {
+			methodName: "NameHasOwner",
+			params:     []interface{}{"org.freedesktop.DBus"},
+		},
+		"ko, already handled Hello message": {
+			methodName: "Hello",
+			err:        true,
+		},
+		"ko, unsupported parameters": {
+			methodName: "NameHasOwner",
+			params:     "org.freedesktop.DBus",
+			err:        true,
+		},
+	}
+
+	startSessionBus(t)
+	native := newDBusAPINative()
+	conn, err := native.BusGet(GBusTypeSession)
+	assert.NoError(t, err)
+	proxy, err := native.BusProxyNew(conn, "org.freedesktop.DBus",
+		"/org/freedesktop/DBus", "org.freedesktop.DBus")
+	assert.NoError(t, err)
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			response, err := native.BusProxyCall(proxy, tc.methodName, tc.params, 1000)
+			if tc.err {
+				assert.Error(t, err)
+				assert.Nil(t, response)
+			} else {
+				assert.NoError(t, err)
+				assert.NotNil(t, response)
+			}
+		})
+	}
+
+	response, err := native.BusProxyCall(proxy, "NameHasOwner",
+		[]interface{}{"org.freedesktop.DBus"}, -1)
+	assert.NoError(t, err)
+	assert.True(t, response.GetBoolean())
+
+	response, err = native.BusProxyCall(proxy, "GetNameOwner",
+		[]interface{}{"org.freedesktop.DBus"}, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, "org.freedesktop.DBus", response.GetString())
+}
+
+func TestNativeAuthManager(t *testing.T) {
+	const (
+		token     = "token"
+		serverURL = "https://hosted.mender.io"
+	)
+
+	address := startSessionBus(t)
+	service := startAuthManager(t, address, token, serverURL)
+
+	native := newDBusAPINative()
+	conn, err := native.BusGet(GBusTypeSession)
+	assert.NoError(t, err)
+	proxy, err := native.BusProxyNew(conn, testAuthManagerName,
+		testAuthManagerObjectPath, testAuthManagerInterfaceName)
+	assert.NoError(t, err)
+
+	loop := native.MainLoopNew()
+	go native.MainLoopRun(loop)
+	defer native.MainLoopQuit(loop)
+
+	response, err := native.BusProxyCall(proxy, "GetJwtToken", nil, 1000)
+	assert.NoError(t, err)
+	receivedToken, receivedServerURL := response.GetTwoStrings()
+	assert.Equal(t, token, receivedToken)
+	assert.Equal(t, serverURL, receivedServerURL)
+
+	response, err = native.BusProxyCall(proxy, "FetchJwtToken", nil, 1000)
+	assert.NoError(t, err)
+	assert.True(t, response.GetBoolean())
+
+	_, err = native.BusProxyCall(proxy, "Unknown", nil, 1000)
+	assert.EqualError(t, err, "GDBus.Error:org.freedesktop.DBus.Error.UnknownMethod: ")
+
+	// signals of other objects are not delivered
+	emitSignal(t, service, "/io/mender/Other", "JwtTokenStateChange", "ss", "other", "")
+	// the values of the container types are left nil, as with libgio
+	emitSignal(t, service, testAuthManagerObjectPath, "JwtTokenStateChange", "suasx",
+		token, uint32(1), []string{"a"}, int64(-1))
+	params, err := native.WaitForSignal("JwtTokenStateChange", 5*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []SignalParams{
+		{ParamType: GDBusTypeString, ParamData: token},
+		{ParamType: "u", ParamData: uint32(1)},
+		{ParamType: "as", ParamData: nil},
+		{ParamType: "x", ParamData: int64(-1)},
+	}, params)
+
+	_, err = native.WaitForSignal("JwtTokenStateChange", 100*time.Millisecond)
+	assert.Error(t, err)
+}
+
+func TestNativeWatchName(t *testing.T) {
+	address := startSessionBus(t)
+	native := newDBusAPINative()
+	conn, err := native.BusGet(GBusTypeSession)
+	assert.NoError(t, err)
+
+	owners := make(chan string, 10)
+	watchID, err := native.BusWatchName(conn, testAuthManagerName, func(name, owner string) {
+		assert.Equal(t, testAuthManagerName, name)
+		owners <- owner
+	})
+	assert.NoError(t, err)
+
+	waitForOwner := func() string {
+		select {
+		case owner := <-owners:
+			return owner
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the owner of the name")
+		}
+		return ""
+	}
+	// not owned yet
+	assert.Equal(t, "", waitForOwner())
+
+	service := startAuthManager(t, address, "token", "")
+	assert.Equal(t, service.uniqueName, waitForOwner())
+	service.Close()
+	assert.Equal(t, "", waitForOwner())
+
+	// restarted
+	service = startAuthManager(t, address, "token", "")
+	assert.Equal(t, service.uniqueName, waitForOwner())
+
+	assert.Error(t, native.BusUnwatchName(conn, watchID+1))
+	assert.NoError(t, native.BusUnwatchName(conn, watchID))
+	service.Close()
+	startAuthManager(t, address, "token", "")
+	select {
+	case owner := <-owners:
+		t.Errorf("unexpected owner %q of the unwatched name", owner)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNativeExportObject(t *testing.T) {
+	const (
+		name          = "io.mender.Test"
+		objectPath    = "/io/mender/Test"
+		interfaceName = "io.mender.Test1"
+	)
+
+	startSessionBus(t)
+	server := newDBusAPINative()
+	serverConn, err := server.BusGet(GBusTypeSession)
+	assert.NoError(t, err)
+	client := newDBusAPINative()
+	clientConn, err := client.BusGet(GBusTypeSession)
+	assert.NoError(t, err)
+
+	err = server.BusOwnName(serverConn, name)
+	assert.NoError(t, err)
+	err = server.BusOwnName(serverConn, name)
+	assert.NoError(t, err)
+	err = client.BusOwnName(clientConn, name)
+	assert.EqualError(t, err, "failed to own the D-Bus name io.mender.Test: the name is already owned")
+
+	handler := func(iface, method string, params []SignalParams) ([]interface{}, error) {
+		switch method {
+		case "Echo":
+			text := params[0].ParamData.(string)
+			count := params[1].ParamData.(int64)
+			return []interface{}{strings.Repeat(text, int(count))}, nil
+		case "Fail":
+			return nil, &MethodError{Name: "io.mender.Error.Test", Message: "failed"}
+		}
+		return nil, errors.New("unexpected method")
+	}
+	_, err = server.BusRegisterObject(serverConn, "dummy", testIntrospection, handler)
+	assert.Error(t, err)
+	_, err = server.BusRegisterObject(serverConn, objectPath, "<node>", handler)
+	assert.Error(t, err)
+	id, err := server.BusRegisterObject(serverConn, objectPath, testIntrospection, handler)
+	assert.NoError(t, err)
+	_, err = server.BusRegisterObject(serverConn, objectPath, testIntrospection, handler)
+	assert.Error(t, err)
+
+	proxy, err := client.BusProxyNew(clientConn, name, objectPath, interfaceName)
+	assert.NoError(t, err)
+	response, err := client.BusProxyCall(proxy, "Echo", []interface{}{"echo", int64(2)}, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, "echoecho", response.GetString())
+
+	_, err = client.BusProxyCall(proxy, "Echo", []interface{}{"echo"}, 1000)
+	assert.EqualError(t, err, "GDBus.Error:org.freedesktop.DBus.Error.InvalidArgs: "+
+		"Type of message, '(s)', does not match expected type '(sx)'")
+	_, err = client.BusProxyCall(proxy, "Fail", nil, 1000)
+	assert.EqualError(t, err, "GDBus.Error:io.mender.Error.Test: failed")
+	_, err = client.BusProxyCall(proxy, "Unknown", nil, 1000)
+	assert.Error(t, err)
+
+	introspectable, err := client.BusProxyNew(clientConn, name, objectPath,
+		"org.freedesktop.DBus.Introspectable")
+	assert.NoError(t, err)
+	response, err = client.BusProxyCall(introspectable, "Introspect", nil, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, testIntrospection, response.GetString())
+
+	err = server.BusEmitSignal(serverConn, objectPath, interfaceName, "Echoed",
+		[]interface{}{"echo", []string{"a", "b"}})
+	assert.NoError(t, err)
+	params, err := client.WaitForSignal("Echoed", 5*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []SignalParams{
+		{ParamType: GDBusTypeString, ParamData: "echo"},
+		{ParamType: "as", ParamData: nil},
+	}, params)
+
+	err = server.BusEmitSignal(serverConn, objectPath, interfaceName, "Unknown", nil)
+	assert.Error(t, err)
+	err = server.BusEmitSignal(serverConn, objectPath, interfaceName, "Echoed",
+		[]interface{}{"echo"})
+	assert.Error(t, err)
+
+	err = server.BusUnregisterObject(serverConn, id)
+	assert.NoError(t, err)
+	err = server.BusUnregisterObject(serverConn, id)
+	assert.Error(t, err)
+	_, err = client.BusProxyCall(proxy, "Echo", []interface{}{"echo", int64(2)}, 1000)
+	assert.EqualError(t, err, "GDBus.Error:org.freedesktop.DBus.Error.UnknownObject: "+
+		"No such object path '/io/mender/Test'")
+	err = server.BusEmitSignal(serverConn, objectPath, interfaceName, "Echoed",
+		[]interface{}{"echo", []string{}})
+	assert.Error(t, err)
+
+	err = server.BusReleaseName(serverConn, name)
+	assert.NoError(t, err)
+	err = client.BusOwnName(clientConn, name)
+	assert.NoError(t, err)
+}
+
+func TestNativeWaitForSignal(t *testing.T) {
+	const signalName = "test"
+	native := newDBusAPINative()
+
+	// received signal
+	native.DrainSignal(signalName)
+	go native.HandleSignal(signalName, []SignalParams{})
+	_, err := native.WaitForSignal(signalName, 100*time.Millisecond)
+	assert.NoError(t, err)
+
+	// timeout
+	native.DrainSignal(signalName)
+	_, err = native.WaitForSignal(signalName, 100*time.Millisecond)
+	assert.Error(t, err)
+}
+
+func TestNativeMainLoop(t *testing.T) {
+	native := newDBusAPINative()
+	loop := native.MainLoopNew()
+	done := make(chan struct{})
+	go func() {
+		native.MainLoopRun(loop)
+		close(done)
+	}()
+
+	native.MainLoopQuit(loop)
+	native.MainLoopQuit(loop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the main loop did not quit")
+	}
+}
+
+func TestSelectDBusAPI(t *testing.T) {
+	defer setDBusAPI(dbusAPI)
+
+	err := SelectDBusAPI(DBusAPINative)
+	assert.NoError(t, err)
+	api, err := GetDBusAPI()
+	assert.NoError(t, err)
+	assert.IsType(t, &dbusAPINative{}, api)
+
+	err = SelectDBusAPI("dummy")
+	assert.Error(t, err)
+}
+
+func TestDialAddress(t *testing.T) {
+	testCases := map[string]struct {
+		address string
+		err     string
+	}{
+		"ko, invalid address": {
+			address: "dummy",
+			err:     `invalid D-Bus address "dummy"`,
+		},
+		"ko, unsupported transport": {
+			address: "launchd:env=DBUS_LAUNCHD_SESSION_BUS_SOCKET",
+			err:     `unsupported D-Bus address "launchd:env=DBUS_LAUNCHD_SESSION_BUS_SOCKET"`,
+		},
+		"ko, invalid escape": {
+			address: "unix:path=/tmp/dbus%2",
+			err:     `invalid D-Bus address value "/tmp/dbus%2"`,
+		},
+		"ko, unreachable": {
+			address: "unix:path=/nonexistent/bus%2dsocket",
+			err: `failed to connect to the D-Bus address ` +
+				`"unix:path=/nonexistent/bus%2dsocket": dial unix /nonexistent/bus-socket: ` +
+				`connect: no such file or directory`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			conn, err := dialAddress(tc.address)
+			assert.EqualError(t, err, tc.err)
+			assert.Nil(t, conn)
+		})
+	}
+}
@@ -28,6 +28,20 @@ type DBusAPI struct {
 	mock.Mock
 }
 
+// BusEmitSignal provides a mock function with given fields: conn, objectPath, interfaceName, signalName, values
+func (_m *DBusAPI) BusEmitSignal(conn dbus.Handle, objectPath string, interfaceName string, signalName string, values []interface{}) error {
+	ret := _m.Called(conn, objectPath, interfaceName, signalName, values)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(dbus.Handle, string, string, string, []interface{}) error); ok {
+		r0 = rf(conn, objectPath, interfaceName, signalName, values)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // BusGet provides a mock function with given fields: _a0
 func (_m *DBusAPI) BusGet(_a0 uint) (dbus.Handle, error) {
 	ret := _m.Called(_a0)
@@ -49,6 +63,20 @@ func (_m *DBusAPI) BusGet(_a0 uint) (dbus.Handle, error) {
 	return r0, r1
 }
 
+// BusOwnName provides a mock function with given fields: conn, name
+func (_m *DBusAPI) BusOwnName(conn dbus.Handle, name string) error {
+	ret := _m.Called(conn, name)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(dbus.Handle, string) error); ok {
+		r0 = rf(conn, name)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // BusProxyCall provides a mock function with given fields: _a0, _a1, _a2, _a3
 func (_m *DBusAPI) BusProxyCall(_a0 dbus.Handle, _a1 string, _a2 interface{}, _a3 int) (dbus.DBusCallResponse, error) {
 	ret := _m.Called(_a0, _a1, _a2, _a3)
@@ -93,6 +121,90 @@ func (_m *DBusAPI) BusProxyNew(_a0 dbus.Handle, _a1 string, _a2 string, _a3 stri
 	return r0, r1
 }
 
+// BusRegisterObject provides a mock function with given fields: conn, objectPath, introspectionXML, handler
+func (_m *DBusAPI) BusRegisterObject(conn dbus.Handle, objectPath string, introspectionXML string, handler dbus.MethodHandler) (uint, error) {
+	ret := _m.Called(conn, objectPath, introspectionXML, handler)
+
+	var r0 uint
+	if rf, ok := ret.Get(0).(func(dbus.Handle, string, string, dbus.MethodHandler) uint); ok {
+		r0 = rf(conn, objectPath, introspectionXML, handler)
+	} else {
+		r0 = ret.Get(0).(uint)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(dbus.Handle, string, string, dbus.MethodHandler) error); ok {
+		r1 = rf(conn, objectPath, introspectionXML, handler)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// BusReleaseName provides a mock function with given fields: conn, name
+func (_m *DBusAPI) BusReleaseName(conn dbus.Handle, name string) error {
+	ret := _m.Called(conn, name)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(dbus.Handle, string) error); ok {
+		r0 = rf(conn, name)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// BusUnregisterObject provides a mock function with given fields: conn, registrationID
+func (_m *DBusAPI) BusUnregisterObject(conn dbus.Handle, registrationID uint) error {
+	ret := _m.Called(conn, registrationID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(dbus.Handle, uint) error); ok {
+		r0 = rf(conn, registrationID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// BusUnwatchName provides a mock function with given fields: conn, watchID
+func (_m *DBusAPI) BusUnwatchName(conn dbus.Handle, watchID uint) error {
+	ret := _m.Called(conn, watchID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(dbus.Handle, uint) error); ok {
+		r0 = rf(conn, watchID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// BusWatchName provides a mock function with given fields: conn, name, handler
+func (_m *DBusAPI) BusWatchName(conn dbus.Handle, name string, handler dbus.NameOwnerHandler) (uint, error) {
+	ret := _m.Called(conn, name, handler)
+
+	var r0 uint
+	if rf, ok := ret.Get(0).(func(dbus.Handle, string, dbus.NameOwnerHandler) uint); ok {
+		r0 = rf(conn, name, handler)
+	} else {
+		r0 = ret.Get(0).(uint)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(dbus.Handle, string, dbus.NameOwnerHandler) error); ok {
+		r1 = rf(conn, name, handler)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetChannelForSignal provides a mock function with given fields: signalName
 func (_m *DBusAPI) GetChannelForSignal(signalName string) chan []dbus.SignalParams {
 	ret := _m.Called(signalName)
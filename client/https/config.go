@@ -15,13 +15,27 @@
 package https
 
 import (
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
 	"strings"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	pkcs11URIPrefix = "pkcs11:"
+
+	proxySchemeHTTP   = "http"
+	proxySchemeSOCKS5 = "socks5"
+
+	publicKeyPinPrefix = "sha256//"
+
+	// compression levels supported by the websocket library
+	minCompressionLevel = flate.HuffmanOnly
+	maxCompressionLevel = flate.BestCompression
 )
 
 // Client configuration
@@ -32,6 +46,14 @@ type Config struct {
 	ServerCert string
 	*Client
 	NoVerify bool
+	// Base64 SHA-256 hashes of the SubjectPublicKeyInfo of the keys the
+	// server certificate chain must contain one of
+	PublicKeyPins []string
+	// Proxy to reach the server through; if nil, the proxy is taken
+	// from the environment
+	Proxy *Proxy
+	// Websocket compression settings; if nil, compression is disabled
+	Compression *Compression
 }
 
 // Client holds the configuration for the client side mTLS configuration
@@ -43,6 +65,102 @@ type Client struct {
 	SSLEngine   string
 }
 
+// ParsePublicKeyPin parses a public key pin, that is the base64 encoded
+// SHA-256 hash of a SubjectPublicKeyInfo optionally prefixed with "sha256//",
+// and returns the hash in its canonical base64 form
+func ParsePublicKeyPin(pin string) (string, error) {
+	hash, err := base64.StdEncoding.DecodeString(
+		strings.TrimPrefix(strings.TrimSpace(pin), publicKeyPinPrefix))
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid public key pin '%s'", pin)
+	} else if len(hash) != sha256.Size {
+		return "", errors.Errorf(
+			"invalid public key pin '%s': not a SHA-256 hash", pin)
+	}
+	return base64.StdEncoding.EncodeToString(hash), nil
+}
+
+// Proxy holds the configuration of the proxy used to reach the server
+// NOTE: Careful when changing this, the struct is exposed directly in the
+// 'mender-connect.conf' file.
+type Proxy struct {
+	// URL of the proxy, either http://host:port for HTTP CONNECT
+	// proxies or socks5://host:port for SOCKS5 proxies
+	URL string
+	// Credentials for the proxy basic authentication
+	Username string
+	Password string
+	// Hosts, domains, IP addresses and CIDR ranges not to be proxied
+	NoProxy []string
+}
+
+// ParseURL returns the proxy URL including the credentials, if any
+func (p *Proxy) ParseURL() (*url.URL, error) {
+	rawURL := p.URL
+	if !strings.Contains(rawURL, "://") {
+		rawURL = proxySchemeHTTP + "://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid proxy URL '%s'", p.URL)
+	}
+	if u.Scheme != proxySchemeHTTP && u.Scheme != proxySchemeSOCKS5 {
+		return nil, errors.Errorf(
+			"unsupported proxy scheme '%s': use either %s or %s",
+			u.Scheme, proxySchemeHTTP, proxySchemeSOCKS5)
+	}
+	if u.Host == "" {
+		return nil, errors.Errorf("invalid proxy URL '%s': missing host", p.URL)
+	}
+	if p.Username != "" {
+		u.User = url.UserPassword(p.Username, p.Password)
+	}
+	return u, nil
+}
+
+// Validate validates the Proxy's configuration
+func (p *Proxy) Validate() error {
+	if p == nil || p.URL == "" {
+		if p != nil && (p.Username != "" || len(p.NoProxy) > 0) {
+			log.Warn("Proxy settings are given, but no proxy URL is set")
+		}
+		return nil
+	}
+	_, err := p.ParseURL()
+	return err
+}
+
+// Compression holds the configuration of the websocket permessage-deflate
+// compression
+// NOTE: Careful when changing this, the struct is exposed directly in the
+// 'mender-connect.conf' file.
+type Compression struct {
+	// Negotiate the compression with the server
+	Enabled bool
+	// Compression level, from -2 (Huffman only) to 9 (best compression),
+	// 0 disabling the compression of the data; nil, when the setting is
+	// omitted, selects the default level
+	Level *int
+	// Messages smaller than this many bytes are sent uncompressed
+	Threshold int
+}
+
+// Validate validates the Compression's configuration
+func (c *Compression) Validate() error {
+	if c == nil || !c.Enabled {
+		return nil
+	}
+	if c.Level != nil && (*c.Level < minCompressionLevel || *c.Level > maxCompressionLevel) {
+		return errors.Errorf("invalid compression level %d: must be between %d and %d",
+			*c.Level, minCompressionLevel, maxCompressionLevel)
+	}
+	if c.Threshold < 0 {
+		return errors.Errorf("invalid compression threshold %d: must not be negative",
+			c.Threshold)
+	}
+	return nil
+}
+
 // MenderServer is a placeholder for a full server definition used when
 // multiple servers are given. The fields corresponds to the definitions
 // given in MenderShellConfig.
@@ -50,6 +168,12 @@ type MenderServer struct {
 	ServerURL string
 }
 
+// IsPKCS11Key returns true if the private key is to be loaded from a PKCS#11
+// URI rather than from a file
+func (h *Client) IsPKCS11Key() bool {
+	return strings.HasPrefix(h.Key, pkcs11URIPrefix)
+}
+
 // Validate validates the Client's configuration
 func (h *Client) Validate() {
 	if h == nil {
@@ -61,7 +185,7 @@ func (h *Client) Validate() {
 		}
 		if h.Key == "" {
 			log.Error("The 'Certificate' field is set in the mTLS configuration, but no 'Key' is given. Both need to be present in order for mTLS to function")
-		} else if strings.HasPrefix(h.Key, pkcs11URIPrefix) && len(h.SSLEngine) == 0 {
+		} else if h.IsPKCS11Key() && len(h.SSLEngine) == 0 {
 			log.Errorf("The 'Key' field is set to be loaded from %s, but no 'SSLEngine' is given. Both need to be present in order for loading of the key to function",
 				pkcs11URIPrefix)
 		}
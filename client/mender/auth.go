@@ -15,8 +15,11 @@
 package mender
 
 import (
+	"sync"
 	"time"
 
+	log "github.com/sirupsen/logrus"
+
 	"github.com/mendersoftware/mender-connect/client/dbus"
 )
 
@@ -48,11 +51,19 @@ type AuthClient interface {
 }
 
 // AuthClientDBUS is the implementation of the client for the Mender
-// Authentication Manager which communicates using DBUS
+// Authentication Manager which communicates using DBUS; it watches the owner
+// of the name of the Authentication Manager to reconnect when the Mender
+// client restarts
 type AuthClientDBUS struct {
-	dbusAPI          dbus.DBusAPI
-	dbusConnection   dbus.Handle
+	dbusAPI dbus.DBusAPI
+
+	mutex            sync.Mutex
 	authManagerProxy dbus.Handle
+	watching         bool
+	// owner is the unique name of the current owner of objectName, set
+	// once the owner is known
+	owner      string
+	ownerKnown bool
 }
 
 // NewAuthClient returns a new AuthClient
@@ -79,14 +90,75 @@ func (a *AuthClientDBUS) Connect(objectName, objectPath, interfaceName string) e
 	if err != nil {
 		return err
 	}
-	a.dbusConnection = dbusConnection
+	a.mutex.Lock()
 	a.authManagerProxy = authManagerProxy
+	watching := a.watching
+	a.watching = true
+	a.mutex.Unlock()
+
+	if !watching {
+		_, err := a.dbusAPI.BusWatchName(dbusConnection, objectName, a.nameOwnerChanged)
+		if err != nil {
+			log.Warnf("failed to watch the D-Bus name %s, the restarts of the "+
+				"Mender client will not be detected: %s", objectName, err.Error())
+		}
+	}
 	return nil
 }
 
+// nameOwnerChanged is called when the owner of the name of the Mender
+// Authentication Manager changes; when a new owner appears, its token is
+// sent with a JwtTokenStateChange signal
+func (a *AuthClientDBUS) nameOwnerChanged(name, owner string) {
+	a.mutex.Lock()
+	previousOwner, ownerKnown := a.owner, a.ownerKnown
+	a.owner = owner
+	a.ownerKnown = true
+	a.mutex.Unlock()
+
+	if owner == "" {
+		log.Warnf("the D-Bus name %s has no owner, the Mender client is not running", name)
+		return
+	} else if !ownerKnown || owner == previousOwner {
+		return
+	}
+	log.Infof("the D-Bus name %s has a new owner %s, reconnecting", name, owner)
+	// the handler must not block
+	go a.reconnect()
+}
+
+// reconnect gets the token from the new owner of the name of the Mender
+// Authentication Manager and emits a JwtTokenStateChange signal with it. The
+// proxy is kept: it addresses the well-known name, so it follows its owner,
+// while a new proxy would add a signal handler for every restart.
+func (a *AuthClientDBUS) reconnect() {
+	token, serverURL, err := a.GetJWTToken()
+	if err != nil {
+		log.Errorf("failed to get the JWT token after reconnecting to the "+
+			"Mender Authentication Manager: %s", err.Error())
+		return
+	}
+	a.dbusAPI.HandleSignal(DBusSignalNameJwtTokenStateChange, []dbus.SignalParams{
+		{
+			ParamType: dbus.GDBusTypeString,
+			ParamData: token,
+		},
+		{
+			ParamType: dbus.GDBusTypeString,
+			ParamData: serverURL,
+		},
+	})
+}
+
+func (a *AuthClientDBUS) proxy() dbus.Handle {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.authManagerProxy
+}
+
 // GetJWTToken returns a device JWT token
 func (a *AuthClientDBUS) GetJWTToken() (string, string, error) {
-	response, err := a.dbusAPI.BusProxyCall(a.authManagerProxy, DBusMethodNameGetJwtToken, nil, DBusMethodTimeoutInMilliSeconds)
+	response, err := a.dbusAPI.BusProxyCall(a.proxy(), DBusMethodNameGetJwtToken, nil, DBusMethodTimeoutInMilliSeconds)
 	if err != nil {
 		return "", "", err
 	}
@@ -96,7 +168,7 @@ func (a *AuthClientDBUS) GetJWTToken() (string, string, error) {
 
 // FetchJWTToken schedules the fetching of a new device JWT token
 func (a *AuthClientDBUS) FetchJWTToken() (bool, error) {
-	response, err := a.dbusAPI.BusProxyCall(a.authManagerProxy, DBusMethodNameFetchJwtToken, nil, DBusMethodTimeoutInMilliSeconds)
+	response, err := a.dbusAPI.BusProxyCall(a.proxy(), DBusMethodNameFetchJwtToken, nil, DBusMethodTimeoutInMilliSeconds)
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,314 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mender
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/client/dbus"
+)
+
+// Defaults of the standalone authentication
+const (
+	DefaultTokenFilePollInterval = 5 * time.Second
+	DefaultTokenCommandTimeout   = 30 * time.Second
+)
+
+var (
+	ErrNoTokenSource       = errors.New("either a token file or a token command is required")
+	ErrTooManyTokenSources = errors.New("a token file and a token command cannot be used together")
+)
+
+// StandaloneAuthConfig configures where the standalone authentication gets
+// the JWT token and the server URL from. Both the token file and the output
+// of the token command hold a JSON object such as:
+//
+//	{"JWTToken": "...", "ServerURL": "https://hosted.mender.io"}
+type StandaloneAuthConfig struct {
+	// Path of the file holding the token
+	TokenFile string
+	// Interval between the checks of the token file for changes, and
+	// between the runs of the token command until it prints a token
+	TokenFilePollInterval time.Duration
+	// Command, and its arguments, printing the token to its standard output
+	TokenCommand []string
+	// Time allowed to the token command to complete
+	TokenCommandTimeout time.Duration
+}
+
+// standaloneToken is the content of the token file and of the output of the
+// token command
+type standaloneToken struct {
+	JWTToken  string `json:"JWTToken"`
+	ServerURL string `json:"ServerURL"`
+}
+
+// AuthClientStandalone is the implementation of the client which gets the
+// JWT token from a file or from a helper command instead of the Mender
+// Authentication Manager; it emits the same state change events as the D-Bus
+// JwtTokenStateChange signal whenever the token changes
+type AuthClientStandalone struct {
+	ctx    context.Context
+	config StandaloneAuthConfig
+
+	mutex       sync.Mutex
+	token       standaloneToken
+	watching    bool
+	stateChange chan []dbus.SignalParams
+}
+
+// NewStandaloneAuthClient returns a new AuthClient getting the JWT token
+// from a file or from a helper command; the token file is watched for
+// changes, and the token command run until it prints a token, until ctx
+// is done
+func NewStandaloneAuthClient(
+	ctx context.Context,
+	config StandaloneAuthConfig,
+) (AuthClient, error) {
+	if config.TokenFile == "" && len(config.TokenCommand) == 0 {
+		return nil, ErrNoTokenSource
+	} else if config.TokenFile != "" && len(config.TokenCommand) > 0 {
+		return nil, ErrTooManyTokenSources
+	}
+	if config.TokenFilePollInterval <= 0 {
+		config.TokenFilePollInterval = DefaultTokenFilePollInterval
+	}
+	if config.TokenCommandTimeout <= 0 {
+		config.TokenCommandTimeout = DefaultTokenCommandTimeout
+	}
+	return &AuthClientStandalone{
+		ctx:         ctx,
+		config:      config,
+		stateChange: make(chan []dbus.SignalParams, 1),
+	}, nil
+}
+
+// Connect reads the token for the first time and starts watching the token
+// file, or polling the token command if it did not print a token; the D-Bus
+// names are not used
+func (a *AuthClientStandalone) Connect(objectName, objectPath, interfaceName string) error {
+	token, err := a.load()
+	if err != nil {
+		log.Warnf("failed to get the JWT token: %s", err.Error())
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.token = token
+	if a.watching {
+		return nil
+	} else if a.config.TokenFile != "" {
+		a.watching = true
+		go a.watchTokenFile()
+	} else if token.JWTToken == "" {
+		a.watching = true
+		go a.pollTokenCommand()
+	}
+	return nil
+}
+
+// GetJWTToken returns a device JWT token
+func (a *AuthClientStandalone) GetJWTToken() (string, string, error) {
+	if len(a.config.TokenCommand) > 0 {
+		token, err := a.refresh()
+		return token.JWTToken, token.ServerURL, err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.token.JWTToken, a.token.ServerURL, nil
+}
+
+// FetchJWTToken reads the token again, emitting a state change event
+// even if the token did not change, as the Mender client does
+func (a *AuthClientStandalone) FetchJWTToken() (bool, error) {
+	token, err := a.load()
+	if err != nil {
+		return false, err
+	}
+	a.mutex.Lock()
+	a.token = token
+	a.mutex.Unlock()
+	a.emitStateChange(token)
+	return true, nil
+}
+
+// GetJwtTokenStateChangeChannel returns a channel that can be used to wait for the JwtTokenStateChange signal
+func (a *AuthClientStandalone) GetJwtTokenStateChangeChannel() chan []dbus.SignalParams {
+	return a.stateChange
+}
+
+// WaitForJwtTokenStateChange synchronously waits for the JwtTokenStateChange signal
+func (a *AuthClientStandalone) WaitForJwtTokenStateChange() ([]dbus.SignalParams, error) {
+	select {
+	case p := <-a.stateChange:
+		return p, nil
+	case <-time.After(timeout):
+		return []dbus.SignalParams{}, errors.New(
+			"timeout waiting for signal " + DBusSignalNameJwtTokenStateChange)
+	}
+}
+
+// refresh reads the token from its source, emitting a state change event
+// if it changed
+func (a *AuthClientStandalone) refresh() (standaloneToken, error) {
+	token, err := a.load()
+	if err != nil {
+		return token, err
+	}
+
+	a.mutex.Lock()
+	changed := token != a.token
+	a.token = token
+	a.mutex.Unlock()
+	if changed {
+		a.emitStateChange(token)
+	}
+	return token, nil
+}
+
+// load reads the token from its source
+func (a *AuthClientStandalone) load() (standaloneToken, error) {
+	if len(a.config.TokenCommand) > 0 {
+		return a.runTokenCommand()
+	}
+	return a.readTokenFile()
+}
+
+func (a *AuthClientStandalone) readTokenFile() (standaloneToken, error) {
+	var token standaloneToken
+	data, err := ioutil.ReadFile(a.config.TokenFile)
+	if os.IsNotExist(err) {
+		// no token yet
+		return token, nil
+	} else if err != nil {
+		return token, errors.Wrap(err, "failed to read the token file")
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return token, nil
+	}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return token, errors.Wrap(err, "failed to parse the token file")
+	}
+	return token, nil
+}
+
+func (a *AuthClientStandalone) runTokenCommand() (standaloneToken, error) {
+	var token standaloneToken
+	ctx, cancel := context.WithTimeout(a.ctx, a.config.TokenCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, a.config.TokenCommand[0], a.config.TokenCommand[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return token, errors.Wrapf(err, "the token command failed: %s",
+			bytes.TrimSpace(stderr.Bytes()))
+	}
+	if err := json.Unmarshal(output, &token); err != nil {
+		return token, errors.Wrap(err, "failed to parse the output of the token command")
+	}
+	return token, nil
+}
+
+// watchTokenFile checks the token file for changes until the context is
+// done
+func (a *AuthClientStandalone) watchTokenFile() {
+	var lastModTime time.Time
+	var lastSize int64 = -1
+	ticker := time.NewTicker(a.config.TokenFilePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.ctx.Done():
+			return
+		}
+
+		var modTime time.Time
+		var size int64 = -1
+		if info, err := os.Stat(a.config.TokenFile); err == nil {
+			modTime, size = info.ModTime(), info.Size()
+		}
+		if modTime.Equal(lastModTime) && size == lastSize {
+			continue
+		}
+		lastModTime, lastSize = modTime, size
+		if _, err := a.refresh(); err != nil {
+			log.Warnf("failed to get the JWT token: %s", err.Error())
+		}
+	}
+}
+
+// pollTokenCommand runs the token command until it prints a token, which
+// is emitted as a state change event, or until the context is done
+func (a *AuthClientStandalone) pollTokenCommand() {
+	defer func() {
+		a.mutex.Lock()
+		a.watching = false
+		a.mutex.Unlock()
+	}()
+	ticker := time.NewTicker(a.config.TokenFilePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.ctx.Done():
+			return
+		}
+
+		token, err := a.refresh()
+		if err != nil {
+			log.Warnf("failed to get the JWT token: %s", err.Error())
+		} else if token.JWTToken != "" {
+			return
+		}
+	}
+}
+
+// emitStateChange queues the state change event, replacing the one not yet
+// consumed, if any
+func (a *AuthClientStandalone) emitStateChange(token standaloneToken) {
+	params := []dbus.SignalParams{
+		{
+			ParamType: dbus.GDBusTypeString,
+			ParamData: token.JWTToken,
+		},
+		{
+			ParamType: dbus.GDBusTypeString,
+			ParamData: token.ServerURL,
+		},
+	}
+	for {
+		select {
+		case a.stateChange <- params:
+			return
+		default:
+		}
+		select {
+		case <-a.stateChange:
+		default:
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mender
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/client/dbus"
+)
+
+func tokenSignal(token, serverURL string) []dbus.SignalParams {
+	return []dbus.SignalParams{
+		{ParamType: dbus.GDBusTypeString, ParamData: token},
+		{ParamType: dbus.GDBusTypeString, ParamData: serverURL},
+	}
+}
+
+func TestNewStandaloneAuthClient(t *testing.T) {
+	testCases := map[string]struct {
+		config StandaloneAuthConfig
+		err    error
+	}{
+		"ok, token file": {
+			config: StandaloneAuthConfig{TokenFile: "/run/token.json"},
+		},
+		"ok, token command": {
+			config: StandaloneAuthConfig{TokenCommand: []string{"get-token"}},
+		},
+		"error, no token source": {
+			err: ErrNoTokenSource,
+		},
+		"error, both token sources": {
+			config: StandaloneAuthConfig{
+				TokenFile:    "/run/token.json",
+				TokenCommand: []string{"get-token"},
+			},
+			err: ErrTooManyTokenSources,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			client, err := NewStandaloneAuthClient(context.Background(), tc.config)
+			if tc.err != nil {
+				assert.Equal(t, tc.err, err)
+				assert.Nil(t, client)
+			} else {
+				assert.NoError(t, err)
+				assert.NotNil(t, client)
+			}
+		})
+	}
+}
+
+func TestStandaloneAuthClientTokenFile(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	tokenFile := path.Join(tdir, "token.json")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := NewStandaloneAuthClient(ctx, StandaloneAuthConfig{
+		TokenFile:             tokenFile,
+		TokenFilePollInterval: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	// no token yet
+	err = client.Connect(DBusObjectName, DBusObjectPath, DBusInterfaceName)
+	assert.NoError(t, err)
+	token, serverURL, err := client.GetJWTToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "", token)
+	assert.Equal(t, "", serverURL)
+
+	// the token file is created
+	err = ioutil.WriteFile(tokenFile,
+		[]byte(`{"JWTToken": "token-1", "ServerURL": "https://hosted.mender.io"}`), 0600)
+	assert.NoError(t, err)
+	select {
+	case p := <-client.GetJwtTokenStateChangeChannel():
+		assert.Equal(t, tokenSignal("token-1", "https://hosted.mender.io"), p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no state change after creating the token file")
+	}
+	token, serverURL, err = client.GetJWTToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+	assert.Equal(t, "https://hosted.mender.io", serverURL)
+
+	// the token changes
+	err = ioutil.WriteFile(tokenFile,
+		[]byte(`{"JWTToken": "token-2", "ServerURL": "https://eu.hosted.mender.io"}`), 0600)
+	assert.NoError(t, err)
+	p, err := client.WaitForJwtTokenStateChange()
+	assert.NoError(t, err)
+	assert.Equal(t, tokenSignal("token-2", "https://eu.hosted.mender.io"), p)
+
+	// fetching emits a state change even if the token did not change
+	fetched, err := client.FetchJWTToken()
+	assert.NoError(t, err)
+	assert.True(t, fetched)
+	p, err = client.WaitForJwtTokenStateChange()
+	assert.NoError(t, err)
+	assert.Equal(t, tokenSignal("token-2", "https://eu.hosted.mender.io"), p)
+
+	// the token file is removed
+	err = os.Remove(tokenFile)
+	assert.NoError(t, err)
+	p, err = client.WaitForJwtTokenStateChange()
+	assert.NoError(t, err)
+	assert.Equal(t, tokenSignal("", ""), p)
+
+	// invalid content
+	err = ioutil.WriteFile(tokenFile, []byte(`token`), 0600)
+	assert.NoError(t, err)
+	_, err = client.FetchJWTToken()
+	assert.Error(t, err)
+}
+
+func TestStandaloneAuthClientTokenCommand(t *testing.T) {
+	testCases := map[string]struct {
+		command   []string
+		token     string
+		serverURL string
+		err       string
+	}{
+		"ok": {
+			command: []string{"sh", "-c",
+				`echo '{"JWTToken": "token", "ServerURL": "https://hosted.mender.io"}'`},
+			token:     "token",
+			serverURL: "https://hosted.mender.io",
+		},
+		"error, command failed": {
+			command: []string{"sh", "-c", "echo 'not authorized' >&2; exit 1"},
+			err:     "the token command failed: not authorized: exit status 1",
+		},
+		"error, invalid output": {
+			command: []string{"echo", "token"},
+			err:     "failed to parse the output of the token command",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			client, err := NewStandaloneAuthClient(ctx, StandaloneAuthConfig{
+				TokenCommand: tc.command,
+			})
+			assert.NoError(t, err)
+			err = client.Connect(DBusObjectName, DBusObjectPath, DBusInterfaceName)
+			assert.NoError(t, err)
+
+			token, serverURL, err := client.GetJWTToken()
+			if tc.err != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tc.err)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.token, token)
+			assert.Equal(t, tc.serverURL, serverURL)
+
+			fetched, err := client.FetchJWTToken()
+			assert.NoError(t, err)
+			assert.True(t, fetched)
+			p, err := client.WaitForJwtTokenStateChange()
+			assert.NoError(t, err)
+			assert.Equal(t, tokenSignal(tc.token, tc.serverURL), p)
+		})
+	}
+}
+
+func TestStandaloneAuthClientTokenCommandRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-connect-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	authorized := path.Join(dir, "authorized")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := NewStandaloneAuthClient(ctx, StandaloneAuthConfig{
+		TokenCommand: []string{"sh", "-c", "test -f " + authorized + ` || exit 1; ` +
+			`echo '{"JWTToken": "token", "ServerURL": "https://hosted.mender.io"}'`},
+		TokenFilePollInterval: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	// the command fails at first
+	err = client.Connect(DBusObjectName, DBusObjectPath, DBusInterfaceName)
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case p := <-client.GetJwtTokenStateChangeChannel():
+		t.Fatalf("unexpected state change: %v", p)
+	default:
+	}
+
+	// and succeeds later on, without being asked for the token
+	err = ioutil.WriteFile(authorized, nil, 0600)
+	assert.NoError(t, err)
+	select {
+	case p := <-client.GetJwtTokenStateChangeChannel():
+		assert.Equal(t, tokenSignal("token", "https://hosted.mender.io"), p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the token state change")
+	}
+}
@@ -17,8 +17,10 @@ package mender
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 
 	"github.com/mendersoftware/mender-connect/client/dbus"
 	dbus_mocks "github.com/mendersoftware/mender-connect/client/dbus/mocks"
@@ -45,11 +47,17 @@ func TestAuthClientConnect(t *testing.T) {
 		busGetError      error
 		busProxyNew      dbus.Handle
 		busProxyNewError error
+		busWatchNameErr  error
 	}{
 		"ok": {
 			busGet:      dbus.Handle(nil),
 			busProxyNew: dbus.Handle(nil),
 		},
+		"ok, error BusWatchName": {
+			busGet:          dbus.Handle(nil),
+			busProxyNew:     dbus.Handle(nil),
+			busWatchNameErr: errors.New("error"),
+		},
 		"error BusGet": {
 			busGet:      dbus.Handle(nil),
 			busGetError: errors.New("error"),
@@ -79,6 +87,13 @@ func TestAuthClientConnect(t *testing.T) {
 					DBusInterfaceName,
 				).Return(tc.busProxyNew, tc.busProxyNewError)
 			}
+			if tc.busGetError == nil && tc.busProxyNewError == nil {
+				dbusAPI.On("BusWatchName",
+					tc.busGet,
+					DBusObjectName,
+					mock.AnythingOfType("dbus.NameOwnerHandler"),
+				).Return(uint(1), tc.busWatchNameErr)
+			}
 
 			client, err := NewAuthClient(dbusAPI)
 			assert.NoError(t, err)
@@ -96,6 +111,71 @@ func TestAuthClientConnect(t *testing.T) {
 	}
 }
 
+func TestAuthClientNameOwnerChanged(t *testing.T) {
+	const (
+		token     = "token"
+		serverURL = "https://hosted.mender.io"
+	)
+
+	response := &dbus_mocks.DBusCallResponse{}
+	defer response.AssertExpectations(t)
+	response.On("GetTwoStrings").Return(token, serverURL)
+
+	dbusAPI := &dbus_mocks.DBusAPI{}
+	defer dbusAPI.AssertExpectations(t)
+	dbusAPI.On("BusGet", uint(dbus.GBusTypeSystem)).Return(dbus.Handle(nil), nil)
+	dbusAPI.On("BusProxyNew",
+		dbus.Handle(nil),
+		DBusObjectName,
+		DBusObjectPath,
+		DBusInterfaceName,
+	).Return(dbus.Handle(nil), nil).Once()
+	var handler dbus.NameOwnerHandler
+	dbusAPI.On("BusWatchName",
+		dbus.Handle(nil),
+		DBusObjectName,
+		mock.AnythingOfType("dbus.NameOwnerHandler"),
+	).Run(func(args mock.Arguments) {
+		handler = args.Get(2).(dbus.NameOwnerHandler)
+	}).Return(uint(1), nil).Once()
+	dbusAPI.On("BusProxyCall",
+		dbus.Handle(nil),
+		DBusMethodNameGetJwtToken,
+		nil,
+		DBusMethodTimeoutInMilliSeconds,
+	).Return(response, nil).Once()
+	signal := make(chan []dbus.SignalParams, 1)
+	dbusAPI.On("HandleSignal",
+		DBusSignalNameJwtTokenStateChange,
+		mock.AnythingOfType("[]dbus.SignalParams"),
+	).Run(func(args mock.Arguments) {
+		signal <- args.Get(1).([]dbus.SignalParams)
+	}).Once()
+
+	client, err := NewAuthClient(dbusAPI)
+	assert.NoError(t, err)
+	err = client.Connect(DBusObjectName, DBusObjectPath, DBusInterfaceName)
+	assert.NoError(t, err)
+	if !assert.NotNil(t, handler) {
+		return
+	}
+
+	// the current owner, and the Mender client stopping
+	handler(DBusObjectName, ":1.1")
+	handler(DBusObjectName, "")
+	// the Mender client restarting
+	handler(DBusObjectName, ":1.2")
+	select {
+	case params := <-signal:
+		assert.Equal(t, []dbus.SignalParams{
+			{ParamType: dbus.GDBusTypeString, ParamData: token},
+			{ParamType: dbus.GDBusTypeString, ParamData: serverURL},
+		}, params)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the JwtTokenStateChange signal")
+	}
+}
+
 func TestAuthClientGetJWTToken(t *testing.T) {
 	const JWTTokenValue = "value"
 
@@ -27,6 +27,8 @@ import (
 	"strings"
 
 	"github.com/mendersoftware/mender-connect/client/https"
+	"github.com/mendersoftware/mender-connect/metrics"
+	"github.com/mendersoftware/mender-connect/utils"
 )
 
 const httpsSchema = "https"
@@ -36,6 +38,46 @@ type TerminalConfig struct {
 	Height uint16
 	// Disable remote terminal
 	Disable bool
+	// Recording of the terminal sessions
+	Recording RecordingConfig `json:"Recording"`
+	// Sharing of the shells with other sessions
+	Sharing SharingConfig `json:"Sharing"`
+}
+
+// SharingConfig holds the settings of the shells shared with other
+// sessions, attached to them as read-only observers or as writers
+type SharingConfig struct {
+	// Enable attaching other sessions to the running shells
+	Enable bool
+	// Let the attached sessions write to the shells, not only observe them
+	AllowWriters bool
+	// Maximum number of sessions attached to a shell; defaults to
+	// DefaultSharingMaxPeers
+	MaxPeers uint32
+	// IDs of the users allowed to attach to the shells of the other users;
+	// the others can only attach to their own shells
+	AllowedUsers []string
+}
+
+// RecordingConfig holds the settings of the recordings of the terminal
+// sessions, stored in asciicast v2 files which can be downloaded with the
+// file transfer
+type RecordingConfig struct {
+	// Enable the recording of the output of the terminal sessions; the
+	// shells do not start if they cannot be recorded
+	Enable bool
+	// Record the input too, including any password typed
+	RecordInput bool
+	// Directory of the recordings; defaults to DefaultRecordingDir
+	Dir string
+	// Size in megabytes a recording stops at; defaults to
+	// DefaultRecordingMaxFileSizeMB
+	MaxFileSizeMB int
+	// Total size in megabytes of the recordings kept, the oldest are
+	// removed first; defaults to DefaultRecordingMaxTotalSizeMB
+	MaxTotalSizeMB int
+	// Days the recordings are kept; 0 keeps them up to MaxTotalSizeMB
+	RetentionDays int
 }
 
 type MenderClientConfig struct {
@@ -62,6 +104,152 @@ type SessionsConfig struct {
 	ExpireAfterIdle uint32
 	// Max sessions per user
 	MaxPerUser uint32
+	// Seconds a shell session is kept alive after losing its client, to be
+	// reattached to; 0 disables reattaching
+	ReattachGracePeriod uint32
+	// Size in bytes of the recent output of a shell session replayed on
+	// reattach; defaults to DefaultScrollbackSize
+	ScrollbackSize uint32
+}
+
+// ReconnectBackoffConfig holds the configuration of the delays between
+// the attempts to reconnect to the server. The delay before the n-th
+// retry is a random value between zero and
+// min(MaxIntervalSeconds, ReconnectIntervalSeconds * Multiplier^(n-1)):
+// with the defaults, the first retry comes within 5 seconds and the
+// following ones within up to 5 minutes, where mender-connect used to wait
+// ReconnectIntervalSeconds between all the attempts.
+type ReconnectBackoffConfig struct {
+	// Maximum delay between reconnect attempts, in seconds
+	MaxIntervalSeconds int
+	// Factor the delay grows by after every failed attempt
+	Multiplier float64
+	// Seconds a connection must stay up for the backoff to be reset
+	StablePeriodSeconds int
+	// Consecutive failed attempts after which reconnecting is suspended;
+	// zero, the default, disables the circuit breaker
+	CircuitBreakerThreshold int
+	// Seconds reconnecting is suspended for once the circuit breaker opens,
+	// before one attempt probes the servers
+	CircuitBreakerCooldownSeconds int
+}
+
+// ConnectionConfig holds the transport settings of the websocket connection
+// to the server
+type ConnectionConfig struct {
+	// Maximum size of the messages the server can send, in bytes
+	MaxMessageSize int64
+	// Maximum size of the messages sent to the server, in bytes; the file
+	// transfer and port forward data is split in chunks fitting in it. It
+	// must not exceed the limit the server sets on the messages it reads.
+	MaxOutboundMessageSize int64
+	// Seconds allowed to write a message to the server
+	WriteTimeoutSeconds int
+	// Seconds allowed between two messages or pongs from the server before
+	// the connection is considered lost; pings are sent at 9/10 of it
+	PingWaitSeconds int
+}
+
+// DBusServiceConfig holds the settings of the io.mender.Connect1 D-Bus
+// service, through which local applications follow the remote sessions
+type DBusServiceConfig struct {
+	// Disable the D-Bus service
+	Disable bool
+}
+
+// ControlSocketConfig holds the settings of the local control socket,
+// through which the mender-connect commands inspect and control the daemon
+type ControlSocketConfig struct {
+	// Disable the control socket
+	Disable bool
+	// Path of the socket; defaults to DefaultControlSocketPath
+	Path string
+	// Group whose members may use the socket, besides root
+	Group string
+}
+
+// MetricsConfig holds the settings of the metrics endpoint, from which
+// Prometheus scrapes the telemetry of the daemon
+type MetricsConfig struct {
+	// Enable the metrics endpoint
+	Enable bool
+	// Address to listen on, either host:port on the loopback interface
+	// or the path of a Unix socket; defaults to DefaultMetricsAddress
+	Address string
+}
+
+// Log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Log destinations
+const (
+	LogDestinationStderr   = "stderr"
+	LogDestinationJournald = "journald"
+	LogDestinationSyslog   = "syslog"
+	LogDestinationFile     = "file"
+)
+
+// LogConfig holds the settings of the log output of the daemon
+type LogConfig struct {
+	// Format of the log entries, "text" or "json"; defaults to text. The
+	// journald destination stores the fields of the entries natively.
+	Format string
+	// Destination of the log entries, "stderr", "journald", "syslog" or
+	// "file"; defaults to stderr
+	Destination string
+	// Path of the socket of the syslog daemon; defaults to the local one
+	SyslogSocket string
+	// Path of the log file, required by the file destination
+	File string
+	// Size in megabytes the log file is rotated at; defaults to
+	// DefaultLogFileMaxSizeMB
+	FileMaxSizeMB int
+	// Number of rotated log files kept; defaults to DefaultLogFileMaxBackups
+	FileMaxBackups int
+}
+
+// AuditConfig holds the settings of the audit log, which records the
+// remote access activity in an append-only, hash-chained file
+type AuditConfig struct {
+	// Enable the audit log; mender-connect does not start if it cannot
+	// append to it
+	Enable bool
+	// Path of the audit log; defaults to DefaultAuditFile
+	File string
+	// Size in megabytes the audit log is rotated at; defaults to
+	// DefaultAuditFileMaxSizeMB
+	FileMaxSizeMB int
+	// Number of rotated audit logs kept; defaults to
+	// DefaultAuditFileMaxBackups
+	FileMaxBackups int
+}
+
+// Authentication modes
+const (
+	AuthModeDBus       = "dbus"
+	AuthModeStandalone = "standalone"
+)
+
+// AuthConfig holds the settings of the device authentication
+type AuthConfig struct {
+	// Where the JWT token comes from: "dbus", the default, to get it from
+	// the Mender Authentication Manager, or "standalone" to get it from
+	// TokenFile or from the output of TokenCommand
+	Mode string
+	// File holding the JWT token and the server URL, as a JSON object with
+	// the JWTToken and ServerURL keys
+	TokenFile string
+	// Seconds between the checks of TokenFile for changes, and between the
+	// runs of TokenCommand until it prints a token
+	TokenFilePollIntervalSeconds int
+	// Command, and its arguments, printing the JWT token and the server URL
+	// in the same format as TokenFile
+	TokenCommand []string
+	// Seconds allowed to TokenCommand to complete
+	TokenCommandTimeoutSeconds int
 }
 
 // Counter for the limits  and restrictions for the File Transfer
@@ -121,10 +309,16 @@ type MenderShellConfigFromFile struct {
 	ClientProtocol string
 	// HTTPS client parameters
 	HTTPSClient https.Client `json:"HttpsClient"`
+	// Proxy to reach the server through
+	Proxy https.Proxy `json:"Proxy"`
+	// Websocket compression settings
+	Compression https.Compression `json:"Compression"`
 	// Skip CA certificate validation
 	SkipVerify bool
 	// Path to server SSL certificate
 	ServerCertificate string
+	// SHA-256 hashes of the public keys to pin the server certificate to
+	ServerPublicKeyPins []string
 	// Server URL (For single server conf)
 	ServerURL string
 	// List of available servers, to which client can fall over
@@ -139,8 +333,30 @@ type MenderShellConfigFromFile struct {
 	Sessions SessionsConfig `json:"Sessions"`
 	// Limits and restrictions
 	Limits Limits `json:"Limits"`
-	// Reconnect interval
+	// Reconnect interval, the upper bound of the delay before the first
+	// retry, which grows as set in ReconnectBackoff
 	ReconnectIntervalSeconds int
+	// Reconnect backoff and circuit breaker settings
+	ReconnectBackoff ReconnectBackoffConfig `json:"ReconnectBackoff"`
+	// Websocket transport limits
+	Connection ConnectionConfig `json:"Connection"`
+	// Seconds allowed to the sessions to close gracefully on shutdown
+	ShutdownTimeoutSeconds int
+	// Device authentication settings
+	Authentication AuthConfig `json:"Authentication"`
+	// D-Bus API implementation, "libgio" or "native"; defaults to libgio
+	// if mender-connect is built with it, to the native one otherwise
+	DBusAPI string `json:"DBusAPI"`
+	// D-Bus service settings
+	DBusService DBusServiceConfig `json:"DBusService"`
+	// Control socket settings
+	ControlSocket ControlSocketConfig `json:"ControlSocket"`
+	// Metrics endpoint settings
+	Metrics MetricsConfig `json:"Metrics"`
+	// Log output settings
+	Log LogConfig `json:"Log"`
+	// Audit log settings
+	Audit AuditConfig `json:"Audit"`
 	// FileTransfer config
 	FileTransfer FileTransferConfig
 	// PortForward config
@@ -301,6 +517,21 @@ func (c *MenderShellConfig) Validate() (err error) {
 		c.Terminal.Height = DefaultTerminalHeight
 	}
 
+	if err := c.Terminal.Recording.validate(); err != nil {
+		log.Errorf("In mender-connect.conf: %s", err.Error())
+		return err
+	}
+	if c.Terminal.Sharing.MaxPeers == 0 {
+		c.Terminal.Sharing.MaxPeers = DefaultSharingMaxPeers
+	}
+
+	if c.Terminal.Recording.Enable && c.Limits.Enabled &&
+		!utils.IsInChroot(c.Terminal.Recording.Dir, c.Limits.FileTransfer.Chroot) {
+		log.Warnf("the recordings in %s cannot be downloaded: "+
+			"the directory is outside of the file transfer chroot %s",
+			c.Terminal.Recording.Dir, c.Limits.FileTransfer.Chroot)
+	}
+
 	if !c.Sessions.StopExpired {
 		c.Sessions.ExpireAfter = 0
 		c.Sessions.ExpireAfterIdle = 0
@@ -310,12 +541,120 @@ func (c *MenderShellConfig) Validate() (err error) {
 		}
 	}
 
+	if c.Sessions.ScrollbackSize == 0 {
+		c.Sessions.ScrollbackSize = DefaultScrollbackSize
+	}
+
 	if c.ReconnectIntervalSeconds == 0 {
 		c.ReconnectIntervalSeconds = DefaultReconnectIntervalsSeconds
 	}
 
+	if c.ReconnectBackoff.MaxIntervalSeconds == 0 {
+		c.ReconnectBackoff.MaxIntervalSeconds = DefaultReconnectMaxIntervalSeconds
+	}
+	if c.ReconnectBackoff.MaxIntervalSeconds < c.ReconnectIntervalSeconds {
+		log.Warnf("ReconnectBackoff.MaxIntervalSeconds is lower than ReconnectIntervalSeconds; "+
+			"using %d", c.ReconnectIntervalSeconds)
+		c.ReconnectBackoff.MaxIntervalSeconds = c.ReconnectIntervalSeconds
+	}
+	if c.ReconnectBackoff.Multiplier == 0 {
+		c.ReconnectBackoff.Multiplier = DefaultReconnectMultiplier
+	} else if c.ReconnectBackoff.Multiplier < 1 {
+		return errors.New("ReconnectBackoff.Multiplier must not be lower than 1")
+	}
+	if c.ReconnectBackoff.StablePeriodSeconds == 0 {
+		c.ReconnectBackoff.StablePeriodSeconds = DefaultReconnectStablePeriodSeconds
+	} else if c.ReconnectBackoff.StablePeriodSeconds < 0 {
+		return errors.New("ReconnectBackoff.StablePeriodSeconds must not be negative")
+	}
+	if c.ReconnectBackoff.CircuitBreakerThreshold < 0 {
+		return errors.New("ReconnectBackoff.CircuitBreakerThreshold must not be negative")
+	}
+	if c.ReconnectBackoff.CircuitBreakerCooldownSeconds == 0 {
+		c.ReconnectBackoff.CircuitBreakerCooldownSeconds = DefaultCircuitBreakerCooldownSeconds
+	} else if c.ReconnectBackoff.CircuitBreakerCooldownSeconds < 0 {
+		return errors.New("ReconnectBackoff.CircuitBreakerCooldownSeconds must not be negative")
+	}
+
+	if c.Connection.MaxMessageSize == 0 {
+		c.Connection.MaxMessageSize = DefaultMaxMessageSize
+	} else if c.Connection.MaxMessageSize < MinMaxMessageSize ||
+		c.Connection.MaxMessageSize > MaxMaxMessageSize {
+		return errors.Errorf("Connection.MaxMessageSize must be between %d and %d bytes",
+			MinMaxMessageSize, MaxMaxMessageSize)
+	}
+	if c.Connection.MaxOutboundMessageSize == 0 {
+		c.Connection.MaxOutboundMessageSize = DefaultMaxMessageSize
+	} else if c.Connection.MaxOutboundMessageSize < MinMaxMessageSize ||
+		c.Connection.MaxOutboundMessageSize > MaxMaxMessageSize {
+		return errors.Errorf("Connection.MaxOutboundMessageSize must be between %d and %d bytes",
+			MinMaxMessageSize, MaxMaxMessageSize)
+	}
+	if c.Connection.WriteTimeoutSeconds == 0 {
+		c.Connection.WriteTimeoutSeconds = DefaultWriteTimeoutSeconds
+	} else if c.Connection.WriteTimeoutSeconds < 0 {
+		return errors.New("Connection.WriteTimeoutSeconds must not be negative")
+	}
+	if c.Connection.PingWaitSeconds == 0 {
+		c.Connection.PingWaitSeconds = DefaultPingWaitSeconds
+	} else if c.Connection.PingWaitSeconds < 0 {
+		return errors.New("Connection.PingWaitSeconds must not be negative")
+	}
+	if c.Connection.PingWaitSeconds <= c.Connection.WriteTimeoutSeconds {
+		return errors.New("Connection.PingWaitSeconds must be greater than " +
+			"Connection.WriteTimeoutSeconds")
+	}
+
+	if c.ShutdownTimeoutSeconds == 0 {
+		c.ShutdownTimeoutSeconds = DefaultShutdownTimeoutSeconds
+	} else if c.ShutdownTimeoutSeconds < 0 {
+		return errors.New("ShutdownTimeoutSeconds must not be negative")
+	}
+
+	if err := c.Authentication.validate(); err != nil {
+		log.Errorf("In mender-connect.conf: %s", err.Error())
+		return err
+	}
+
+	if err := c.ControlSocket.validate(); err != nil {
+		log.Errorf("In mender-connect.conf: %s", err.Error())
+		return err
+	}
+
+	if err := c.Metrics.validate(); err != nil {
+		log.Errorf("In mender-connect.conf: %s", err.Error())
+		return err
+	}
+
+	if err := c.Log.validate(); err != nil {
+		log.Errorf("In mender-connect.conf: %s", err.Error())
+		return err
+	}
+
+	if err := c.Audit.validate(); err != nil {
+		log.Errorf("In mender-connect.conf: %s", err.Error())
+		return err
+	}
+
 	c.HTTPSClient.Validate()
 
+	for _, pin := range c.ServerPublicKeyPins {
+		if _, err := https.ParsePublicKeyPin(pin); err != nil {
+			log.Errorf("In mender-connect.conf: %s", err.Error())
+			return err
+		}
+	}
+
+	if err := c.Proxy.Validate(); err != nil {
+		log.Errorf("In mender-connect.conf: %s", err.Error())
+		return err
+	}
+
+	if err := c.Compression.Validate(); err != nil {
+		log.Errorf("In mender-connect.conf: %s", err.Error())
+		return err
+	}
+
 	// permit by default, probably will be changed after integration test is modified
 	c.Limits.FileTransfer.PreserveMode = true
 	c.Limits.FileTransfer.PreserveOwner = true
@@ -324,6 +663,143 @@ func (c *MenderShellConfig) Validate() (err error) {
 	return nil
 }
 
+func (c *AuthConfig) validate() error {
+	switch c.Mode {
+	case "":
+		c.Mode = AuthModeDBus
+	case AuthModeDBus:
+	case AuthModeStandalone:
+		if c.TokenFile == "" && len(c.TokenCommand) == 0 {
+			return errors.New("Authentication.TokenFile or Authentication.TokenCommand " +
+				"is required in the standalone mode")
+		} else if c.TokenFile != "" && len(c.TokenCommand) > 0 {
+			return errors.New("Authentication.TokenFile and Authentication.TokenCommand " +
+				"cannot be used together")
+		}
+	default:
+		return errors.Errorf("unknown Authentication.Mode %q", c.Mode)
+	}
+	if c.TokenFilePollIntervalSeconds == 0 {
+		c.TokenFilePollIntervalSeconds = DefaultTokenFilePollIntervalSeconds
+	} else if c.TokenFilePollIntervalSeconds < 0 {
+		return errors.New("Authentication.TokenFilePollIntervalSeconds must not be negative")
+	}
+	if c.TokenCommandTimeoutSeconds == 0 {
+		c.TokenCommandTimeoutSeconds = DefaultTokenCommandTimeoutSeconds
+	} else if c.TokenCommandTimeoutSeconds < 0 {
+		return errors.New("Authentication.TokenCommandTimeoutSeconds must not be negative")
+	}
+	return nil
+}
+
+func (c *ControlSocketConfig) validate() error {
+	if c.Path == "" {
+		c.Path = DefaultControlSocketPath
+	} else if !filepath.IsAbs(c.Path) {
+		return errors.Errorf("ControlSocket.Path %q is not an absolute path", c.Path)
+	}
+	if c.Group != "" {
+		if _, err := user.LookupGroup(c.Group); err != nil {
+			return errors.Wrap(err, "ControlSocket.Group")
+		}
+	}
+	return nil
+}
+
+func (c *MetricsConfig) validate() error {
+	if !c.Enable {
+		return nil
+	}
+	if c.Address == "" {
+		c.Address = DefaultMetricsAddress
+	} else if !filepath.IsAbs(c.Address) {
+		if err := metrics.CheckLoopbackAddress(c.Address); err != nil {
+			return errors.Wrap(err, "Metrics.Address")
+		}
+	}
+	return nil
+}
+
+func (c *LogConfig) validate() error {
+	switch c.Format {
+	case "":
+		c.Format = LogFormatText
+	case LogFormatText, LogFormatJSON:
+	default:
+		return errors.Errorf("unknown Log.Format %q", c.Format)
+	}
+	switch c.Destination {
+	case "":
+		c.Destination = LogDestinationStderr
+	case LogDestinationStderr, LogDestinationJournald:
+	case LogDestinationSyslog:
+		if c.SyslogSocket != "" && !filepath.IsAbs(c.SyslogSocket) {
+			return errors.Errorf("Log.SyslogSocket %q is not an absolute path",
+				c.SyslogSocket)
+		}
+	case LogDestinationFile:
+		if c.File == "" {
+			return errors.New("Log.File is required by the file destination")
+		} else if !filepath.IsAbs(c.File) {
+			return errors.Errorf("Log.File %q is not an absolute path", c.File)
+		}
+		if c.FileMaxSizeMB == 0 {
+			c.FileMaxSizeMB = DefaultLogFileMaxSizeMB
+		} else if c.FileMaxSizeMB < 0 {
+			return errors.New("Log.FileMaxSizeMB must not be negative")
+		}
+		if c.FileMaxBackups == 0 {
+			c.FileMaxBackups = DefaultLogFileMaxBackups
+		} else if c.FileMaxBackups < 0 {
+			return errors.New("Log.FileMaxBackups must not be negative")
+		}
+	default:
+		return errors.Errorf("unknown Log.Destination %q", c.Destination)
+	}
+	return nil
+}
+
+func (c *RecordingConfig) validate() error {
+	if c.Dir == "" {
+		c.Dir = DefaultRecordingDir
+	} else if !filepath.IsAbs(c.Dir) {
+		return errors.Errorf("Terminal.Recording.Dir %q is not an absolute path", c.Dir)
+	}
+	if c.MaxFileSizeMB == 0 {
+		c.MaxFileSizeMB = DefaultRecordingMaxFileSizeMB
+	} else if c.MaxFileSizeMB < 0 {
+		return errors.New("Terminal.Recording.MaxFileSizeMB must not be negative")
+	}
+	if c.MaxTotalSizeMB == 0 {
+		c.MaxTotalSizeMB = DefaultRecordingMaxTotalSizeMB
+	} else if c.MaxTotalSizeMB < 0 {
+		return errors.New("Terminal.Recording.MaxTotalSizeMB must not be negative")
+	}
+	if c.RetentionDays < 0 {
+		return errors.New("Terminal.Recording.RetentionDays must not be negative")
+	}
+	return nil
+}
+
+func (c *AuditConfig) validate() error {
+	if c.File == "" {
+		c.File = DefaultAuditFile
+	} else if !filepath.IsAbs(c.File) {
+		return errors.Errorf("Audit.File %q is not an absolute path", c.File)
+	}
+	if c.FileMaxSizeMB == 0 {
+		c.FileMaxSizeMB = DefaultAuditFileMaxSizeMB
+	} else if c.FileMaxSizeMB < 0 {
+		return errors.New("Audit.FileMaxSizeMB must not be negative")
+	}
+	if c.FileMaxBackups == 0 {
+		c.FileMaxBackups = DefaultAuditFileMaxBackups
+	} else if c.FileMaxBackups < 0 {
+		return errors.New("Audit.FileMaxBackups must not be negative")
+	}
+	return nil
+}
+
 func loadConfigFile(configFile string, config *MenderShellConfig, filesLoadedCount *int) error {
 	// Do not treat a single config file not existing as an error here.
 	// It is up to the caller to fail when both config files don't exist.
@@ -371,12 +847,32 @@ func maybeHTTPSClient(c *MenderShellConfig) *https.Client {
 	return nil
 }
 
+// maybeProxy returns the Proxy config only when the proxy URL is provided
+func maybeProxy(c *MenderShellConfig) *https.Proxy {
+	if c.Proxy.URL != "" {
+		return &c.Proxy
+	}
+	return nil
+}
+
+// maybeCompression returns the Compression config only when compression is
+// enabled
+func maybeCompression(c *MenderShellConfig) *https.Compression {
+	if c.Compression.Enabled {
+		return &c.Compression
+	}
+	return nil
+}
+
 // GetHTTPConfig returns the configuration for the HTTP client
 func (c *MenderShellConfig) GetHTTPConfig() https.Config {
 	return https.Config{
-		ServerCert: c.ServerCertificate,
-		IsHTTPS:    c.ClientProtocol == httpsSchema,
-		Client:     maybeHTTPSClient(c),
-		NoVerify:   c.SkipVerify,
+		ServerCert:    c.ServerCertificate,
+		IsHTTPS:       c.ClientProtocol == httpsSchema,
+		Client:        maybeHTTPSClient(c),
+		NoVerify:      c.SkipVerify,
+		PublicKeyPins: c.ServerPublicKeyPins,
+		Proxy:         maybeProxy(c),
+		Compression:   maybeCompression(c),
 	}
 }
@@ -0,0 +1,57 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// ChangedSettings returns the names of the settings of the configuration
+// file which differ between the two configurations, as the dotted paths of
+// the settings in the file, e.g. Limits.FileTransfer.MaxFileSize
+func ChangedSettings(oldConfig, newConfig *MenderShellConfig) []string {
+	return changedFields("",
+		reflect.ValueOf(oldConfig.MenderShellConfigFromFile),
+		reflect.ValueOf(newConfig.MenderShellConfigFromFile),
+		nil)
+}
+
+func changedFields(prefix string, oldValue, newValue reflect.Value, changed []string) []string {
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		name := prefix + settingName(field)
+		oldField, newField := oldValue.Field(i), newValue.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			changed = changedFields(name+".", oldField, newField, changed)
+		} else if !reflect.DeepEqual(oldField.Interface(), newField.Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// settingName returns the name of the setting in the configuration file
+func settingName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
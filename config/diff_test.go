@@ -0,0 +1,47 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangedSettings(t *testing.T) {
+	oldConfig := NewMenderShellConfig()
+	oldConfig.ServerURL = "https://hosted.mender.io"
+	oldConfig.User = "root"
+	oldConfig.Limits.FileTransfer.OwnerGet = []string{"root"}
+	oldConfig.Debug = true
+
+	newConfig := NewMenderShellConfig()
+	*newConfig = *oldConfig
+	assert.Empty(t, ChangedSettings(oldConfig, newConfig))
+
+	newConfig.User = "mender"
+	newConfig.HTTPSClient.Key = "/data/client.key"
+	newConfig.Limits.FileTransfer.OwnerGet = []string{"root", "mender"}
+	newConfig.Limits.FileTransfer.Counters.MaxBytesTxPerMinute = 1024
+	newConfig.FileTransfer.Disable = true
+	newConfig.Debug = false
+	assert.Equal(t, []string{
+		"HttpsClient.Key",
+		"User",
+		"Limits.FileTransfer.OwnerGet",
+		"Limits.FileTransfer.Counters.MaxBytesTxPerMinute",
+		"FileTransfer.Disable",
+	}, ChangedSettings(oldConfig, newConfig))
+}
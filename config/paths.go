@@ -35,6 +35,10 @@ var (
 	DefaultConfFile         = path.Join(GetConfDirPath(), "mender-connect.conf")
 	DefaultFallbackConfFile = path.Join(GetStateDirPath(), "mender-connect.conf")
 
+	DefaultAuditFile = path.Join(GetStateDirPath(), "mender-connect-audit.log")
+
+	DefaultRecordingDir = path.Join(GetStateDirPath(), "mender-connect-recordings")
+
 	DefaultDebug = false
 	DefaultTrace = false
 
@@ -42,6 +46,50 @@ var (
 	DefaultReconnectIntervalsSeconds = 5
 	MessageWriteTimeout              = 2 * time.Second
 	MaxShellsSpawned                 = uint(16)
+
+	// reconnect backoff and circuit breaker defaults
+	DefaultReconnectMaxIntervalSeconds   = 300
+	DefaultReconnectMultiplier           = 2.0
+	DefaultReconnectStablePeriodSeconds  = 60
+	DefaultCircuitBreakerCooldownSeconds = 600
+
+	// websocket transport defaults and limits
+	DefaultMaxMessageSize      = int64(8192)
+	MinMaxMessageSize          = int64(1024)
+	MaxMaxMessageSize          = int64(16 * 1024 * 1024)
+	DefaultWriteTimeoutSeconds = 4
+	DefaultPingWaitSeconds     = 60
+
+	// seconds allowed to the sessions to close on shutdown
+	DefaultShutdownTimeoutSeconds = 10
+
+	// path of the local control socket
+	DefaultControlSocketPath = "/run/mender-connect.sock"
+
+	// address of the metrics endpoint
+	DefaultMetricsAddress = "localhost:9469"
+
+	// log file rotation defaults
+	DefaultLogFileMaxSizeMB  = 10
+	DefaultLogFileMaxBackups = 5
+
+	// audit log rotation defaults
+	DefaultAuditFileMaxSizeMB  = 10
+	DefaultAuditFileMaxBackups = 10
+
+	// terminal recording defaults
+	DefaultRecordingMaxFileSizeMB  = 10
+	DefaultRecordingMaxTotalSizeMB = 100
+
+	// shared shells default
+	DefaultSharingMaxPeers = uint32(4)
+
+	// shell sessions scrollback default
+	DefaultScrollbackSize = uint32(64 * 1024)
+
+	// standalone authentication defaults
+	DefaultTokenFilePollIntervalSeconds = 5
+	DefaultTokenCommandTimeoutSeconds   = 30
 )
 
 // GetStateDirPath returns the default data store directory
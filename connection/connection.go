@@ -15,21 +15,29 @@
 package connection
 
 import (
+	"compress/flate"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/vmihailenco/msgpack/v5"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
+
+	"github.com/mendersoftware/mender-connect/client/https"
 )
 
 const (
@@ -37,6 +45,30 @@ const (
 	errMissingCerts       = "No trusted certificates. The client will continue running but will " +
 		"not be able to communicate with the server. Either specify ServerCertificate in " +
 		"mender-connect.conf, or make sure that CA certificates are installed on the system"
+	errClientKeyPKCS11 = "The client key '%s' is a PKCS#11 URI; loading keys through an " +
+		"SSL engine is not supported by mender-connect"
+)
+
+const (
+	// DefaultHandshakeTimeout is the time allowed for the websocket handshake
+	DefaultHandshakeTimeout = 45 * time.Second
+	// DefaultWriteWait is the time allowed to write a message to the peer
+	DefaultWriteWait = 4 * time.Second
+	// DefaultMaxMessageSize is the maximum message size allowed from peer
+	DefaultMaxMessageSize = 8192
+	// DefaultPingWait is the time allowed to read the next pong message
+	DefaultPingWait = time.Minute
+	// DefaultCompressionLevel is the compression level used when the
+	// configuration does not set one
+	DefaultCompressionLevel = flate.BestSpeed
+
+	compressionExtension = "permessage-deflate"
+)
+
+var (
+	// ErrUnauthorized is returned when the server rejects the handshake
+	// because of the JWT token
+	ErrUnauthorized = errors.New("the server rejected the JWT token")
 )
 
 type Connection struct {
@@ -49,6 +81,11 @@ type Connection struct {
 	maxMessageSize int64
 	// Time allowed to read the next pong message from the peer.
 	defaultPingWait time.Duration
+	// Whether the messages are compressed, and the size of the smallest
+	// message to compress
+	compression          bool
+	compressionThreshold int
+	counters             *byteCounters
 	// Channel to stop the go routines
 	done chan bool
 }
@@ -99,45 +136,204 @@ func loadServerTrust(serverCertFilePath string) *x509.CertPool {
 	return systemPool
 }
 
-//Websocket connection routine. setup the ping-pong and connection settings
-func NewConnection(u url.URL,
-	token string,
-	writeWait time.Duration,
-	maxMessageSize int64,
-	defaultPingWait time.Duration,
-	skipVerify bool,
-	serverCertFilePath string) (*Connection, error) {
-	// skip verification of HTTPS certificate if skipVerify is set in the config file
+// loadClientCertificate loads the client certificate and private key used
+// for mutual TLS authentication with the server
+func loadClientCertificate(client *https.Client) (*tls.Certificate, error) {
+	if client.IsPKCS11Key() {
+		return nil, errors.Errorf(errClientKeyPKCS11, client.Key)
+	}
+
+	log.Infof("loading the client certificate from %s", client.Certificate)
+	certificate, err := ioutil.ReadFile(client.Certificate)
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"failed to read the client certificate '%s'", client.Certificate)
+	}
+	key, err := ioutil.ReadFile(client.Key)
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"failed to read the client key '%s'", client.Key)
+	}
+
+	cert, err := tls.X509KeyPair(certificate, key)
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"the client certificate '%s' and key '%s' cannot be used together",
+			client.Certificate, client.Key)
+	}
+	return &cert, nil
+}
 
-	websocket.DefaultDialer.TLSClientConfig = &tls.Config{
-		RootCAs:            loadServerTrust(serverCertFilePath),
-		InsecureSkipVerify: skipVerify,
+// newTLSConfig returns the TLS configuration used to dial the server,
+// including the client certificate if mutual TLS is configured
+func newTLSConfig(config https.Config) (*tls.Config, error) {
+	// skip verification of HTTPS certificate if SkipVerify is set in the config file
+	tlsConfig := &tls.Config{
+		RootCAs:            loadServerTrust(config.ServerCert),
+		InsecureSkipVerify: config.NoVerify,
+	}
+	if len(config.PublicKeyPins) > 0 {
+		verify, err := verifyPublicKeyPins(config.PublicKeyPins)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyPeerCertificate = verify
+	}
+	if config.Client != nil {
+		cert, err := loadClientCertificate(config.Client)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{*cert}
 	}
+	return tlsConfig, nil
+}
 
-	var ws *websocket.Conn
-	dialer := *websocket.DefaultDialer
+// Dialer holds the settings of a websocket connection; every connection
+// dialed owns a copy of them, so connections with different settings can
+// coexist in the same process
+type Dialer struct {
+	// TLS configuration used to connect to the server
+	TLSConfig *tls.Config
+	// Time allowed for the websocket handshake
+	HandshakeTimeout time.Duration
+	// Proxy returns the proxy to use for the handshake request, nil for
+	// a direct connection
+	Proxy func(*http.Request) (*url.URL, error)
+	// Additional headers of the handshake request
+	Header http.Header
+	// Time allowed to write a message to the peer.
+	WriteWait time.Duration
+	// Maximum message size allowed from peer.
+	MaxMessageSize int64
+	// Time allowed to read the next pong message from the peer.
+	PingWait time.Duration
+	// Compression settings; nil disables compression
+	Compression *https.Compression
+}
+
+// NewDialer returns a Dialer for the given client configuration
+func NewDialer(config https.Config) (*Dialer, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Dialer{
+		TLSConfig:        tlsConfig,
+		HandshakeTimeout: DefaultHandshakeTimeout,
+		Proxy:            proxyFunc(config.Proxy),
+		Header:           http.Header{},
+		WriteWait:        DefaultWriteWait,
+		MaxMessageSize:   DefaultMaxMessageSize,
+		PingWait:         DefaultPingWait,
+		Compression:      config.Compression,
+	}, nil
+}
+
+// compressionNegotiated returns true if the server accepted the
+// permessage-deflate extension
+func compressionNegotiated(rsp *http.Response) bool {
+	if rsp == nil {
+		return false
+	}
+	for _, extensions := range rsp.Header["Sec-Websocket-Extensions"] {
+		for _, extension := range strings.Split(extensions, ",") {
+			params := strings.Split(extension, ";")
+			if strings.TrimSpace(params[0]) == compressionExtension {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Dial connects to the server and sets up the ping-pong health check
+func (d *Dialer) Dial(u url.URL, token string) (*Connection, error) {
+	var tlsConfig *tls.Config
+	if d.TLSConfig != nil {
+		tlsConfig = d.TLSConfig.Clone()
+	}
+	counters := &byteCounters{}
+	netDialer := &net.Dialer{}
+	dialer := websocket.Dialer{
+		Proxy:            d.Proxy,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: d.HandshakeTimeout,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := netDialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &countingConn{Conn: conn, counters: counters}, nil
+		},
+		EnableCompression: d.Compression != nil && d.Compression.Enabled,
+	}
 
 	headers := http.Header{}
+	for key, values := range d.Header {
+		headers[key] = append([]string(nil), values...)
+	}
 	headers.Set("Authorization", "Bearer "+token)
-	ws, _, err := dialer.Dial(u.String(), headers)
+	ws, rsp, err := dialer.Dial(u.String(), headers)
 	if err != nil {
+		if rsp != nil && (rsp.StatusCode == http.StatusUnauthorized ||
+			rsp.StatusCode == http.StatusForbidden) {
+			return nil, errors.Wrap(ErrUnauthorized, rsp.Status)
+		}
 		return nil, err
 	}
 
 	c := &Connection{
 		connection:      ws,
-		writeWait:       writeWait,
-		maxMessageSize:  maxMessageSize,
-		defaultPingWait: defaultPingWait,
+		writeWait:       d.WriteWait,
+		maxMessageSize:  d.MaxMessageSize,
+		defaultPingWait: d.PingWait,
+		counters:        counters,
 		done:            make(chan bool),
 	}
-	ws.SetReadLimit(maxMessageSize)
+	ws.SetReadLimit(d.MaxMessageSize)
+	if dialer.EnableCompression {
+		if compressionNegotiated(rsp) {
+			level := DefaultCompressionLevel
+			if d.Compression.Level != nil {
+				level = *d.Compression.Level
+			}
+			if err := ws.SetCompressionLevel(level); err != nil {
+				ws.Close()
+				return nil, err
+			}
+			c.compression = true
+			c.compressionThreshold = d.Compression.Threshold
+			log.Infof("websocket compression enabled (level %d, threshold %d bytes)",
+				level, d.Compression.Threshold)
+		} else {
+			log.Warn("the server did not accept the websocket compression; " +
+				"sending the messages uncompressed")
+		}
+	}
 
 	go c.pingPongHandler()
 
 	return c, nil
 }
 
+//Websocket connection routine. setup the ping-pong and connection settings
+func NewConnection(u url.URL,
+	token string,
+	writeWait time.Duration,
+	maxMessageSize int64,
+	defaultPingWait time.Duration,
+	config https.Config) (*Connection, error) {
+	dialer, err := NewDialer(config)
+	if err != nil {
+		return nil, err
+	}
+	dialer.WriteWait = writeWait
+	dialer.MaxMessageSize = maxMessageSize
+	dialer.PingWait = defaultPingWait
+	return dialer.Dial(u, token)
+}
+
 func (c *Connection) pingPongHandler() {
 	// handle the ping-pong connection health check
 	err := c.connection.SetReadDeadline(time.Now().Add(c.defaultPingWait))
@@ -204,8 +400,15 @@ func (c *Connection) WriteMessage(m *ws.ProtoMsg) (err error) {
 	}
 	c.writeMutex.Lock()
 	defer c.writeMutex.Unlock()
+	if c.compression {
+		c.connection.EnableWriteCompression(len(data) >= c.compressionThreshold)
+	}
 	_ = c.connection.SetWriteDeadline(time.Now().Add(c.writeWait))
-	return c.connection.WriteMessage(websocket.BinaryMessage, data)
+	err = c.connection.WriteMessage(websocket.BinaryMessage, data)
+	if err == nil {
+		atomic.AddUint64(&c.counters.txMessage, uint64(len(data)))
+	}
+	return err
 }
 
 func (c *Connection) ReadMessage() (*ws.ProtoMsg, error) {
@@ -213,6 +416,7 @@ func (c *Connection) ReadMessage() (*ws.ProtoMsg, error) {
 	if err != nil {
 		return nil, err
 	}
+	atomic.AddUint64(&c.counters.rxMessage, uint64(len(data)))
 
 	m := &ws.ProtoMsg{}
 	err = msgpack.Unmarshal(data, m)
@@ -222,6 +426,18 @@ func (c *Connection) ReadMessage() (*ws.ProtoMsg, error) {
 	return m, nil
 }
 
+// GetCounters returns the amount of data written to and read from the
+// connection
+func (c *Connection) GetCounters() Counters {
+	return Counters{
+		Compression:    c.compression,
+		TxMessageBytes: atomic.LoadUint64(&c.counters.txMessage),
+		RxMessageBytes: atomic.LoadUint64(&c.counters.rxMessage),
+		TxWireBytes:    atomic.LoadUint64(&c.counters.txWire),
+		RxWireBytes:    atomic.LoadUint64(&c.counters.rxWire),
+	}
+}
+
 func (c *Connection) Close() error {
 	select {
 	case c.done <- true:
@@ -15,18 +15,34 @@
 package connection
 
 import (
+	"compress/flate"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
+
+	"github.com/mendersoftware/mender-connect/client/https"
 )
 
 const (
@@ -58,6 +74,7 @@ func writeMessage(c *websocket.Conn, body []byte) {
 		writeWait:       writeWait,
 		maxMessageSize:  maxMessageSize,
 		defaultPingWait: defaultPingWait,
+		counters:        &byteCounters{},
 	}
 
 	m := &ws.ProtoMsg{
@@ -105,11 +122,179 @@ func TestNewConnection(t *testing.T) {
 
 	u := url.URL{Scheme: parsedUrl.Scheme, Host: parsedUrl.Host, Path: "/"}
 
-	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, true, "")
+	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, https.Config{NoVerify: true})
 	assert.NoError(t, err)
 	assert.NotNil(t, c)
 }
 
+func TestNewConnectionUnauthorized(t *testing.T) {
+	testCases := map[string]struct {
+		status int
+		err    error
+	}{
+		"unauthorized": {
+			status: http.StatusUnauthorized,
+			err:    ErrUnauthorized,
+		},
+		"forbidden": {
+			status: http.StatusForbidden,
+			err:    ErrUnauthorized,
+		},
+		"other error": {
+			status: http.StatusBadGateway,
+			err:    websocket.ErrBadHandshake,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+			}))
+			defer s.Close()
+
+			parsedUrl, err := url.Parse("ws" + strings.TrimPrefix(s.URL, "http"))
+			assert.NoError(t, err)
+			u := url.URL{Scheme: parsedUrl.Scheme, Host: parsedUrl.Host, Path: "/"}
+
+			c, err := NewConnection(u, "expired-token", writeWait, maxMessageSize, defaultPingWait,
+				https.Config{NoVerify: true})
+			assert.Nil(t, c)
+			assert.Equal(t, tc.err, errors.Cause(err))
+		})
+	}
+}
+
+func TestDialerIndependentConnections(t *testing.T) {
+	headers := make(chan string, 4)
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("X-Device-Test")
+		helloHandler(w, r)
+	}))
+	defer s.Close()
+
+	parsedUrl, err := url.Parse("wss" + strings.TrimPrefix(s.URL, "https"))
+	assert.NoError(t, err)
+	u := url.URL{Scheme: parsedUrl.Scheme, Host: parsedUrl.Host, Path: "/"}
+
+	trusting, err := NewDialer(https.Config{NoVerify: true})
+	assert.NoError(t, err)
+	trusting.Header.Set("X-Device-Test", "trusting")
+	strict, err := NewDialer(https.Config{})
+	assert.NoError(t, err)
+
+	// the settings of one dialer do not leak into the other one
+	c, err := trusting.Dial(u, "some-token")
+	assert.NoError(t, err)
+	if assert.NotNil(t, c) {
+		defer c.Close()
+	}
+	assert.Equal(t, "trusting", <-headers)
+	_, err = strict.Dial(u, "some-token")
+	assert.Error(t, err)
+	assert.Nil(t, websocket.DefaultDialer.TLSClientConfig)
+
+	c, err = trusting.Dial(u, "some-token")
+	assert.NoError(t, err)
+	if assert.NotNil(t, c) {
+		m, err := c.ReadMessage()
+		assert.NoError(t, err)
+		if assert.NotNil(t, m) {
+			assert.Equal(t, []byte(helloMessage), m.Body)
+		}
+		c.Close()
+	}
+
+	// the read limit is per connection
+	trusting.MaxMessageSize = 16
+	c, err = trusting.Dial(u, "some-token")
+	assert.NoError(t, err)
+	if assert.NotNil(t, c) {
+		_, err = c.ReadMessage()
+		assert.EqualError(t, err, websocket.ErrReadLimit.Error())
+		c.Close()
+	}
+}
+
+func TestDialerCompression(t *testing.T) {
+	noCompression, bestCompression := flate.NoCompression, flate.BestCompression
+	testCases := map[string]struct {
+		serverCompression bool
+		compression       *https.Compression
+		negotiated        bool
+		// storedTx is set if the data sent is deflated without compression
+		storedTx bool
+	}{
+		"compressed": {
+			serverCompression: true,
+			compression:       &https.Compression{Enabled: true, Threshold: 64},
+			negotiated:        true,
+		},
+		"not compressing the data": {
+			serverCompression: true,
+			compression:       &https.Compression{Enabled: true, Level: &noCompression},
+			negotiated:        true,
+			storedTx:          true,
+		},
+		"not accepted by the server": {
+			compression: &https.Compression{Enabled: true, Level: &bestCompression},
+		},
+		"disabled": {
+			serverCompression: true,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			upgrader := websocket.Upgrader{EnableCompression: tc.serverCompression}
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				c, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				for {
+					messageType, data, err := c.ReadMessage()
+					if err != nil {
+						return
+					}
+					_ = c.WriteMessage(messageType, data)
+				}
+			}))
+			defer s.Close()
+
+			parsedUrl, err := url.Parse("ws" + strings.TrimPrefix(s.URL, "http"))
+			assert.NoError(t, err)
+			dialer, err := NewDialer(https.Config{Compression: tc.compression})
+			assert.NoError(t, err)
+			c, err := dialer.Dial(*parsedUrl, "some-token")
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer c.Close()
+
+			body := []byte(strings.Repeat("compressible ", 512))
+			err = c.WriteMessage(&ws.ProtoMsg{Body: body})
+			assert.NoError(t, err)
+			m, err := c.ReadMessage()
+			if assert.NoError(t, err) {
+				assert.Equal(t, body, m.Body)
+			}
+
+			counters := c.GetCounters()
+			assert.Equal(t, tc.negotiated, counters.Compression)
+			assert.True(t, counters.TxMessageBytes > uint64(len(body)))
+			assert.True(t, counters.RxMessageBytes > uint64(len(body)))
+			if tc.negotiated {
+				assert.Equal(t, tc.storedTx, counters.TxWireBytes > counters.TxMessageBytes)
+				assert.True(t, counters.RxWireBytes < counters.RxMessageBytes)
+			} else {
+				assert.True(t, counters.TxWireBytes > counters.TxMessageBytes)
+				assert.True(t, counters.RxWireBytes > counters.RxMessageBytes)
+			}
+		})
+	}
+}
+
 func TestConnection_ReadMessage(t *testing.T) {
 	expectedMessage := &ws.ProtoMsg{
 		Header: ws.ProtoHdr{
@@ -134,7 +319,7 @@ func TestConnection_ReadMessage(t *testing.T) {
 
 	u := url.URL{Scheme: parsedUrl.Scheme, Host: parsedUrl.Host, Path: "/"}
 
-	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, true, "")
+	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, https.Config{NoVerify: true})
 	time.Sleep(time.Second)
 	m, err := c.ReadMessage()
 	assert.NoError(t, err)
@@ -156,7 +341,7 @@ func TestConnection_WriteMessage(t *testing.T) {
 
 	u := url.URL{Scheme: parsedUrl.Scheme, Host: parsedUrl.Host, Path: "/"}
 
-	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, true, "")
+	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, https.Config{NoVerify: true})
 	time.Sleep(time.Second)
 	m, err := c.ReadMessage()
 	assert.NoError(t, err)
@@ -180,7 +365,7 @@ func TestConnection_Close(t *testing.T) {
 
 	u := url.URL{Scheme: parsedUrl.Scheme, Host: parsedUrl.Host, Path: "/"}
 
-	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, true, "")
+	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, https.Config{NoVerify: true})
 	assert.NotNil(t, c)
 
 	assert.True(t, c.GetWriteTimeout() > 0)
@@ -215,3 +400,196 @@ func TestMenderShellConnectionLoadServerTrust(t *testing.T) {
 		})
 	}
 }
+
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// newMutualTLSServer starts a websocket server which requires the clients to
+// present a certificate signed by the returned CA
+func newMutualTLSServer(t *testing.T, dir string) (*httptest.Server, *testCertificate) {
+	ca := newTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mender-connect test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	err := ioutil.WriteFile(path.Join(dir, "ca.crt"), ca.certPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCert, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(helloHandler))
+	s.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	s.StartTLS()
+	return s, ca
+}
+
+func TestNewConnectionMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestNewConnectionMutualTLS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, ca := newMutualTLSServer(t, dir)
+	defer s.Close()
+
+	client := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "device"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	other := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      pkix.Name{CommonName: "other-device"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	files := map[string][]byte{
+		"client.crt": client.certPEM,
+		"client.key": client.keyPEM,
+		"other.key":  other.keyPEM,
+		"broken.crt": []byte("not a certificate"),
+	}
+	for name, data := range files {
+		err := ioutil.WriteFile(path.Join(dir, name), data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	parsedUrl, err := url.Parse("wss" + strings.TrimPrefix(s.URL, "https"))
+	assert.NoError(t, err)
+	u := url.URL{Scheme: parsedUrl.Scheme, Host: parsedUrl.Host, Path: "/"}
+
+	testCases := map[string]struct {
+		client *https.Client
+		err    string
+	}{
+		"ok": {
+			client: &https.Client{
+				Certificate: path.Join(dir, "client.crt"),
+				Key:         path.Join(dir, "client.key"),
+			},
+		},
+		"error, no client certificate": {
+			err: "remote error: tls",
+		},
+		"error, certificate not readable": {
+			client: &https.Client{
+				Certificate: path.Join(dir, "missing.crt"),
+				Key:         path.Join(dir, "client.key"),
+			},
+			err: "failed to read the client certificate",
+		},
+		"error, key not readable": {
+			client: &https.Client{
+				Certificate: path.Join(dir, "client.crt"),
+				Key:         path.Join(dir, "missing.key"),
+			},
+			err: "failed to read the client key",
+		},
+		"error, key does not match the certificate": {
+			client: &https.Client{
+				Certificate: path.Join(dir, "client.crt"),
+				Key:         path.Join(dir, "other.key"),
+			},
+			err: "private key does not match public key",
+		},
+		"error, broken certificate": {
+			client: &https.Client{
+				Certificate: path.Join(dir, "broken.crt"),
+				Key:         path.Join(dir, "client.key"),
+			},
+			err: "cannot be used together",
+		},
+		"error, PKCS#11 key": {
+			client: &https.Client{
+				Certificate: path.Join(dir, "client.crt"),
+				Key:         "pkcs11:object=device-key",
+				SSLEngine:   "pkcs11",
+			},
+			err: "is a PKCS#11 URI",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait,
+				https.Config{
+					ServerCert: path.Join(dir, "ca.crt"),
+					Client:     tc.client,
+				})
+			if tc.err != "" {
+				assert.Error(t, err)
+				if err != nil {
+					assert.Contains(t, err.Error(), tc.err)
+				}
+				assert.Nil(t, c)
+			} else {
+				assert.NoError(t, err)
+				if assert.NotNil(t, c) {
+					m, err := c.ReadMessage()
+					assert.NoError(t, err)
+					if assert.NotNil(t, m) {
+						assert.Equal(t, []byte(helloMessage), m.Body)
+					}
+					c.Close()
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package connection
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Counters holds the amount of data written to and read from a connection
+type Counters struct {
+	// Whether the server accepted the permessage-deflate compression
+	Compression bool
+	// Bytes of the messages written and read, before compression
+	TxMessageBytes uint64
+	RxMessageBytes uint64
+	// Bytes written to and read from the network, including the
+	// handshake, the websocket framing and TLS
+	TxWireBytes uint64
+	RxWireBytes uint64
+}
+
+type byteCounters struct {
+	txMessage uint64
+	rxMessage uint64
+	txWire    uint64
+	rxWire    uint64
+}
+
+// countingConn counts the bytes written to and read from the network
+type countingConn struct {
+	net.Conn
+	counters *byteCounters
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.counters.rxWire, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.counters.txWire, uint64(n))
+	return n, err
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package connection
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/client/https"
+)
+
+var (
+	ErrPublicKeyPinMismatch = errors.New(
+		"none of the server certificates matches the pinned public keys")
+)
+
+// publicKeyHash returns the base64 encoded SHA-256 hash of the certificate's
+// SubjectPublicKeyInfo
+func publicKeyHash(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// verifyPublicKeyPins returns the function verifying that the certificate
+// chain presented by the server contains one of the pinned public keys. The
+// verified chains are checked, so a pinned CA key matches too; without
+// verification (NoVerify), the certificates presented by the server are.
+func verifyPublicKeyPins(
+	pins []string,
+) (func([][]byte, [][]*x509.Certificate) error, error) {
+	pinned := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		hash, err := https.ParsePublicKeyPin(pin)
+		if err != nil {
+			return nil, err
+		}
+		pinned[hash] = true
+	}
+
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		var presented []*x509.Certificate
+		if len(verifiedChains) > 0 {
+			for _, chain := range verifiedChains {
+				presented = append(presented, chain...)
+			}
+		} else {
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return errors.Wrap(err, "failed to parse the server certificate")
+				}
+				presented = append(presented, cert)
+			}
+		}
+
+		for _, cert := range presented {
+			if pinned[publicKeyHash(cert)] {
+				return nil
+			}
+		}
+		for _, cert := range presented {
+			log.Errorf("Public key pin mismatch: certificate '%s' has public key "+
+				"sha256//%s", cert.Subject.String(), publicKeyHash(cert))
+		}
+		return ErrPublicKeyPinMismatch
+	}, nil
+}
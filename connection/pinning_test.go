@@ -0,0 +1,144 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package connection
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/client/https"
+)
+
+func TestNewConnectionPublicKeyPins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestNewConnectionPublicKeyPins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := httptest.NewTLSServer(http.HandlerFunc(helloHandler))
+	defer s.Close()
+
+	serverCert := path.Join(dir, "server.crt")
+	err = ioutil.WriteFile(serverCert, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: s.TLS.Certificates[0].Certificate[0],
+	}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(s.TLS.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin := publicKeyHash(cert)
+	otherHash := sha256.Sum256([]byte("some other key"))
+	otherPin := base64.StdEncoding.EncodeToString(otherHash[:])
+
+	parsedUrl, err := url.Parse("wss" + strings.TrimPrefix(s.URL, "https"))
+	assert.NoError(t, err)
+	u := url.URL{Scheme: parsedUrl.Scheme, Host: parsedUrl.Host, Path: "/"}
+
+	testCases := map[string]struct {
+		config https.Config
+		err    error
+		errMsg string
+	}{
+		"ok": {
+			config: https.Config{
+				ServerCert:    serverCert,
+				PublicKeyPins: []string{pin},
+			},
+		},
+		"ok, rotation with several pins": {
+			config: https.Config{
+				ServerCert:    serverCert,
+				PublicKeyPins: []string{otherPin, "sha256//" + pin},
+			},
+		},
+		"ok, no verification": {
+			config: https.Config{
+				NoVerify:      true,
+				PublicKeyPins: []string{pin},
+			},
+		},
+		"error, pin mismatch": {
+			config: https.Config{
+				ServerCert:    serverCert,
+				PublicKeyPins: []string{otherPin},
+			},
+			err: ErrPublicKeyPinMismatch,
+		},
+		"error, pin mismatch, no verification": {
+			config: https.Config{
+				NoVerify:      true,
+				PublicKeyPins: []string{otherPin},
+			},
+			err: ErrPublicKeyPinMismatch,
+		},
+		"error, invalid pin": {
+			config: https.Config{
+				ServerCert:    serverCert,
+				PublicKeyPins: []string{"c2hvcnQ="},
+			},
+			errMsg: "not a SHA-256 hash",
+		},
+		"error, pin not base64": {
+			config: https.Config{
+				ServerCert:    serverCert,
+				PublicKeyPins: []string{"sha256//not base64"},
+			},
+			errMsg: "invalid public key pin",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait,
+				tc.config)
+			if tc.err != nil || tc.errMsg != "" {
+				assert.Error(t, err)
+				assert.Nil(t, c)
+				if err != nil && tc.err != nil {
+					assert.Contains(t, err.Error(), tc.err.Error())
+				} else if err != nil {
+					assert.Contains(t, err.Error(), tc.errMsg)
+				}
+			} else {
+				assert.NoError(t, err)
+				if assert.NotNil(t, c) {
+					m, err := c.ReadMessage()
+					assert.NoError(t, err)
+					if assert.NotNil(t, m) {
+						assert.Equal(t, []byte(helloMessage), m.Body)
+					}
+					c.Close()
+				}
+			}
+		})
+	}
+}
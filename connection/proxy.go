@@ -0,0 +1,128 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package connection
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/mendersoftware/mender-connect/client/https"
+)
+
+const (
+	schemeHTTPS = "https"
+
+	defaultPortHTTP  = "80"
+	defaultPortHTTPS = "443"
+)
+
+// proxyFunc returns the function the websocket dialer uses to select the
+// proxy for the handshake request. The proxy from the configuration takes
+// precedence; without one, the proxy is taken from the environment.
+func proxyFunc(config *https.Proxy) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxy := config
+		if proxy == nil || proxy.URL == "" {
+			proxy = proxyFromEnvironment(req.URL.Scheme)
+		}
+		if proxy.URL == "" || useDirectConnection(proxy.NoProxy, req.URL) {
+			return nil, nil
+		}
+		return proxy.ParseURL()
+	}
+}
+
+func getEnvAny(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// proxyFromEnvironment returns the proxy settings from the HTTPS_PROXY (or
+// HTTP_PROXY for plain connections) and NO_PROXY environment variables
+func proxyFromEnvironment(scheme string) *https.Proxy {
+	proxy := &https.Proxy{}
+	if scheme == schemeHTTPS {
+		proxy.URL = getEnvAny("HTTPS_PROXY", "https_proxy")
+	} else {
+		proxy.URL = getEnvAny("HTTP_PROXY", "http_proxy")
+	}
+	if noProxy := getEnvAny("NO_PROXY", "no_proxy"); noProxy != "" {
+		proxy.NoProxy = strings.Split(noProxy, ",")
+	}
+	return proxy
+}
+
+// useDirectConnection returns true if the URL matches any of the entries
+// of the no-proxy list. An entry is either "*", an IP address, a CIDR
+// range, or a domain name which also matches its sub-domains; IP addresses
+// and domain names may be followed by a port number.
+func useDirectConnection(noProxy []string, u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	ip := net.ParseIP(host)
+	port := u.Port()
+	if port == "" {
+		port = defaultPortHTTP
+		if u.Scheme == schemeHTTPS {
+			port = defaultPortHTTPS
+		}
+	}
+
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		} else if entry == "*" {
+			return true
+		}
+
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && ipNet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if entryHost, entryPort, err := net.SplitHostPort(entry); err == nil {
+			if entryPort != port {
+				continue
+			}
+			entry = entryHost
+		}
+
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		entry = strings.TrimPrefix(entry, "*")
+		if strings.HasPrefix(entry, ".") {
+			if strings.HasSuffix(host, entry) {
+				return true
+			}
+		} else if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package connectionmanager
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// BackoffConfig configures the delays between the reconnect attempts. The
+// delay before the n-th retry is a random value between zero and
+// min(MaxInterval, interval * Multiplier^(n-1)), where the interval is set
+// with SetReconnectIntervalSeconds.
+type BackoffConfig struct {
+	// Upper bound of the delay between attempts; zero means the delay
+	// does not grow beyond the reconnect interval
+	MaxInterval time.Duration
+	// Factor the delay grows by after every failed attempt; values lower
+	// than one are treated as one
+	Multiplier float64
+	// Period a connection must stay up for the backoff to be reset; zero
+	// resets the backoff as soon as a connection is established
+	StablePeriod time.Duration
+	// Number of consecutive failed attempts after which the circuit
+	// breaker opens; zero disables the circuit breaker
+	CircuitBreakerThreshold uint
+	// Time the circuit breaker stays open before it half-opens to let one
+	// attempt probe the servers
+	CircuitBreakerCooldown time.Duration
+}
+
+// BackoffStatus describes the state of the reconnect backoff
+type BackoffStatus struct {
+	// Number of consecutive failed attempts
+	Attempt uint
+	// Time of the next attempt; zero if not waiting to reconnect
+	NextRetry time.Time
+	// Whether the circuit breaker is open, or half-open while probing the
+	// servers once its cooldown is over
+	CircuitOpen     bool
+	CircuitHalfOpen bool
+	// Total number of connections established and of failed attempts
+	Connections uint64
+	Failures    uint64
+}
+
+type backoff struct {
+	mutex       sync.Mutex
+	config      BackoffConfig
+	attempt     uint
+	nextRetry   time.Time
+	connectedAt time.Time
+	circuitOpen bool
+	halfOpen    bool
+	connections uint64
+	failures    uint64
+	rand        *rand.Rand
+}
+
+func newBackoff() *backoff {
+	return &backoff{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (b *backoff) setConfig(config BackoffConfig) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.config = config
+}
+
+func (b *backoff) status() BackoffStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return BackoffStatus{
+		Attempt:         b.attempt,
+		NextRetry:       b.nextRetry,
+		CircuitOpen:     b.circuitOpen,
+		CircuitHalfOpen: b.halfOpen,
+		Connections:     b.connections,
+		Failures:        b.failures,
+	}
+}
+
+// ceiling returns the upper bound of the delay before the given attempt
+func (b *backoff) ceiling(interval time.Duration, attempt uint) time.Duration {
+	maxInterval := b.config.MaxInterval
+	if maxInterval < interval {
+		maxInterval = interval
+	}
+	multiplier := math.Max(b.config.Multiplier, 1)
+	ceiling := float64(interval) * math.Pow(multiplier, float64(attempt-1))
+	if ceiling > float64(maxInterval) {
+		return maxInterval
+	}
+	return time.Duration(ceiling)
+}
+
+// failed records a failed attempt and returns the delay before the next one.
+// Once the attempts reach the threshold, the circuit breaker opens for the
+// cooldown; a failed probe opens it again for another cooldown.
+func (b *backoff) failed(interval time.Duration) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.attempt++
+	ceiling := b.ceiling(interval, b.attempt)
+	delay := time.Duration(0)
+	if ceiling > 0 {
+		delay = time.Duration(b.rand.Int63n(int64(ceiling)))
+	}
+	if b.config.CircuitBreakerThreshold > 0 && b.attempt >= b.config.CircuitBreakerThreshold {
+		b.circuitOpen = true
+		b.halfOpen = false
+		if b.config.CircuitBreakerCooldown > 0 {
+			delay = b.config.CircuitBreakerCooldown
+		}
+	}
+	b.nextRetry = time.Now().Add(delay)
+	return delay
+}
+
+// probe half-opens the circuit breaker once its cooldown is over, letting
+// the next attempt probe the servers; it tells if the attempt is a probe
+func (b *backoff) probe() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.circuitOpen && !time.Now().Before(b.nextRetry) {
+		b.circuitOpen = false
+		b.halfOpen = true
+	}
+	return b.halfOpen
+}
+
+// countFailure counts a failed attempt to connect
+func (b *backoff) countFailure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+}
+
+// pending returns the delay to wait for before attempting to connect again,
+// which is non-zero if the previous connection did not stay up long enough
+// to be considered stable
+func (b *backoff) pending(interval time.Duration) time.Duration {
+	b.mutex.Lock()
+	connectedAt := b.connectedAt
+	b.connectedAt = time.Time{}
+	if connectedAt.IsZero() {
+		b.mutex.Unlock()
+		return 0
+	} else if time.Since(connectedAt) >= b.config.StablePeriod || b.attempt == 0 {
+		b.attempt = 0
+		b.mutex.Unlock()
+		return 0
+	}
+	b.mutex.Unlock()
+	return b.failed(interval)
+}
+
+// connected records a successful attempt
+func (b *backoff) connected() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.connections++
+	b.connectedAt = time.Now()
+	b.nextRetry = time.Time{}
+	b.circuitOpen = false
+	b.halfOpen = false
+	if b.config.StablePeriod == 0 {
+		b.attempt = 0
+	}
+}
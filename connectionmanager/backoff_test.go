@@ -0,0 +1,158 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package connectionmanager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/client/https"
+)
+
+func TestBackoffCeiling(t *testing.T) {
+	b := newBackoff()
+	b.setConfig(BackoffConfig{
+		MaxInterval: 30 * time.Second,
+		Multiplier:  2,
+	})
+	assert.Equal(t, 5*time.Second, b.ceiling(5*time.Second, 1))
+	assert.Equal(t, 10*time.Second, b.ceiling(5*time.Second, 2))
+	assert.Equal(t, 20*time.Second, b.ceiling(5*time.Second, 3))
+	assert.Equal(t, 30*time.Second, b.ceiling(5*time.Second, 4))
+	assert.Equal(t, 30*time.Second, b.ceiling(5*time.Second, 100))
+
+	// no growth without a multiplier, and at least the interval
+	b.setConfig(BackoffConfig{})
+	assert.Equal(t, 5*time.Second, b.ceiling(5*time.Second, 1))
+	assert.Equal(t, 5*time.Second, b.ceiling(5*time.Second, 10))
+}
+
+func TestBackoffFullJitter(t *testing.T) {
+	b := newBackoff()
+	b.setConfig(BackoffConfig{
+		MaxInterval: 8 * time.Second,
+		Multiplier:  2,
+	})
+	var ceilings = []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second,
+	}
+	distinct := map[time.Duration]bool{}
+	for i, ceiling := range ceilings {
+		before := time.Now()
+		delay := b.failed(time.Second)
+		assert.True(t, delay >= 0 && delay < ceiling, "delay %s, ceiling %s", delay, ceiling)
+		distinct[delay] = true
+
+		status := b.status()
+		assert.Equal(t, uint(i+1), status.Attempt)
+		assert.False(t, status.CircuitOpen)
+		assert.False(t, status.NextRetry.Before(before.Add(delay)))
+	}
+	assert.True(t, len(distinct) > 1)
+}
+
+func TestBackoffCircuitBreaker(t *testing.T) {
+	b := newBackoff()
+	b.setConfig(BackoffConfig{
+		Multiplier:              2,
+		MaxInterval:             time.Second,
+		CircuitBreakerThreshold: 3,
+		CircuitBreakerCooldown:  time.Minute,
+	})
+	for i := 0; i < 2; i++ {
+		delay := b.failed(time.Second)
+		assert.True(t, delay < time.Second)
+		assert.False(t, b.status().CircuitOpen)
+	}
+	delay := b.failed(time.Second)
+	assert.Equal(t, time.Minute, delay)
+	assert.True(t, b.status().CircuitOpen)
+
+	// no probe before the end of the cooldown
+	assert.False(t, b.probe())
+	assert.True(t, b.status().CircuitOpen)
+
+	// one probe once the cooldown is over, opening the breaker again if
+	// it fails
+	b.nextRetry = time.Now()
+	assert.True(t, b.probe())
+	status := b.status()
+	assert.False(t, status.CircuitOpen)
+	assert.True(t, status.CircuitHalfOpen)
+	delay = b.failed(time.Second)
+	assert.Equal(t, time.Minute, delay)
+	status = b.status()
+	assert.True(t, status.CircuitOpen)
+	assert.False(t, status.CircuitHalfOpen)
+	assert.False(t, b.probe())
+
+	// a successful probe closes the breaker
+	b.nextRetry = time.Now()
+	assert.True(t, b.probe())
+	b.connected()
+	status = b.status()
+	assert.Equal(t, uint64(1), status.Connections)
+	assert.False(t, status.CircuitOpen)
+	assert.False(t, status.CircuitHalfOpen)
+	assert.True(t, status.NextRetry.IsZero())
+	assert.Equal(t, uint(0), status.Attempt)
+}
+
+func TestBackoffStablePeriod(t *testing.T) {
+	b := newBackoff()
+	b.setConfig(BackoffConfig{
+		Multiplier:   2,
+		MaxInterval:  time.Minute,
+		StablePeriod: time.Hour,
+	})
+
+	// no connection was established: connect right away
+	assert.Equal(t, time.Duration(0), b.pending(time.Second))
+
+	b.failed(time.Second)
+	b.failed(time.Second)
+	b.connected()
+	assert.Equal(t, uint(2), b.status().Attempt)
+
+	// the connection dropped before the stable period: keep backing off
+	delay := b.pending(time.Second)
+	assert.True(t, delay < 4*time.Second)
+	assert.Equal(t, uint(3), b.status().Attempt)
+
+	// the connection stayed up long enough: reset
+	b.connected()
+	b.connectedAt = time.Now().Add(-2 * time.Hour)
+	assert.Equal(t, time.Duration(0), b.pending(time.Second))
+	assert.Equal(t, uint(0), b.status().Attempt)
+}
+
+func TestConnectBackoffStatus(t *testing.T) {
+	m := NewManager(testPingWait)
+	m.SetReconnectIntervalSeconds(1)
+
+	err := m.Reconnect(ws.ProtoTypeShell, "ws://localhost:1", "/ws", "token",
+		https.Config{}, 3, context.Background())
+	assert.Equal(t, ErrConnectionRetriesExhausted, err)
+
+	status := m.GetReconnectStatus()
+	assert.Equal(t, uint(2), status.Attempt)
+	assert.False(t, status.CircuitOpen)
+	assert.Equal(t, uint64(0), status.Connections)
+	assert.Equal(t, uint64(3), status.Failures)
+}
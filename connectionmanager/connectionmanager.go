@@ -16,23 +16,22 @@ package connectionmanager
 
 import (
 	"context"
-	"errors"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/mendersoftware/mender-connect/client/https"
 	"github.com/mendersoftware/mender-connect/connection"
+	"github.com/mendersoftware/mender-connect/logging"
 )
 
 const (
-	// Time allowed to write a message to the peer.
-	writeWait = 4 * time.Second
-	// Maximum message size allowed from peer.
-	maxMessageSize = 8192
-
 	httpsProtocol = "https"
 	httpProtocol  = "http"
 	wssProtocol   = "wss"
@@ -43,135 +42,472 @@ var (
 	ErrHandlerNotRegistered       = errors.New("protocol handler not registered")
 	ErrHandlerAlreadyRegistered   = errors.New("protocol handler already registered")
 	ErrConnectionRetriesExhausted = errors.New("failed to connect after max number of retries")
+	ErrConnectionClosed           = errors.New("connection closed")
 )
 
 type ProtocolHandler struct {
 	proto      ws.ProtoType
 	connection *connection.Connection
-	mutex      *sync.Mutex
+	queue      *outboundQueue
+	serverUrl  string
+}
+
+// TokenRefresher returns a new JWT token to replace the one the server
+// rejected
+type TokenRefresher func(rejectedToken string) (string, error)
+
+// Manager manages the websocket connections to the server, one per protocol
+type Manager struct {
+	// connectMutex serializes the connections, which wait and dial without
+	// holding handlersByTypeMutex, so that the established connections can
+	// be used meanwhile
+	connectMutex             *sync.Mutex
+	handlersByTypeMutex      *sync.Mutex
+	handlersByType           map[ws.ProtoType]*ProtocolHandler
+	reconnectIntervalSeconds int
+	writeWait                time.Duration
+	maxMessageSize           int64
+	maxOutboundMessageSize   int64
+	pingWait                 time.Duration
+	queueSize                int
+	backoff                  *backoff
+	tokenRefresherMutex      *sync.Mutex
+	tokenRefresher           TokenRefresher
+	// servers to fall over to, and the last one a connection was established with
+	serversMutex      *sync.Mutex
+	servers           []string
+	lastWorkingServer string
+	// IDs of the connections in the log entries, by protocol; apart from
+	// the handlers so that they can be read while reconnecting
+	connectionIDsMutex *sync.Mutex
+	connectionIDs      map[ws.ProtoType]string
 }
 
-var handlersByTypeMutex = &sync.Mutex{}
-var handlersByType = map[ws.ProtoType]*ProtocolHandler{}
-var reconnectIntervalSeconds = 5
-var DefaultPingWait = time.Minute
+// NewManager returns a new connection manager whose connections allow
+// pingWait to read the next pong message; zero selects the default
+func NewManager(pingWait time.Duration) *Manager {
+	if pingWait <= 0 {
+		pingWait = connection.DefaultPingWait
+	}
+	return &Manager{
+		connectMutex:             &sync.Mutex{},
+		handlersByTypeMutex:      &sync.Mutex{},
+		handlersByType:           map[ws.ProtoType]*ProtocolHandler{},
+		reconnectIntervalSeconds: 5,
+		writeWait:                connection.DefaultWriteWait,
+		maxMessageSize:           connection.DefaultMaxMessageSize,
+		maxOutboundMessageSize:   connection.DefaultMaxMessageSize,
+		pingWait:                 pingWait,
+		queueSize:                DefaultQueueSize,
+		backoff:                  newBackoff(),
+		tokenRefresherMutex:      &sync.Mutex{},
+		serversMutex:             &sync.Mutex{},
+		connectionIDsMutex:       &sync.Mutex{},
+		connectionIDs:            map[ws.ProtoType]string{},
+	}
+}
 
-func GetWriteTimeout() time.Duration {
-	return writeWait
+func (m *Manager) GetWriteTimeout() time.Duration {
+	return m.writeWait
 }
 
-func SetReconnectIntervalSeconds(i int) {
-	reconnectIntervalSeconds = i
+// SetWriteTimeout sets the time allowed to write a message to the server;
+// zero restores the default
+func (m *Manager) SetWriteTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = connection.DefaultWriteWait
+	}
+	m.writeWait = timeout
+}
+
+// GetMaxMessageSize returns the maximum size of the messages read from the
+// server
+func (m *Manager) GetMaxMessageSize() int64 {
+	return m.maxMessageSize
+}
+
+// SetMaxMessageSize sets the maximum size of the messages read from the
+// server; zero restores the default
+func (m *Manager) SetMaxMessageSize(size int64) {
+	if size <= 0 {
+		size = connection.DefaultMaxMessageSize
+	}
+	m.maxMessageSize = size
 }
 
-func connect(proto ws.ProtoType, serverUrl, connectUrl, token string, skipVerify bool, serverCertificate string, retries uint, ctx context.Context) error {
+// GetMaxOutboundMessageSize returns the maximum size of the messages written
+// to the server
+func (m *Manager) GetMaxOutboundMessageSize() int64 {
+	return m.maxOutboundMessageSize
+}
+
+// SetMaxOutboundMessageSize sets the maximum size of the messages written to
+// the server, which must not exceed the one the server reads; zero restores
+// the default
+func (m *Manager) SetMaxOutboundMessageSize(size int64) {
+	if size <= 0 {
+		size = connection.DefaultMaxMessageSize
+	}
+	m.maxOutboundMessageSize = size
+}
+
+// GetPingWait returns the time allowed to read the next pong message
+func (m *Manager) GetPingWait() time.Duration {
+	return m.pingWait
+}
+
+func (m *Manager) SetReconnectIntervalSeconds(i int) {
+	m.reconnectIntervalSeconds = i
+}
+
+// SetQueueSize sets the number of messages each outbound queue of the
+// connections established from now on holds
+func (m *Manager) SetQueueSize(size int) {
+	m.handlersByTypeMutex.Lock()
+	defer m.handlersByTypeMutex.Unlock()
+	m.queueSize = size
+}
+
+// SetBackoffConfig sets the configuration of the reconnect backoff
+func (m *Manager) SetBackoffConfig(config BackoffConfig) {
+	m.backoff.setConfig(config)
+}
+
+// GetReconnectStatus returns the state of the reconnect backoff
+func (m *Manager) GetReconnectStatus() BackoffStatus {
+	return m.backoff.status()
+}
+
+// SetTokenRefresher sets the function called to get a new JWT token when the
+// server rejects the handshake because of the token
+func (m *Manager) SetTokenRefresher(refresher TokenRefresher) {
+	m.tokenRefresherMutex.Lock()
+	defer m.tokenRefresherMutex.Unlock()
+	m.tokenRefresher = refresher
+}
+
+func (m *Manager) refreshToken(rejectedToken string) (string, error) {
+	m.tokenRefresherMutex.Lock()
+	refresher := m.tokenRefresher
+	m.tokenRefresherMutex.Unlock()
+	if refresher == nil {
+		return "", errors.New("no token refresher set")
+	}
+	return refresher(rejectedToken)
+}
+
+// SetServers sets the list of servers the connection manager rotates through
+// when dialing a server fails
+func (m *Manager) SetServers(serverUrls []string) {
+	m.serversMutex.Lock()
+	defer m.serversMutex.Unlock()
+	m.servers = serverUrls
+}
+
+// candidateServers returns the servers to dial in order of preference: the
+// server given by the caller and then the configured servers, moving the
+// server which last accepted a connection to the front
+func (m *Manager) candidateServers(serverUrl string) []string {
+	m.serversMutex.Lock()
+	defer m.serversMutex.Unlock()
+
+	candidates := make([]string, 0, len(m.servers)+1)
+	seen := make(map[string]bool)
+	for _, u := range append([]string{serverUrl}, m.servers...) {
+		u = strings.TrimSuffix(u, "/")
+		if u == "" || seen[u] {
+			continue
+		}
+		seen[u] = true
+		if u == m.lastWorkingServer {
+			candidates = append([]string{u}, candidates...)
+		} else {
+			candidates = append(candidates, u)
+		}
+	}
+	return candidates
+}
+
+func (m *Manager) setLastWorkingServer(serverUrl string) {
+	m.serversMutex.Lock()
+	defer m.serversMutex.Unlock()
+	m.lastWorkingServer = serverUrl
+}
+
+func connectionURL(serverUrl, connectUrl string) (*url.URL, error) {
 	parsedUrl, err := url.Parse(serverUrl)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	scheme := getWebSocketScheme(parsedUrl.Scheme)
-	u := url.URL{Scheme: scheme, Host: parsedUrl.Host, Path: connectUrl}
+	return &url.URL{Scheme: scheme, Host: parsedUrl.Host, Path: connectUrl}, nil
+}
+
+// newDialer returns the dialer for the connections to the server
+func (m *Manager) newDialer(config https.Config) (*connection.Dialer, error) {
+	dialer, err := connection.NewDialer(config)
+	if err != nil {
+		return nil, err
+	}
+	dialer.WriteWait = m.writeWait
+	dialer.MaxMessageSize = m.maxMessageSize
+	dialer.PingWait = m.pingWait
+	return dialer, nil
+}
+
+// dialServers tries to connect to every server once and returns the
+// connection, the index of the server and the token it was established with;
+// if the token is rejected, it is refreshed once and the server is retried
+func (m *Manager) dialServers(logger *log.Entry, candidates []string, urls []*url.URL,
+	connectUrl, token string, config https.Config,
+	try, retries uint) (*connection.Connection, int, string, error) {
+	dialer, err := m.newDialer(config)
+	if err != nil {
+		logger.Errorf("connection manager failed to set up the connection: %s", err.Error())
+		return nil, 0, token, err
+	}
+
+	refreshed := false
+	for server := 0; server < len(candidates); server++ {
+		var c *connection.Connection
+		c, err = dialer.Dial(*urls[server], token)
+		if err == nil {
+			return c, server, token, nil
+		}
+		if errors.Cause(err) == connection.ErrUnauthorized && !refreshed {
+			refreshed = true
+			logger.Warnf("connection manager: %s rejected the JWT token: %s; "+
+				"requesting a new one", candidates[server], err.Error())
+			newToken, errRefresh := m.refreshToken(token)
+			if errRefresh == nil && newToken != "" {
+				token = newToken
+				server--
+				continue
+			} else if errRefresh != nil {
+				logger.Errorf("connection manager failed to refresh the JWT token: %s",
+					errRefresh.Error())
+			}
+		}
+		logger.Errorf("connection manager failed to connect to %s%s "+
+			"(server %d/%d, try %d/%d): %s; len(token)=%d", candidates[server], connectUrl,
+			server+1, len(candidates), try, retries, err.Error(), len(token))
+	}
+	return nil, 0, token, err
+}
+
+func (m *Manager) connect(proto ws.ProtoType, serverUrl, connectUrl, token string, config https.Config, retries uint, ctx context.Context) error {
+	logger := log.WithField(logging.FieldProto, logging.ProtoName(proto))
+	var candidates []string
+	var urls []*url.URL
+	var err error
+	for _, candidate := range m.candidateServers(serverUrl) {
+		u, errParse := connectionURL(candidate, connectUrl)
+		if errParse != nil {
+			logger.Errorf("connection manager: skipping server %s: %s", candidate, errParse.Error())
+			err = errParse
+			continue
+		}
+		candidates = append(candidates, candidate)
+		urls = append(urls, u)
+	}
+	if len(candidates) == 0 {
+		if err == nil {
+			err = errors.New("no server URL to connect to")
+		}
+		return err
+	}
+
+	interval := time.Second * time.Duration(m.reconnectIntervalSeconds)
+	if delay := m.backoff.pending(interval); delay > 0 {
+		logger.Warnf("connection manager: the previous connection was not stable; "+
+			"reconnecting in %s", delay.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
 
 	var c *connection.Connection
 	var i uint = 0
+	var server int
 	for {
 		i++
-		c, err = connection.NewConnection(u, token, writeWait, maxMessageSize, DefaultPingWait, skipVerify, serverCertificate)
-		if err != nil || c == nil {
-			if retries == 0 || i < retries {
-				if err == nil {
-					err = errors.New("unknown error: connection was nil but no error provided by connection.NewConnection")
-				}
-				log.Errorf("connection manager failed to connect to %s%s: %s; "+
-					"reconnecting in %ds (try %d/%d); len(token)=%d", serverUrl, connectUrl,
-					err.Error(), reconnectIntervalSeconds, i, retries, len(token))
-				select {
-				case <-ctx.Done():
-					return nil
-				case <-time.After(time.Second * time.Duration(reconnectIntervalSeconds)):
-					break
-				}
-				continue
-			} else if i >= retries {
-				return ErrConnectionRetriesExhausted
-			}
-			return err
-		} else {
+		if m.backoff.probe() {
+			logger.Info("connection manager circuit breaker half-open, probing the servers")
+		}
+		c, server, token, err = m.dialServers(logger, candidates, urls, connectUrl, token,
+			config, i, retries)
+		if err == nil {
 			break
 		}
+		m.backoff.countFailure()
+		if retries == 0 || i < retries {
+			delay := m.backoff.failed(interval)
+			if m.backoff.status().CircuitOpen {
+				logger.Errorf("connection manager failed to connect to any of the servers; "+
+					"circuit breaker open, reconnecting in %s (try %d/%d)",
+					delay.Round(time.Millisecond), i, retries)
+			} else {
+				logger.Errorf("connection manager failed to connect to any of the servers; "+
+					"reconnecting in %s (try %d/%d)", delay.Round(time.Millisecond), i, retries)
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
+				break
+			}
+			continue
+		}
+		return ErrConnectionRetriesExhausted
 	}
 
-	handlersByType[proto] = &ProtocolHandler{
+	connectionID := uuid.NewV4().String()
+	logger = logger.WithField(logging.FieldConnectionID, connectionID)
+	logger.Infof("connection manager connected to %s", candidates[server])
+	m.backoff.connected()
+	m.setLastWorkingServer(candidates[server])
+
+	m.handlersByTypeMutex.Lock()
+	queue := newOutboundQueue(c, m.queueSize, logger)
+	m.handlersByType[proto] = &ProtocolHandler{
 		proto:      proto,
 		connection: c,
-		mutex:      &sync.Mutex{},
+		queue:      queue,
+		serverUrl:  candidates[server],
 	}
+	m.handlersByTypeMutex.Unlock()
+	go queue.run()
+	m.setConnectionID(proto, connectionID)
 	return nil
 }
 
-func Connect(proto ws.ProtoType, serverUrl, connectUrl, token string, skipVerify bool, serverCertificate string, retries uint, ctx context.Context) error {
-	handlersByTypeMutex.Lock()
-	defer handlersByTypeMutex.Unlock()
+func (m *Manager) Connect(proto ws.ProtoType, serverUrl, connectUrl, token string, config https.Config, retries uint, ctx context.Context) error {
+	m.connectMutex.Lock()
+	defer m.connectMutex.Unlock()
 
-	if _, exists := handlersByType[proto]; exists {
+	m.handlersByTypeMutex.Lock()
+	_, exists := m.handlersByType[proto]
+	m.handlersByTypeMutex.Unlock()
+	if exists {
 		return ErrHandlerAlreadyRegistered
 	}
 
-	return connect(proto, serverUrl, connectUrl, token, skipVerify, serverCertificate, retries, ctx)
+	return m.connect(proto, serverUrl, connectUrl, token, config, retries, ctx)
 }
 
-func Reconnect(proto ws.ProtoType, serverUrl, connectUrl, token string, skipVerify bool, serverCertificate string, retries uint, ctx context.Context) error {
-	handlersByTypeMutex.Lock()
-	defer handlersByTypeMutex.Unlock()
+func (m *Manager) Reconnect(proto ws.ProtoType, serverUrl, connectUrl, token string, config https.Config, retries uint, ctx context.Context) error {
+	m.connectMutex.Lock()
+	defer m.connectMutex.Unlock()
 
-	if h, exists := handlersByType[proto]; exists {
-		if h != nil && h.connection != nil {
-			h.connection.Close()
-		}
+	m.handlersByTypeMutex.Lock()
+	h := m.handlersByType[proto]
+	delete(m.handlersByType, proto)
+	m.handlersByTypeMutex.Unlock()
+	if h != nil && h.queue != nil {
+		h.queue.close(0)
 	}
 
-	delete(handlersByType, proto)
-	return connect(proto, serverUrl, connectUrl, token, skipVerify, serverCertificate, retries, ctx)
+	m.setConnectionID(proto, "")
+	return m.connect(proto, serverUrl, connectUrl, token, config, retries, ctx)
 }
 
-func Read(proto ws.ProtoType) (*ws.ProtoMsg, error) {
-	handlersByTypeMutex.Lock()
-	h := handlersByType[proto]
+func (m *Manager) Read(proto ws.ProtoType) (*ws.ProtoMsg, error) {
+	m.handlersByTypeMutex.Lock()
+	h := m.handlersByType[proto]
 	if h == nil {
-		handlersByTypeMutex.Unlock()
+		m.handlersByTypeMutex.Unlock()
 		return nil, ErrHandlerNotRegistered
 	}
 
-	handlersByTypeMutex.Unlock()
+	m.handlersByTypeMutex.Unlock()
 	return h.connection.ReadMessage()
 }
 
-func Write(proto ws.ProtoType, m *ws.ProtoMsg) error {
-	handlersByTypeMutex.Lock()
-	h := handlersByType[proto]
+// Write queues the message to be written to the connection for the given
+// protocol, blocking while the queue of the message's priority is full; it
+// fails if the connection was closed or a previous write failed. The queue
+// holds a copy of the message, the caller may reuse it and its body.
+func (m *Manager) Write(proto ws.ProtoType, msg *ws.ProtoMsg) error {
+	m.handlersByTypeMutex.Lock()
+	h := m.handlersByType[proto]
 	if h == nil {
-		handlersByTypeMutex.Unlock()
+		m.handlersByTypeMutex.Unlock()
 		return ErrHandlerNotRegistered
 	}
 
-	handlersByTypeMutex.Unlock()
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
-
-	return h.connection.WriteMessage(m)
+	m.handlersByTypeMutex.Unlock()
+	queued := *msg
+	if msg.Body != nil {
+		queued.Body = make([]byte, len(msg.Body))
+		copy(queued.Body, msg.Body)
+	}
+	return h.queue.push(&queued)
 }
 
-func Close(proto ws.ProtoType) error {
-	handlersByTypeMutex.Lock()
-	defer handlersByTypeMutex.Unlock()
-
-	h := handlersByType[proto]
+func (m *Manager) Close(proto ws.ProtoType) error {
+	m.handlersByTypeMutex.Lock()
+	h := m.handlersByType[proto]
+	m.handlersByTypeMutex.Unlock()
 	if h == nil {
 		return ErrHandlerNotRegistered
 	}
 
-	return h.connection.Close()
+	// flushing the queue takes up to the write timeout
+	return h.queue.close(m.writeWait)
+}
+
+// GetCounters returns the amount of data written to and read from the
+// connection for the given protocol
+func (m *Manager) GetCounters(proto ws.ProtoType) connection.Counters {
+	m.handlersByTypeMutex.Lock()
+	defer m.handlersByTypeMutex.Unlock()
+
+	if h := m.handlersByType[proto]; h != nil {
+		return h.connection.GetCounters()
+	}
+	return connection.Counters{}
+}
+
+// GetQueueStats returns the state of the outbound queues of the connection
+// for the given protocol
+func (m *Manager) GetQueueStats(proto ws.ProtoType) []QueueStats {
+	m.handlersByTypeMutex.Lock()
+	defer m.handlersByTypeMutex.Unlock()
+
+	if h := m.handlersByType[proto]; h != nil {
+		return h.queue.stats()
+	}
+	return nil
+}
+
+// GetActiveServerURL returns the URL of the server the connection for the
+// given protocol is established with
+func (m *Manager) GetActiveServerURL(proto ws.ProtoType) string {
+	m.handlersByTypeMutex.Lock()
+	defer m.handlersByTypeMutex.Unlock()
+
+	if h := m.handlersByType[proto]; h != nil {
+		return h.serverUrl
+	}
+	return ""
+}
+
+func (m *Manager) setConnectionID(proto ws.ProtoType, connectionID string) {
+	m.connectionIDsMutex.Lock()
+	defer m.connectionIDsMutex.Unlock()
+	m.connectionIDs[proto] = connectionID
+}
+
+// GetConnectionID returns the ID identifying the connection for the given
+// protocol in the log entries, empty while not connected; every new
+// connection gets a new ID
+func (m *Manager) GetConnectionID(proto ws.ProtoType) string {
+	m.connectionIDsMutex.Lock()
+	defer m.connectionIDsMutex.Unlock()
+	return m.connectionIDs[proto]
 }
 
 func getWebSocketScheme(scheme string) string {
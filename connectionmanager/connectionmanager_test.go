@@ -17,19 +17,25 @@ package connectionmanager
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/mender-connect/client/https"
+	"github.com/mendersoftware/mender-connect/connection"
 )
 
-func init() {
-	DefaultPingWait = 10 * time.Second
-}
+// testPingWait is the ping wait of the managers of the tests
+const testPingWait = 10 * time.Second
 
 func newWebsocketServer() *http.Server {
 	var upgrader = websocket.Upgrader{
@@ -67,13 +73,44 @@ func newWebsocketServer() *http.Server {
 }
 
 func TestSetReconnectIntervalSeconds(t *testing.T) {
-	SetReconnectIntervalSeconds(15)
-	assert.Equal(t, 15, reconnectIntervalSeconds)
+	m := NewManager(testPingWait)
+	m.SetReconnectIntervalSeconds(15)
+	assert.Equal(t, 15, m.reconnectIntervalSeconds)
 }
 
 func TestGetWriteTimeout(t *testing.T) {
-	timeOut := GetWriteTimeout()
-	assert.Equal(t, writeWait, timeOut)
+	m := NewManager(testPingWait)
+	timeOut := m.GetWriteTimeout()
+	assert.Equal(t, connection.DefaultWriteWait, timeOut)
+
+	m.SetWriteTimeout(10 * time.Second)
+	assert.Equal(t, 10*time.Second, m.GetWriteTimeout())
+	m.SetWriteTimeout(0)
+	assert.Equal(t, connection.DefaultWriteWait, m.GetWriteTimeout())
+}
+
+func TestSetTransportLimits(t *testing.T) {
+	assert.Equal(t, connection.DefaultPingWait, NewManager(0).GetPingWait())
+
+	m := NewManager(30 * time.Second)
+	assert.Equal(t, int64(connection.DefaultMaxMessageSize), m.GetMaxMessageSize())
+	assert.Equal(t, int64(connection.DefaultMaxMessageSize), m.GetMaxOutboundMessageSize())
+
+	m.SetMaxMessageSize(65536)
+	m.SetMaxOutboundMessageSize(16384)
+	assert.Equal(t, int64(65536), m.GetMaxMessageSize())
+	assert.Equal(t, int64(16384), m.GetMaxOutboundMessageSize())
+	assert.Equal(t, 30*time.Second, m.GetPingWait())
+	dialer, err := m.newDialer(https.Config{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(65536), dialer.MaxMessageSize)
+		assert.Equal(t, 30*time.Second, dialer.PingWait)
+	}
+
+	m.SetMaxMessageSize(0)
+	m.SetMaxOutboundMessageSize(0)
+	assert.Equal(t, int64(connection.DefaultMaxMessageSize), m.GetMaxMessageSize())
+	assert.Equal(t, int64(connection.DefaultMaxMessageSize), m.GetMaxOutboundMessageSize())
 }
 
 func TestGetWsScheme(t *testing.T) {
@@ -85,24 +122,27 @@ func TestGetWsScheme(t *testing.T) {
 
 func TestConnect(t *testing.T) {
 	srv := newWebsocketServer()
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
 	go func() {
-		_ = srv.ListenAndServe()
+		_ = srv.Serve(l)
 	}()
 	defer func() {
 		_ = srv.Shutdown(context.Background())
 	}()
 
-	_ = Close(ws.ProtoTypeShell)
-
+	m := NewManager(testPingWait)
 	ctx := context.Background()
-	err := Connect(ws.ProtoTypeShell, "ws://localhost:8999", "/ws", "token", true, "", 1, ctx)
+	err = m.Connect(ws.ProtoTypeShell, "ws://localhost:8999", "/ws", "token", https.Config{NoVerify: true}, 1, ctx)
 	assert.Nil(t, err)
 
-	msg, err := Read(ws.ProtoTypeShell)
+	msg, err := m.Read(ws.ProtoTypeShell)
 	assert.Nil(t, err)
 	assert.Equal(t, []byte("dummy"), msg.Body)
 
-	err = Write(ws.ProtoTypeShell, &ws.ProtoMsg{
+	err = m.Write(ws.ProtoTypeShell, &ws.ProtoMsg{
 		Header: ws.ProtoHdr{
 			Proto: ws.ProtoTypeShell,
 		},
@@ -110,57 +150,273 @@ func TestConnect(t *testing.T) {
 	})
 	assert.Nil(t, err)
 
-	err = Close(ws.ProtoTypeShell)
+	err = m.Close(ws.ProtoTypeShell)
 	assert.Nil(t, err)
 }
 
 func TestReconnect(t *testing.T) {
 	srv := newWebsocketServer()
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
 	go func() {
-		_ = srv.ListenAndServe()
+		_ = srv.Serve(l)
 	}()
 	defer func() {
 		_ = srv.Shutdown(context.Background())
 	}()
 
-	_ = Close(ws.ProtoTypeShell)
-
+	m := NewManager(testPingWait)
 	ctx := context.Background()
-	err := Reconnect(ws.ProtoTypeShell, "ws://localhost:8999", "/ws", "token", true, "", 1, ctx)
+	assert.Equal(t, "", m.GetConnectionID(ws.ProtoTypeShell))
+	err = m.Reconnect(ws.ProtoTypeShell, "ws://localhost:8999", "/ws", "token", https.Config{NoVerify: true}, 1, ctx)
+	assert.Nil(t, err)
+	connectionID := m.GetConnectionID(ws.ProtoTypeShell)
+	assert.NotEmpty(t, connectionID)
+
+	// every connection gets a new ID
+	err = m.Reconnect(ws.ProtoTypeShell, "ws://localhost:8999", "/ws", "token", https.Config{NoVerify: true}, 1, ctx)
 	assert.Nil(t, err)
+	assert.NotEmpty(t, m.GetConnectionID(ws.ProtoTypeShell))
+	assert.NotEqual(t, connectionID, m.GetConnectionID(ws.ProtoTypeShell))
 
-	err = Close(ws.ProtoTypeShell)
+	err = m.Close(ws.ProtoTypeShell)
 	assert.Nil(t, err)
 }
 
-func TestConnectFailed(t *testing.T) {
-	_ = Close(ws.ProtoTypeShell)
+func TestReconnectDoesNotBlock(t *testing.T) {
+	m := NewManager(testPingWait)
+	m.SetReconnectIntervalSeconds(1)
+	m.SetBackoffConfig(BackoffConfig{MaxInterval: time.Minute, Multiplier: 60})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reconnected := make(chan error, 1)
+	go func() {
+		reconnected <- m.Reconnect(ws.ProtoTypeShell, "ws://localhost:1", "/ws", "token",
+			https.Config{}, 0, ctx)
+	}()
+	assert.Eventually(t, func() bool {
+		return m.GetReconnectStatus().Attempt > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the manager is usable while waiting to reconnect
+	done := make(chan struct{})
+	go func() {
+		assert.Equal(t, ErrHandlerNotRegistered, m.Write(ws.ProtoTypeShell, &ws.ProtoMsg{}))
+		assert.Equal(t, "", m.GetActiveServerURL(ws.ProtoTypeShell))
+		assert.Nil(t, m.GetQueueStats(ws.ProtoTypeShell))
+		assert.Equal(t, connection.Counters{}, m.GetCounters(ws.ProtoTypeShell))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("the manager is locked while reconnecting")
+	}
+
+	cancel()
+	assert.NoError(t, <-reconnected)
+}
 
+func TestConnectFailed(t *testing.T) {
+	m := NewManager(testPingWait)
 	ctx := context.Background()
-	err := Connect(ws.ProtoTypeShell, "wrong-url", "/ws", "", true, "token", 1, ctx)
+	err := m.Connect(ws.ProtoTypeShell, "wrong-url", "/ws", "", https.Config{NoVerify: true, ServerCert: "token"}, 1, ctx)
 	assert.NotNil(t, err)
 }
 
 func TestConnectRetries(t *testing.T) {
-	oldReconnectIntervalSeconds := reconnectIntervalSeconds
-	reconnectIntervalSeconds = 1
-	defer func() {
-		reconnectIntervalSeconds = oldReconnectIntervalSeconds
-	}()
-
-	_ = Close(ws.ProtoTypeShell)
+	m := NewManager(testPingWait)
+	m.SetReconnectIntervalSeconds(1)
 
 	ctx := context.Background()
-	err := Reconnect(ws.ProtoTypeShell, "ws://localhost:8999", "/ws", "", true, "token", 3, ctx)
+	err := m.Reconnect(ws.ProtoTypeShell, "ws://localhost:8999", "/ws", "", https.Config{NoVerify: true, ServerCert: "token"}, 3, ctx)
 	assert.Equal(t, ErrConnectionRetriesExhausted, err)
 }
 
+func TestCandidateServers(t *testing.T) {
+	m := NewManager(testPingWait)
+	m.SetServers([]string{"https://a.example.com", "https://b.example.com/", ""})
+	assert.Equal(t, []string{
+		"https://c.example.com",
+		"https://a.example.com",
+		"https://b.example.com",
+	}, m.candidateServers("https://c.example.com"))
+	assert.Equal(t, []string{
+		"https://a.example.com",
+		"https://b.example.com",
+	}, m.candidateServers(""))
+
+	m.setLastWorkingServer("https://b.example.com")
+	assert.Equal(t, []string{
+		"https://b.example.com",
+		"https://a.example.com",
+	}, m.candidateServers("https://a.example.com"))
+}
+
+func TestConnectFailover(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	// the first server refuses connections, the second one works
+	m := NewManager(testPingWait)
+	unavailable := httptest.NewServer(http.NotFoundHandler())
+	unavailableURL := unavailable.URL
+	unavailable.Close()
+	workingURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	m.SetServers([]string{unavailableURL, workingURL})
+
+	err := m.Reconnect(ws.ProtoTypeShell, "", "/ws", "token", https.Config{}, 1, context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, workingURL, m.GetActiveServerURL(ws.ProtoTypeShell))
+
+	// the working server is now the preferred one
+	assert.Equal(t, []string{workingURL, unavailableURL}, m.candidateServers(unavailableURL))
+
+	err = m.Close(ws.ProtoTypeShell)
+	assert.NoError(t, err)
+}
+
+func TestConnectRefreshToken(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer new-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+	serverURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	testCases := map[string]struct {
+		refresher TokenRefresher
+		err       error
+		refreshes int
+	}{
+		"ok": {
+			refresher: func(rejectedToken string) (string, error) {
+				return "new-token", nil
+			},
+			refreshes: 1,
+		},
+		"error, refresh failed": {
+			refresher: func(rejectedToken string) (string, error) {
+				return "", errors.New("no D-Bus")
+			},
+			err:       ErrConnectionRetriesExhausted,
+			refreshes: 1,
+		},
+		"error, no refresher": {
+			err: ErrConnectionRetriesExhausted,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := NewManager(testPingWait)
+			refreshes := 0
+			if tc.refresher != nil {
+				m.SetTokenRefresher(func(rejectedToken string) (string, error) {
+					assert.Equal(t, "expired-token", rejectedToken)
+					refreshes++
+					return tc.refresher(rejectedToken)
+				})
+			}
+
+			err := m.Reconnect(ws.ProtoTypeShell, serverURL, "/ws", "expired-token",
+				https.Config{}, 1, context.Background())
+			assert.Equal(t, tc.err, err)
+			assert.Equal(t, tc.refreshes, refreshes)
+			_ = m.Close(ws.ProtoTypeShell)
+		})
+	}
+}
+
+func TestConnectNoServers(t *testing.T) {
+	m := NewManager(testPingWait)
+	err := m.Reconnect(ws.ProtoTypeShell, "", "/ws", "token", https.Config{}, 1, context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, "", m.GetActiveServerURL(12345))
+}
+
+func TestIndependentManagers(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	newServer := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			data, _ := msgpack.Marshal(&ws.ProtoMsg{Body: []byte(body)})
+			_ = conn.WriteMessage(websocket.BinaryMessage, data)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}))
+	}
+	one := newServer("one")
+	defer one.Close()
+	two := newServer("two")
+	defer two.Close()
+
+	m1 := NewManager(testPingWait)
+	m2 := NewManager(testPingWait)
+	err := m1.Connect(ws.ProtoTypeShell, one.URL, "/ws", "token", https.Config{}, 1,
+		context.Background())
+	assert.NoError(t, err)
+	err = m2.Connect(ws.ProtoTypeShell, two.URL, "/ws", "token", https.Config{}, 1,
+		context.Background())
+	assert.NoError(t, err)
+
+	assert.Equal(t, one.URL, m1.GetActiveServerURL(ws.ProtoTypeShell))
+	assert.Equal(t, two.URL, m2.GetActiveServerURL(ws.ProtoTypeShell))
+	msg, err := m1.Read(ws.ProtoTypeShell)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte("one"), msg.Body)
+	}
+	msg, err = m2.Read(ws.ProtoTypeShell)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte("two"), msg.Body)
+	}
+
+	assert.NoError(t, m1.Close(ws.ProtoTypeShell))
+	assert.NoError(t, m2.Close(ws.ProtoTypeShell))
+}
+
 func TestCloseFailed(t *testing.T) {
-	err := Close(12345)
+	m := NewManager(testPingWait)
+	err := m.Close(12345)
 	assert.Error(t, err)
 
 }
 func TestWriteFailed(t *testing.T) {
-	err := Write(12345, nil)
+	m := NewManager(testPingWait)
+	err := m.Write(12345, nil)
 	assert.Error(t, err)
 }
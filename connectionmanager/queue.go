@@ -0,0 +1,343 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package connectionmanager
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/connection"
+)
+
+// DefaultQueueSize is the number of messages each outbound queue holds
+const DefaultQueueSize = 64
+
+// Priority of an outbound message; queued messages of a higher priority
+// (lower value) are written before the ones of a lower priority, except that
+// the messages of a session are written in the order they are queued
+type Priority int
+
+const (
+	// PriorityControl is the priority of the pings and pongs, which are the
+	// only messages overtaking the ones queued before for the same session
+	PriorityControl Priority = iota
+	// PriorityInteractive is the priority of the shell, Mender client and
+	// session control messages
+	PriorityInteractive
+	// PriorityBulk is the priority of the file transfer and port forward
+	// messages
+	PriorityBulk
+
+	numPriorities = 3
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityControl:
+		return "control"
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityBulk:
+		return "bulk"
+	}
+	return "unknown"
+}
+
+func priorityOf(msg *ws.ProtoMsg) Priority {
+	switch msg.Header.Proto {
+	case ws.ProtoTypeControl:
+		if msg.Header.MsgType == ws.MessageTypePing ||
+			msg.Header.MsgType == ws.MessageTypePong {
+			return PriorityControl
+		}
+		return PriorityInteractive
+	case ws.ProtoTypeShell:
+		if msg.Header.MsgType == wsshell.MessageTypePingShell ||
+			msg.Header.MsgType == wsshell.MessageTypePongShell {
+			return PriorityControl
+		}
+		return PriorityInteractive
+	case ws.ProtoTypeMenderClient:
+		return PriorityInteractive
+	}
+	return PriorityBulk
+}
+
+// QueueStats describes the state of the outbound queue of one priority
+type QueueStats struct {
+	Priority Priority
+	// Number of messages waiting to be written
+	Depth int
+	// Number of messages the queue holds
+	Capacity int
+	// Number of messages written to the connection
+	Sent uint64
+	// Number of times a writer had to wait because the queue was full
+	Blocked uint64
+}
+
+// outboundQueue writes the messages to the connection from a single
+// goroutine, taking them from the queue of the highest priority first; a
+// message is queued with the lowest priority of the messages of its session
+// still queued, so that a session's close or error never overtakes its data
+type outboundQueue struct {
+	// accessed atomically; kept first for 64-bit alignment on 32-bit
+	// platforms
+	sent    [numPriorities]uint64
+	blocked [numPriorities]uint64
+
+	connection *connection.Connection
+	logger     *log.Entry
+	size       int
+	// mutex protects the queues, the sessions and the changed channel
+	mutex  sync.Mutex
+	queues [numPriorities][]*ws.ProtoMsg
+	// number of queued messages of each session by priority
+	sessions map[string]*[numPriorities]int
+	// changed is closed, and replaced, once the queues change if waiting
+	// is set
+	changed  chan struct{}
+	waiting  bool
+	done     chan struct{}
+	finished chan struct{}
+	stopOnce sync.Once
+	// error returned to the writers once the queue is stopped, and the
+	// deadline for writing the remaining messages
+	err           error
+	flushDeadline time.Time
+}
+
+func newOutboundQueue(c *connection.Connection, size int, logger *log.Entry) *outboundQueue {
+	if size < 1 {
+		size = 1
+	}
+	return &outboundQueue{
+		connection: c,
+		logger:     logger,
+		size:       size,
+		sessions:   make(map[string]*[numPriorities]int),
+		changed:    make(chan struct{}),
+		done:       make(chan struct{}),
+		finished:   make(chan struct{}),
+	}
+}
+
+// priority returns the priority to queue the message with: its own one,
+// lowered to the lowest one of the queued messages of the same session
+func (q *outboundQueue) priority(msg *ws.ProtoMsg) Priority {
+	p := priorityOf(msg)
+	if p == PriorityControl || msg.Header.SessionID == "" {
+		return p
+	}
+	if queued, ok := q.sessions[msg.Header.SessionID]; ok {
+		for i := numPriorities - 1; i > int(p); i-- {
+			if queued[i] > 0 {
+				return Priority(i)
+			}
+		}
+	}
+	return p
+}
+
+// wait returns the channel closed on the next change of the queues; the
+// caller must hold the mutex
+func (q *outboundQueue) wait() <-chan struct{} {
+	q.waiting = true
+	return q.changed
+}
+
+// notify wakes the goroutines waiting for the queues to change; the caller
+// must hold the mutex
+func (q *outboundQueue) notify() {
+	if q.waiting {
+		close(q.changed)
+		q.changed = make(chan struct{})
+		q.waiting = false
+	}
+}
+
+// count updates the number of queued messages of the session by delta
+func (q *outboundQueue) count(msg *ws.ProtoMsg, p Priority, delta int) {
+	if p == PriorityControl || msg.Header.SessionID == "" {
+		return
+	}
+	queued, ok := q.sessions[msg.Header.SessionID]
+	if !ok {
+		queued = &[numPriorities]int{}
+		q.sessions[msg.Header.SessionID] = queued
+	}
+	queued[p] += delta
+	if *queued == [numPriorities]int{} {
+		delete(q.sessions, msg.Header.SessionID)
+	}
+}
+
+// push queues the message, blocking while the queue of its priority is full
+func (q *outboundQueue) push(msg *ws.ProtoMsg) error {
+	blocked := false
+	for {
+		q.mutex.Lock()
+		select {
+		case <-q.done:
+			q.mutex.Unlock()
+			return q.err
+		default:
+		}
+
+		p := q.priority(msg)
+		if len(q.queues[p]) < q.size {
+			q.queues[p] = append(q.queues[p], msg)
+			q.count(msg, p, 1)
+			q.notify()
+			q.mutex.Unlock()
+			return nil
+		}
+		changed := q.wait()
+		q.mutex.Unlock()
+
+		if !blocked {
+			blocked = true
+			atomic.AddUint64(&q.blocked[p], 1)
+		}
+		select {
+		case <-changed:
+		case <-q.done:
+			return q.err
+		}
+	}
+}
+
+// next returns the queued message of the highest priority, waiting for one
+// if the queues are empty; it returns false once the queue is stopped
+func (q *outboundQueue) next() (*ws.ProtoMsg, Priority, bool) {
+	for {
+		q.mutex.Lock()
+		msg, p, ok := q.pop()
+		if ok {
+			q.mutex.Unlock()
+			return msg, p, true
+		}
+		changed := q.wait()
+		q.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-q.done:
+			return nil, 0, false
+		}
+	}
+}
+
+func (q *outboundQueue) write(msg *ws.ProtoMsg, p Priority) error {
+	err := q.connection.WriteMessage(msg)
+	if err != nil {
+		q.logger.Errorf("connection manager failed to write a %s message: %s", p, err.Error())
+		return err
+	}
+	atomic.AddUint64(&q.sent[p], 1)
+	return nil
+}
+
+// run writes the queued messages until the queue is stopped
+func (q *outboundQueue) run() {
+	defer close(q.finished)
+	for {
+		msg, p, ok := q.next()
+		if !ok {
+			break
+		}
+		if err := q.write(msg, p); err != nil {
+			q.stop(err, time.Time{})
+			return
+		}
+	}
+
+	// write the messages queued before the queue was stopped, if required
+	for time.Now().Before(q.flushDeadline) {
+		msg, p, ok := q.pending()
+		if !ok || q.write(msg, p) != nil {
+			return
+		}
+	}
+}
+
+// pending returns the queued message of the highest priority without waiting
+// for one
+func (q *outboundQueue) pending() (*ws.ProtoMsg, Priority, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.pop()
+}
+
+// pop removes the queued message of the highest priority, if any; the caller
+// must hold the mutex
+func (q *outboundQueue) pop() (*ws.ProtoMsg, Priority, bool) {
+	for p := range q.queues {
+		if len(q.queues[p]) > 0 {
+			msg := q.queues[p][0]
+			q.queues[p][0] = nil
+			q.queues[p] = q.queues[p][1:]
+			q.count(msg, Priority(p), -1)
+			q.notify()
+			return msg, Priority(p), true
+		}
+	}
+	return nil, 0, false
+}
+
+// stop stops accepting messages, making the writers fail with err; the
+// messages already queued are written until the flush deadline, if any
+func (q *outboundQueue) stop(err error, flushDeadline time.Time) {
+	q.stopOnce.Do(func() {
+		q.mutex.Lock()
+		q.err = err
+		q.flushDeadline = flushDeadline
+		close(q.done)
+		q.mutex.Unlock()
+	})
+}
+
+// close stops the queue and closes the connection; if flushTimeout is not
+// zero, the queued messages are written before closing the connection
+func (q *outboundQueue) close(flushTimeout time.Duration) error {
+	if flushTimeout > 0 {
+		q.stop(ErrConnectionClosed, time.Now().Add(flushTimeout))
+		<-q.finished
+	} else {
+		q.stop(ErrConnectionClosed, time.Time{})
+	}
+	return q.connection.Close()
+}
+
+func (q *outboundQueue) stats() []QueueStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	stats := make([]QueueStats, numPriorities)
+	for i := range q.queues {
+		stats[i] = QueueStats{
+			Priority: Priority(i),
+			Depth:    len(q.queues[i]),
+			Capacity: q.size,
+			Sent:     atomic.LoadUint64(&q.sent[i]),
+			Blocked:  atomic.LoadUint64(&q.blocked[i]),
+		}
+	}
+	return stats
+}
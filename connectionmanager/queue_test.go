@@ -0,0 +1,295 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package connectionmanager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/mender-connect/client/https"
+	"github.com/mendersoftware/mender-connect/connection"
+)
+
+// newRecordingServer returns a server sending the bodies of the messages it
+// receives to the returned channel
+func newRecordingServer(t *testing.T) (*httptest.Server, chan string) {
+	received := make(chan string, 100)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg := &ws.ProtoMsg{}
+			if err := msgpack.Unmarshal(data, msg); err != nil {
+				t.Error(err)
+				return
+			}
+			received <- string(msg.Body)
+		}
+	}))
+	return srv, received
+}
+
+func dialRecordingServer(t *testing.T, srv *httptest.Server) *connection.Connection {
+	u, err := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := connection.NewConnection(*u, "token", connection.DefaultWriteWait,
+		connection.DefaultMaxMessageSize, testPingWait, https.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func receive(t *testing.T, received chan string, n int) []string {
+	var bodies []string
+	for i := 0; i < n; i++ {
+		select {
+		case body := <-received:
+			bodies = append(bodies, body)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d messages out of %d", i, n)
+		}
+	}
+	return bodies
+}
+
+func newMessage(proto ws.ProtoType, msgType, body string) *ws.ProtoMsg {
+	return &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:   proto,
+			MsgType: msgType,
+		},
+		Body: []byte(body),
+	}
+}
+
+func TestPriorityOf(t *testing.T) {
+	testCases := map[string]struct {
+		msg      *ws.ProtoMsg
+		priority Priority
+	}{
+		"control pong": {
+			msg:      newMessage(ws.ProtoTypeControl, ws.MessageTypePong, ""),
+			priority: PriorityControl,
+		},
+		"control close": {
+			msg:      newMessage(ws.ProtoTypeControl, ws.MessageTypeClose, ""),
+			priority: PriorityInteractive,
+		},
+		"shell ping": {
+			msg:      newMessage(ws.ProtoTypeShell, wsshell.MessageTypePingShell, ""),
+			priority: PriorityControl,
+		},
+		"shell data": {
+			msg:      newMessage(ws.ProtoTypeShell, wsshell.MessageTypeShellCommand, ""),
+			priority: PriorityInteractive,
+		},
+		"mender client": {
+			msg:      newMessage(ws.ProtoTypeMenderClient, "", ""),
+			priority: PriorityInteractive,
+		},
+		"file transfer": {
+			msg:      newMessage(ws.ProtoTypeFileTransfer, "", ""),
+			priority: PriorityBulk,
+		},
+		"port forward": {
+			msg:      newMessage(ws.ProtoTypePortForward, "", ""),
+			priority: PriorityBulk,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.priority, priorityOf(tc.msg))
+		})
+	}
+}
+
+func TestOutboundQueuePriority(t *testing.T) {
+	srv, received := newRecordingServer(t)
+	defer srv.Close()
+
+	q := newOutboundQueue(dialRecordingServer(t, srv), 8, log.NewEntry(log.StandardLogger()))
+	defer q.close(0)
+	for _, msg := range []*ws.ProtoMsg{
+		newMessage(ws.ProtoTypeFileTransfer, "", "bulk-1"),
+		newMessage(ws.ProtoTypeShell, wsshell.MessageTypeShellCommand, "shell"),
+		newMessage(ws.ProtoTypePortForward, "", "bulk-2"),
+		newMessage(ws.ProtoTypeControl, ws.MessageTypePong, "pong"),
+	} {
+		assert.NoError(t, q.push(msg))
+	}
+
+	stats := q.stats()
+	assert.Equal(t, 1, stats[PriorityControl].Depth)
+	assert.Equal(t, 1, stats[PriorityInteractive].Depth)
+	assert.Equal(t, 2, stats[PriorityBulk].Depth)
+	assert.Equal(t, 8, stats[PriorityBulk].Capacity)
+
+	go q.run()
+	assert.Equal(t, []string{"pong", "shell", "bulk-1", "bulk-2"}, receive(t, received, 4))
+
+	stats = q.stats()
+	assert.Equal(t, 0, stats[PriorityBulk].Depth)
+	assert.Equal(t, uint64(1), stats[PriorityControl].Sent)
+	assert.Equal(t, uint64(1), stats[PriorityInteractive].Sent)
+	assert.Equal(t, uint64(2), stats[PriorityBulk].Sent)
+}
+
+func TestOutboundQueueSessionOrder(t *testing.T) {
+	srv, received := newRecordingServer(t)
+	defer srv.Close()
+
+	sessionMessage := func(proto ws.ProtoType, msgType, sessionID, body string) *ws.ProtoMsg {
+		msg := newMessage(proto, msgType, body)
+		msg.Header.SessionID = sessionID
+		return msg
+	}
+	q := newOutboundQueue(dialRecordingServer(t, srv), 8, log.NewEntry(log.StandardLogger()))
+	defer q.close(0)
+	for _, msg := range []*ws.ProtoMsg{
+		sessionMessage(ws.ProtoTypeFileTransfer, "", "1", "chunk-1"),
+		sessionMessage(ws.ProtoTypeFileTransfer, "", "1", "chunk-2"),
+		sessionMessage(ws.ProtoTypeShell, wsshell.MessageTypeShellCommand, "1", "shell-1"),
+		sessionMessage(ws.ProtoTypeControl, ws.MessageTypeClose, "1", "close-1"),
+		sessionMessage(ws.ProtoTypeShell, wsshell.MessageTypeShellCommand, "2", "shell-2"),
+		sessionMessage(ws.ProtoTypeControl, ws.MessageTypeClose, "2", "close-2"),
+		sessionMessage(ws.ProtoTypeShell, wsshell.MessageTypePingShell, "1", "ping-1"),
+	} {
+		assert.NoError(t, q.push(msg))
+	}
+
+	stats := q.stats()
+	assert.Equal(t, 1, stats[PriorityControl].Depth)
+	assert.Equal(t, 2, stats[PriorityInteractive].Depth)
+	assert.Equal(t, 4, stats[PriorityBulk].Depth)
+
+	// only the ping overtakes the messages queued before for its session
+	go q.run()
+	assert.Equal(t, []string{"ping-1", "shell-2", "close-2", "chunk-1", "chunk-2", "shell-1",
+		"close-1"}, receive(t, received, 7))
+
+	q.mutex.Lock()
+	assert.Empty(t, q.sessions)
+	q.mutex.Unlock()
+}
+
+func TestOutboundQueueBackpressure(t *testing.T) {
+	srv, received := newRecordingServer(t)
+	defer srv.Close()
+
+	q := newOutboundQueue(dialRecordingServer(t, srv), 1, log.NewEntry(log.StandardLogger()))
+	defer q.close(0)
+	assert.NoError(t, q.push(newMessage(ws.ProtoTypeFileTransfer, "", "bulk-1")))
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- q.push(newMessage(ws.ProtoTypeFileTransfer, "", "bulk-2"))
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push did not block on a full queue")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, uint64(1), q.stats()[PriorityBulk].Blocked)
+
+	// the other priorities are not affected
+	assert.NoError(t, q.push(newMessage(ws.ProtoTypeShell, "", "shell")))
+
+	go q.run()
+	select {
+	case err := <-pushed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("push did not return after the queue was drained")
+	}
+	assert.Equal(t, []string{"shell", "bulk-1", "bulk-2"}, receive(t, received, 3))
+}
+
+func TestOutboundQueueClose(t *testing.T) {
+	srv, received := newRecordingServer(t)
+	defer srv.Close()
+
+	q := newOutboundQueue(dialRecordingServer(t, srv), 4, log.NewEntry(log.StandardLogger()))
+	assert.NoError(t, q.push(newMessage(ws.ProtoTypeShell, "", "one")))
+	assert.NoError(t, q.push(newMessage(ws.ProtoTypeShell, "", "two")))
+	go q.run()
+
+	// the queued messages are written before closing the connection
+	assert.NoError(t, q.close(connection.DefaultWriteWait))
+	assert.Equal(t, []string{"one", "two"}, receive(t, received, 2))
+
+	err := q.push(newMessage(ws.ProtoTypeShell, "", "three"))
+	assert.Equal(t, ErrConnectionClosed, err)
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	srv, received := newRecordingServer(t)
+	defer srv.Close()
+
+	m := NewManager(testPingWait)
+	m.SetQueueSize(4)
+	err := m.Connect(ws.ProtoTypeShell, srv.URL, "/", "token", https.Config{}, 1, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, m.GetQueueStats(ws.ProtoTypeShell)[PriorityBulk].Capacity)
+
+	err = m.Write(ws.ProtoTypeShell, newMessage(ws.ProtoTypeShell, "", "data"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"data"}, receive(t, received, 1))
+
+	assert.NoError(t, m.Close(ws.ProtoTypeShell))
+	err = m.Write(ws.ProtoTypeShell, newMessage(ws.ProtoTypeShell, "", "data"))
+	assert.Equal(t, ErrConnectionClosed, err)
+}
+
+func TestWriteReusedBuffer(t *testing.T) {
+	srv, received := newRecordingServer(t)
+	defer srv.Close()
+
+	m := NewManager(testPingWait)
+	err := m.Connect(ws.ProtoTypeShell, srv.URL, "/", "token", https.Config{}, 1, nil)
+	assert.NoError(t, err)
+	defer m.Close(ws.ProtoTypeShell)
+
+	// the writers reuse their buffer once Write returns, as io.Writer
+	buf := []byte("0")
+	msg := &ws.ProtoMsg{Header: ws.ProtoHdr{Proto: ws.ProtoTypeShell}, Body: buf}
+	for i := 0; i < 10; i++ {
+		buf[0] = byte('0' + i)
+		assert.NoError(t, m.Write(ws.ProtoTypeShell, msg))
+	}
+	assert.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"},
+		receive(t, received, 10))
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package control implements the local control API of the daemon, a JSON
+// API served over HTTP on a Unix socket:
+//
+//  GET    /status          the status of the daemon
+//  GET    /sessions        the open sessions
+//  DELETE /sessions/{id}   closes a session
+//  POST   /disconnect      closes the sessions and the connection
+package control
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoSession is returned when killing a session which does not exist
+var ErrNoSession = errors.New("no such session")
+
+// Status is the status of the daemon
+type Status struct {
+	Version      string               `json:"version"`
+	Connection   Connection           `json:"connection"`
+	Sessions     int                  `json:"sessions"`
+	FileTransfer FileTransferCounters `json:"file_transfer"`
+	PortForwards []PortForward        `json:"port_forwards"`
+}
+
+// Connection is the state of the connection to the server
+type Connection struct {
+	// State is connected, disconnected or unauthorized
+	State     string `json:"state"`
+	ServerURL string `json:"server_url"`
+	// Number of consecutive failed reconnection attempts
+	ReconnectAttempt uint `json:"reconnect_attempt"`
+	// Time of the next reconnection attempt, if waiting to reconnect
+	NextRetry   *time.Time `json:"next_retry,omitempty"`
+	CircuitOpen bool       `json:"circuit_open"`
+	Compression bool       `json:"compression"`
+	// Bytes of the messages written and read, before compression, and
+	// bytes written to and read from the network
+	TxMessageBytes uint64 `json:"tx_message_bytes"`
+	TxWireBytes    uint64 `json:"tx_wire_bytes"`
+	RxMessageBytes uint64 `json:"rx_message_bytes"`
+	RxWireBytes    uint64 `json:"rx_wire_bytes"`
+}
+
+// FileTransferCounters are the bytes transferred off and onto the device
+type FileTransferCounters struct {
+	TxBytes uint64 `json:"tx_bytes"`
+	RxBytes uint64 `json:"rx_bytes"`
+	// Exponentially weighted moving averages of the transfers over the
+	// last minute
+	TxAverage1m float64 `json:"tx_average_1m"`
+	RxAverage1m float64 `json:"rx_average_1m"`
+}
+
+// Session is an open remote session
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Protocol  string    `json:"protocol"`
+	StartedAt time.Time `json:"started_at"`
+	ActiveAt  time.Time `json:"active_at"`
+}
+
+// PortForward is an open port forward
+type PortForward struct {
+	SessionID    string    `json:"session_id"`
+	ConnectionID string    `json:"connection_id"`
+	Protocol     string    `json:"protocol"`
+	RemoteHost   string    `json:"remote_host"`
+	RemotePort   uint16    `json:"remote_port"`
+	StartedAt    time.Time `json:"started_at"`
+}
+
+// Handler serves the requests of the control API
+type Handler interface {
+	Status() Status
+	Sessions() []Session
+	// KillSession closes the session with the given ID, notifying the
+	// server; it returns ErrNoSession if there is no such session.
+	KillSession(sessionID string) error
+	// Disconnect closes the sessions and the connection to the server.
+	Disconnect()
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// the host is ignored, the requests go to the socket
+	clientBaseURL = "http://mender-connect"
+	clientTimeout = 10 * time.Second
+)
+
+// Client calls the control API of the daemon
+type Client struct {
+	path string
+	http *http.Client
+}
+
+// NewClient returns a client of the control socket at the given path
+func NewClient(path string) *Client {
+	return &Client{
+		path: path,
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			},
+			Timeout: clientTimeout,
+		},
+	}
+}
+
+// Status returns the status of the daemon
+func (c *Client) Status() (*Status, error) {
+	status := &Status{}
+	if err := c.do(http.MethodGet, "/status", status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Sessions returns the open sessions
+func (c *Client) Sessions() ([]Session, error) {
+	var sessions []Session
+	if err := c.do(http.MethodGet, "/sessions", &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// KillSession closes the session with the given ID
+func (c *Client) KillSession(sessionID string) error {
+	return c.do(http.MethodDelete, "/sessions/"+url.PathEscape(sessionID), nil)
+}
+
+// Disconnect closes the sessions and the connection to the server
+func (c *Client) Disconnect() error {
+	return c.do(http.MethodPost, "/disconnect", nil)
+}
+
+func (c *Client) do(method, path string, result interface{}) error {
+	req, err := http.NewRequest(method, clientBaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := c.http.Do(req)
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to call the daemon on %s", c.path)
+	}
+	defer rsp.Body.Close()
+
+	switch {
+	case rsp.StatusCode == http.StatusNotFound && method == http.MethodDelete:
+		return ErrNoSession
+	case rsp.StatusCode >= 300:
+		errRsp := errorResponse{}
+		if err := json.NewDecoder(rsp.Body).Decode(&errRsp); err != nil || errRsp.Error == "" {
+			return errors.Errorf("the daemon returned %s", rsp.Status)
+		}
+		return errors.New(errRsp.Error)
+	case result != nil:
+		if err := json.NewDecoder(rsp.Body).Decode(result); err != nil {
+			return errors.Wrap(err, "invalid response from the daemon")
+		}
+	}
+	return nil
+}
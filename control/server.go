@@ -0,0 +1,160 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package control
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Server serves the control API on a Unix socket
+type Server struct {
+	path     string
+	listener *net.UnixListener
+	server   *http.Server
+	handler  Handler
+}
+
+// Listen creates the control socket at the given path, replacing a stale
+// one; the socket is accessible to root and, if gid is not negative, to the
+// members of the group gid
+func Listen(path string, gid int, handler Handler) (*Server, error) {
+	if !filepath.IsAbs(path) {
+		return nil, errors.Errorf("the control socket path %q is not absolute", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// the socket is created aside and moved into place once its
+	// permissions are set
+	newPath := path + ".new"
+	_ = os.Remove(newPath)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: newPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	mode := os.FileMode(0600)
+	if gid >= 0 {
+		mode = 0660
+		err = os.Chown(newPath, -1, gid)
+	}
+	if err == nil {
+		err = os.Chmod(newPath, mode)
+	}
+	if err == nil {
+		err = os.Rename(newPath, path)
+	}
+	if err != nil {
+		listener.Close()
+		os.Remove(newPath)
+		return nil, err
+	}
+
+	s := &Server{
+		path:     path,
+		listener: listener,
+		handler:  handler,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.serveStatus)
+	mux.HandleFunc("/sessions", s.serveSessions)
+	mux.HandleFunc("/sessions/", s.serveSession)
+	mux.HandleFunc("/disconnect", s.serveDisconnect)
+	s.server = &http.Server{Handler: mux}
+	return s, nil
+}
+
+// Serve serves the requests until the server closes
+func (s *Server) Serve() error {
+	err := s.server.Serve(s.listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close stops serving and removes the socket
+func (s *Server) Close() error {
+	err := s.server.Close()
+	if rmErr := os.Remove(s.path); rmErr != nil && !os.IsNotExist(rmErr) {
+		log.Debugf("failed to remove the control socket %s: %s", s.path, rmErr.Error())
+	}
+	return err
+}
+
+func (s *Server) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.handler.Status())
+}
+
+func (s *Server) serveSessions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.handler.Sessions())
+}
+
+func (s *Server) serveSession(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+	sessionID := strings.TrimPrefix(r.URL.Path, "/sessions/")
+	if err := s.handler.KillSession(sessionID); err == ErrNoSession {
+		writeError(w, http.StatusNotFound, err.Error())
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) serveDisconnect(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	s.handler.Disconnect()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debugf("failed to write the control API response: %s", err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorResponse{Error: message})
+}
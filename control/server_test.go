@@ -0,0 +1,156 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package control
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type testHandler struct {
+	status       Status
+	sessions     []Session
+	killed       []string
+	disconnected bool
+}
+
+func (h *testHandler) Status() Status {
+	return h.status
+}
+
+func (h *testHandler) Sessions() []Session {
+	return h.sessions
+}
+
+func (h *testHandler) KillSession(sessionID string) error {
+	switch sessionID {
+	case "unknown":
+		return ErrNoSession
+	case "failing":
+		return errors.New("failed to stop the shell")
+	}
+	h.killed = append(h.killed, sessionID)
+	return nil
+}
+
+func (h *testHandler) Disconnect() {
+	h.disconnected = true
+}
+
+func TestServer(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mender-connect-control")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	socketPath := path.Join(tdir, "run", "control.sock")
+
+	startedAt := time.Date(2021, 5, 4, 12, 0, 0, 0, time.UTC)
+	handler := &testHandler{
+		status: Status{
+			Version: "1.0.0",
+			Connection: Connection{
+				State:       "connected",
+				ServerURL:   "https://hosted.mender.io",
+				Compression: true,
+			},
+			Sessions: 1,
+			PortForwards: []PortForward{{
+				SessionID:    "session",
+				ConnectionID: "c1",
+				Protocol:     "tcp",
+				RemoteHost:   "localhost",
+				RemotePort:   22,
+				StartedAt:    startedAt,
+			}},
+		},
+		sessions: []Session{{
+			ID:        "session",
+			UserID:    "user",
+			Protocol:  "portforward",
+			StartedAt: startedAt,
+			ActiveAt:  startedAt,
+		}},
+	}
+	server, err := Listen(socketPath, -1, handler)
+	assert.NoError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve()
+	}()
+
+	info, err := os.Stat(socketPath)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.ModeSocket|0600, info.Mode())
+	}
+
+	client := NewClient(socketPath)
+	status, err := client.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, &handler.status, status)
+
+	sessions, err := client.Sessions()
+	assert.NoError(t, err)
+	assert.Equal(t, handler.sessions, sessions)
+
+	assert.NoError(t, client.KillSession("session"))
+	assert.Equal(t, []string{"session"}, handler.killed)
+	assert.Equal(t, ErrNoSession, client.KillSession("unknown"))
+	assert.EqualError(t, client.KillSession("failing"), "failed to stop the shell")
+
+	assert.NoError(t, client.Disconnect())
+	assert.True(t, handler.disconnected)
+
+	assert.EqualError(t, client.do(http.MethodPost, "/status", nil), "method not allowed")
+
+	assert.NoError(t, server.Close())
+	assert.NoError(t, <-served)
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = client.Status()
+	assert.Error(t, err)
+}
+
+func TestListenGroup(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mender-connect-control")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	socketPath := path.Join(tdir, "control.sock")
+
+	// a stale socket is replaced
+	err = ioutil.WriteFile(socketPath, nil, 0644)
+	assert.NoError(t, err)
+
+	server, err := Listen(socketPath, os.Getgid(), &testHandler{})
+	assert.NoError(t, err)
+	defer server.Close()
+	info, err := os.Stat(socketPath)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.ModeSocket|0660, info.Mode())
+	}
+	_, err = os.Stat(socketPath + ".new")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestListenRelativePath(t *testing.T) {
+	_, err := Listen("control.sock", -1, &testHandler{})
+	assert.EqualError(t, err, `the control socket path "control.sock" is not absolute`)
+}
@@ -0,0 +1,152 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// journaldSocketPath is the socket of the native protocol of journald
+var journaldSocketPath = "/run/systemd/journal/socket"
+
+// journaldHook sends the log entries to journald over its native
+// protocol, the fields of the entries becoming journal fields
+type journaldHook struct {
+	mutex sync.Mutex
+	conn  *net.UnixConn
+}
+
+func newJournaldHook(socketPath string) (*journaldHook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldHook{conn: conn}, nil
+}
+
+// Levels returns all the levels, the entries are filtered by the logger
+func (h *journaldHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire sends the entry to journald
+func (h *journaldHook) Fire(entry *log.Entry) error {
+	var b bytes.Buffer
+	writeJournaldField(&b, "MESSAGE", entry.Message)
+	writeJournaldField(&b, "PRIORITY", fmt.Sprintf("%d", syslogPriority(entry.Level)))
+	writeJournaldField(&b, "SYSLOG_IDENTIFIER", identifier)
+	for key, value := range entry.Data {
+		if name := journaldFieldName(key); name != "" {
+			writeJournaldField(&b, name, fmt.Sprint(value))
+		}
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	_, err := h.conn.Write(b.Bytes())
+	if isMessageTooLong(err) {
+		err = h.sendFile(b.Bytes())
+	}
+	return err
+}
+
+// sendFile passes the entries too large for a datagram in a file, as
+// required by the native protocol
+func (h *journaldHook) sendFile(data []byte) error {
+	file, err := ioutil.TempFile("/dev/shm", "mender-connect-journal-")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	_, _, err = h.conn.WriteMsgUnix(nil, syscall.UnixRights(int(file.Fd())), nil)
+	return err
+}
+
+// Close closes the connection to journald
+func (h *journaldHook) Close() error {
+	return h.conn.Close()
+}
+
+func isMessageTooLong(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.EMSGSIZE || sysErr.Err == syscall.ENOBUFS
+		}
+	}
+	return false
+}
+
+// writeJournaldField writes a field in the format of the native protocol,
+// the values with newlines prefixed with their length
+func writeJournaldField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if !strings.ContainsRune(value, '\n') {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// journaldFieldName returns the journal field name of a log entry field:
+// upper case letters, digits and underscores, not starting with an
+// underscore or a digit
+func journaldFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	return strings.TrimLeft(name, "_0123456789")
+}
+
+// syslogPriority returns the syslog priority of a log level
+func syslogPriority(level log.Level) int {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return 2
+	case log.ErrorLevel:
+		return 3
+	case log.WarnLevel:
+		return 4
+	case log.InfoLevel:
+		return 6
+	}
+	return 7
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+)
+
+func listenUnixgram(t *testing.T, socketPath string) *net.UnixConn {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readDatagram(t *testing.T, conn *net.UnixConn) string {
+	b := make([]byte, 65536)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b[:n])
+}
+
+func TestJournald(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "logging")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	socketPath := path.Join(tdir, "journal.socket")
+	conn := listenUnixgram(t, socketPath)
+	defer func(socketPath string) {
+		journaldSocketPath = socketPath
+	}(journaldSocketPath)
+	journaldSocketPath = socketPath
+
+	logger := log.New()
+	closer, err := setup(logger, config.LogConfig{
+		Format:      config.LogFormatJSON,
+		Destination: config.LogDestinationJournald,
+	})
+	assert.NoError(t, err)
+	defer closer.Close()
+
+	logger.WithFields(log.Fields{
+		FieldSessionID: "session",
+		"2nd-field":    "value",
+	}).Warn("message")
+	datagram := readDatagram(t, conn)
+	fields := strings.Split(strings.TrimSuffix(datagram, "\n"), "\n")
+	assert.ElementsMatch(t, []string{
+		"MESSAGE=message",
+		"PRIORITY=4",
+		"SYSLOG_IDENTIFIER=mender-connect",
+		"SESSION_ID=session",
+		"ND_FIELD=value",
+	}, fields)
+
+	logger.Error("multi\nline")
+	var expected bytes.Buffer
+	expected.WriteString("MESSAGE\n")
+	_ = binary.Write(&expected, binary.LittleEndian, uint64(len("multi\nline")))
+	expected.WriteString("multi\nline\n")
+	assert.True(t, strings.HasPrefix(readDatagram(t, conn), expected.String()))
+}
+
+func TestJournaldNotAvailable(t *testing.T) {
+	_, err := newJournaldHook("/does/not/exist")
+	assert.Error(t, err)
+}
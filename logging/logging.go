@@ -0,0 +1,139 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package logging sets up the log output of the daemon and defines the
+// fields the log entries carry.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/config"
+	"github.com/mendersoftware/mender-connect/utils"
+)
+
+// Names of the fields identifying the session, its protocol, its user and
+// the connection to the server in the log entries
+const (
+	FieldSessionID    = "session_id"
+	FieldProto        = "proto"
+	FieldUserID       = "user_id"
+	FieldConnectionID = "connection_id"
+)
+
+// FieldPortForwardID is the name of the field identifying a port forward
+// within its session
+const FieldPortForwardID = "portforward_id"
+
+// identifier is the name the entries are logged under in journald and
+// syslog
+const identifier = "mender-connect"
+
+// ProtoName returns the name of a protocol, as logged in the proto field
+func ProtoName(proto ws.ProtoType) string {
+	switch proto {
+	case ws.ProtoTypeShell:
+		return "shell"
+	case ws.ProtoTypeFileTransfer:
+		return "filetransfer"
+	case ws.ProtoTypePortForward:
+		return "portforward"
+	case ws.ProtoTypeMenderClient:
+		return "menderclient"
+	case ws.ProtoTypeControl:
+		return "control"
+	}
+	return fmt.Sprintf("0x%04X", uint16(proto))
+}
+
+// SessionFields returns the fields of the log entries of a session; the
+// empty session and user IDs are left out
+func SessionFields(sessionID, userID string, proto ws.ProtoType) log.Fields {
+	fields := log.Fields{FieldProto: ProtoName(proto)}
+	if sessionID != "" {
+		fields[FieldSessionID] = sessionID
+	}
+	if userID != "" {
+		fields[FieldUserID] = userID
+	}
+	return fields
+}
+
+// MessageFields returns the fields of the log entries of a message: its
+// session, its protocol and the user who sent it, if the message says
+func MessageFields(hdr *ws.ProtoHdr) log.Fields {
+	userID, _ := hdr.Properties["user_id"].(string)
+	return SessionFields(hdr.SessionID, userID, hdr.Proto)
+}
+
+// newFormatter returns the formatter of the given format
+func newFormatter(format string) log.Formatter {
+	if format == config.LogFormatJSON {
+		return &log.JSONFormatter{}
+	}
+	return &log.TextFormatter{
+		FullTimestamp: true,
+	}
+}
+
+// Setup sets the format and the destination of the standard logger; the
+// destination stays open until the process exits, so that the last entries
+// are not lost
+func Setup(conf config.LogConfig) error {
+	_, err := setup(log.StandardLogger(), conf)
+	return err
+}
+
+// setup sets the format and the destination of the logger, and returns the
+// closer of the destination
+func setup(logger *log.Logger, conf config.LogConfig) (io.Closer, error) {
+	formatter := newFormatter(conf.Format)
+	switch conf.Destination {
+	case config.LogDestinationJournald:
+		hook, err := newJournaldHook(journaldSocketPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to connect to journald")
+		}
+		logger.AddHook(hook)
+		logger.SetOutput(ioutil.Discard)
+		return hook, nil
+	case config.LogDestinationSyslog:
+		hook, err := newSyslogHook(conf.SyslogSocket, conf.Format)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to connect to syslog")
+		}
+		logger.AddHook(hook)
+		logger.SetOutput(ioutil.Discard)
+		return hook, nil
+	case config.LogDestinationFile:
+		file, err := utils.OpenRotatingFile(conf.File,
+			int64(conf.FileMaxSizeMB)*1024*1024, conf.FileMaxBackups, 0640)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open the log file")
+		}
+		logger.SetFormatter(formatter)
+		logger.SetOutput(file)
+		return file, nil
+	}
+	logger.SetFormatter(formatter)
+	logger.SetOutput(os.Stderr)
+	return ioutil.NopCloser(nil), nil
+}
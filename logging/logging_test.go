@@ -0,0 +1,92 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package logging
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+)
+
+func TestProtoName(t *testing.T) {
+	assert.Equal(t, "shell", ProtoName(ws.ProtoTypeShell))
+	assert.Equal(t, "filetransfer", ProtoName(ws.ProtoTypeFileTransfer))
+	assert.Equal(t, "portforward", ProtoName(ws.ProtoTypePortForward))
+	assert.Equal(t, "menderclient", ProtoName(ws.ProtoTypeMenderClient))
+	assert.Equal(t, "control", ProtoName(ws.ProtoTypeControl))
+	assert.Equal(t, "0x00FF", ProtoName(ws.ProtoType(0xff)))
+}
+
+func TestMessageFields(t *testing.T) {
+	fields := MessageFields(&ws.ProtoHdr{
+		Proto:     ws.ProtoTypeShell,
+		SessionID: "session",
+		Properties: map[string]interface{}{
+			"user_id": "user",
+		},
+	})
+	assert.Equal(t, log.Fields{
+		FieldSessionID: "session",
+		FieldProto:     "shell",
+		FieldUserID:    "user",
+	}, fields)
+
+	fields = MessageFields(&ws.ProtoHdr{Proto: ws.ProtoTypePortForward})
+	assert.Equal(t, log.Fields{FieldProto: "portforward"}, fields)
+}
+
+func TestSetupFile(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "logging")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	logPath := path.Join(tdir, "mender-connect.log")
+	logger := log.New()
+	closer, err := setup(logger, config.LogConfig{
+		Format:         config.LogFormatJSON,
+		Destination:    config.LogDestinationFile,
+		File:           logPath,
+		FileMaxSizeMB:  1,
+		FileMaxBackups: 1,
+	})
+	assert.NoError(t, err)
+	logger.WithFields(SessionFields("session", "user", ws.ProtoTypeFileTransfer)).
+		Info("message")
+	assert.NoError(t, closer.Close())
+
+	b, err := ioutil.ReadFile(logPath)
+	assert.NoError(t, err)
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(b, &entry))
+	assert.Equal(t, "message", entry["msg"])
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "session", entry[FieldSessionID])
+	assert.Equal(t, "user", entry[FieldUserID])
+	assert.Equal(t, "filetransfer", entry[FieldProto])
+
+	_, err = setup(logger, config.LogConfig{
+		Destination: config.LogDestinationFile,
+		File:        path.Join(tdir, "does-not-exist", "mender-connect.log"),
+	})
+	assert.Error(t, err)
+}
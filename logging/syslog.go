@@ -0,0 +1,93 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package logging
+
+import (
+	"log/syslog"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/config"
+)
+
+// syslogHook sends the log entries to the syslog daemon, formatted as
+// text or JSON
+type syslogHook struct {
+	mutex     sync.Mutex
+	writer    *syslog.Writer
+	formatter log.Formatter
+}
+
+// newSyslogHook connects to the syslog daemon on the given socket, or on
+// the default one if empty
+func newSyslogHook(socketPath, format string) (*syslogHook, error) {
+	var writer *syslog.Writer
+	var err error
+	if socketPath == "" {
+		writer, err = syslog.New(syslog.LOG_DAEMON, identifier)
+	} else {
+		writer, err = syslog.Dial("unixgram", socketPath, syslog.LOG_DAEMON, identifier)
+		if err != nil {
+			writer, err = syslog.Dial("unix", socketPath, syslog.LOG_DAEMON, identifier)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// syslog timestamps the messages
+	var formatter log.Formatter = &log.TextFormatter{
+		DisableTimestamp: true,
+		DisableColors:    true,
+	}
+	if format == config.LogFormatJSON {
+		formatter = &log.JSONFormatter{}
+	}
+	return &syslogHook{writer: writer, formatter: formatter}, nil
+}
+
+// Levels returns all the levels, the entries are filtered by the logger
+func (h *syslogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire sends the entry with the syslog severity of its level
+func (h *syslogHook) Fire(entry *log.Entry) error {
+	b, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(string(b), "\n")
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	switch entry.Level {
+	case log.PanicLevel, log.FatalLevel:
+		return h.writer.Crit(msg)
+	case log.ErrorLevel:
+		return h.writer.Err(msg)
+	case log.WarnLevel:
+		return h.writer.Warning(msg)
+	case log.InfoLevel:
+		return h.writer.Info(msg)
+	}
+	return h.writer.Debug(msg)
+}
+
+// Close closes the connection to the syslog daemon
+func (h *syslogHook) Close() error {
+	return h.writer.Close()
+}
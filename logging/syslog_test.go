@@ -0,0 +1,54 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/config"
+)
+
+func TestSyslog(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "logging")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	socketPath := path.Join(tdir, "log")
+	conn := listenUnixgram(t, socketPath)
+
+	logger := log.New()
+	closer, err := setup(logger, config.LogConfig{
+		Format:       config.LogFormatText,
+		Destination:  config.LogDestinationSyslog,
+		SyslogSocket: socketPath,
+	})
+	assert.NoError(t, err)
+	defer closer.Close()
+
+	logger.WithField(FieldUserID, "user").Error("message")
+	// daemon facility (3), error severity (3)
+	msg := readDatagram(t, conn)
+	assert.True(t, strings.HasPrefix(msg, "<27>"), msg)
+	assert.Contains(t, msg, "mender-connect[")
+	assert.Contains(t, msg, `level=error msg=message user_id=user`)
+	assert.NotContains(t, msg, "time=")
+}
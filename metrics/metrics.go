@@ -0,0 +1,112 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package metrics exposes the telemetry of the daemon to Prometheus, in the
+// Prometheus text format or in the OpenMetrics one
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Metric types
+const (
+	TypeGauge   = "gauge"
+	TypeCounter = "counter"
+)
+
+// Metric is a family of samples
+type Metric struct {
+	// Name of the metric; the samples of the counters are suffixed
+	// with _total
+	Name    string
+	Help    string
+	Type    string
+	Samples []Sample
+}
+
+// Sample is a value of a metric with the given labels
+type Sample struct {
+	Labels []Label
+	Value  float64
+}
+
+// Label is a name and value pair identifying a sample
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Write writes the metrics in the Prometheus text format, or in the
+// OpenMetrics one if openMetrics is set
+func Write(w io.Writer, metrics []Metric, openMetrics bool) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		name := m.Name
+		if m.Type == TypeCounter && !openMetrics {
+			name += "_total"
+		}
+		bw.WriteString("# HELP " + name + " " + escape(m.Help, false) + "\n")
+		bw.WriteString("# TYPE " + name + " " + m.Type + "\n")
+		sampleName := m.Name
+		if m.Type == TypeCounter {
+			sampleName += "_total"
+		}
+		for _, s := range m.Samples {
+			bw.WriteString(sampleName)
+			if len(s.Labels) > 0 {
+				bw.WriteByte('{')
+				for i, l := range s.Labels {
+					if i > 0 {
+						bw.WriteByte(',')
+					}
+					bw.WriteString(l.Name + `="` + escape(l.Value, true) + `"`)
+				}
+				bw.WriteByte('}')
+			}
+			bw.WriteString(" " + formatValue(s.Value) + "\n")
+		}
+	}
+	if openMetrics {
+		bw.WriteString("# EOF\n")
+	}
+	return bw.Flush()
+}
+
+// escape escapes the backslashes and the line feeds, and the double quotes
+// of the label values
+func escape(s string, quotes bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quotes {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
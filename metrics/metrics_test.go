@@ -0,0 +1,70 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testMetrics = []Metric{{
+	Name: "mender_connect_sessions",
+	Help: "Open sessions, by protocol",
+	Type: TypeGauge,
+	Samples: []Sample{
+		{Labels: []Label{{Name: "protocol", Value: "shell"}}, Value: 2},
+		{Labels: []Label{{Name: "protocol", Value: `"quoted"\` + "\n"}}, Value: 0},
+	},
+}, {
+	Name:    "mender_connect_handler_panics",
+	Help:    "Panics of the session handlers \\ recovered",
+	Type:    TypeCounter,
+	Samples: []Sample{{Value: 3}},
+}, {
+	Name:    "mender_connect_filetransfer_tx_bytes_1m",
+	Help:    "Average",
+	Type:    TypeGauge,
+	Samples: []Sample{{Value: 0.25}, {Value: math.NaN()}},
+}}
+
+func TestWrite(t *testing.T) {
+	var b bytes.Buffer
+	err := Write(&b, testMetrics, false)
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP mender_connect_sessions Open sessions, by protocol
+# TYPE mender_connect_sessions gauge
+mender_connect_sessions{protocol="shell"} 2
+mender_connect_sessions{protocol="\"quoted\"\\\n"} 0
+# HELP mender_connect_handler_panics_total Panics of the session handlers \\ recovered
+# TYPE mender_connect_handler_panics_total counter
+mender_connect_handler_panics_total 3
+# HELP mender_connect_filetransfer_tx_bytes_1m Average
+# TYPE mender_connect_filetransfer_tx_bytes_1m gauge
+mender_connect_filetransfer_tx_bytes_1m 0.25
+mender_connect_filetransfer_tx_bytes_1m NaN
+`, b.String())
+
+	b.Reset()
+	err = Write(&b, testMetrics[1:2], true)
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP mender_connect_handler_panics Panics of the session handlers \\ recovered
+# TYPE mender_connect_handler_panics counter
+mender_connect_handler_panics_total 3
+# EOF
+`, b.String())
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Content types of the formats
+const (
+	contentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Collector returns the current metrics
+type Collector func() []Metric
+
+// Handler serves the metrics on /metrics, in the OpenMetrics format if
+// accepted by the client
+func Handler(collect Collector) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+		if openMetrics {
+			w.Header().Set("Content-Type", contentTypeOpenMetrics)
+		} else {
+			w.Header().Set("Content-Type", contentTypeText)
+		}
+		if err := Write(w, collect(), openMetrics); err != nil {
+			log.Debugf("failed to write the metrics: %s", err.Error())
+		}
+	})
+	return mux
+}
+
+// Server serves the metrics
+type Server struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+// Listen listens on the given address, either the path of a Unix socket or
+// a host:port address on the loopback interface
+func Listen(address string, collect Collector) (*Server, error) {
+	s := &Server{
+		server: &http.Server{Handler: Handler(collect)},
+	}
+	var err error
+	if filepath.IsAbs(address) {
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		s.listener, err = net.Listen("unix", address)
+	} else if err = CheckLoopbackAddress(address); err == nil {
+		s.listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// CheckLoopbackAddress checks that the host:port address is on the
+// loopback interface
+func CheckLoopbackAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	} else if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return errors.Errorf("%s is not a loopback address", address)
+	}
+	return nil
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve serves the requests until the server closes
+func (s *Server) Serve() error {
+	err := s.server.Serve(s.listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close stops serving; the Unix socket, if any, is removed
+func (s *Server) Close() error {
+	return s.server.Close()
+}
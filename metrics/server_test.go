@@ -0,0 +1,109 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func collectTestMetrics() []Metric {
+	return testMetrics[1:2]
+}
+
+func TestServer(t *testing.T) {
+	server, err := Listen("127.0.0.1:0", collectTestMetrics)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve()
+	}()
+	url := "http://" + server.Addr().String() + "/metrics"
+
+	rsp, err := http.Get(url)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		assert.Equal(t, contentTypeText, rsp.Header.Get("Content-Type"))
+		assert.Contains(t, string(body), "mender_connect_handler_panics_total 3\n")
+		assert.False(t, strings.Contains(string(body), "# EOF"))
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	rsp, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		assert.Equal(t, contentTypeOpenMetrics, rsp.Header.Get("Content-Type"))
+		assert.True(t, strings.HasSuffix(string(body), "# EOF\n"))
+	}
+
+	assert.NoError(t, server.Close())
+	assert.NoError(t, <-served)
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mender-connect-metrics")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	socketPath := path.Join(tdir, "metrics.sock")
+
+	server, err := Listen(socketPath, collectTestMetrics)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	go server.Serve() //nolint:errcheck
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	rsp, err := client.Get("http://localhost/metrics")
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		assert.Contains(t, string(body), "mender_connect_handler_panics_total 3\n")
+	}
+
+	assert.NoError(t, server.Close())
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCheckLoopbackAddress(t *testing.T) {
+	assert.NoError(t, CheckLoopbackAddress("localhost:9469"))
+	assert.NoError(t, CheckLoopbackAddress("127.0.0.1:9469"))
+	assert.NoError(t, CheckLoopbackAddress("[::1]:9469"))
+	assert.EqualError(t, CheckLoopbackAddress("0.0.0.0:9469"),
+		"0.0.0.0:9469 is not a loopback address")
+	assert.EqualError(t, CheckLoopbackAddress(":9469"),
+		":9469 is not a loopback address")
+	assert.Error(t, CheckLoopbackAddress("localhost"))
+}
@@ -42,11 +42,49 @@ func TerminateAndWait(pid int, command *exec.Cmd, waitTimeout time.Duration) (er
 	}()
 	select {
 	case err := <-done:
-		if err != nil && err.Error() != "signal: killed" && err.Error() != "signal: terminated" && err.Error() != "signal: hangup" && err.Error() != "exit status 130" {
-			return errors.New("error waiting for the process: " + err.Error())
+		return waitError(err)
+	case <-time.After(waitTimeout):
+		return errors.New("waiting for pid " + strconv.Itoa(pid) + " timeout. the process will remain as zombie.")
+	}
+}
+
+// TerminateGroupAndWait terminates the process group led by the process:
+// it sends SIGTERM to the group, and SIGKILL once the process exits or after
+// gracePeriod, so that no process of the group is left behind; it then waits
+// up to waitTimeout for the process to exit. If the process does not lead a
+// group, only the process is signaled.
+func TerminateGroupAndWait(pid int, command *exec.Cmd, gracePeriod, waitTimeout time.Duration) error {
+	signal := func(sig syscall.Signal) {
+		if syscall.Kill(-pid, sig) != nil {
+			_ = syscall.Kill(pid, sig)
 		}
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- command.Wait()
+	}()
+
+	signal(syscall.SIGTERM)
+	select {
+	case err := <-done:
+		_ = syscall.Kill(-pid, syscall.SIGKILL)
+		return waitError(err)
+	case <-time.After(gracePeriod):
+	}
+	signal(syscall.SIGKILL)
+	select {
+	case err := <-done:
+		return waitError(err)
 	case <-time.After(waitTimeout):
 		return errors.New("waiting for pid " + strconv.Itoa(pid) + " timeout. the process will remain as zombie.")
 	}
+}
+
+// waitError returns the error of waiting for a process, unless the process
+// exited because it was terminated
+func waitError(err error) error {
+	if err != nil && err.Error() != "signal: killed" && err.Error() != "signal: terminated" && err.Error() != "signal: hangup" && err.Error() != "exit status 130" {
+		return errors.New("error waiting for the process: " + err.Error())
+	}
 	return nil
 }
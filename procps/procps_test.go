@@ -15,6 +15,7 @@ package procps
 
 import (
 	"os/exec"
+	"syscall"
 	"testing"
 	"time"
 
@@ -32,3 +33,29 @@ func TestMenderShellProcPs(t *testing.T) {
 	assert.Nil(t, err)
 	assert.False(t, ProcessExists(cmd.Process.Pid))
 }
+
+func TestTerminateGroupAndWait(t *testing.T) {
+	// the shell and its child ignore SIGTERM
+	cmd := exec.Command("sh", "-c", "trap '' TERM; sleep 16 & wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err := cmd.Start()
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	err = TerminateGroupAndWait(cmd.Process.Pid, cmd, time.Second, time.Second)
+	assert.NoError(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second))
+	assert.False(t, ProcessExists(cmd.Process.Pid))
+
+	// not a group leader
+	cmd = exec.Command("sleep", "16")
+	err = cmd.Start()
+	assert.NoError(t, err)
+
+	start = time.Now()
+	err = TerminateGroupAndWait(cmd.Process.Pid, cmd, time.Second, time.Second)
+	assert.NoError(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.False(t, ProcessExists(cmd.Process.Pid))
+}
@@ -0,0 +1,220 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package recording
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Extension of the recording files
+const Extension = ".cast"
+
+// Types of the asciicast v2 events
+const (
+	eventOutput = "o"
+	eventInput  = "i"
+	eventMarker = "m"
+	eventResize = "r"
+)
+
+var (
+	ErrInvalidSessionID = errors.New("invalid session ID")
+)
+
+// timeNow is the clock of the recordings
+var timeNow = time.Now
+
+// header is the first line of an asciicast v2 file
+type header struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Settings of a recording
+type Settings struct {
+	// Dir is the directory of the recording
+	Dir string
+	// SessionID and UserID of the recorded session
+	SessionID string
+	UserID    string
+	// Width and Height of the terminal
+	Width  uint16
+	Height uint16
+	// Env holds the TERM and SHELL variables of the session
+	Env map[string]string
+	// MaxSize is the size in bytes the recording stops at
+	MaxSize int64
+}
+
+// Recorder records a terminal session in the asciicast v2 format. The
+// recording stops, with a marker, once it reaches its maximum size.
+type Recorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	start   time.Time
+	size    int64
+	maxSize int64
+	stopped bool
+	// pending holds the incomplete UTF-8 sequences at the end of the last
+	// output and input, completed by the next ones
+	pending map[string][]byte
+}
+
+// FileName returns the name of the recording of the session started at t;
+// the names sort in the order the sessions started
+func FileName(sessionID string, t time.Time) string {
+	return t.UTC().Format("20060102T150405Z") + "-" + sessionID + Extension
+}
+
+// Start creates the recording of a session in the directory, creating it
+// if needed
+func Start(settings Settings) (*Recorder, error) {
+	if settings.SessionID == "" || settings.SessionID == "." ||
+		settings.SessionID == ".." || strings.ContainsAny(settings.SessionID, `/\`) {
+		return nil, ErrInvalidSessionID
+	}
+	if err := os.MkdirAll(settings.Dir, 0700); err != nil {
+		return nil, err
+	}
+	start := timeNow()
+	path := filepath.Join(settings.Dir, FileName(settings.SessionID, start))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		file:    file,
+		start:   start,
+		maxSize: settings.MaxSize,
+		pending: make(map[string][]byte),
+	}
+	title := "session " + settings.SessionID
+	if settings.UserID != "" {
+		title += " of user " + settings.UserID
+	}
+	b, _ := json.Marshal(header{
+		Version:   2,
+		Width:     settings.Width,
+		Height:    settings.Height,
+		Timestamp: start.Unix(),
+		Title:     title,
+		Env:       settings.Env,
+	})
+	if err := r.write(append(b, '\n')); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	active.add(path)
+	return r, nil
+}
+
+// Path returns the path of the recording
+func (r *Recorder) Path() string {
+	return r.file.Name()
+}
+
+func (r *Recorder) write(b []byte) error {
+	n, err := r.file.Write(b)
+	r.size += int64(n)
+	return err
+}
+
+// event writes an event, stopping the recording if it reached its maximum
+// size or failed to write
+func (r *Recorder) event(eventType string, data string) {
+	if r.stopped {
+		return
+	}
+	elapsed := timeNow().Sub(r.start).Seconds()
+	b, _ := json.Marshal(data)
+	line := fmt.Sprintf("[%.6f, %q, %s]\n", elapsed, eventType, b)
+	if r.maxSize > 0 && r.size+int64(len(line)) > r.maxSize {
+		r.stopped = true
+		b, _ = json.Marshal("recording stopped: maximum size reached")
+		_ = r.write([]byte(fmt.Sprintf("[%.6f, %q, %s]\n", elapsed, eventMarker, b)))
+		return
+	}
+	if err := r.write([]byte(line)); err != nil {
+		r.stopped = true
+	}
+}
+
+// stream records the data of the output or input stream, holding back an
+// incomplete UTF-8 sequence at its end
+func (r *Recorder) stream(eventType string, data []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	data = append(r.pending[eventType], data...)
+	r.pending[eventType] = nil
+	for i := len(data) - 1; i >= 0 && i > len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				r.pending[eventType] = append([]byte(nil), data[i:]...)
+				data = data[:i]
+			}
+			break
+		}
+	}
+	if len(data) > 0 {
+		r.event(eventType, string(data))
+	}
+}
+
+// Output records the output of the terminal
+func (r *Recorder) Output(data []byte) {
+	r.stream(eventOutput, data)
+}
+
+// Input records the input of the terminal
+func (r *Recorder) Input(data []byte) {
+	r.stream(eventInput, data)
+}
+
+// Resize records the new size of the terminal
+func (r *Recorder) Resize(width, height uint16) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.event(eventResize, fmt.Sprintf("%dx%d", width, height))
+}
+
+// Close flushes the incomplete UTF-8 sequences left and closes the
+// recording
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, eventType := range []string{eventOutput, eventInput} {
+		if pending := r.pending[eventType]; len(pending) > 0 {
+			r.pending[eventType] = nil
+			r.event(eventType, string(pending))
+		}
+	}
+	r.stopped = true
+	active.remove(r.file.Name())
+	return r.file.Close()
+}
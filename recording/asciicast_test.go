@@ -0,0 +1,152 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package recording
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock sets the clock of the recordings, advancing by step on every
+// reading, until the test ends
+func fakeClock(t *testing.T, start time.Time, step time.Duration) {
+	now := start
+	timeNow = func() time.Time {
+		t := now
+		now = now.Add(step)
+		return t
+	}
+	t.Cleanup(func() {
+		timeNow = time.Now
+	})
+}
+
+func readRecording(t *testing.T, path string) (header, [][]interface{}) {
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	var h header
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &h))
+	var events [][]interface{}
+	for _, line := range lines[1:] {
+		var event []interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &event))
+		events = append(events, event)
+	}
+	return h, events
+}
+
+func TestRecorder(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "recording")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	start := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	fakeClock(t, start, 500*time.Millisecond)
+
+	dir := path.Join(tdir, "recordings")
+	r, err := Start(Settings{
+		Dir:       dir,
+		SessionID: "session",
+		UserID:    "user",
+		Width:     80,
+		Height:    24,
+		Env:       map[string]string{"TERM": "xterm-256color", "SHELL": "/bin/sh"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, path.Join(dir, "20210304T050607Z-session.cast"), r.Path())
+
+	r.Output([]byte("$ "))
+	r.Input([]byte("ls\r"))
+	// "é" split across two reads
+	r.Output([]byte("caf\xc3"))
+	r.Output([]byte("\xa9\r\n"))
+	r.Resize(100, 30)
+	// an incomplete sequence is flushed on close
+	r.Output([]byte("\xe2\x82"))
+	assert.NoError(t, r.Close())
+
+	info, err := os.Stat(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	info, err = os.Stat(r.Path())
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	h, events := readRecording(t, r.Path())
+	assert.Equal(t, header{
+		Version:   2,
+		Width:     80,
+		Height:    24,
+		Timestamp: start.Unix(),
+		Title:     "session session of user user",
+		Env:       map[string]string{"TERM": "xterm-256color", "SHELL": "/bin/sh"},
+	}, h)
+	assert.Equal(t, [][]interface{}{
+		{0.5, "o", "$ "},
+		{1.0, "i", "ls\r"},
+		{1.5, "o", "caf"},
+		{2.0, "o", "é\r\n"},
+		{2.5, "r", "100x30"},
+		{3.0, "o", "��"},
+	}, events)
+}
+
+func TestRecorderMaxSize(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "recording")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	fakeClock(t, time.Now(), time.Second)
+
+	r, err := Start(Settings{
+		Dir:       tdir,
+		SessionID: "session",
+		Width:     80,
+		Height:    24,
+		MaxSize:   150,
+	})
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		r.Output([]byte("0123456789"))
+	}
+	assert.NoError(t, r.Close())
+
+	_, events := readRecording(t, r.Path())
+	if assert.True(t, len(events) > 1) {
+		last := events[len(events)-1]
+		assert.Equal(t, "m", last[1])
+		assert.Equal(t, "recording stopped: maximum size reached", last[2])
+		for _, event := range events[:len(events)-1] {
+			assert.Equal(t, "o", event[1])
+		}
+	}
+}
+
+func TestStartInvalidSessionID(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "recording")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	for _, sessionID := range []string{"", ".", "..", "../session", "a/b"} {
+		_, err := Start(Settings{Dir: tdir, SessionID: sessionID})
+		assert.Equal(t, ErrInvalidSessionID, err, sessionID)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package recording
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// active registers the paths of the recordings in progress, never pruned
+var active = activeRecordings{paths: make(map[string]struct{})}
+
+type activeRecordings struct {
+	sync.Mutex
+	paths map[string]struct{}
+}
+
+func (a *activeRecordings) add(path string) {
+	a.Lock()
+	defer a.Unlock()
+	a.paths[path] = struct{}{}
+}
+
+func (a *activeRecordings) remove(path string) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.paths, path)
+}
+
+func (a *activeRecordings) contains(path string) bool {
+	a.Lock()
+	defer a.Unlock()
+	_, ok := a.paths[path]
+	return ok
+}
+
+// Prune removes the recordings of the directory older than maxAge, unless
+// zero, and then the oldest ones until the recordings total at most
+// maxTotalSize bytes; the recordings in progress are kept. It returns the
+// paths of the removed recordings.
+func Prune(dir string, maxTotalSize int64, maxAge time.Duration) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var recordings []os.FileInfo
+	for _, info := range infos {
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), Extension) &&
+			!active.contains(filepath.Join(dir, info.Name())) {
+			recordings = append(recordings, info)
+		}
+	}
+	// the oldest last, removed first
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].ModTime().After(recordings[j].ModTime())
+	})
+
+	var (
+		removed   []string
+		totalSize int64
+	)
+	now := timeNow()
+	for _, info := range recordings {
+		path := filepath.Join(dir, info.Name())
+		totalSize += info.Size()
+		if (maxAge > 0 && now.Sub(info.ModTime()) > maxAge) ||
+			(maxTotalSize > 0 && totalSize > maxTotalSize) {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return removed, err
+			}
+			removed = append(removed, path)
+		}
+	}
+	return removed, nil
+}
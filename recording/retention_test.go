@@ -0,0 +1,81 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package recording
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrune(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "recording")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	now := time.Now()
+	// recordings of 100 bytes, modified 1 to 5 days ago
+	for i := 1; i <= 5; i++ {
+		name := path.Join(tdir, FileName("session"+string(rune('0'+i)), now))
+		err := ioutil.WriteFile(name, []byte(strings.Repeat("x", 100)), 0600)
+		assert.NoError(t, err)
+		modTime := now.Add(-time.Duration(i) * 24 * time.Hour)
+		assert.NoError(t, os.Chtimes(name, modTime, modTime))
+	}
+	// not a recording
+	err = ioutil.WriteFile(path.Join(tdir, "notes.txt"), []byte("notes"), 0600)
+	assert.NoError(t, err)
+	// in progress, the oldest
+	r, err := Start(Settings{Dir: tdir, SessionID: "active"})
+	assert.NoError(t, err)
+	defer r.Close()
+	modTime := now.Add(-30 * 24 * time.Hour)
+	assert.NoError(t, os.Chtimes(r.Path(), modTime, modTime))
+
+	// older than 4 days and a half
+	removed, err := Prune(tdir, 0, 108*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path.Join(tdir, FileName("session5", now))}, removed)
+
+	// at most 250 bytes
+	removed, err = Prune(tdir, 250, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		path.Join(tdir, FileName("session3", now)),
+		path.Join(tdir, FileName("session4", now)),
+	}, removed)
+
+	infos, err := ioutil.ReadDir(tdir)
+	assert.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	assert.ElementsMatch(t, []string{
+		FileName("session1", now),
+		FileName("session2", now),
+		path.Base(r.Path()),
+		"notes.txt",
+	}, names)
+
+	removed, err = Prune(path.Join(tdir, "does-not-exist"), 1, time.Hour)
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+}
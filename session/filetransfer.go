@@ -21,6 +21,7 @@ import (
 	"path"
 	"runtime"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"syscall"
 
@@ -31,6 +32,7 @@ import (
 	"github.com/mendersoftware/go-lib-micro/ws"
 	wsft "github.com/mendersoftware/go-lib-micro/ws/filetransfer"
 
+	"github.com/mendersoftware/mender-connect/audit"
 	"github.com/mendersoftware/mender-connect/config"
 	"github.com/mendersoftware/mender-connect/limits/filetransfer"
 	"github.com/mendersoftware/mender-connect/session/model"
@@ -42,7 +44,10 @@ const (
 	FileTransferBufSize  = 4096
 )
 
-var errFileTransferAbort = errors.New("handler aborted")
+var (
+	errFileTransferAbort    = errors.New("handler aborted")
+	errFileTransferShutdown = errors.New("the device is shutting down")
+)
 
 type FileTransferHandler struct {
 	// mutex is used for protecting the async handler. A channel with cap(1)
@@ -52,19 +57,41 @@ type FileTransferHandler struct {
 	// msgChan is used to pass messages down to the async file transfer handler routine.
 	msgChan chan *ws.ProtoMsg
 	permit  *filetransfer.Permit
+	// size of the file chunks sent to the client
+	chunkSize int
+	// transfers tracks the async handler routine, awaited on shutdown
+	transfers sync.WaitGroup
+	// shutdown is set once the handler refuses new transfers
+	shutdown bool
+	// audit records the transfers
+	audit *audit.Recorder
+	// logger carries the fields of the session
+	logger *log.Entry
 }
 
-// FileTransfer creates a new filetransfer constructor
-func FileTransfer(limits config.Limits) Constructor {
+// FileTransfer creates a new filetransfer constructor sending the files in
+// chunks of the given size; if zero, FileTransferBufSize is used
+func FileTransfer(limits config.Limits, chunkSize int, recorder *audit.Recorder) Constructor {
+	if chunkSize <= 0 {
+		chunkSize = FileTransferBufSize
+	}
 	return func() SessionHandler {
 		return &FileTransferHandler{
-			mutex:   make(chan struct{}, 1),
-			msgChan: make(chan *ws.ProtoMsg),
-			permit:  filetransfer.NewPermit(limits),
+			mutex:     make(chan struct{}, 1),
+			msgChan:   make(chan *ws.ProtoMsg),
+			permit:    filetransfer.NewPermit(limits),
+			chunkSize: chunkSize,
+			audit:     recorder,
+			logger:    log.NewEntry(log.StandardLogger()),
 		}
 	}
 }
 
+// SetLogger sets the entry the handler logs with
+func (h *FileTransferHandler) SetLogger(logger *log.Entry) {
+	h.logger = logger
+}
+
 func (h *FileTransferHandler) Error(msg *ws.ProtoMsg, w ResponseWriter, err error) {
 	errMsg := err.Error()
 	msgErr := wsft.Error{
@@ -77,11 +104,35 @@ func (h *FileTransferHandler) Error(msg *ws.ProtoMsg, w ResponseWriter, err erro
 	w.WriteProtoMsg(&rsp) //nolint:errcheck
 }
 
+// Close aborts the file transfer in progress, if any, and waits for the
+// async handler to roll it back.
 func (h *FileTransferHandler) Close() error {
 	close(h.msgChan)
+	h.transfers.Wait()
 	return nil
 }
 
+// Shutdown refuses the new file transfers; the returned channel closes once
+// the one in progress, if any, completes.
+func (h *FileTransferHandler) Shutdown() <-chan struct{} {
+	h.shutdown = true
+	done := make(chan struct{})
+	go func() {
+		h.transfers.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// startTransfer runs the async handler routine
+func (h *FileTransferHandler) startTransfer(handler func()) {
+	h.transfers.Add(1)
+	go func() {
+		defer h.transfers.Done()
+		handler()
+	}()
+}
+
 func (h *FileTransferHandler) ServeProtoMsg(msg *ws.ProtoMsg, w ResponseWriter) {
 	switch msg.Header.MsgType {
 	case wsft.MessageTypePut:
@@ -113,9 +164,9 @@ func (h *FileTransferHandler) ServeProtoMsg(msg *ws.ProtoMsg, w ResponseWriter)
 			var erro wsft.Error
 			err := msgpack.Unmarshal(msg.Body, &erro)
 			if err != nil {
-				log.Errorf("Error decoding error message from client: %s", err.Error())
+				h.logger.Errorf("Error decoding error message from client: %s", err.Error())
 			} else {
-				log.Errorf("Received error from client: %s", *erro.Error)
+				h.logger.Errorf("Received error from client: %s", *erro.Error)
 			}
 		case h.msgChan <- msg:
 		}
@@ -128,9 +179,30 @@ func (h *FileTransferHandler) ServeProtoMsg(msg *ws.ProtoMsg, w ResponseWriter)
 	}
 }
 
+// auditEvent returns the audit event of the file transfer request; path
+// is nil if the request is malformed
+func auditEvent(eventType string, msg *ws.ProtoMsg, path *string) audit.Event {
+	event := audit.Event{
+		Type:      eventType,
+		SessionID: msg.Header.SessionID,
+	}
+	if path != nil {
+		event.Path = *path
+	}
+	return event
+}
+
 func (h *FileTransferHandler) StatFile(msg *ws.ProtoMsg, w ResponseWriter) {
-	var params model.StatFile
+	var (
+		params model.StatFile
+		size   *int64
+	)
 	err := msgpack.Unmarshal(msg.Body, &params)
+	defer func() {
+		event := auditEvent(audit.EventFileStat, msg, params.Path)
+		event.Size = size
+		h.audit.Record(event.WithResult(err))
+	}()
 	if err != nil {
 		h.Error(msg, w, errors.Wrap(err, "malformed request parameters"))
 		return
@@ -145,11 +217,12 @@ func (h *FileTransferHandler) StatFile(msg *ws.ProtoMsg, w ResponseWriter) {
 		return
 	}
 	mode := uint32(stat.Mode())
-	size := stat.Size()
+	fileSize := stat.Size()
+	size = &fileSize
 	modTime := stat.ModTime()
 	fileInfo := wsft.FileInfo{
 		Path:    params.Path,
-		Size:    &size,
+		Size:    size,
 		Mode:    &mode,
 		ModTime: &modTime,
 	}
@@ -169,7 +242,7 @@ func (h *FileTransferHandler) StatFile(msg *ws.ProtoMsg, w ResponseWriter) {
 		Body: b,
 	})
 	if err != nil {
-		log.Errorf("error sending FileInfo to client: %s", err.Error())
+		h.logger.Errorf("error sending FileInfo to client: %s", err.Error())
 	}
 }
 
@@ -205,8 +278,9 @@ func (h *FileTransferHandler) InitFileDownload(msg *ws.ProtoMsg, w ResponseWrite
 	var params model.GetFile
 	defer func() {
 		if err != nil {
-			log.Error(err.Error())
+			h.logger.Error(err.Error())
 			h.Error(msg, w, err)
+			h.audit.Record(auditEvent(audit.EventFileGet, msg, params.Path).WithResult(err))
 		}
 	}()
 	if err = msgpack.Unmarshal(msg.Body, &params); err != nil {
@@ -215,14 +289,17 @@ func (h *FileTransferHandler) InitFileDownload(msg *ws.ProtoMsg, w ResponseWrite
 	} else if err = params.Validate(); err != nil {
 		err = errors.Wrap(err, "invalid request parameters")
 		return err
+	} else if h.shutdown {
+		err = errFileTransferShutdown
+		return err
 	} else if err = h.permit.DownloadFile(params); err != nil {
-		log.Warnf("file download access denied: %s", err.Error())
+		h.logger.Warnf("file download access denied: %s", err.Error())
 		err = errors.Wrap(err, "access denied")
 		return err
 	}
 	belowLimit := h.permit.BytesSent(uint64(0))
 	if !belowLimit {
-		log.Warnf("file download tx bytes limit reached.")
+		h.logger.Warnf("file download tx bytes limit reached.")
 		return filetransfer.ErrTxBytesLimitExhausted
 	}
 
@@ -233,11 +310,13 @@ func (h *FileTransferHandler) InitFileDownload(msg *ws.ProtoMsg, w ResponseWrite
 	}
 	select {
 	case h.mutex <- struct{}{}:
-		go h.DownloadHandler(fd, msg, w) //nolint:errcheck
+		h.startTransfer(func() {
+			h.DownloadHandler(fd, msg, w) //nolint:errcheck
+		})
 	default:
 		errClose := fd.Close()
 		if errClose != nil {
-			log.Warnf("error closing file: %s", err.Error())
+			h.logger.Warnf("error closing file: %s", err.Error())
 		}
 		return errors.New("another file transfer is in progress")
 	}
@@ -252,11 +331,11 @@ func (h *FileTransferHandler) DownloadHandler(fd *os.File, msg *ws.ProtoMsg, w R
 	defer func() {
 		errClose := fd.Close()
 		if errClose != nil {
-			log.Warnf("error closing file descriptor: %s", errClose.Error())
+			h.logger.Warnf("error closing file descriptor: %s", errClose.Error())
 		}
 		if err != nil && err != errFileTransferAbort {
 			h.Error(msg, w, err)
-			log.Error(err.Error())
+			h.logger.Error(err.Error())
 		}
 		<-h.mutex
 	}()
@@ -265,6 +344,11 @@ func (h *FileTransferHandler) DownloadHandler(fd *os.File, msg *ws.ProtoMsg, w R
 		SessionID: msg.Header.SessionID,
 		W:         w,
 	}
+	filePath := fd.Name()
+	event := auditEvent(audit.EventFileGet, msg, &filePath)
+	defer func() {
+		h.audit.Record(event.WithSize(chunker.Offset).WithResult(err))
+	}()
 
 	waitAck := func() (*ws.ProtoMsg, error) {
 		msg, open := <-h.msgChan
@@ -278,9 +362,9 @@ func (h *FileTransferHandler) DownloadHandler(fd *os.File, msg *ws.ProtoMsg, w R
 			var erro wsft.Error
 			msgpack.Unmarshal(msg.Body, &erro) //nolint:errcheck
 			if erro.Error != nil {
-				log.Errorf("received error message from client: %s", *erro.Error)
+				h.logger.Errorf("received error message from client: %s", *erro.Error)
 			} else {
-				log.Error("received malformed error message from client: aborting")
+				h.logger.Error("received malformed error message from client: aborting")
 			}
 			return msg, errFileTransferAbort
 
@@ -302,10 +386,10 @@ func (h *FileTransferHandler) DownloadHandler(fd *os.File, msg *ws.ProtoMsg, w R
 		return msg, nil
 	}
 
-	buf := make([]byte, FileTransferBufSize)
+	buf := make([]byte, h.chunkSize)
 	for {
 		windowBytes := ackOffset - chunker.Offset +
-			ACKSlidingWindowRecv*FileTransferBufSize
+			ACKSlidingWindowRecv*int64(h.chunkSize)
 		if windowBytes > 0 {
 			N, err = io.CopyBuffer(chunker, io.LimitReader(fd, windowBytes), buf)
 			if err != nil {
@@ -314,7 +398,7 @@ func (h *FileTransferHandler) DownloadHandler(fd *os.File, msg *ws.ProtoMsg, w R
 			}
 			belowLimit := h.permit.BytesSent(uint64(N))
 			if !belowLimit {
-				log.Warnf("file download tx bytes limit reached.")
+				h.logger.Warnf("file download tx bytes limit reached.")
 				return filetransfer.ErrTxBytesLimitExhausted
 			}
 			if N < windowBytes {
@@ -340,7 +424,7 @@ func (h *FileTransferHandler) DownloadHandler(fd *os.File, msg *ws.ProtoMsg, w R
 		},
 	})
 	if err != nil {
-		log.Errorf("failed to send EOF message to client: %s", err.Error())
+		h.logger.Errorf("failed to send EOF message to client: %s", err.Error())
 		return err
 	}
 
@@ -367,22 +451,26 @@ func (h *FileTransferHandler) InitFileUpload(msg *ws.ProtoMsg, w ResponseWriter)
 	defer func() {
 		if err != nil {
 			h.Error(msg, w, err)
+			h.audit.Record(auditEvent(audit.EventFilePut, msg, params.Path).WithResult(err))
 		}
 	}()
 
 	err = msgpack.Unmarshal(msg.Body, &params)
-	log.Debugf("InitFileUpload getting upload file: %+v", params)
 	if err != nil {
 		return errors.Wrap(err, "malformed request parameters")
 	} else if err = params.Validate(); err != nil {
 		return errors.Wrap(err, "invalid request parameters")
+	}
+	h.logger.WithField("path", *params.Path).Debug("InitFileUpload getting upload file")
+	if h.shutdown {
+		return errFileTransferShutdown
 	} else if err = h.permit.UploadFile(params); err != nil {
 		return errors.Wrap(err, "access denied")
 	}
 
 	belowLimit := h.permit.BytesReceived(uint64(0))
 	if !belowLimit {
-		log.Warnf("file upload rx bytes limit reached.")
+		h.logger.Warnf("file upload rx bytes limit reached.")
 		err = filetransfer.ErrTxBytesLimitExhausted
 		return filetransfer.ErrTxBytesLimitExhausted
 	}
@@ -411,7 +499,9 @@ StatAgain:
 
 	select {
 	case h.mutex <- struct{}{}:
-		go h.FileUploadHandler(msg, params, w) //nolint:errcheck
+		h.startTransfer(func() {
+			h.FileUploadHandler(msg, params, w) //nolint:errcheck
+		})
 	default:
 		err = errors.New("another file transfer is in progress")
 		return err
@@ -447,25 +537,30 @@ func (h *FileTransferHandler) FileUploadHandler(
 	var (
 		fd      *os.File
 		closeFd bool
+		written int64
 	)
+	defer func() {
+		h.audit.Record(auditEvent(audit.EventFilePut, msg, params.Path).
+			WithSize(written).WithResult(err))
+	}()
 	defer func() {
 		if fd != nil {
 			if closeFd {
 				errClose := fd.Close()
 				if errClose != nil {
-					log.Warnf("error closing file: %s", errClose.Error())
+					h.logger.Warnf("error closing file: %s", errClose.Error())
 				}
 			}
 			errRm := os.Remove(fd.Name())
 			if errRm != nil {
-				log.Errorf(
+				h.logger.Errorf(
 					"error removing file after aborting upload: %s",
 					errRm.Error(),
 				)
 			}
 		}
 		if err != nil {
-			log.Error(err.Error())
+			h.logger.Error(err.Error())
 			if errors.Cause(err) != errFileTransferAbort {
 				h.Error(msg, w, err)
 			}
@@ -489,11 +584,11 @@ func (h *FileTransferHandler) FileUploadHandler(
 		},
 	})
 	if err != nil {
-		log.Errorf("failed to respond to client: %s", err.Error())
+		h.logger.Errorf("failed to respond to client: %s", err.Error())
 		return errFileTransferAbort
 	}
 
-	_, err = h.writeFile(w, fd)
+	written, err = h.writeFile(w, fd)
 	if err != nil {
 		return err
 	}
@@ -511,7 +606,7 @@ func (h *FileTransferHandler) FileUploadHandler(
 	filename := fd.Name()
 	errClose := fd.Close()
 	if errClose != nil {
-		log.Warnf("error closing file: %s", errClose.Error())
+		h.logger.Warnf("error closing file: %s", errClose.Error())
 	}
 	err = os.Rename(filename, *params.Path)
 	if err != nil {
@@ -539,7 +634,7 @@ func (h *FileTransferHandler) dstWrite(dst *os.File, body []byte, offset int64)
 	offset += int64(n)
 	belowLimit := h.permit.BytesReceived(uint64(n))
 	if !belowLimit || !h.permit.BelowMaxAllowedFileSize(offset) {
-		log.Warnf("file upload rx bytes limit reached.")
+		h.logger.Warnf("file upload rx bytes limit reached.")
 		return n, filetransfer.ErrTxBytesLimitExhausted
 	} else {
 		return n, err
@@ -564,9 +659,9 @@ func (h *FileTransferHandler) writeFile(w ResponseWriter, dst *os.File) (int64,
 			var cerr wsft.Error
 			packErr := msgpack.Unmarshal(msg.Body, &cerr)
 			if packErr == nil && cerr.Error != nil {
-				log.Errorf("Received error during upload: %s", *cerr.Error)
+				h.logger.Errorf("Received error during upload: %s", *cerr.Error)
 			} else {
-				log.Error("Received malformed error during upload: aborting")
+				h.logger.Error("Received malformed error during upload: aborting")
 			}
 			return errFileTransferAbort
 
@@ -634,7 +729,7 @@ func (h *FileTransferHandler) writeFile(w ResponseWriter, dst *os.File) (int64,
 		rsp.Header.MsgType = wsft.MessageTypeACK
 		err = w.WriteProtoMsg(rsp)
 		if err != nil {
-			log.Errorf("failed to ack file chunk: %s", err.Error())
+			h.logger.Errorf("failed to ack file chunk: %s", err.Error())
 			return offset, errFileTransferAbort
 		}
 	}
@@ -273,7 +273,7 @@ func TestFileTransferUpload(t *testing.T) {
 			handler := FileTransfer(config.Limits{
 				Enabled:      tc.LimitsEnabled,
 				FileTransfer: tc.Limits,
-			})().(*FileTransferHandler)
+			}, 0, nil)().(*FileTransferHandler)
 			b, _ := msgpack.Marshal(tc.Params)
 			request := &ws.ProtoMsg{
 				Header: ws.ProtoHdr{
@@ -433,6 +433,7 @@ func TestFileTransferDownload(t *testing.T) {
 
 		FileContents []byte
 		Acker        func(msg *ws.ProtoMsg) *ws.ProtoMsg
+		ChunkSize    int
 
 		LimitsEnabled    bool
 		Limits           config.FileTransferLimits
@@ -465,6 +466,22 @@ func TestFileTransferDownload(t *testing.T) {
 			ret.Header.MsgType = wsft.MessageTypeACK
 			return ret
 		},
+	}, {
+		Name: "ok, chunk size adapted to the message size limit",
+
+		FileContents: func() []byte {
+			b := make([]byte, ChunkSize(65536)*(ACKSlidingWindowRecv+1))
+			copy(b, "zeroes...")
+			return b
+		}(),
+		ChunkSize: ChunkSize(65536),
+		Acker: func(msg *ws.ProtoMsg) *ws.ProtoMsg {
+			ret := &ws.ProtoMsg{
+				Header: msg.Header,
+			}
+			ret.Header.MsgType = wsft.MessageTypeACK
+			return ret
+		},
 	}, {
 		Name: "error, bad ack data type",
 
@@ -605,7 +622,11 @@ func TestFileTransferDownload(t *testing.T) {
 			handler := FileTransfer(config.Limits{
 				Enabled:      tc.LimitsEnabled,
 				FileTransfer: tc.Limits,
-			})().(*FileTransferHandler)
+			}, tc.ChunkSize, nil)().(*FileTransferHandler)
+			chunkSize := tc.ChunkSize
+			if chunkSize == 0 {
+				chunkSize = FileTransferBufSize
+			}
 			fd, err := ioutil.TempFile(testdir, "testfile")
 			if err != nil {
 				panic(err)
@@ -658,6 +679,7 @@ func TestFileTransferDownload(t *testing.T) {
 				if msg.Header.MsgType == wsft.MessageTypeChunk {
 					off := msg.Header.Properties["offset"].(int64)
 					assert.GreaterOrEqual(t, off, offset)
+					assert.LessOrEqual(t, len(msg.Body), chunkSize)
 					offset = off
 					recvBuf.Write(msg.Body)
 					rsp := tc.Acker(msg)
@@ -708,6 +730,12 @@ func TestFileTransferDownload(t *testing.T) {
 	}
 }
 
+func TestChunkSize(t *testing.T) {
+	assert.Equal(t, 512, ChunkSize(1024))
+	assert.Equal(t, FileTransferBufSize, ChunkSize(8192))
+	assert.Equal(t, 65536-4096, ChunkSize(65536))
+}
+
 func TestFileTransferStat(t *testing.T) {
 	t.Parallel()
 	const (
@@ -859,7 +887,7 @@ func TestFileTransferStat(t *testing.T) {
 		t.Run(tc.Name, func(t *testing.T) {
 			t.Parallel()
 
-			handler := FileTransfer(config.Limits{})()
+			handler := FileTransfer(config.Limits{}, 0, nil)()
 			w := NewTestWriter(tc.WriteError)
 			handler.ServeProtoMsg(tc.Message, w)
 			tc.ResponseValidator(t, w.Messages)
@@ -1045,7 +1073,7 @@ func TestFileTransferServeErrors(t *testing.T) {
 		t.Run(tc.Name, func(t *testing.T) {
 			t.Parallel()
 
-			handler := FileTransfer(config.Limits{})().(*FileTransferHandler)
+			handler := FileTransfer(config.Limits{}, 0, nil)().(*FileTransferHandler)
 			if tc.LockMutex {
 				handler.mutex <- struct{}{}
 			}
@@ -1069,3 +1097,86 @@ func TestFileTransferServeErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestFileTransferShutdown(t *testing.T) {
+	t.Parallel()
+	testdir, err := ioutil.TempDir("", "filetransfer-testing")
+	if err != nil {
+		panic(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(testdir) })
+
+	written := make(chan *ws.ProtoMsg, 10)
+	w := ResponseWriterFunc(func(msg *ws.ProtoMsg) error {
+		written <- msg
+		return nil
+	})
+	upload := func(handler SessionHandler, filename string) {
+		filePath := path.Join(testdir, filename)
+		b, _ := msgpack.Marshal(model.UploadRequest{Path: &filePath})
+		handler.ServeProtoMsg(&ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:   ws.ProtoTypeFileTransfer,
+				MsgType: wsft.MessageTypePut,
+			},
+			Body: b,
+		}, w)
+	}
+	chunk := func(handler SessionHandler, offset int64, data []byte) {
+		handler.ServeProtoMsg(&ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:      ws.ProtoTypeFileTransfer,
+				MsgType:    wsft.MessageTypeChunk,
+				Properties: map[string]interface{}{"offset": offset},
+			},
+			Body: data,
+		}, w)
+	}
+	expectMessage := func(msgType string) {
+		select {
+		case msg := <-written:
+			assert.Equal(t, msgType, msg.Header.MsgType)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s message", msgType)
+		}
+	}
+
+	// the upload in progress completes, new ones are refused
+	handler := FileTransfer(config.Limits{}, 0, nil)()
+	upload(handler, "completed")
+	expectMessage(wsft.MessageTypeACK)
+	drained := handler.(ShutdownHandler).Shutdown()
+	select {
+	case <-drained:
+		t.Fatal("the upload in progress did not complete")
+	default:
+	}
+	upload(handler, "refused")
+	expectMessage(wsft.MessageTypeError)
+	chunk(handler, 0, []byte("data"))
+	expectMessage(wsft.MessageTypeACK)
+	chunk(handler, 4, nil)
+	expectMessage(wsft.MessageTypeACK)
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler did not drain")
+	}
+	handler.Close()
+	data, err := ioutil.ReadFile(path.Join(testdir, "completed"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("data"), data)
+
+	// closing the handler rolls back the upload in progress
+	handler = FileTransfer(config.Limits{}, 0, nil)()
+	upload(handler, "rolled-back")
+	expectMessage(wsft.MessageTypeACK)
+	chunk(handler, 0, []byte("data"))
+	expectMessage(wsft.MessageTypeACK)
+	handler.Close()
+	files, err := ioutil.ReadDir(testdir)
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, "completed", files[0].Name())
+	}
+}
@@ -21,6 +21,9 @@ import (
 	"github.com/mendersoftware/go-lib-micro/ws/menderclient"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-connect/audit"
+	"github.com/mendersoftware/mender-connect/logging"
 )
 
 const (
@@ -30,8 +33,12 @@ const (
 
 const propertyStatus = "status"
 
-func MenderClient() Constructor {
-	f := HandlerFunc(menderClientHandler)
+// MenderClient creates a new constructor of the handlers running the
+// mender client commands, which are recorded to the audit log
+func MenderClient(recorder *audit.Recorder) Constructor {
+	f := HandlerFunc(func(message *ws.ProtoMsg, w ResponseWriter) {
+		menderClientHandler(recorder, message, w)
+	})
 	return func() SessionHandler { return f }
 }
 
@@ -43,7 +50,7 @@ var runCommand = func(command []string) error {
 	return errors.New("no command provided")
 }
 
-func menderClientHandler(message *ws.ProtoMsg, w ResponseWriter) {
+func menderClientHandler(recorder *audit.Recorder, message *ws.ProtoMsg, w ResponseWriter) {
 	command := ""
 	switch message.Header.MsgType {
 	case menderclient.MessageTypeMenderClientCheckUpdate:
@@ -57,6 +64,11 @@ func menderClientHandler(message *ws.ProtoMsg, w ResponseWriter) {
 	} else {
 		err = errors.New("unknown message type")
 	}
+	recorder.Record(audit.Event{
+		Type:      audit.EventMenderClient,
+		SessionID: message.Header.SessionID,
+		Command:   command,
+	}.WithResult(err))
 	response := &ws.ProtoMsg{
 		Header: ws.ProtoHdr{
 			Proto:     message.Header.Proto,
@@ -72,6 +84,7 @@ func menderClientHandler(message *ws.ProtoMsg, w ResponseWriter) {
 		response.Body = []byte(err.Error())
 	}
 	if err := w.WriteProtoMsg(response); err != nil {
-		log.Errorf("menderClientHandler: webSock.WriteMessage(%+v)", err)
+		log.WithFields(logging.MessageFields(&message.Header)).
+			Errorf("menderClientHandler: webSock.WriteMessage: %s", err.Error())
 	}
 }
@@ -15,12 +15,18 @@
 package session
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
 	"github.com/mendersoftware/go-lib-micro/ws/menderclient"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/audit"
 )
 
 func TestMenderClientHandler(t *testing.T) {
@@ -38,7 +44,7 @@ func TestMenderClientHandler(t *testing.T) {
 		},
 	}
 	w := new(testWriter)
-	menderClientHandler(msg, w)
+	menderClientHandler(nil, msg, w)
 	if !assert.Len(t, w.Messages, 1) {
 		t.FailNow()
 	}
@@ -56,7 +62,7 @@ func TestMenderClientHandler(t *testing.T) {
 			MsgType: menderclient.MessageTypeMenderClientSendInventory,
 		},
 	}
-	menderClientHandler(msg, w)
+	menderClientHandler(nil, msg, w)
 	if !assert.Len(t, w.Messages, 1) {
 		t.FailNow()
 	}
@@ -67,6 +73,43 @@ func TestMenderClientHandler(t *testing.T) {
 	}
 }
 
+func TestMenderClientHandlerAudit(t *testing.T) {
+	prevRunCommand := runCommand
+	runCommand = func(command []string) error {
+		return nil
+	}
+	defer func() {
+		runCommand = prevRunCommand
+	}()
+	tdir, err := ioutil.TempDir("", "audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	auditPath := path.Join(tdir, "audit.log")
+	auditLog, err := audit.Open(auditPath, 1024*1024, 1)
+	assert.NoError(t, err)
+	recorder := &audit.Recorder{}
+	recorder.SetLog(auditLog)
+
+	msg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeMenderClient,
+			MsgType:   menderclient.MessageTypeMenderClientCheckUpdate,
+			SessionID: "session",
+		},
+	}
+	menderClientHandler(recorder, msg, new(testWriter))
+	assert.NoError(t, auditLog.Close())
+
+	b, err := ioutil.ReadFile(auditPath)
+	assert.NoError(t, err)
+	entry := audit.Entry{}
+	assert.NoError(t, json.Unmarshal(b, &entry))
+	assert.Equal(t, audit.EventMenderClient, entry.Type)
+	assert.Equal(t, "session", entry.SessionID)
+	assert.Equal(t, "check-update", entry.Command)
+	assert.Equal(t, audit.ResultSuccess, entry.Result)
+}
+
 func TestRunCommand(t *testing.T) {
 	err := runCommand([]string{"false"})
 	assert.Error(t, err)
@@ -17,6 +17,8 @@
 package mocks
 
 import (
+	context "context"
+
 	ws "github.com/mendersoftware/go-lib-micro/ws"
 	session "github.com/mendersoftware/mender-connect/session"
 	mock "github.com/stretchr/testify/mock"
@@ -40,3 +42,52 @@ func (_m *Router) RouteMessage(msg *ws.ProtoMsg, w session.ResponseWriter) error
 
 	return r0
 }
+
+// Sessions provides a mock function with given fields:
+func (_m *Router) Sessions() []session.Info {
+	ret := _m.Called()
+
+	var r0 []session.Info
+	if rf, ok := ret.Get(0).(func() []session.Info); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]session.Info)
+		}
+	}
+
+	return r0
+}
+
+// SetRoutes provides a mock function with given fields: routes
+func (_m *Router) SetRoutes(routes session.ProtoRoutes) {
+	_m.Called(routes)
+}
+
+// Shutdown provides a mock function with given fields: ctx
+func (_m *Router) Shutdown(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Terminate provides a mock function with given fields: sessionID
+func (_m *Router) Terminate(sessionID string) error {
+	ret := _m.Called(sessionID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(sessionID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
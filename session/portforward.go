@@ -18,8 +18,10 @@ import (
 	"context"
 	"io"
 	"net"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
@@ -27,6 +29,9 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/mender-connect/audit"
+	"github.com/mendersoftware/mender-connect/logging"
 )
 
 const (
@@ -40,20 +45,67 @@ var (
 	errPortForwardUnkonwnConnection  = errors.New("unknown connection")
 )
 
+// PortForwardInfo describes an open port forward
+type PortForwardInfo struct {
+	SessionID    string
+	ConnectionID string
+	Protocol     string
+	RemoteHost   string
+	RemotePort   uint16
+	StartedAt    time.Time
+}
+
+// portForwards registers the open port forwards, listed by PortForwards
+var portForwards = struct {
+	sync.Mutex
+	forwarders map[*MenderPortForwarder]PortForwardInfo
+}{
+	forwarders: make(map[*MenderPortForwarder]PortForwardInfo),
+}
+
+// bytes sent to the server from the remote ends of the port forwards and
+// written to them
+var portForwardTxBytes, portForwardRxBytes uint64
+
+// PortForwardCounters returns the bytes sent to the server from the remote
+// ends of the port forwards and written to them since the start
+func PortForwardCounters() (tx uint64, rx uint64) {
+	return atomic.LoadUint64(&portForwardTxBytes), atomic.LoadUint64(&portForwardRxBytes)
+}
+
+// PortForwards returns the open port forwards of all the sessions, the
+// oldest first
+func PortForwards() []PortForwardInfo {
+	portForwards.Lock()
+	infos := make([]PortForwardInfo, 0, len(portForwards.forwarders))
+	for _, info := range portForwards.forwarders {
+		infos = append(infos, info)
+	}
+	portForwards.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartedAt.Before(infos[j].StartedAt)
+	})
+	return infos
+}
+
 type MenderPortForwarder struct {
 	SessionID      string
 	ConnectionID   string
 	ResponseWriter ResponseWriter
+	// size of the data chunks sent to the client
+	bufSize        int
 	conn           net.Conn
 	closed         bool
 	ctx            context.Context
 	ctxCancel      context.CancelFunc
 	mutexAck       *sync.Mutex
 	portForwarders map[string]*MenderPortForwarder
+	audit          *audit.Recorder
+	logger         *log.Entry
 }
 
 func (f *MenderPortForwarder) Connect(protocol string, host string, portNumber uint16) error {
-	log.Debugf("port-forward[%s/%s] connect: %s/%s:%d", f.SessionID, f.ConnectionID, protocol, host, portNumber)
+	f.logger.Debugf("port-forward connect: %s/%s:%d", protocol, host, portNumber)
 
 	if protocol == wspf.PortForwardProtocolTCP || protocol == wspf.PortForwardProtocolUDP {
 		conn, err := net.Dial(protocol, host+":"+strconv.Itoa(int(portNumber)))
@@ -69,6 +121,17 @@ func (f *MenderPortForwarder) Connect(protocol string, host string, portNumber u
 	f.ctx = ctx
 	f.ctxCancel = cancelFunc
 
+	portForwards.Lock()
+	portForwards.forwarders[f] = PortForwardInfo{
+		SessionID:    f.SessionID,
+		ConnectionID: f.ConnectionID,
+		Protocol:     protocol,
+		RemoteHost:   host,
+		RemotePort:   portNumber,
+		StartedAt:    time.Now(),
+	}
+	portForwards.Unlock()
+
 	go f.Read()
 
 	return nil
@@ -79,7 +142,18 @@ func (f *MenderPortForwarder) Close(sendStopMessage bool) error {
 		return nil
 	}
 	f.closed = true
-	log.Debugf("port-forward[%s/%s] close", f.SessionID, f.ConnectionID)
+	f.logger.Debug("port-forward close")
+	portForwards.Lock()
+	info := portForwards.forwarders[f]
+	delete(portForwards.forwarders, f)
+	portForwards.Unlock()
+	f.audit.Record(audit.Event{
+		Type:      audit.EventPortForwardStop,
+		SessionID: f.SessionID,
+		Protocol:  info.Protocol,
+		Host:      info.RemoteHost,
+		Port:      info.RemotePort,
+	})
 	if sendStopMessage {
 		m := &ws.ProtoMsg{
 			Header: ws.ProtoHdr{
@@ -92,7 +166,7 @@ func (f *MenderPortForwarder) Close(sendStopMessage bool) error {
 			},
 		}
 		if err := f.ResponseWriter.WriteProtoMsg(m); err != nil {
-			log.Errorf("portForwardHandler: webSock.WriteMessage(%+v)", err)
+			f.logger.Errorf("portForwardHandler: webSock.WriteMessage: %s", err.Error())
 		}
 	}
 	defer delete(f.portForwarders, f.ConnectionID)
@@ -105,7 +179,11 @@ func (f *MenderPortForwarder) Read() {
 	dataChan := make(chan []byte)
 
 	go func() {
-		data := make([]byte, portForwardBuffSize)
+		bufSize := f.bufSize
+		if bufSize <= 0 {
+			bufSize = portForwardBuffSize
+		}
+		data := make([]byte, bufSize)
 
 		for {
 			n, err := f.conn.Read(data)
@@ -125,11 +203,11 @@ func (f *MenderPortForwarder) Read() {
 		select {
 		case err := <-errChan:
 			if err != io.EOF {
-				log.Errorf("port-forward[%s/%s] error: %v\n", f.SessionID, f.ConnectionID, err.Error())
+				f.logger.Errorf("port-forward error: %s", err.Error())
 			}
 			f.Close(true)
 		case data := <-dataChan:
-			log.Debugf("port-forward[%s/%s] read %d bytes", f.SessionID, f.ConnectionID, len(data))
+			f.logger.Debugf("port-forward read %d bytes", len(data))
 
 			// lock the ack mutex, we don't allow more than one in-flight message
 			f.mutexAck.Lock()
@@ -146,7 +224,9 @@ func (f *MenderPortForwarder) Read() {
 				Body: data,
 			}
 			if err := f.ResponseWriter.WriteProtoMsg(m); err != nil {
-				log.Errorf("portForwardHandler: webSock.WriteMessage(%+v)", err)
+				f.logger.Errorf("portForwardHandler: webSock.WriteMessage: %s", err.Error())
+			} else {
+				atomic.AddUint64(&portForwardTxBytes, uint64(len(data)))
 			}
 		case <-time.After(portForwardConnectionTimeout):
 			f.Close(true)
@@ -157,8 +237,9 @@ func (f *MenderPortForwarder) Read() {
 }
 
 func (f *MenderPortForwarder) Write(body []byte) error {
-	log.Debugf("port-forward[%s/%s] write %d bytes", f.SessionID, f.ConnectionID, len(body))
-	_, err := f.conn.Write(body)
+	f.logger.Debugf("port-forward write %d bytes", len(body))
+	n, err := f.conn.Write(body)
+	atomic.AddUint64(&portForwardRxBytes, uint64(n))
 	if err != nil {
 		return err
 	}
@@ -167,16 +248,34 @@ func (f *MenderPortForwarder) Write(body []byte) error {
 
 type PortForwardHandler struct {
 	portForwarders map[string]*MenderPortForwarder
+	bufSize        int
+	// audit records the port forwards
+	audit *audit.Recorder
+	// logger carries the fields of the session
+	logger *log.Entry
 }
 
-func PortForward() Constructor {
+// PortForward creates a new port forward constructor sending the data in
+// chunks of at most the given size; if zero, a default of 4 KiB is used
+func PortForward(bufSize int, recorder *audit.Recorder) Constructor {
+	if bufSize <= 0 {
+		bufSize = portForwardBuffSize
+	}
 	return func() SessionHandler {
 		return &PortForwardHandler{
 			portForwarders: make(map[string]*MenderPortForwarder),
+			bufSize:        bufSize,
+			audit:          recorder,
+			logger:         log.NewEntry(log.StandardLogger()),
 		}
 	}
 }
 
+// SetLogger sets the entry the handler logs with
+func (h *PortForwardHandler) SetLogger(logger *log.Entry) {
+	h.logger = logger
+}
+
 func (h *PortForwardHandler) Close() error {
 	for _, f := range h.portForwarders {
 		f.Close(false)
@@ -184,6 +283,17 @@ func (h *PortForwardHandler) Close() error {
 	return nil
 }
 
+// Shutdown closes the port forwards, notifying the client; the returned
+// channel is closed.
+func (h *PortForwardHandler) Shutdown() <-chan struct{} {
+	for _, f := range h.portForwarders {
+		f.Close(true)
+	}
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
 func (h *PortForwardHandler) ServeProtoMsg(msg *ws.ProtoMsg, w ResponseWriter) {
 	var err error
 	switch msg.Header.MsgType {
@@ -199,7 +309,7 @@ func (h *PortForwardHandler) ServeProtoMsg(msg *ws.ProtoMsg, w ResponseWriter) {
 		err = errPortForwardUnkonwnMessageType
 	}
 	if err != nil {
-		log.Errorf("portForwardHandler(%+v)", err)
+		h.logger.Errorf("portForwardHandler: %s", err.Error())
 
 		errMessage := err.Error()
 		body, err := msgpack.Marshal(&wspf.Error{
@@ -207,7 +317,7 @@ func (h *PortForwardHandler) ServeProtoMsg(msg *ws.ProtoMsg, w ResponseWriter) {
 			MessageType: &msg.Header.MsgType,
 		})
 		if err != nil {
-			log.Errorf("portForwardHandler: msgpack.Marshal(%+v)", err)
+			h.logger.Errorf("portForwardHandler: msgpack.Marshal: %s", err.Error())
 		}
 		response := &ws.ProtoMsg{
 			Header: ws.ProtoHdr{
@@ -218,7 +328,7 @@ func (h *PortForwardHandler) ServeProtoMsg(msg *ws.ProtoMsg, w ResponseWriter) {
 			Body: body,
 		}
 		if err := w.WriteProtoMsg(response); err != nil {
-			log.Errorf("portForwardHandler: webSock.WriteMessage(%+v)", err)
+			h.logger.Errorf("portForwardHandler: webSock.WriteMessage: %s", err.Error())
 		}
 	}
 }
@@ -243,14 +353,24 @@ func (h *PortForwardHandler) portForwardHandlerNew(message *ws.ProtoMsg, w Respo
 		SessionID:      message.Header.SessionID,
 		ConnectionID:   connectionID,
 		ResponseWriter: w,
+		bufSize:        h.bufSize,
 		mutexAck:       &sync.Mutex{},
 		portForwarders: h.portForwarders,
+		audit:          h.audit,
+		logger:         h.logger.WithField(logging.FieldPortForwardID, connectionID),
 	}
 
 	h.portForwarders[connectionID] = portForwarder
 
-	log.Infof("port-forward: new %s/%s: %s/%s:%d", message.Header.SessionID, connectionID, *protocol, *host, *portNumber)
+	portForwarder.logger.Infof("port-forward: new %s/%s:%d", *protocol, *host, *portNumber)
 	err = portForwarder.Connect(string(*protocol), *host, *portNumber)
+	h.audit.Record(audit.Event{
+		Type:      audit.EventPortForwardNew,
+		SessionID: message.Header.SessionID,
+		Protocol:  string(*protocol),
+		Host:      *host,
+		Port:      *portNumber,
+	}.WithResult(err))
 	if err != nil {
 		delete(h.portForwarders, connectionID)
 		return err
@@ -267,7 +387,7 @@ func (h *PortForwardHandler) portForwardHandlerNew(message *ws.ProtoMsg, w Respo
 		},
 	}
 	if err := w.WriteProtoMsg(response); err != nil {
-		log.Errorf("portForwardHandler: webSock.WriteMessage(%+v)", err)
+		h.logger.Errorf("portForwardHandler: webSock.WriteMessage: %s", err.Error())
 	}
 
 	return nil
@@ -276,7 +396,7 @@ func (h *PortForwardHandler) portForwardHandlerNew(message *ws.ProtoMsg, w Respo
 func (h *PortForwardHandler) portForwardHandlerStop(message *ws.ProtoMsg, w ResponseWriter) error {
 	connectionID, _ := message.Header.Properties[wspf.PropertyConnectionID].(string)
 	if portForwarder, ok := h.portForwarders[connectionID]; ok {
-		log.Infof("port-forward: stop %s/%s", message.Header.SessionID, connectionID)
+		portForwarder.logger.Info("port-forward: stop")
 		defer delete(h.portForwarders, connectionID)
 		if err := portForwarder.Close(false); err != nil {
 			return err
@@ -293,7 +413,7 @@ func (h *PortForwardHandler) portForwardHandlerStop(message *ws.ProtoMsg, w Resp
 			},
 		}
 		if err := w.WriteProtoMsg(response); err != nil {
-			log.Errorf("portForwardHandler: webSock.WriteMessage(%+v)", err)
+			h.logger.Errorf("portForwardHandler: webSock.WriteMessage: %s", err.Error())
 		}
 
 		return nil
@@ -318,7 +438,7 @@ func (h *PortForwardHandler) portForwardHandlerForward(message *ws.ProtoMsg, w R
 			},
 		}
 		if err := w.WriteProtoMsg(response); err != nil {
-			log.Errorf("portForwardHandler: webSock.WriteMessage(%+v)", err)
+			h.logger.Errorf("portForwardHandler: webSock.WriteMessage: %s", err.Error())
 		}
 		return err
 	} else {
@@ -332,7 +452,7 @@ func (h *PortForwardHandler) portForwardHandlerAck(message *ws.ProtoMsg, w Respo
 		// unlock the ack mutex, do not panic if it is not locked
 		defer func() {
 			if r := recover(); r != nil {
-				log.Errorf("portForwardHandlerAck: recover(%+v)", r)
+				portForwarder.logger.Errorf("portForwardHandlerAck: recover: %v", r)
 			}
 		}()
 		portForwarder.mutexAck.Unlock()
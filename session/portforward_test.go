@@ -39,7 +39,7 @@ func getFreeTCPPort() int {
 }
 
 func TestPortForwardHandler(t *testing.T) {
-	handler := PortForward()()
+	handler := PortForward(0, nil)()
 
 	// unkonwn message
 	msg := &ws.ProtoMsg{
@@ -179,7 +179,7 @@ func TestPortForwardHandler(t *testing.T) {
 }
 
 func TestPortForwardHandlerSuccessfulConnection(t *testing.T) {
-	handler := PortForward()()
+	handler := PortForward(0, nil)()
 
 	// mock echo TCP server
 	tcpPort := getFreeTCPPort()
@@ -461,3 +461,141 @@ func TestPortForwardHandlerSuccessfulConnection(t *testing.T) {
 	}
 	handler.ServeProtoMsg(msg, w)
 }
+
+func TestPortForwardHandlerShutdown(t *testing.T) {
+	handler := PortForward(0, nil)()
+
+	l, err := net.Listen(wspf.PortForwardProtocolTCP, "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	closed := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		_, err = conn.Read(make([]byte, 1))
+		closed <- err
+	}()
+
+	protocol := wspf.PortForwardProtocol(wspf.PortForwardProtocolTCP)
+	remoteHost := "localhost"
+	remotePort := uint16(l.Addr().(*net.TCPAddr).Port)
+	body, _ := msgpack.Marshal(&wspf.PortForwardNew{
+		Protocol:   &protocol,
+		RemoteHost: &remoteHost,
+		RemotePort: &remotePort,
+	})
+	written := make(chan *ws.ProtoMsg, 10)
+	w := ResponseWriterFunc(func(msg *ws.ProtoMsg) error {
+		written <- msg
+		return nil
+	})
+	handler.ServeProtoMsg(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypePortForward,
+			MsgType:   wspf.MessageTypePortForwardNew,
+			SessionID: "session",
+			Properties: map[string]interface{}{
+				wspf.PropertyConnectionID: "c1",
+			},
+		},
+		Body: body,
+	}, w)
+	rsp := <-written
+	assert.Equal(t, wspf.MessageTypePortForwardNew, rsp.Header.MsgType)
+	forwarded := func() *PortForwardInfo {
+		for _, info := range PortForwards() {
+			if info.RemotePort == remotePort {
+				return &info
+			}
+		}
+		return nil
+	}
+	if info := forwarded(); assert.NotNil(t, info) {
+		assert.Equal(t, "session", info.SessionID)
+		assert.Equal(t, "c1", info.ConnectionID)
+		assert.Equal(t, wspf.PortForwardProtocolTCP, info.Protocol)
+		assert.Equal(t, "localhost", info.RemoteHost)
+	}
+
+	select {
+	case <-handler.(ShutdownHandler).Shutdown():
+	default:
+		t.Fatal("the handler did not drain")
+	}
+	rsp = <-written
+	assert.Equal(t, wspf.MessageTypePortForwardStop, rsp.Header.MsgType)
+	assert.Equal(t, "c1", rsp.Header.Properties[wspf.PropertyConnectionID])
+	assert.Nil(t, forwarded())
+	select {
+	case err := <-closed:
+		assert.Equal(t, io.EOF, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the port forward did not close")
+	}
+	assert.NoError(t, handler.Close())
+}
+
+func TestPortForwardCounters(t *testing.T) {
+	handler := PortForward(0, nil)()
+	defer handler.Close()
+
+	l, err := net.Listen(wspf.PortForwardProtocolTCP, "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	txBefore, rxBefore := PortForwardCounters()
+	protocol := wspf.PortForwardProtocol(wspf.PortForwardProtocolTCP)
+	remoteHost := "localhost"
+	remotePort := uint16(l.Addr().(*net.TCPAddr).Port)
+	body, _ := msgpack.Marshal(&wspf.PortForwardNew{
+		Protocol:   &protocol,
+		RemoteHost: &remoteHost,
+		RemotePort: &remotePort,
+	})
+	written := make(chan *ws.ProtoMsg, 10)
+	w := ResponseWriterFunc(func(msg *ws.ProtoMsg) error {
+		written <- msg
+		return nil
+	})
+	header := ws.ProtoHdr{
+		Proto:     ws.ProtoTypePortForward,
+		MsgType:   wspf.MessageTypePortForwardNew,
+		SessionID: "session-counters",
+		Properties: map[string]interface{}{
+			wspf.PropertyConnectionID: "c1",
+		},
+	}
+	handler.ServeProtoMsg(&ws.ProtoMsg{Header: header, Body: body}, w)
+	rsp := <-written
+	assert.Equal(t, wspf.MessageTypePortForwardNew, rsp.Header.MsgType)
+
+	header.MsgType = wspf.MessageTypePortForward
+	handler.ServeProtoMsg(&ws.ProtoMsg{Header: header, Body: []byte("hello")}, w)
+	rsp = <-written
+	assert.Equal(t, wspf.MessageTypePortForwardAck, rsp.Header.MsgType)
+	select {
+	case rsp = <-written:
+		assert.Equal(t, wspf.MessageTypePortForward, rsp.Header.MsgType)
+		assert.Equal(t, []byte("hello"), rsp.Body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the data was not forwarded back")
+	}
+
+	tx, rx := PortForwardCounters()
+	assert.GreaterOrEqual(t, tx-txBefore, uint64(5))
+	assert.GreaterOrEqual(t, rx-rxBefore, uint64(5))
+}
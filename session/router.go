@@ -15,6 +15,7 @@
 package session
 
 import (
+	"context"
 	"sync"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
@@ -24,6 +25,7 @@ import (
 var (
 	ErrNoSession   = errors.New("session: does not exist")
 	ErrNoSessionID = errors.New("session: message does not have a session ID")
+	ErrShutdown    = errors.New("session: shutting down")
 )
 
 const MaxTraceback = 32
@@ -33,13 +35,27 @@ type ProtoRoutes map[ws.ProtoType]Constructor
 //go:generate ../utils/mockgen.sh
 type Router interface {
 	RouteMessage(msg *ws.ProtoMsg, w ResponseWriter) error
+	// Sessions returns the open sessions.
+	Sessions() []Info
+	// Terminate closes the session with the given ID.
+	Terminate(sessionID string) error
+	// Shutdown refuses the new sessions and closes the open ones
+	// gracefully, terminating those still open when the context is done.
+	Shutdown(ctx context.Context) error
+	// SetRoutes replaces the routes of the new sessions; the open ones
+	// keep theirs.
+	SetRoutes(routes ProtoRoutes)
 }
 
 // router manages creation/deletion and routing of concurrent sessions.
 type router struct {
 	Config
 	sessions sync.Map
+	// mutex protects routes and shutdown, which is set once the router
+	// refuses the new sessions
+	mutex    sync.RWMutex
 	routes   ProtoRoutes
+	shutdown bool
 }
 
 func NewRouter(routes ProtoRoutes, config Config) Router {
@@ -55,19 +71,31 @@ func (mgr *router) startSession(sess *Session) {
 	sess.ListenAndServe()
 }
 
-func (mgr *router) RouteMessage(msg *ws.ProtoMsg, w ResponseWriter) (err error) {
-	var sess *Session
+// session returns the session of the message, starting a new one unless
+// the router shuts down
+func (mgr *router) session(msg *ws.ProtoMsg, w ResponseWriter) (*Session, error) {
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
 	sessFace, loaded := mgr.sessions.Load(msg.Header.SessionID)
-	if !loaded {
-		msgChan := make(chan *ws.ProtoMsg)
-		sess = New(msg.Header.SessionID, msgChan, w, mgr.routes, mgr.Config)
-		sessFace, loaded = mgr.sessions.LoadOrStore(msg.Header.SessionID, sess)
-		if loaded {
-			sess = sessFace.(*Session)
-		}
-		go mgr.startSession(sess)
-	} else {
-		sess = sessFace.(*Session)
+	if loaded {
+		return sessFace.(*Session), nil
+	}
+	sess := New(msg.Header.SessionID, make(chan *ws.ProtoMsg), w, mgr.routes, mgr.Config)
+	if mgr.shutdown {
+		sess.Error(msg, true, ErrShutdown.Error())
+		return nil, ErrShutdown
+	}
+	if sessFace, loaded = mgr.sessions.LoadOrStore(msg.Header.SessionID, sess); loaded {
+		return sessFace.(*Session), nil
+	}
+	go mgr.startSession(sess)
+	return sess, nil
+}
+
+func (mgr *router) RouteMessage(msg *ws.ProtoMsg, w ResponseWriter) (err error) {
+	sess, err := mgr.session(msg, w)
+	if err != nil {
+		return err
 	}
 	select {
 	case <-sess.Done():
@@ -76,3 +104,54 @@ func (mgr *router) RouteMessage(msg *ws.ProtoMsg, w ResponseWriter) (err error)
 	}
 	return nil
 }
+
+func (mgr *router) Sessions() []Info {
+	sessions := []Info{}
+	mgr.sessions.Range(func(_, sessFace interface{}) bool {
+		if info, opened := sessFace.(*Session).Info(); opened {
+			sessions = append(sessions, info)
+		}
+		return true
+	})
+	return sessions
+}
+
+func (mgr *router) Terminate(sessionID string) error {
+	sessFace, loaded := mgr.sessions.Load(sessionID)
+	if !loaded {
+		return ErrNoSession
+	}
+	sessFace.(*Session).Terminate()
+	return nil
+}
+
+func (mgr *router) SetRoutes(routes ProtoRoutes) {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	mgr.routes = routes
+}
+
+func (mgr *router) Shutdown(ctx context.Context) (err error) {
+	mgr.mutex.Lock()
+	mgr.shutdown = true
+	mgr.mutex.Unlock()
+
+	var sessions []*Session
+	mgr.sessions.Range(func(_, sessFace interface{}) bool {
+		sess := sessFace.(*Session)
+		sess.Shutdown()
+		sessions = append(sessions, sess)
+		return true
+	})
+	for _, sess := range sessions {
+		select {
+		case <-sess.Done():
+			continue
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		sess.Terminate()
+		<-sess.Done()
+	}
+	return err
+}
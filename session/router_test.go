@@ -15,11 +15,15 @@
 package session
 
 import (
+	"context"
 	"testing"
 	"time"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-connect/logging"
 )
 
 type panicHandler struct {
@@ -95,6 +99,7 @@ func TestRouterRace(t *testing.T) {
 			return &panicHandler{panicDelay: time.Second}
 		},
 	}
+	panics := HandlerPanics()
 	w := &testWriter{}
 	router := NewRouter(routes, Config{IdleTimeout: time.Second * 30})
 	err := router.RouteMessage(&ws.ProtoMsg{
@@ -105,4 +110,305 @@ func TestRouterRace(t *testing.T) {
 		Header: ws.ProtoHdr{Proto: ws.ProtoType(0x4321)},
 	}, w)
 	assert.EqualError(t, err, "session completed before message handoff")
+	assert.GreaterOrEqual(t, HandlerPanics()-panics, uint64(1))
+}
+
+func TestRouterSetRoutes(t *testing.T) {
+	t.Parallel()
+	router := NewRouter(ProtoRoutes{
+		ws.ProtoType(0x1234): func() SessionHandler {
+			return new(echoHandler)
+		},
+	}, Config{IdleTimeout: time.Second * 10})
+	written := make(chan *ws.ProtoMsg, 10)
+	w := ResponseWriterFunc(func(msg *ws.ProtoMsg) error {
+		written <- msg
+		return nil
+	})
+	msg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoType(0x1234),
+			SessionID: "session-id",
+		},
+	}
+	err := router.RouteMessage(msg, w)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, <-written)
+
+	router.SetRoutes(ProtoRoutes{
+		ws.ProtoType(0x4321): func() SessionHandler {
+			return new(echoHandler)
+		},
+	})
+
+	// the open session keeps its handler
+	err = router.RouteMessage(msg, w)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, <-written)
+
+	// the new sessions get the new routes
+	err = router.RouteMessage(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoType(0x1234),
+			SessionID: "new-session-id",
+		},
+	}, w)
+	assert.NoError(t, err)
+	rsp := <-written
+	assert.Equal(t, ws.MessageTypeError, rsp.Header.MsgType)
+	assert.Equal(t, "new-session-id", rsp.Header.SessionID)
+
+	newMsg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoType(0x4321),
+			SessionID: "new-session-id",
+		},
+	}
+	err = router.RouteMessage(newMsg, w)
+	assert.NoError(t, err)
+	assert.Equal(t, newMsg, <-written)
+}
+
+type testObserver struct {
+	opened chan Info
+	closed chan Info
+}
+
+func newTestObserver() *testObserver {
+	return &testObserver{
+		opened: make(chan Info, 10),
+		closed: make(chan Info, 10),
+	}
+}
+
+func (o *testObserver) SessionOpened(info Info) {
+	o.opened <- info
+}
+
+func (o *testObserver) SessionClosed(info Info) {
+	o.closed <- info
+}
+
+func TestRouterSessions(t *testing.T) {
+	t.Parallel()
+	const sessionID = "session-id"
+	routes := ProtoRoutes{
+		ws.ProtoType(0x1234): func() SessionHandler {
+			return new(echoHandler)
+		},
+	}
+	observer := newTestObserver()
+	router := NewRouter(routes, Config{
+		IdleTimeout: time.Second * 10,
+		Observer:    observer,
+	})
+	written := make(chan *ws.ProtoMsg, 10)
+	w := ResponseWriterFunc(func(msg *ws.ProtoMsg) error {
+		written <- msg
+		return nil
+	})
+
+	// control messages do not open the session
+	err := router.RouteMessage(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   ws.MessageTypePong,
+			SessionID: sessionID,
+		},
+	}, w)
+	assert.NoError(t, err)
+	assert.Equal(t, []Info{}, router.Sessions())
+
+	err = router.RouteMessage(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoType(0x1234),
+			MsgType:   "hello?",
+			SessionID: sessionID,
+			Properties: map[string]interface{}{
+				"user_id": "user-id",
+			},
+		},
+	}, w)
+	assert.NoError(t, err)
+	select {
+	case info := <-observer.opened:
+		assert.Equal(t, sessionID, info.ID)
+		assert.Equal(t, "user-id", info.UserID)
+		assert.Equal(t, ws.ProtoType(0x1234), info.Proto)
+		assert.False(t, info.StartedAt.IsZero())
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session did not open")
+	}
+	<-written
+
+	sessions := router.Sessions()
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, sessionID, sessions[0].ID)
+		assert.Equal(t, "user-id", sessions[0].UserID)
+		assert.False(t, sessions[0].ActiveAt.Before(sessions[0].StartedAt))
+	}
+
+	err = router.Terminate("dummy")
+	assert.Equal(t, ErrNoSession, err)
+
+	err = router.Terminate(sessionID)
+	assert.NoError(t, err)
+	select {
+	case msg := <-written:
+		assert.Equal(t, ws.ProtoTypeControl, msg.Header.Proto)
+		assert.Equal(t, ws.MessageTypeClose, msg.Header.MsgType)
+		assert.Equal(t, sessionID, msg.Header.SessionID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the peer was not notified of the termination")
+	}
+	select {
+	case info := <-observer.closed:
+		assert.Equal(t, sessionID, info.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session did not close")
+	}
+}
+
+type drainHandler struct {
+	echoHandler
+	shutdown chan struct{}
+	drained  chan struct{}
+}
+
+func (h *drainHandler) Shutdown() <-chan struct{} {
+	close(h.shutdown)
+	return h.drained
+}
+
+// loggingHandler passes the entry it is set to log with
+type loggingHandler struct {
+	echoHandler
+	loggers chan *log.Entry
+}
+
+func (h loggingHandler) SetLogger(logger *log.Entry) {
+	h.loggers <- logger
+}
+
+func TestRouterLoggingHandler(t *testing.T) {
+	t.Parallel()
+	loggers := make(chan *log.Entry, 1)
+	router := NewRouter(ProtoRoutes{
+		ws.ProtoTypeFileTransfer: func() SessionHandler {
+			return loggingHandler{loggers: loggers}
+		},
+	}, Config{IdleTimeout: time.Second * 10})
+	w := ResponseWriterFunc(func(msg *ws.ProtoMsg) error {
+		return nil
+	})
+
+	err := router.RouteMessage(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeFileTransfer,
+			SessionID: "session-id",
+			Properties: map[string]interface{}{
+				"user_id": "user-id",
+			},
+		},
+	}, w)
+	assert.NoError(t, err)
+	select {
+	case logger := <-loggers:
+		assert.Equal(t, log.Fields{
+			logging.FieldSessionID: "session-id",
+			logging.FieldUserID:    "user-id",
+			logging.FieldProto:     "filetransfer",
+		}, logger.Data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the logger of the handler was not set")
+	}
+	assert.NoError(t, router.Terminate("session-id"))
+}
+
+func TestRouterShutdown(t *testing.T) {
+	t.Parallel()
+	testCases := map[string]struct {
+		timeout time.Duration
+		drain   bool
+		err     error
+	}{
+		"drained": {
+			timeout: 5 * time.Second,
+			drain:   true,
+		},
+		"timeout": {
+			timeout: 100 * time.Millisecond,
+			err:     context.DeadlineExceeded,
+		},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			handler := &drainHandler{
+				shutdown: make(chan struct{}),
+				drained:  make(chan struct{}),
+			}
+			router := NewRouter(ProtoRoutes{
+				ws.ProtoType(0x1234): func() SessionHandler {
+					return handler
+				},
+			}, Config{IdleTimeout: time.Second * 10})
+			written := make(chan *ws.ProtoMsg, 10)
+			w := ResponseWriterFunc(func(msg *ws.ProtoMsg) error {
+				written <- msg
+				return nil
+			})
+			msg := &ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:     ws.ProtoType(0x1234),
+					SessionID: "session-id",
+				},
+			}
+			err := router.RouteMessage(msg, w)
+			assert.NoError(t, err)
+			assert.Equal(t, msg, <-written)
+
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			defer cancel()
+			shutdown := make(chan error, 1)
+			go func() {
+				shutdown <- router.Shutdown(ctx)
+			}()
+			select {
+			case <-handler.shutdown:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the handler did not shut down")
+			}
+
+			// new sessions are refused
+			err = router.RouteMessage(&ws.ProtoMsg{
+				Header: ws.ProtoHdr{
+					Proto:     ws.ProtoType(0x1234),
+					SessionID: "new-session-id",
+				},
+			}, w)
+			assert.Equal(t, ErrShutdown, err)
+			rsp := <-written
+			assert.Equal(t, ws.MessageTypeError, rsp.Header.MsgType)
+			assert.Equal(t, "new-session-id", rsp.Header.SessionID)
+
+			if tc.drain {
+				// the pending operations are still served
+				err = router.RouteMessage(msg, w)
+				assert.NoError(t, err)
+				assert.Equal(t, msg, <-written)
+				close(handler.drained)
+			}
+			select {
+			case err := <-shutdown:
+				assert.Equal(t, tc.err, err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("the router did not shut down")
+			}
+			rsp = <-written
+			assert.Equal(t, ws.MessageTypeClose, rsp.Header.MsgType)
+			assert.Equal(t, "session-id", rsp.Header.SessionID)
+		})
+	}
 }
@@ -0,0 +1,68 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package session
+
+import "sync"
+
+// scrollback keeps the most recent output of a shell session, up to its
+// size, to be replayed when a client reattaches to the session
+type scrollback struct {
+	mutex sync.Mutex
+	buf   []byte
+	// next is the position of the next byte written, and full tells if
+	// the buffer wrapped around, in which case next is the oldest byte
+	next int
+	full bool
+}
+
+func newScrollback(size int) *scrollback {
+	return &scrollback{buf: make([]byte, size)}
+}
+
+// Output appends the data to the buffer, dropping the oldest bytes once
+// full
+func (b *scrollback) Output(data []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	size := len(b.buf)
+	if size == 0 {
+		return
+	}
+	if len(data) >= size {
+		copy(b.buf, data[len(data)-size:])
+		b.next = 0
+		b.full = true
+		return
+	}
+	n := copy(b.buf[b.next:], data)
+	if n < len(data) {
+		copy(b.buf, data[n:])
+		b.full = true
+	}
+	b.next = (b.next + len(data)) % size
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Bytes returns a copy of the buffered output, the oldest first
+func (b *scrollback) Bytes() []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.full {
+		return append([]byte(nil), b.buf[:b.next]...)
+	}
+	return append(append([]byte(nil), b.buf[b.next:]...), b.buf[:b.next]...)
+}
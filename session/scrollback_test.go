@@ -0,0 +1,68 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package session
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrollback(t *testing.T) {
+	testCases := map[string]struct {
+		size   int
+		writes []string
+		output string
+	}{
+		"empty": {
+			size:   8,
+			output: "",
+		},
+		"not full": {
+			size:   8,
+			writes: []string{"abc", "de"},
+			output: "abcde",
+		},
+		"exactly full": {
+			size:   8,
+			writes: []string{"abcd", "efgh"},
+			output: "abcdefgh",
+		},
+		"wrapped around": {
+			size:   8,
+			writes: []string{"abcdef", "ghij", "k"},
+			output: "defghijk",
+		},
+		"larger than the buffer": {
+			size:   4,
+			writes: []string{"ab", "cdefghij"},
+			output: "ghij",
+		},
+		"disabled": {
+			size:   0,
+			writes: []string{"abc"},
+			output: "",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			b := newScrollback(tc.size)
+			for _, data := range tc.writes {
+				b.Output([]byte(data))
+			}
+			assert.Equal(t, tc.output, string(b.Bytes()))
+		})
+	}
+}
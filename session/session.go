@@ -39,12 +39,16 @@ import (
 	"fmt"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/vmihailenco/msgpack/v5"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
+
+	"github.com/mendersoftware/mender-connect/logging"
 )
 
 type ResponseWriter interface {
@@ -65,6 +69,24 @@ type SessionHandler interface {
 	Close() error
 }
 
+// ShutdownHandler is implemented by the SessionHandlers which complete their
+// pending operations before the session shuts down.
+type ShutdownHandler interface {
+	// Shutdown refuses the new operations and returns a channel which
+	// closes once the pending ones completed. The handler still serves
+	// the messages of the pending operations until then.
+	Shutdown() <-chan struct{}
+}
+
+// LoggingHandler is implemented by the SessionHandlers which log with the
+// fields of their session.
+type LoggingHandler interface {
+	// SetLogger sets the entry the handler logs with, carrying the ID, the
+	// user and the protocol of the session; it is called once the handler
+	// is created.
+	SetLogger(logger *log.Entry)
+}
+
 type HandlerFunc func(msg *ws.ProtoMsg, w ResponseWriter)
 
 func (h HandlerFunc) ServeProtoMsg(msg *ws.ProtoMsg, w ResponseWriter) { h(msg, w) }
@@ -76,11 +98,66 @@ func (h HandlerFunc) Close() error { return nil }
 // (factory).
 type Constructor func() SessionHandler
 
+// messageHeaderReserve is the room left for the message header when sizing
+// the data chunks
+const messageHeaderReserve = 4096
+
+// ChunkSize returns the size of the file transfer and port forward data
+// chunks which fit, together with the message header, in a message of the
+// given maximum size
+func ChunkSize(maxMessageSize int64) int {
+	reserve := maxMessageSize / 2
+	if reserve > messageHeaderReserve {
+		reserve = messageHeaderReserve
+	}
+	return int(maxMessageSize - reserve)
+}
+
+// Info describes an open session.
+type Info struct {
+	// ID is the session ID.
+	ID string
+	// UserID is the ID of the user who opened the session.
+	UserID string
+	// Proto is the protocol of the session.
+	Proto ws.ProtoType
+	// StartedAt is the time at which the session opened.
+	StartedAt time.Time
+	// ActiveAt is the time of the last message of the session.
+	ActiveAt time.Time
+}
+
+// Observer is notified when sessions open and close.
+type Observer interface {
+	SessionOpened(info Info)
+	SessionClosed(info Info)
+}
+
+// Observers notifies each of the observers in turn.
+type Observers []Observer
+
+// SessionOpened notifies the observers that the session opened.
+func (o Observers) SessionOpened(info Info) {
+	for _, observer := range o {
+		observer.SessionOpened(info)
+	}
+}
+
+// SessionClosed notifies the observers that the session closed.
+func (o Observers) SessionClosed(info Info) {
+	for _, observer := range o {
+		observer.SessionClosed(info)
+	}
+}
+
 // Config is the static configuration for Sessions and Routers.
 type Config struct {
 	// IdleTimeout is the duration a session can remain inactive before
 	// it shuts down.
 	IdleTimeout time.Duration
+	// Observer, if set, is notified when the sessions open and close. A
+	// session opens with its first non-control message.
+	Observer Observer
 }
 
 type Session struct {
@@ -91,6 +168,16 @@ type Session struct {
 	msgChan  chan *ws.ProtoMsg
 	done     chan struct{}
 	w        ResponseWriter
+
+	// infoMutex protects info and opened, which are read by the Router
+	infoMutex sync.Mutex
+	info      Info
+	opened    bool
+
+	terminate     chan struct{}
+	terminateOnce sync.Once
+	shutdown      chan struct{}
+	shutdownOnce  sync.Once
 }
 
 func New(
@@ -108,6 +195,11 @@ func New(
 		msgChan:  msgChan,
 		done:     make(chan struct{}),
 		w:        w,
+		info: Info{
+			ID: sessionID,
+		},
+		terminate: make(chan struct{}),
+		shutdown:  make(chan struct{}),
 	}
 }
 
@@ -119,6 +211,109 @@ func (sess *Session) MsgChan() chan<- *ws.ProtoMsg {
 	return sess.msgChan
 }
 
+// Info returns the description of the session, and whether it opened.
+func (sess *Session) Info() (Info, bool) {
+	sess.infoMutex.Lock()
+	defer sess.infoMutex.Unlock()
+	return sess.info, sess.opened
+}
+
+// logger returns the entry the session logs with, carrying its ID and,
+// once it opened, its user and protocol.
+func (sess *Session) logger() *log.Entry {
+	info, opened := sess.Info()
+	if !opened {
+		return log.WithField(logging.FieldSessionID, sess.ID)
+	}
+	return log.WithFields(logging.SessionFields(sess.ID, info.UserID, info.Proto))
+}
+
+// Terminate closes the session, notifying the peer.
+func (sess *Session) Terminate() {
+	sess.terminateOnce.Do(func() {
+		close(sess.terminate)
+	})
+}
+
+// Shutdown closes the session gracefully: the handlers complete their
+// pending operations, then the peer is notified.
+func (sess *Session) Shutdown() {
+	sess.shutdownOnce.Do(func() {
+		close(sess.shutdown)
+	})
+}
+
+// drain shuts down the handlers, returning a channel which closes once
+// they completed their pending operations.
+func (sess *Session) drain() <-chan struct{} {
+	var pending []<-chan struct{}
+	for _, handler := range sess.handlers {
+		if h, ok := handler.(ShutdownHandler); ok {
+			pending = append(pending, h.Shutdown())
+		}
+	}
+	drained := make(chan struct{})
+	go func() {
+		for _, c := range pending {
+			<-c
+		}
+		close(drained)
+	}()
+	return drained
+}
+
+// notifyTerminated notifies the peer that the session closed.
+func (sess *Session) notifyTerminated() {
+	err := sess.w.WriteProtoMsg(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeControl,
+			MsgType:   ws.MessageTypeClose,
+			SessionID: sess.ID,
+		},
+	})
+	if err != nil {
+		sess.logger().Errorf("failed to notify client of session termination: %s",
+			err.Error())
+	}
+	sess.logger().Infof("session: terminated %s", sess.ID)
+}
+
+// touch records the activity of the session.
+func (sess *Session) touch() {
+	sess.infoMutex.Lock()
+	defer sess.infoMutex.Unlock()
+	sess.info.ActiveAt = time.Now()
+}
+
+// open opens the session when the handler of its first protocol starts,
+// and notifies the observer.
+func (sess *Session) open(msg *ws.ProtoMsg) {
+	sess.infoMutex.Lock()
+	if sess.opened {
+		sess.infoMutex.Unlock()
+		return
+	}
+	sess.opened = true
+	sess.info.Proto = msg.Header.Proto
+	sess.info.UserID, _ = msg.Header.Properties["user_id"].(string)
+	sess.info.StartedAt = time.Now()
+	sess.info.ActiveAt = sess.info.StartedAt
+	info := sess.info
+	sess.infoMutex.Unlock()
+
+	if sess.Observer != nil {
+		sess.Observer.SessionOpened(info)
+	}
+}
+
+// notifyClosed notifies the observer that the session closed, if it opened.
+func (sess *Session) notifyClosed() {
+	info, opened := sess.Info()
+	if opened && sess.Observer != nil {
+		sess.Observer.SessionClosed(info)
+	}
+}
+
 func (sess *Session) Error(msg *ws.ProtoMsg, close bool, errMessage string) {
 	errSchema := ws.Error{
 		Error:        errMessage,
@@ -140,7 +335,7 @@ func (sess *Session) Error(msg *ws.ProtoMsg, close bool, errMessage string) {
 		Body: b,
 	})
 	if err != nil {
-		log.Errorf("failed to write response to client: %s", err.Error())
+		sess.logger().Errorf("failed to write response to client: %s", err.Error())
 	}
 }
 
@@ -194,10 +389,11 @@ func (sess *Session) HandleControl(msg *ws.ProtoMsg) (close bool) {
 					Body: b,
 				})
 				if err != nil {
-					log.Errorf("failed to reply to peer handshake: %s", err.Error())
+					sess.logger().Errorf("failed to reply to peer handshake: %s",
+						err.Error())
 					close = true
 				} else {
-					log.Infof("session: accepting new session with ID: %s", sess.ID)
+					sess.logger().Infof("session: accepting new session with ID: %s", sess.ID)
 				}
 				return
 			}
@@ -224,12 +420,12 @@ func (sess *Session) HandleControl(msg *ws.ProtoMsg) (close bool) {
 
 	case ws.MessageTypeClose:
 		close = true
-		log.Infof("session: closed %s", msg.Header.SessionID)
+		sess.logger().Infof("session: closed %s", msg.Header.SessionID)
 
 	case ws.MessageTypeError:
 		var errMsg ws.Error
 		msgpack.Unmarshal(msg.Body, &errMsg) //nolint:errcheck
-		log.Errorf("session: received error from client: %s", errMsg.Error)
+		sess.logger().Errorf("session: received error from client: %s", errMsg.Error)
 		close = errMsg.Close
 
 	default:
@@ -262,11 +458,21 @@ func funcname(fn string) string {
 	return fn
 }
 
+// handlerPanics counts the panics recovered by handlePanic
+var handlerPanics uint64
+
+// HandlerPanics returns the number of panics of the session handlers
+// recovered since the start
+func HandlerPanics() uint64 {
+	return atomic.LoadUint64(&handlerPanics)
+}
+
 // handlePanic recover from panics within session handlers by responding with
 // an internal error message and dumping a log entry with the panic message and
 // a stack trace.
 func (sess *Session) handlePanic() {
 	if r := recover(); r != nil {
+		atomic.AddUint64(&handlerPanics, 1)
 		var stacktrace strings.Builder
 		var trace [MaxTraceback]uintptr
 		num := runtime.Callers(3, trace[:])
@@ -281,7 +487,7 @@ func (sess *Session) handlePanic() {
 				file, line, funcname(fn.Name()),
 			)
 		}
-		log.WithField("trace", stacktrace.String()).
+		sess.logger().WithField("trace", stacktrace.String()).
 			Errorf("[panic] %s", r)
 		sess.Error(&ws.ProtoMsg{}, true, "internal error")
 	}
@@ -290,6 +496,7 @@ func (sess *Session) handlePanic() {
 
 func (sess *Session) ListenAndServe() {
 	defer sess.handlePanic()
+	defer sess.notifyClosed()
 	var (
 		msg       *ws.ProtoMsg
 		open      bool
@@ -297,6 +504,9 @@ func (sess *Session) ListenAndServe() {
 		pingWait  = (sess.Config.IdleTimeout * 4) / 5
 		pongWait  = sess.Config.IdleTimeout - pingWait
 		timerPing = time.NewTimer(pingWait)
+		shutdown  = sess.shutdown
+		// drained is set once shutting down
+		drained <-chan struct{}
 	)
 	select {
 	case <-sess.done:
@@ -318,7 +528,7 @@ func (sess *Session) ListenAndServe() {
 				// Config.IdleTimeout)
 				err := sess.Ping()
 				if err != nil {
-					log.Errorf("failed to ping client: %s", err.Error())
+					sess.logger().Errorf("failed to ping client: %s", err.Error())
 					return
 				}
 				sessIdle = true
@@ -326,6 +536,19 @@ func (sess *Session) ListenAndServe() {
 			}
 			continue
 
+		case <-sess.terminate:
+			sess.notifyTerminated()
+			return
+
+		case <-shutdown:
+			shutdown = nil
+			drained = sess.drain()
+			continue
+
+		case <-drained:
+			sess.notifyTerminated()
+			return
+
 		case msg, open = <-sess.msgChan:
 			if !open {
 				return
@@ -334,6 +557,7 @@ func (sess *Session) ListenAndServe() {
 			// on incoming messages from the other peer.
 			timerPing.Reset(pingWait)
 			sessIdle = false
+			sess.touch()
 		}
 
 		if msg.Header.Proto == ws.ProtoTypeControl {
@@ -355,10 +579,20 @@ func (sess *Session) ListenAndServe() {
 					msg.Header.Proto,
 				))
 				continue
+			} else if drained != nil {
+				// no new handlers while shutting down
+				sess.Error(msg, false, "session: shutting down")
+				continue
 			}
 			handler = constructor()
 			defer handler.Close()
 			sess.handlers[msg.Header.Proto] = handler
+			sess.open(msg)
+			if h, ok := handler.(LoggingHandler); ok {
+				info, _ := sess.Info()
+				h.SetLogger(log.WithFields(logging.SessionFields(
+					sess.ID, info.UserID, msg.Header.Proto)))
+			}
 		}
 		// Apply the SessionHandler.
 		handler.ServeProtoMsg(msg, sess.w)
@@ -14,8 +14,10 @@
 package session
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -23,6 +25,7 @@ import (
 	"os/user"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -35,6 +38,8 @@ import (
 	"github.com/mendersoftware/go-lib-micro/ws"
 	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
 
+	"github.com/mendersoftware/mender-connect/client/https"
+	"github.com/mendersoftware/mender-connect/config"
 	"github.com/mendersoftware/mender-connect/connection"
 	"github.com/mendersoftware/mender-connect/connectionmanager"
 	"github.com/mendersoftware/mender-connect/procps"
@@ -578,12 +583,12 @@ func newShellTransaction(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func init() {
-	connectionmanager.DefaultPingWait = 10 * time.Second
-}
+// testPingWait is the ping wait of the connection managers of the tests
+const testPingWait = 10 * time.Second
 
 func TestMenderShellStartStopShell(t *testing.T) {
-	MaxUserSessions = 2
+	shellSessions := NewMenderShellSessions(nil, nil)
+	shellSessions.SetMaxUserSessions(2)
 	t.Log("starting mock httpd with websockets")
 	server := httptest.NewServer(http.HandlerFunc(newShellTransaction))
 	defer server.Close()
@@ -593,9 +598,10 @@ func TestMenderShellStartStopShell(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, https.Config{NoVerify: true})
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
@@ -616,7 +622,7 @@ func TestMenderShellStartStopShell(t *testing.T) {
 		return
 	}
 
-	s, err := NewMenderShellSession("c4993deb-26b4-4c58-aaee-fd0c9e694328", "user-id-f435678-f4567ff", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := shellSessions.NewSession(manager, "c4993deb-26b4-4c58-aaee-fd0c9e694328", "user-id-f435678-f4567ff", defaultSessionExpiredTimeout, NoExpirationTimeout)
 	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
 		Uid:            uint32(uid),
 		Gid:            uint32(gid),
@@ -647,7 +653,7 @@ func TestMenderShellStartStopShell(t *testing.T) {
 	assert.Equal(t, strings.Split(s.GetActiveAtFmt(), ":")[0], nowUpToHours)
 	assert.Equal(t, "/bin/sh", s.GetShellCommandPath())
 
-	sNew, err := NewMenderShellSession("c4993deb-26b4-4c58-aaee-fd0c9e694328", "user-id-f435678-f4567ff", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	sNew, err := shellSessions.NewSession(manager, "c4993deb-26b4-4c58-aaee-fd0c9e694328", "user-id-f435678-f4567ff", defaultSessionExpiredTimeout, NoExpirationTimeout)
 	err = sNew.StartShell(sNew.GetId(), MenderShellTerminalSettings{
 		Uid:            uint32(uid),
 		Gid:            uint32(gid),
@@ -668,15 +674,16 @@ func TestMenderShellStartStopShell(t *testing.T) {
 	}
 	assert.False(t, procps.ProcessExists(s.shellPid))
 
-	count, err := MenderShellStopByUserId("user-id-f435678-f4567ff")
+	count, err := shellSessions.StopByUserId("user-id-f435678-f4567ff")
 	assert.NoError(t, err)
 	assert.Equal(t, uint(2), count) //the reason for 2 here: s.StopShell does not intrinsically remove the session
 
-	count, err = MenderShellStopByUserId("not-really-there")
+	count, err = shellSessions.StopByUserId("not-really-there")
 	assert.Error(t, err)
 }
 
 func TestMenderShellCommand(t *testing.T) {
+	shellSessions := NewMenderShellSessions(nil, nil)
 	t.Log("starting mock httpd with websockets")
 	server := httptest.NewServer(http.HandlerFunc(newShellTransaction))
 	defer server.Close()
@@ -686,9 +693,10 @@ func TestMenderShellCommand(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	conn, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	conn, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, https.Config{NoVerify: true})
 	assert.NoError(t, err)
 	assert.NotNil(t, conn)
 
@@ -709,7 +717,7 @@ func TestMenderShellCommand(t *testing.T) {
 		return
 	}
 
-	s, err := NewMenderShellSession("c4993deb-26b4-4c58-aaee-fd0c9e694328", uuid.NewV4().String(), defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := shellSessions.NewSession(manager, "c4993deb-26b4-4c58-aaee-fd0c9e694328", uuid.NewV4().String(), defaultSessionExpiredTimeout, NoExpirationTimeout)
 	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
 		Uid:            uint32(uid),
 		Gid:            uint32(gid),
@@ -752,8 +760,184 @@ func TestMenderShellCommand(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestMenderShellRecording(t *testing.T) {
+	shellSessions := NewMenderShellSessions(nil, nil)
+	server := httptest.NewServer(http.HandlerFunc(newShellTransaction))
+	defer server.Close()
+
+	u := "ws" + strings.TrimPrefix(server.URL, "http")
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
+
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	tdir, err := ioutil.TempDir("", "recording")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	s, err := shellSessions.NewSession(manager, uuid.NewV4().String(), uuid.NewV4().String(),
+		defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer shellSessions.DeleteById(s.GetId())
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+		Recording: config.RecordingConfig{
+			Enable:        true,
+			RecordInput:   true,
+			Dir:           tdir,
+			MaxFileSizeMB: 1,
+		},
+	})
+	assert.NoError(t, err)
+	recordingPath := s.recorder.Path()
+
+	s.ResizeShell(30, 100)
+	err = s.ShellCommand(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeShellCommand,
+			SessionID: s.GetId(),
+		},
+		Body: []byte("echo rec$((40+2))\n"),
+	})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		b, _ := ioutil.ReadFile(recordingPath)
+		return strings.Contains(string(b), "rec42")
+	}, 5*time.Second, 50*time.Millisecond)
+	s.StopShell() //nolint:errcheck
+	assert.Nil(t, s.recorder)
+
+	b, err := ioutil.ReadFile(recordingPath)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	var header map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &header))
+	assert.Equal(t, float64(2), header["version"])
+	assert.Equal(t, float64(80), header["width"])
+	assert.Equal(t, float64(40), header["height"])
+	events := strings.Join(lines[1:], "\n")
+	assert.Regexp(t, `(?m)^\[[0-9.]+, "r", "100x30"\]$`, events)
+	assert.Regexp(t, `(?m)^\[[0-9.]+, "i", "echo rec\$\(\(40\+2\)\)\\n"\]$`, events)
+	assert.Regexp(t, `"o", ".*rec42`, events)
+}
+
+func TestMenderShellReattach(t *testing.T) {
+	shellSessions := NewMenderShellSessions(nil, nil)
+	server := httptest.NewServer(http.HandlerFunc(newShellTransaction))
+	defer server.Close()
+
+	u := "ws" + strings.TrimPrefix(server.URL, "http")
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
+
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	userId := uuid.NewV4().String()
+	s, err := shellSessions.NewSession(manager, uuid.NewV4().String(), userId,
+		defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer shellSessions.DeleteById(s.GetId())
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:                 uint32(uid),
+		Gid:                 uint32(gid),
+		Shell:               "/bin/sh",
+		TerminalString:      "xterm-256color",
+		Height:              40,
+		Width:               80,
+		ReattachGracePeriod: time.Minute,
+		ScrollbackSize:      1024,
+	})
+	assert.NoError(t, err)
+	defer s.StopShell() //nolint:errcheck
+
+	err = s.ShellCommand(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeShellCommand,
+			SessionID: s.GetId(),
+		},
+		Body: []byte("echo out$((40+2))\n"),
+	})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(string(s.scrollback.Bytes()), "out42")
+	}, 5*time.Second, 50*time.Millisecond)
+
+	assert.True(t, s.DetachedAt().IsZero())
+	shellSessions.Detach()
+	detachedAt := s.DetachedAt()
+	assert.False(t, detachedAt.IsZero())
+	assert.False(t, s.IsDetachedExpired())
+	// detaching again keeps the time of the first detach
+	s.Detach()
+	assert.Equal(t, detachedAt, s.DetachedAt())
+
+	assert.Equal(t, ErrSessionUserMismatch, s.Reattach(uuid.NewV4().String()))
+	assert.False(t, s.DetachedAt().IsZero())
+	assert.NoError(t, s.Reattach(userId))
+	assert.True(t, s.DetachedAt().IsZero())
+	assert.NoError(t, s.ReplayScrollback())
+
+	s.Detach()
+	s.attachMutex.Lock()
+	s.detachedAt = timeNow().Add(-2 * time.Minute)
+	s.attachMutex.Unlock()
+	assert.True(t, s.IsDetachedExpired())
+}
+
+func TestMenderShellReattachDisabled(t *testing.T) {
+	shellSessions := NewMenderShellSessions(nil, nil)
+	server := httptest.NewServer(http.HandlerFunc(newShellTransaction))
+	defer server.Close()
+
+	u := "ws" + strings.TrimPrefix(server.URL, "http")
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
+
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	userId := uuid.NewV4().String()
+	s, err := shellSessions.NewSession(manager, uuid.NewV4().String(), userId,
+		defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer shellSessions.DeleteById(s.GetId())
+	assert.Equal(t, ErrSessionShellNotRunning, s.Reattach(userId))
+
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	defer s.StopShell() //nolint:errcheck
+	assert.Nil(t, s.scrollback)
+
+	shellSessions.Detach()
+	assert.True(t, s.DetachedAt().IsZero())
+	assert.Equal(t, ErrSessionReattachDisabled, s.Reattach(userId))
+}
+
 func TestMenderShellShellAlreadyStartedFailedToStart(t *testing.T) {
-	MaxUserSessions = 2
+	shellSessions := NewMenderShellSessions(nil, nil)
+	shellSessions.SetMaxUserSessions(2)
 	t.Log("starting mock httpd with websockets")
 	server := httptest.NewServer(http.HandlerFunc(newShellTransaction))
 	defer server.Close()
@@ -763,9 +947,10 @@ func TestMenderShellShellAlreadyStartedFailedToStart(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, https.Config{NoVerify: true})
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
@@ -787,7 +972,7 @@ func TestMenderShellShellAlreadyStartedFailedToStart(t *testing.T) {
 	}
 
 	userId := uuid.NewV4().String()
-	s, err := NewMenderShellSession("c4993deb-26b4-4c58-aaee-fd0c9e694328", userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := shellSessions.NewSession(manager, "c4993deb-26b4-4c58-aaee-fd0c9e694328", userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
 		Uid:            uint32(uid),
 		Gid:            uint32(gid),
@@ -816,7 +1001,7 @@ func TestMenderShellShellAlreadyStartedFailedToStart(t *testing.T) {
 	assert.Error(t, err)
 	assert.True(t, procps.ProcessExists(s.shellPid))
 
-	sNew, err := NewMenderShellSession("c4993deb-26b4-4c58-aaee-fd0c9e694328", userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	sNew, err := shellSessions.NewSession(manager, "c4993deb-26b4-4c58-aaee-fd0c9e694328", userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	err = sNew.StartShell(sNew.GetId(), MenderShellTerminalSettings{
 		Uid:            uint32(uid),
 		Gid:            uint32(gid),
@@ -845,6 +1030,7 @@ func noopMainServerLoop(w http.ResponseWriter, r *http.Request) {
 }
 
 func TestMenderShellSessionExpire(t *testing.T) {
+	shellSessions := NewMenderShellSessions(nil, nil)
 	defaultSessionExpiredTimeout = 2
 
 	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
@@ -855,13 +1041,14 @@ func TestMenderShellSessionExpire(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, https.Config{NoVerify: true})
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
-	s, err := NewMenderShellSession("c4993deb-26b4-4c58-aaee-fd0c9e694328", "user-id-f435678-f4567f2", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := shellSessions.NewSession(manager, "c4993deb-26b4-4c58-aaee-fd0c9e694328", "user-id-f435678-f4567f2", defaultSessionExpiredTimeout, NoExpirationTimeout)
 	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
 		Uid:            500,
 		Gid:            501,
@@ -877,6 +1064,7 @@ func TestMenderShellSessionExpire(t *testing.T) {
 }
 
 func TestMenderShellSessionUpdateWS(t *testing.T) {
+	shellSessions := NewMenderShellSessions(nil, nil)
 	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
 	defer server.Close()
 
@@ -885,13 +1073,14 @@ func TestMenderShellSessionUpdateWS(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, https.Config{NoVerify: true})
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
-	s, err := NewMenderShellSession("c4993deb-26b4-4c58-aaee-fd0c9e694328", "user-id-f435678-f451212", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := shellSessions.NewSession(manager, "c4993deb-26b4-4c58-aaee-fd0c9e694328", "user-id-f435678-f451212", defaultSessionExpiredTimeout, NoExpirationTimeout)
 	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
 		Uid:            500,
 		Gid:            501,
@@ -904,6 +1093,7 @@ func TestMenderShellSessionUpdateWS(t *testing.T) {
 }
 
 func TestMenderShellSessionGetByUserId(t *testing.T) {
+	shellSessions := NewMenderShellSessions(nil, nil)
 	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
 	defer server.Close()
 
@@ -912,43 +1102,45 @@ func TestMenderShellSessionGetByUserId(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, https.Config{NoVerify: true})
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
 	userId := "user-id-f431212-f4567ff"
-	s, err := NewMenderShellSession("c4993deb-26b4-4c58-aaee-fd0c9e694328", userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := shellSessions.NewSession(manager, "c4993deb-26b4-4c58-aaee-fd0c9e694328", userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
 
 	anotherUserId := "user-id-f4433528-43b342b234b"
-	anotherUserSession, err := NewMenderShellSession("c4993deb-26b4-4c58-aaee-fd0c9e694328", anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	anotherUserSession, err := shellSessions.NewSession(manager, "c4993deb-26b4-4c58-aaee-fd0c9e694328", anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
 
 	assert.NotEqual(t, anotherUserId, userId)
 
-	userSessions := MenderShellSessionsGetByUserId(userId)
+	userSessions := shellSessions.GetByUserId(userId)
 	assert.True(t, len(userSessions) > 0)
 	assert.NotNil(t, userSessions[0])
 	assert.True(t, userSessions[0].GetId() == s.id)
 	assert.True(t, userSessions[0].GetShellPid() == s.shellPid)
 
-	anotherUserSessions := MenderShellSessionsGetByUserId(anotherUserId)
+	anotherUserSessions := shellSessions.GetByUserId(anotherUserId)
 	assert.True(t, len(anotherUserSessions) > 0)
 	assert.NotNil(t, anotherUserSessions[0])
 	assert.True(t, anotherUserSessions[0].GetId() == anotherUserSession.id)
 	assert.True(t, anotherUserSessions[0].GetShellPid() == anotherUserSession.shellPid)
 
-	userSessions = MenderShellSessionsGetByUserId(userId + "-different")
+	userSessions = shellSessions.GetByUserId(userId + "-different")
 	assert.False(t, len(userSessions) > 0)
 
-	anotherUserSessions = MenderShellSessionsGetByUserId(anotherUserId + "-different")
+	anotherUserSessions = shellSessions.GetByUserId(anotherUserId + "-different")
 	assert.False(t, len(anotherUserSessions) > 0)
 }
 
 func TestMenderShellSessionGetById(t *testing.T) {
-	MaxUserSessions = 2
+	shellSessions := NewMenderShellSessions(nil, nil)
+	shellSessions.SetMaxUserSessions(2)
 	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
 	defer server.Close()
 
@@ -957,54 +1149,56 @@ func TestMenderShellSessionGetById(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, https.Config{NoVerify: true})
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
 	userId := "user-id-8989-f431212-f4567ff"
-	s, err := NewMenderShellSession("c4993deb-26b4-4c58-aaee-fd0c9e694328", userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := shellSessions.NewSession(manager, "c4993deb-26b4-4c58-aaee-fd0c9e694328", userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
-	r, err := NewMenderShellSession("c4993deb-26b4-4c58-aaee-fd0c9e694328", userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	r, err := shellSessions.NewSession(manager, "c4993deb-26b4-4c58-aaee-fd0c9e694328", userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
 
 	anotherUserId := "user-id-8989-f4433528-43b342b234b"
-	anotherUserSession, err := NewMenderShellSession("c4993deb-26b4-4c58-aaee-fd0c9e694328", anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	anotherUserSession, err := shellSessions.NewSession(manager, "c4993deb-26b4-4c58-aaee-fd0c9e694328", anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
-	andAnotherUserSession, err := NewMenderShellSession("c4993deb-26b4-4c58-aaee-fd0c9e694328", anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	andAnotherUserSession, err := shellSessions.NewSession(manager, "c4993deb-26b4-4c58-aaee-fd0c9e694328", anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
 
 	assert.NotEqual(t, anotherUserId, userId)
 
-	userSessions := MenderShellSessionsGetByUserId(userId)
+	userSessions := shellSessions.GetByUserId(userId)
 	assert.True(t, len(userSessions) == 2)
 	assert.NotNil(t, userSessions[0])
 	assert.True(t, userSessions[0].GetId() == s.id)
 
-	anotherUserSessions := MenderShellSessionsGetByUserId(anotherUserId)
+	anotherUserSessions := shellSessions.GetByUserId(anotherUserId)
 	assert.True(t, len(anotherUserSessions) == 2)
 	assert.NotNil(t, anotherUserSessions[0])
 	assert.True(t, anotherUserSessions[0].GetId() == anotherUserSession.id)
 
-	assert.NotNil(t, MenderShellSessionGetById(userSessions[0].GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(userSessions[1].GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(anotherUserSessions[0].GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(anotherUserSessions[1].GetId()))
-	assert.Nil(t, MenderShellSessionGetById("not-really-there"))
+	assert.NotNil(t, shellSessions.GetById(userSessions[0].GetId()))
+	assert.NotNil(t, shellSessions.GetById(userSessions[1].GetId()))
+	assert.NotNil(t, shellSessions.GetById(anotherUserSessions[0].GetId()))
+	assert.NotNil(t, shellSessions.GetById(anotherUserSessions[1].GetId()))
+	assert.Nil(t, shellSessions.GetById("not-really-there"))
 
 	var ids []string
 
 	ids = []string{anotherUserSession.id, andAnotherUserSession.id}
-	assert.Contains(t, ids, MenderShellSessionGetById(anotherUserSessions[0].GetId()).id)
-	assert.Contains(t, ids, MenderShellSessionGetById(anotherUserSessions[1].GetId()).id)
+	assert.Contains(t, ids, shellSessions.GetById(anotherUserSessions[0].GetId()).id)
+	assert.Contains(t, ids, shellSessions.GetById(anotherUserSessions[1].GetId()).id)
 	ids = []string{s.id, r.id}
-	assert.Contains(t, ids, MenderShellSessionGetById(userSessions[0].GetId()).id)
-	assert.Contains(t, ids, MenderShellSessionGetById(userSessions[1].GetId()).id)
+	assert.Contains(t, ids, shellSessions.GetById(userSessions[0].GetId()).id)
+	assert.Contains(t, ids, shellSessions.GetById(userSessions[1].GetId()).id)
 }
 
 func TestMenderShellDeleteById(t *testing.T) {
-	MaxUserSessions = 2
+	shellSessions := NewMenderShellSessions(nil, nil)
+	shellSessions.SetMaxUserSessions(2)
 	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
 	defer server.Close()
 
@@ -1013,73 +1207,163 @@ func TestMenderShellDeleteById(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, https.Config{NoVerify: true})
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
 	userId := "user-id-1212-8989-f431212-f4567ff"
-	s, err := NewMenderShellSession(uuid.NewV4().String(), userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := shellSessions.NewSession(manager, uuid.NewV4().String(), userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
-	r, err := NewMenderShellSession(uuid.NewV4().String(), userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	r, err := shellSessions.NewSession(manager, uuid.NewV4().String(), userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
 
 	anotherUserId := "user-id-1212-8989-f4433528-43b342b234b"
-	anotherUserSession, err := NewMenderShellSession(uuid.NewV4().String(), anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	anotherUserSession, err := shellSessions.NewSession(manager, uuid.NewV4().String(), anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
 	assert.NotNil(t, anotherUserSession)
-	andAnotherUserSession, err := NewMenderShellSession(uuid.NewV4().String(), anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	andAnotherUserSession, err := shellSessions.NewSession(manager, uuid.NewV4().String(), anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
 	assert.NotNil(t, anotherUserSession)
 
-	assert.NotNil(t, MenderShellSessionGetById(anotherUserSession.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(andAnotherUserSession.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(s.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(r.GetId()))
+	assert.NotNil(t, shellSessions.GetById(anotherUserSession.GetId()))
+	assert.NotNil(t, shellSessions.GetById(andAnotherUserSession.GetId()))
+	assert.NotNil(t, shellSessions.GetById(s.GetId()))
+	assert.NotNil(t, shellSessions.GetById(r.GetId()))
 
-	err = MenderShellDeleteById("not-really-here")
+	err = shellSessions.DeleteById("not-really-here")
 	assert.Error(t, err)
 
-	err = MenderShellDeleteById(anotherUserSession.GetId())
+	err = shellSessions.DeleteById(anotherUserSession.GetId())
 	assert.NoError(t, err)
-	assert.Nil(t, MenderShellSessionGetById(anotherUserSession.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(andAnotherUserSession.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(s.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(r.GetId()))
+	assert.Nil(t, shellSessions.GetById(anotherUserSession.GetId()))
+	assert.NotNil(t, shellSessions.GetById(andAnotherUserSession.GetId()))
+	assert.NotNil(t, shellSessions.GetById(s.GetId()))
+	assert.NotNil(t, shellSessions.GetById(r.GetId()))
 
-	err = MenderShellDeleteById("not-really-here")
+	err = shellSessions.DeleteById("not-really-here")
 	assert.Error(t, err)
 
-	err = MenderShellDeleteById(andAnotherUserSession.GetId())
+	err = shellSessions.DeleteById(andAnotherUserSession.GetId())
 	assert.NoError(t, err)
-	assert.Nil(t, MenderShellSessionGetById(anotherUserSession.GetId()))
-	assert.Nil(t, MenderShellSessionGetById(andAnotherUserSession.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(s.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(r.GetId()))
+	assert.Nil(t, shellSessions.GetById(anotherUserSession.GetId()))
+	assert.Nil(t, shellSessions.GetById(andAnotherUserSession.GetId()))
+	assert.NotNil(t, shellSessions.GetById(s.GetId()))
+	assert.NotNil(t, shellSessions.GetById(r.GetId()))
 
-	err = MenderShellDeleteById(s.GetId())
+	err = shellSessions.DeleteById(s.GetId())
 	assert.NoError(t, err)
-	assert.Nil(t, MenderShellSessionGetById(anotherUserSession.GetId()))
-	assert.Nil(t, MenderShellSessionGetById(andAnotherUserSession.GetId()))
-	assert.Nil(t, MenderShellSessionGetById(s.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(r.GetId()))
+	assert.Nil(t, shellSessions.GetById(anotherUserSession.GetId()))
+	assert.Nil(t, shellSessions.GetById(andAnotherUserSession.GetId()))
+	assert.Nil(t, shellSessions.GetById(s.GetId()))
+	assert.NotNil(t, shellSessions.GetById(r.GetId()))
 
-	err = MenderShellDeleteById(r.GetId())
+	err = shellSessions.DeleteById(r.GetId())
 	assert.NoError(t, err)
-	assert.Nil(t, MenderShellSessionGetById(anotherUserSession.GetId()))
-	assert.Nil(t, MenderShellSessionGetById(andAnotherUserSession.GetId()))
-	assert.Nil(t, MenderShellSessionGetById(s.GetId()))
-	assert.Nil(t, MenderShellSessionGetById(r.GetId()))
+	assert.Nil(t, shellSessions.GetById(anotherUserSession.GetId()))
+	assert.Nil(t, shellSessions.GetById(andAnotherUserSession.GetId()))
+	assert.Nil(t, shellSessions.GetById(s.GetId()))
+	assert.Nil(t, shellSessions.GetById(r.GetId()))
 
-	err = MenderShellDeleteById("not-really-here")
+	err = shellSessions.DeleteById("not-really-here")
 	assert.Error(t, err)
 }
 
+func TestMenderShellSessionObserver(t *testing.T) {
+	observer := newTestObserver()
+	shellSessions := NewMenderShellSessions(observer, nil)
+
+	userId := "user-id-observer"
+	s, err := shellSessions.NewSession(nil, uuid.NewV4().String(), userId,
+		defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	info := <-observer.opened
+	assert.Equal(t, s.GetId(), info.ID)
+	assert.Equal(t, userId, info.UserID)
+	assert.Equal(t, ws.ProtoTypeShell, info.Proto)
+	assert.Equal(t, s.Info(), info)
+	assert.Equal(t, info.StartedAt, info.ActiveAt)
+
+	err = shellSessions.DeleteById(s.GetId())
+	assert.NoError(t, err)
+	info = <-observer.closed
+	assert.Equal(t, s.GetId(), info.ID)
+	assert.Len(t, observer.closed, 0)
+}
+
+func TestSetMaxUserSessions(t *testing.T) {
+	shellSessions := NewMenderShellSessions(nil, nil)
+	assert.Equal(t, DefaultMaxUserSessions, shellSessions.GetMaxUserSessions())
+
+	shellSessions.SetMaxUserSessions(3)
+	assert.Equal(t, 3, shellSessions.GetMaxUserSessions())
+	shellSessions.SetMaxUserSessions(0)
+	assert.Equal(t, DefaultMaxUserSessions, shellSessions.GetMaxUserSessions())
+}
+
+func TestMenderShellPeerSessionLimit(t *testing.T) {
+	shellSessions := NewMenderShellSessions(nil, nil)
+	shellSessions.SetMaxUserSessions(1)
+
+	userId := "user-id-peer-limit"
+	s, err := shellSessions.NewSession(nil, uuid.NewV4().String(), userId,
+		defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer shellSessions.DeleteById(s.GetId())
+
+	_, err = shellSessions.NewSession(nil, uuid.NewV4().String(), userId,
+		defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.Error(t, err)
+
+	// the peers attach to a shell running in another session
+	for i := 0; i < 2; i++ {
+		p, err := shellSessions.NewPeerSession(nil, uuid.NewV4().String(), userId,
+			defaultSessionExpiredTimeout, NoExpirationTimeout)
+		assert.NoError(t, err)
+		defer shellSessions.DeleteById(p.GetId())
+	}
+	assert.Len(t, shellSessions.GetByUserId(userId), 3)
+}
+
+func TestMenderShellSessionsConcurrentAccess(t *testing.T) {
+	shellSessions := NewMenderShellSessions(nil, nil)
+	shellSessions.SetMaxUserSessions(4)
+
+	// the sessions are created and deleted by the message loop, while the
+	// sweep of the expired sessions and the status go through them
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id := fmt.Sprintf("concurrent-%d-%d", i, j)
+				s, err := shellSessions.NewSession(nil, id, "concurrent-user", NoExpirationTimeout,
+					NoExpirationTimeout)
+				if err == nil {
+					assert.NoError(t, shellSessions.DeleteById(s.GetId()))
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				shellSessions.GetCount()
+				shellSessions.GetByUserId("concurrent-user")
+				shellSessions.GetSessionIds()
+				shellSessions.Detach()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, shellSessions.GetByUserId("concurrent-user"))
+}
+
 func TestMenderShellNewMenderShellSession(t *testing.T) {
-	MaxUserSessions = 2
-	sessionsMap = map[string]*MenderShellSession{}
-	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+	shellSessions := NewMenderShellSessions(nil, nil)
+	shellSessions.SetMaxUserSessions(2)
 	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
 	defer server.Close()
 
@@ -1088,41 +1372,41 @@ func TestMenderShellNewMenderShellSession(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, https.Config{NoVerify: true})
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
 	var createdSessonsIds []string
 	var s *MenderShellSession
 	userId := uuid.NewV4().String()
-	for i := 0; i < MaxUserSessions; i++ {
-		s, err = NewMenderShellSession(uuid.NewV4().String(), userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	for i := 0; i < shellSessions.GetMaxUserSessions(); i++ {
+		s, err = shellSessions.NewSession(manager, uuid.NewV4().String(), userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 		assert.NoError(t, err)
 		assert.NotNil(t, s)
 		createdSessonsIds = append(createdSessonsIds, s.id)
 	}
-	notFoundSession, err := NewMenderShellSession(uuid.NewV4().String(), userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	notFoundSession, err := shellSessions.NewSession(manager, uuid.NewV4().String(), userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.Error(t, err)
 	assert.Nil(t, notFoundSession)
 
-	sessionById := MenderShellSessionGetById(s.GetId())
+	sessionById := shellSessions.GetById(s.GetId())
 	assert.NotNil(t, sessionById)
 	assert.True(t, sessionById.id == s.GetId())
 
-	count := MenderShellSessionGetCount()
-	assert.Equal(t, MaxUserSessions, count)
+	count := shellSessions.GetCount()
+	assert.Equal(t, shellSessions.GetMaxUserSessions(), count)
 
-	sessionsIds := MenderShellSessionGetSessionIds()
+	sessionsIds := shellSessions.GetSessionIds()
 	assert.Equal(t, len(createdSessonsIds), len(sessionsIds))
 	assert.ElementsMatch(t, createdSessonsIds, sessionsIds)
 }
 
 func TestMenderSessionTerminateExpired(t *testing.T) {
+	shellSessions := NewMenderShellSessions(nil, nil)
 	defaultSessionExpiredTimeout = 8 * time.Second
-	sessionsMap = map[string]*MenderShellSession{}
-	sessionsByUserIdMap = map[string][]*MenderShellSession{}
 
 	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
 	defer server.Close()
@@ -1132,13 +1416,14 @@ func TestMenderSessionTerminateExpired(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, https.Config{NoVerify: true})
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
-	s, err := NewMenderShellSession("c4993deb-26b4-4c58-aaee-fd0c9e694328", "user-id-f435678-f4567f2", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := shellSessions.NewSession(manager, "c4993deb-26b4-4c58-aaee-fd0c9e694328", "user-id-f435678-f4567f2", defaultSessionExpiredTimeout, NoExpirationTimeout)
 	t.Logf("created session:\n id:%s,\n createdAt:%s,\n expiresAt:%s\n now:%s",
 		s.id,
 		s.createdAt.Format("Mon Jan 2 15:04:05 -0700 MST 2006"),
@@ -1154,7 +1439,7 @@ func TestMenderSessionTerminateExpired(t *testing.T) {
 	})
 	assert.NoError(t, err)
 
-	shells, sessions, total, err := MenderSessionTerminateExpired()
+	shells, sessions, total, err := shellSessions.TerminateExpired()
 	assert.NoError(t, err)
 	assert.Equal(t, 0, shells)
 	assert.Equal(t, 0, sessions)
@@ -1163,7 +1448,7 @@ func TestMenderSessionTerminateExpired(t *testing.T) {
 	time.Sleep(2 * defaultSessionExpiredTimeout)
 	assert.True(t, s.IsExpired(false))
 
-	shells, sessions, total, err = MenderSessionTerminateExpired()
+	shells, sessions, total, err = shellSessions.TerminateExpired()
 	assert.NoError(t, err)
 	assert.Equal(t, 1, shells)
 	assert.Equal(t, 1, sessions)
@@ -1172,9 +1457,8 @@ func TestMenderSessionTerminateExpired(t *testing.T) {
 }
 
 func TestMenderSessionTerminateAll(t *testing.T) {
+	shellSessions := NewMenderShellSessions(nil, nil)
 	defaultSessionExpiredTimeout = 8 * time.Second
-	sessionsMap = map[string]*MenderShellSession{}
-	sessionsByUserIdMap = map[string][]*MenderShellSession{}
 
 	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
 	defer server.Close()
@@ -1184,13 +1468,14 @@ func TestMenderSessionTerminateAll(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, https.Config{NoVerify: true})
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
-	s0, err := NewMenderShellSession(uuid.NewV4().String(), "user-id-f435678-f4567f2", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s0, err := shellSessions.NewSession(manager, uuid.NewV4().String(), "user-id-f435678-f4567f2", defaultSessionExpiredTimeout, NoExpirationTimeout)
 	t.Logf("created session:\n id:%s,\n createdAt:%s,\n expiresAt:%s\n now:%s",
 		s0.id,
 		s0.createdAt.Format("Mon Jan 2 15:04:05 -0700 MST 2006"),
@@ -1206,7 +1491,7 @@ func TestMenderSessionTerminateAll(t *testing.T) {
 	})
 	assert.NoError(t, err)
 
-	s1, err := NewMenderShellSession(uuid.NewV4().String(), "user-id-f435678-f4567f3", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s1, err := shellSessions.NewSession(manager, uuid.NewV4().String(), "user-id-f435678-f4567f3", defaultSessionExpiredTimeout, NoExpirationTimeout)
 	t.Logf("created session:\n id:%s,\n createdAt:%s,\n expiresAt:%s\n now:%s",
 		s1.id,
 		s1.createdAt.Format("Mon Jan 2 15:04:05 -0700 MST 2006"),
@@ -1222,16 +1507,15 @@ func TestMenderSessionTerminateAll(t *testing.T) {
 	})
 	assert.NoError(t, err)
 
-	MenderSessionTerminateAll()
+	shellSessions.TerminateAll()
 	assert.True(t, !procps.ProcessExists(s0.shellPid))
 	assert.True(t, !procps.ProcessExists(s1.shellPid))
 }
 
 func TestMenderSessionTerminateIdle(t *testing.T) {
+	shellSessions := NewMenderShellSessions(nil, nil)
 	defaultSessionExpiredTimeout = 255 * time.Second
 	idleTimeOut := 4 * time.Second
-	sessionsMap = map[string]*MenderShellSession{}
-	sessionsByUserIdMap = map[string][]*MenderShellSession{}
 
 	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
 	defer server.Close()
@@ -1241,13 +1525,14 @@ func TestMenderSessionTerminateIdle(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, https.Config{NoVerify: true})
 	assert.NoError(t, err)
 	assert.NotNil(t, ws)
 
-	s, err := NewMenderShellSession("c4993deb-26b4-4c58-aaee-fd0c9e694328", "user-id-f435678-f4567f2", NoExpirationTimeout, idleTimeOut)
+	s, err := shellSessions.NewSession(manager, "c4993deb-26b4-4c58-aaee-fd0c9e694328", "user-id-f435678-f4567f2", NoExpirationTimeout, idleTimeOut)
 	t.Logf("created session:\n id:%s,\n createdAt:%s,\n expiresAt:%s\n now:%s",
 		s.id,
 		s.createdAt.Format("Mon Jan 2 15:04:05 -0700 MST 2006"),
@@ -1270,7 +1555,7 @@ func TestMenderSessionTerminateIdle(t *testing.T) {
 		}
 	}(s.pseudoTTY)
 
-	shells, sessions, total, err := MenderSessionTerminateExpired()
+	shells, sessions, total, err := shellSessions.TerminateExpired()
 	assert.NoError(t, err)
 	assert.Equal(t, 0, shells)
 	assert.Equal(t, 0, sessions)
@@ -1279,7 +1564,7 @@ func TestMenderSessionTerminateIdle(t *testing.T) {
 	time.Sleep(2 * idleTimeOut)
 	assert.True(t, s.IsExpired(false))
 
-	shells, sessions, total, err = MenderSessionTerminateExpired()
+	shells, sessions, total, err = shellSessions.TerminateExpired()
 	assert.NoError(t, err)
 	assert.Equal(t, 1, shells)
 	assert.Equal(t, 1, sessions)
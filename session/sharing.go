@@ -0,0 +1,258 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package session
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+
+	"github.com/mendersoftware/mender-connect/audit"
+)
+
+// Modes of the sessions attached to a shared shell
+const (
+	PeerModeObserver = "observer"
+	PeerModeWriter   = "writer"
+)
+
+// Events announced to the participants of a shared shell
+const (
+	PeerEventAttached = "peer_attached"
+	PeerEventDetached = "peer_detached"
+)
+
+var (
+	ErrSessionReadOnly          = errors.New("session is read-only")
+	ErrSessionTooManyPeers      = errors.New("too many sessions attached to the shell")
+	ErrSessionSharingDisabled   = errors.New("sharing the shells is disabled")
+	ErrSessionWritersNotAllowed = errors.New("writing to a shared shell is not allowed")
+)
+
+// sharingMutex protects the links between the shared shells and the
+// sessions attached to them
+var sharingMutex sync.Mutex
+
+// peersOutput passes the output of a shared shell to the sessions
+// attached to it
+type peersOutput struct {
+	session *MenderShellSession
+}
+
+func (o peersOutput) Output(data []byte) {
+	peers := o.session.Peers()
+	if len(peers) == 0 {
+		return
+	}
+	// the data is reused once recorded
+	body := append([]byte(nil), data...)
+	for _, peer := range peers {
+		if err := peer.send(wsshell.MessageTypeShellCommand, wsshell.NormalMessage,
+			body, nil); err != nil {
+			peer.logger().Debugf("error on write: %s", err.Error())
+		}
+	}
+}
+
+// send writes a message of the shell protocol to the client of the session
+func (s *MenderShellSession) send(
+	msgType string,
+	status wsshell.MenderShellMessageStatus,
+	body []byte,
+	properties map[string]interface{},
+) error {
+	msg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   msgType,
+			SessionID: s.id,
+			Properties: map[string]interface{}{
+				"status": status,
+			},
+		},
+		Body: body,
+	}
+	for key, value := range properties {
+		msg.Header.Properties[key] = value
+	}
+	return s.manager.Write(ws.ProtoTypeShell, msg)
+}
+
+func peerMode(writer bool) string {
+	if writer {
+		return PeerModeWriter
+	}
+	return PeerModeObserver
+}
+
+// mode returns the mode of the session attached to a shared shell
+func (s *MenderShellSession) mode() string {
+	return peerMode(s.canWrite)
+}
+
+// IsPeer tells if the session is attached to the shell of another session
+func (s *MenderShellSession) IsPeer() bool {
+	sharingMutex.Lock()
+	defer sharingMutex.Unlock()
+	return s.shared != nil
+}
+
+// sharedShell returns the session owning the shell the session is attached
+// to, if any, and whether the session may write to it
+func (s *MenderShellSession) sharedShell() (*MenderShellSession, bool) {
+	sharingMutex.Lock()
+	defer sharingMutex.Unlock()
+	return s.shared, s.canWrite
+}
+
+// Peers returns the sessions attached to the shell of the session
+func (s *MenderShellSession) Peers() []*MenderShellSession {
+	sharingMutex.Lock()
+	defer sharingMutex.Unlock()
+	return append([]*MenderShellSession(nil), s.peers...)
+}
+
+// AttachPeer attaches the peer session to the running shell of the
+// session, or to the one the session is attached to, as a writer or as a
+// read-only observer, and announces it to the participants; maxPeers, if
+// not zero, limits the number of sessions attached to the shell
+func (s *MenderShellSession) AttachPeer(peer *MenderShellSession, writer bool, maxPeers int) (err error) {
+	sharingMutex.Lock()
+	if s.shared != nil {
+		s = s.shared
+	}
+	defer func() {
+		s.sessions.audit.Record(audit.Event{
+			Type:            audit.EventShellAttach,
+			SessionID:       peer.id,
+			UserID:          peer.userId,
+			SharedSessionID: s.id,
+			Mode:            peerMode(writer),
+		}.WithResult(err))
+	}()
+	if s.status != ActiveSession || peer == s {
+		sharingMutex.Unlock()
+		return ErrSessionShellNotRunning
+	} else if maxPeers > 0 && len(s.peers) >= maxPeers {
+		sharingMutex.Unlock()
+		return ErrSessionTooManyPeers
+	}
+	participants := append([]*MenderShellSession{s}, s.peers...)
+	peer.shared = s
+	peer.canWrite = writer
+	peer.status = ActiveSession
+	peer.activeAt = timeNow()
+	s.peers = append(s.peers, peer)
+	sharingMutex.Unlock()
+
+	peer.logger().Infof("session %s attached to the shell of the session %s as %s",
+		peer.id, s.id, peer.mode())
+	announce(participants, PeerEventAttached, peer)
+	return nil
+}
+
+// detachPeer detaches the session from the shared shell it is attached
+// to, if any, and announces it to the remaining participants
+func (s *MenderShellSession) detachPeer() bool {
+	sharingMutex.Lock()
+	shared := s.shared
+	if shared == nil {
+		sharingMutex.Unlock()
+		return false
+	}
+	for i, peer := range shared.peers {
+		if peer == s {
+			shared.peers = append(shared.peers[:i:i], shared.peers[i+1:]...)
+			break
+		}
+	}
+	s.shared = nil
+	s.status = EmptySession
+	participants := append([]*MenderShellSession{shared}, shared.peers...)
+	sharingMutex.Unlock()
+
+	s.sessions.audit.Record(audit.Event{
+		Type:            audit.EventShellDetach,
+		SessionID:       s.id,
+		UserID:          s.userId,
+		SharedSessionID: shared.id,
+		Mode:            s.mode(),
+	})
+	s.logger().Infof("session %s detached from the shell of the session %s", s.id, shared.id)
+	announce(participants, PeerEventDetached, s)
+	return true
+}
+
+// closePeers detaches the sessions attached to the shell of the session,
+// once stopped, notifying their clients of the end of the shell; they stay
+// listed to be deleted along with the session
+func (s *MenderShellSession) closePeers() {
+	sharingMutex.Lock()
+	peers := append([]*MenderShellSession(nil), s.peers...)
+	for _, peer := range peers {
+		peer.shared = nil
+		peer.status = EmptySession
+	}
+	sharingMutex.Unlock()
+
+	for _, peer := range peers {
+		err := peer.send(wsshell.MessageTypeStopShell, wsshell.NormalMessage, nil, nil)
+		if err != nil {
+			peer.logger().Debugf("error on write: %s", err.Error())
+		}
+	}
+}
+
+// takePeers detaches the sessions attached to the shell of the session and
+// returns them
+func (s *MenderShellSession) takePeers() []*MenderShellSession {
+	sharingMutex.Lock()
+	defer sharingMutex.Unlock()
+	peers := s.peers
+	s.peers = nil
+	for _, peer := range peers {
+		peer.shared = nil
+		peer.status = EmptySession
+	}
+	return peers
+}
+
+// announce tells the participants of a shared shell that the peer session
+// attached to or detached from it
+func announce(participants []*MenderShellSession, event string, peer *MenderShellSession) {
+	var text string
+	if event == PeerEventAttached {
+		text = fmt.Sprintf("\r\n*** user %s attached to the shell as %s ***\r\n",
+			peer.userId, peer.mode())
+	} else {
+		text = fmt.Sprintf("\r\n*** user %s detached from the shell ***\r\n", peer.userId)
+	}
+	properties := map[string]interface{}{
+		"event":           event,
+		"peer_session_id": peer.id,
+		"peer_user_id":    peer.userId,
+		"peer_mode":       peer.mode(),
+	}
+	for _, participant := range participants {
+		err := participant.send(wsshell.MessageTypeShellCommand, wsshell.ControlMessage,
+			[]byte(text), properties)
+		if err != nil {
+			participant.logger().Debugf("error on write: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os/user"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+
+	"github.com/mendersoftware/mender-connect/client/https"
+	"github.com/mendersoftware/mender-connect/connectionmanager"
+	"github.com/mendersoftware/mender-connect/procps"
+	"github.com/mendersoftware/mender-connect/utils/wstest"
+)
+
+func TestMenderShellSharing(t *testing.T) {
+	shellSessions := NewMenderShellSessions(nil, nil)
+	shellSessions.SetMaxUserSessions(4)
+	received := make(chan *ws.ProtoMsg, 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrader = websocket.Upgrader{}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg := &ws.ProtoMsg{}
+			if msgpack.Unmarshal(data, msg) == nil {
+				received <- msg
+			}
+		}
+	}))
+	defer server.Close()
+	isOutput := func(sessionID string, text string) func(msg *ws.ProtoMsg) bool {
+		return func(msg *ws.ProtoMsg) bool {
+			return msg.Header.SessionID == sessionID &&
+				msg.Header.MsgType == wsshell.MessageTypeShellCommand &&
+				strings.Contains(string(msg.Body), text)
+		}
+	}
+	isAnnouncement := func(sessionID string, event string) func(msg *ws.ProtoMsg) bool {
+		return func(msg *ws.ProtoMsg) bool {
+			return msg.Header.SessionID == sessionID &&
+				msg.Header.MsgType == wsshell.MessageTypeShellCommand &&
+				msg.Header.Properties["event"] == event
+		}
+	}
+
+	u := "ws" + strings.TrimPrefix(server.URL, "http")
+	manager := connectionmanager.NewManager(testPingWait)
+	manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
+
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+
+	owner, err := shellSessions.NewSession(manager, uuid.NewV4().String(), "owner",
+		defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer shellSessions.DeleteById(owner.GetId())
+	err = owner.StartShell(owner.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+		ScrollbackSize: 1024,
+	})
+	assert.NoError(t, err)
+	defer owner.StopShell() //nolint:errcheck
+	shellCommand := func(s *MenderShellSession, command string) error {
+		return s.ShellCommand(&ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     ws.ProtoTypeShell,
+				MsgType:   wsshell.MessageTypeShellCommand,
+				SessionID: s.GetId(),
+			},
+			Body: []byte(command),
+		})
+	}
+	assert.NoError(t, shellCommand(owner, "echo first$((40+2))\n"))
+	wstest.WaitForMessage(t, received, isOutput(owner.GetId(), "first42"))
+
+	// an observer gets the output replayed, but cannot write
+	observer, err := shellSessions.NewSession(manager, uuid.NewV4().String(), "observer",
+		defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer shellSessions.DeleteById(observer.GetId())
+	assert.NoError(t, owner.AttachPeer(observer, false, 2))
+	assert.True(t, observer.IsPeer())
+	assert.Equal(t, []*MenderShellSession{observer}, owner.Peers())
+	msg := wstest.WaitForMessage(t, received, isAnnouncement(owner.GetId(), PeerEventAttached))
+	assert.EqualValues(t, wsshell.ControlMessage, msg.Header.Properties["status"])
+	assert.Equal(t, observer.GetId(), msg.Header.Properties["peer_session_id"])
+	assert.Equal(t, "observer", msg.Header.Properties["peer_user_id"])
+	assert.Equal(t, PeerModeObserver, msg.Header.Properties["peer_mode"])
+	assert.NoError(t, observer.ReplayScrollback())
+	wstest.WaitForMessage(t, received, isOutput(observer.GetId(), "first42"))
+	assert.Equal(t, ErrSessionReadOnly, shellCommand(observer, "echo no\n"))
+
+	// a writer attaches through the observer, to the shell of the owner
+	writer, err := shellSessions.NewSession(manager, uuid.NewV4().String(), "writer",
+		defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer shellSessions.DeleteById(writer.GetId())
+	assert.NoError(t, observer.AttachPeer(writer, true, 2))
+	assert.Equal(t, []*MenderShellSession{observer, writer}, owner.Peers())
+	wstest.WaitForMessage(t, received, isAnnouncement(observer.GetId(), PeerEventAttached))
+	assert.NoError(t, shellCommand(writer, "echo second$((40+2))\n"))
+	// the output fans out to all the participants, in any order
+	pending := map[string]bool{owner.GetId(): true, observer.GetId(): true, writer.GetId(): true}
+	wstest.WaitForMessage(t, received, func(msg *ws.ProtoMsg) bool {
+		if isOutput(msg.Header.SessionID, "second42")(msg) {
+			delete(pending, msg.Header.SessionID)
+		}
+		return len(pending) == 0
+	})
+
+	extra, err := shellSessions.NewSession(manager, uuid.NewV4().String(), "extra",
+		defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer shellSessions.DeleteById(extra.GetId())
+	assert.Equal(t, ErrSessionTooManyPeers, owner.AttachPeer(extra, false, 2))
+	assert.False(t, extra.IsPeer())
+
+	// the observer leaves, the shell keeps running
+	assert.NoError(t, observer.StopShell())
+	assert.False(t, observer.IsPeer())
+	assert.Equal(t, []*MenderShellSession{writer}, owner.Peers())
+	wstest.WaitForMessage(t, received, isAnnouncement(writer.GetId(), PeerEventDetached))
+	assert.True(t, procps.ProcessExists(owner.GetShellPid()))
+
+	// the writer is stopped and deleted along with the owner
+	assert.NoError(t, owner.StopShell())
+	wstest.WaitForMessage(t, received, func(msg *ws.ProtoMsg) bool {
+		return msg.Header.SessionID == writer.GetId() &&
+			msg.Header.MsgType == wsshell.MessageTypeStopShell
+	})
+	assert.False(t, writer.IsPeer())
+	assert.Equal(t, ErrSessionShellNotRunning, writer.StopShell())
+	assert.NoError(t, shellSessions.DeleteById(owner.GetId()))
+	assert.Nil(t, shellSessions.GetById(writer.GetId()))
+	assert.NotNil(t, shellSessions.GetById(observer.GetId()))
+}
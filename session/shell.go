@@ -19,6 +19,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"sync"
 	"syscall"
 	"time"
 
@@ -26,8 +27,12 @@ import (
 
 	"github.com/mendersoftware/go-lib-micro/ws"
 	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/mendersoftware/mender-connect/audit"
+	"github.com/mendersoftware/mender-connect/config"
 	"github.com/mendersoftware/mender-connect/connectionmanager"
+	"github.com/mendersoftware/mender-connect/logging"
 	"github.com/mendersoftware/mender-connect/procps"
+	"github.com/mendersoftware/mender-connect/recording"
 	"github.com/mendersoftware/mender-connect/shell"
 )
 
@@ -52,7 +57,8 @@ const (
 )
 
 const (
-	NoExpirationTimeout = time.Second * 0
+	NoExpirationTimeout    = time.Second * 0
+	DefaultMaxUserSessions = 1
 )
 
 var (
@@ -61,15 +67,15 @@ var (
 	ErrSessionShellTooManySessionsPerUser = errors.New("user has too many open sessions")
 	ErrSessionNotFound                    = errors.New("session not found")
 	ErrSessionTooManyShellsAlreadyRunning = errors.New("too many shells spawned")
+	ErrSessionReattachDisabled            = errors.New("reattaching to the session is disabled")
+	ErrSessionUserMismatch                = errors.New("session belongs to another user")
 )
 
 var (
-	defaultSessionExpiredTimeout     = 1024 * time.Second
-	defaultSessionIdleExpiredTimeout = NoExpirationTimeout
-	defaultTimeFormat                = "Mon Jan 2 15:04:05 -0700 MST 2006"
-	MaxUserSessions                  = 1
-	healthcheckInterval              = time.Second * 60
-	healthcheckTimeout               = time.Second * 5
+	defaultSessionExpiredTimeout = 1024 * time.Second
+	defaultTimeFormat            = "Mon Jan 2 15:04:05 -0700 MST 2006"
+	healthcheckInterval          = time.Second * 60
+	healthcheckTimeout           = time.Second * 5
 )
 
 type MenderShellTerminalSettings struct {
@@ -80,9 +86,21 @@ type MenderShellTerminalSettings struct {
 	TerminalString string
 	Height         uint16
 	Width          uint16
+	// Recording settings of the session
+	Recording config.RecordingConfig
+	// ReattachGracePeriod is the time the session is kept after losing its
+	// client, to be reattached to; zero disables reattaching
+	ReattachGracePeriod time.Duration
+	// ScrollbackSize is the size in bytes of the output replayed on reattach
+	// and to the sessions attached to the shell; zero keeps none
+	ScrollbackSize int
 }
 
 type MenderShellSession struct {
+	//registry the session is registered in
+	sessions *MenderShellSessions
+	//connection manager used to send messages to the backend
+	manager *connectionmanager.Manager
 	//mender shell represents a process of passing data between a running shell
 	//subprocess running
 	shell *shell.MenderShell
@@ -117,23 +135,116 @@ type MenderShellSession struct {
 	pong chan struct{}
 	// healthcheck
 	healthcheckTimeout time.Time
+	// recorder of the terminal, if recording
+	recorder *recording.Recorder
+	// recent output of the shell, replayed on reattach
+	scrollback *scrollback
+	// attachMutex protects detachedAt, the time the session lost its
+	// client, zero while attached
+	attachMutex sync.Mutex
+	detachedAt  time.Time
+	// shared is the session owning the shell the session is attached to,
+	// as a writer or a read-only observer, and peers are the sessions
+	// attached to the shell of the session; protected by sharingMutex
+	shared   *MenderShellSession
+	canWrite bool
+	peers    []*MenderShellSession
+	// peerOnly is set on the sessions created to attach to a shared shell,
+	// which do not count in the limit of sessions per user
+	peerOnly bool
 }
 
-var sessionsMap = map[string]*MenderShellSession{}
-var sessionsByUserIdMap = map[string][]*MenderShellSession{}
+// outputRecorders passes the output of the shell to each of the recorders
+// in turn
+type outputRecorders []shell.OutputRecorder
+
+func (o outputRecorders) Output(data []byte) {
+	for _, recorder := range o {
+		recorder.Output(data)
+	}
+}
+
+// MenderShellSessions is the registry of the shell sessions of a daemon,
+// which limits the number of sessions of each user, notifies the observer
+// when the sessions are created and deleted, and records the events of the
+// sessions to the audit log
+type MenderShellSessions struct {
+	// mutex protects the maps, the limit of sessions per user, and the
+	// idle timeout set by the last session created
+	mutex               sync.Mutex
+	sessionsMap         map[string]*MenderShellSession
+	sessionsByUserIdMap map[string][]*MenderShellSession
+	maxUserSessions     int
+	idleTimeout         time.Duration
+	observer            Observer
+	audit               *audit.Recorder
+}
+
+// NewMenderShellSessions returns an empty registry of shell sessions,
+// allowing DefaultMaxUserSessions per user; observer, if not nil, is
+// notified when the sessions are created and deleted, and recorder, if not
+// nil, records the events of the sessions
+func NewMenderShellSessions(observer Observer, recorder *audit.Recorder) *MenderShellSessions {
+	return &MenderShellSessions{
+		sessionsMap:         map[string]*MenderShellSession{},
+		sessionsByUserIdMap: map[string][]*MenderShellSession{},
+		maxUserSessions:     DefaultMaxUserSessions,
+		idleTimeout:         NoExpirationTimeout,
+		observer:            observer,
+		audit:               recorder,
+	}
+}
+
+// GetMaxUserSessions returns the number of shell sessions each user may open
+func (r *MenderShellSessions) GetMaxUserSessions() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.maxUserSessions
+}
+
+// SetMaxUserSessions sets the number of shell sessions each user may open;
+// zero restores the default
+func (r *MenderShellSessions) SetMaxUserSessions(max int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if max <= 0 {
+		max = DefaultMaxUserSessions
+	}
+	r.maxUserSessions = max
+}
 
 func timeNow() time.Time {
 	return time.Now().UTC()
 }
 
-func NewMenderShellSession(sessionId string, userId string, expireAfter time.Duration, expireAfterIdle time.Duration) (s *MenderShellSession, err error) {
-	if userSessions, ok := sessionsByUserIdMap[userId]; ok {
-		log.Debugf("user %s has %d sessions.", userId, len(userSessions))
-		if len(userSessions) >= MaxUserSessions {
+func (r *MenderShellSessions) NewSession(manager *connectionmanager.Manager, sessionId string, userId string, expireAfter time.Duration, expireAfterIdle time.Duration) (s *MenderShellSession, err error) {
+	return r.newSession(manager, sessionId, userId, expireAfter, expireAfterIdle, false)
+}
+
+// NewPeerSession returns a new session to attach to a shared shell with
+// AttachPeer; unlike the sessions running their own shell, it does not
+// count in the limit of sessions per user
+func (r *MenderShellSessions) NewPeerSession(manager *connectionmanager.Manager, sessionId string, userId string, expireAfter time.Duration, expireAfterIdle time.Duration) (s *MenderShellSession, err error) {
+	return r.newSession(manager, sessionId, userId, expireAfter, expireAfterIdle, true)
+}
+
+func (r *MenderShellSessions) newSession(manager *connectionmanager.Manager, sessionId string, userId string, expireAfter time.Duration, expireAfterIdle time.Duration, peerOnly bool) (s *MenderShellSession, err error) {
+	r.mutex.Lock()
+	if userSessions, ok := r.sessionsByUserIdMap[userId]; ok {
+		count := 0
+		for _, userSession := range userSessions {
+			if !userSession.peerOnly {
+				count++
+			}
+		}
+		log.WithField(logging.FieldUserID, userId).
+			Debugf("user %s has %d sessions.", userId, count)
+		if !peerOnly && count >= r.maxUserSessions {
+			r.mutex.Unlock()
 			return nil, ErrSessionShellTooManySessionsPerUser
 		}
 	} else {
-		sessionsByUserIdMap[userId] = []*MenderShellSession{}
+		r.sessionsByUserIdMap[userId] = []*MenderShellSession{}
 	}
 
 	if expireAfter == NoExpirationTimeout {
@@ -141,11 +252,13 @@ func NewMenderShellSession(sessionId string, userId string, expireAfter time.Dur
 	}
 
 	if expireAfterIdle != NoExpirationTimeout {
-		defaultSessionIdleExpiredTimeout = expireAfterIdle
+		r.idleTimeout = expireAfterIdle
 	}
 
 	createdAt := timeNow()
 	s = &MenderShellSession{
+		sessions:    r,
+		manager:     manager,
 		id:          sessionId,
 		userId:      userId,
 		createdAt:   createdAt,
@@ -154,60 +267,104 @@ func NewMenderShellSession(sessionId string, userId string, expireAfter time.Dur
 		status:      NewSession,
 		stop:        make(chan struct{}),
 		pong:        make(chan struct{}),
+		peerOnly:    peerOnly,
+	}
+	r.sessionsMap[sessionId] = s
+	r.sessionsByUserIdMap[userId] = append(r.sessionsByUserIdMap[userId], s)
+	r.mutex.Unlock()
+	if r.observer != nil {
+		r.observer.SessionOpened(s.Info())
 	}
-	sessionsMap[sessionId] = s
-	sessionsByUserIdMap[userId] = append(sessionsByUserIdMap[userId], s)
 	return s, nil
 }
 
-func MenderShellSessionGetCount() int {
-	return len(sessionsMap)
+func (r *MenderShellSessions) GetCount() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.sessionsMap)
 }
 
-func MenderShellSessionGetSessionIds() []string {
-	keys := make([]string, 0, len(sessionsMap))
-	for k := range sessionsMap {
+func (r *MenderShellSessions) GetSessionIds() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	keys := make([]string, 0, len(r.sessionsMap))
+	for k := range r.sessionsMap {
 		keys = append(keys, k)
 	}
 
 	return keys
 }
 
-func MenderShellSessionGetById(id string) *MenderShellSession {
-	if v, ok := sessionsMap[id]; ok {
+func (r *MenderShellSessions) GetById(id string) *MenderShellSession {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if v, ok := r.sessionsMap[id]; ok {
 		return v
 	} else {
 		return nil
 	}
 }
 
-func MenderShellDeleteById(id string) error {
-	if v, ok := sessionsMap[id]; ok {
-		userSessions := sessionsByUserIdMap[v.userId]
-		for i, s := range userSessions {
-			if s.id == id {
-				sessionsByUserIdMap[v.userId] = append(userSessions[:i], userSessions[i+1:]...)
-				break
-			}
+// sessions returns the registered sessions
+func (r *MenderShellSessions) sessions() []*MenderShellSession {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	sessions := make([]*MenderShellSession, 0, len(r.sessionsMap))
+	for _, s := range r.sessionsMap {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// remove unregisters the session, if still registered
+func (r *MenderShellSessions) remove(s *MenderShellSession) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.sessionsMap[s.id] != s {
+		return false
+	}
+	userSessions := r.sessionsByUserIdMap[s.userId]
+	for i, userSession := range userSessions {
+		if userSession == s {
+			r.sessionsByUserIdMap[s.userId] = append(userSessions[:i:i], userSessions[i+1:]...)
+			break
 		}
-		delete(sessionsMap, id)
-		return nil
-	} else {
+	}
+	delete(r.sessionsMap, s.id)
+	return true
+}
+
+func (r *MenderShellSessions) DeleteById(id string) error {
+	v := r.GetById(id)
+	if v == nil || !r.remove(v) {
 		return ErrSessionNotFound
 	}
+	v.detachPeer()
+	if r.observer != nil {
+		r.observer.SessionClosed(v.Info())
+	}
+	// the sessions attached to the shell go along
+	for _, peer := range v.takePeers() {
+		if r.remove(peer) && r.observer != nil {
+			r.observer.SessionClosed(peer.Info())
+		}
+	}
+	return nil
 }
 
-func MenderShellSessionsGetByUserId(userId string) []*MenderShellSession {
-	if v, ok := sessionsByUserIdMap[userId]; ok {
-		return v
+func (r *MenderShellSessions) GetByUserId(userId string) []*MenderShellSession {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if v, ok := r.sessionsByUserIdMap[userId]; ok {
+		return append([]*MenderShellSession(nil), v...)
 	} else {
 		return nil
 	}
 }
 
-func MenderShellStopByUserId(userId string) (count uint, err error) {
-	a := sessionsByUserIdMap[userId]
-	log.Debugf("stopping all shells of user %s.", userId)
+func (r *MenderShellSessions) StopByUserId(userId string) (count uint, err error) {
+	a := r.GetByUserId(userId)
+	log.WithField(logging.FieldUserID, userId).Debugf("stopping all shells of user %s.", userId)
 	if len(a) == 0 {
 		return 0, ErrSessionNotFound
 	}
@@ -215,6 +372,9 @@ func MenderShellStopByUserId(userId string) (count uint, err error) {
 	err = nil
 	for _, s := range a {
 		if s.shell == nil {
+			if s.IsPeer() {
+				_ = r.DeleteById(s.id)
+			}
 			continue
 		}
 		e := s.StopShell()
@@ -222,29 +382,32 @@ func MenderShellStopByUserId(userId string) (count uint, err error) {
 			err = e
 			continue
 		}
-		delete(sessionsMap, s.id)
+		_ = r.DeleteById(s.id)
 		count++
 	}
-	delete(sessionsByUserIdMap, userId)
+	r.mutex.Lock()
+	delete(r.sessionsByUserIdMap, userId)
+	r.mutex.Unlock()
 	return count, err
 }
 
-func MenderSessionTerminateAll() (shellCount int, sessionCount int, err error) {
+func (r *MenderShellSessions) TerminateAll() (shellCount int, sessionCount int, err error) {
 	shellCount = 0
 	sessionCount = 0
-	for id, s := range sessionsMap {
+	for _, s := range r.sessions() {
+		id := s.id
 		e := s.StopShell()
 		if e == nil {
 			shellCount++
 		} else {
-			log.Debugf("terminate sessions: failed to stop shell for session: %s: %s", id, e.Error())
+			s.logger().Debugf("terminate sessions: failed to stop shell for session: %s: %s", id, e.Error())
 			err = e
 		}
-		e = MenderShellDeleteById(id)
+		e = r.DeleteById(id)
 		if e == nil {
 			sessionCount++
 		} else {
-			log.Debugf("terminate sessions: failed to remove session: %s: %s", id, e.Error())
+			s.logger().Debugf("terminate sessions: failed to remove session: %s: %s", id, e.Error())
 			err = e
 		}
 	}
@@ -252,24 +415,25 @@ func MenderSessionTerminateAll() (shellCount int, sessionCount int, err error) {
 	return shellCount, sessionCount, err
 }
 
-func MenderSessionTerminateExpired() (shellCount int, sessionCount int, totalExpiredLeft int, err error) {
+func (r *MenderShellSessions) TerminateExpired() (shellCount int, sessionCount int, totalExpiredLeft int, err error) {
 	shellCount = 0
 	sessionCount = 0
 	totalExpiredLeft = 0
-	for id, s := range sessionsMap {
+	for _, s := range r.sessions() {
+		id := s.id
 		if s.IsExpired(false) {
 			e := s.StopShell()
 			if e == nil {
 				shellCount++
 			} else {
-				log.Debugf("expire sessions: failed to stop shell for session: %s: %s", id, e.Error())
+				s.logger().Debugf("expire sessions: failed to stop shell for session: %s: %s", id, e.Error())
 				err = e
 			}
-			e = MenderShellDeleteById(id)
+			e = r.DeleteById(id)
 			if e == nil {
 				sessionCount++
 			} else {
-				log.Debugf("expire sessions: failed to delete session: %s: %s", id, e.Error())
+				s.logger().Debugf("expire sessions: failed to delete session: %s: %s", id, e.Error())
 				totalExpiredLeft++
 				err = e
 			}
@@ -279,6 +443,36 @@ func MenderSessionTerminateExpired() (shellCount int, sessionCount int, totalExp
 	return shellCount, sessionCount, totalExpiredLeft, err
 }
 
+// Detach marks the sessions which may be reattached to as having lost
+// their client
+func (r *MenderShellSessions) Detach() {
+	for _, s := range r.sessions() {
+		if s.status == ActiveSession && s.terminal.ReattachGracePeriod > 0 {
+			s.Detach()
+		}
+	}
+}
+
+// logger returns the entry the session logs with
+func (s *MenderShellSession) logger() *log.Entry {
+	return log.WithFields(logging.SessionFields(s.id, s.userId, ws.ProtoTypeShell))
+}
+
+// Info returns the description of the session
+func (s *MenderShellSession) Info() Info {
+	activeAt := s.activeAt
+	if activeAt.IsZero() {
+		activeAt = s.createdAt
+	}
+	return Info{
+		ID:        s.id,
+		UserID:    s.userId,
+		Proto:     ws.ProtoTypeShell,
+		StartedAt: s.createdAt,
+		ActiveAt:  activeAt,
+	}
+}
+
 func (s *MenderShellSession) GetStatus() MenderSessionStatus {
 	return s.status
 }
@@ -299,10 +493,30 @@ func (s *MenderShellSession) GetShellCommandPath() string {
 	return s.command.Path
 }
 
-func (s *MenderShellSession) StartShell(sessionId string, terminal MenderShellTerminalSettings) error {
+func (s *MenderShellSession) StartShell(sessionId string, terminal MenderShellTerminalSettings) (err error) {
 	if s.status == ActiveSession || s.status == HangedSession {
 		return ErrSessionShellAlreadyRunning
 	}
+	defer func() {
+		event := audit.Event{
+			Type:      audit.EventShellSpawn,
+			SessionID: s.id,
+			UserID:    s.userId,
+			Command:   terminal.Shell,
+		}
+		if s.recorder != nil {
+			event.Path = s.recorder.Path()
+		}
+		s.sessions.audit.Record(event.WithResult(err))
+	}()
+
+	if terminal.Recording.Enable {
+		if s.recorder, err = s.startRecording(terminal); err != nil {
+			s.logger().Errorf("failed to start the recording of the session %s: %s",
+				s.id, err.Error())
+			return err
+		}
+	}
 
 	pid, pseudoTTY, cmd, err := shell.ExecuteShell(
 		terminal.Uid,
@@ -313,14 +527,24 @@ func (s *MenderShellSession) StartShell(sessionId string, terminal MenderShellTe
 		terminal.Height,
 		terminal.Width)
 	if err != nil {
+		s.discardRecording()
 		return err
 	}
 
 	//MenderShell represents a process of passing messages between backend
 	//and the shell subprocess (started above via shell.ExecuteShell) over
 	//the websocket connection
-	log.Infof("mender-connect starting shell command passing process, pid: %d", pid)
-	s.shell = shell.NewMenderShell(sessionId, pseudoTTY, pseudoTTY)
+	s.logger().Infof("mender-connect starting shell command passing process, pid: %d", pid)
+	s.shell = shell.NewMenderShell(s.manager, sessionId, pseudoTTY, pseudoTTY)
+	recorders := outputRecorders{peersOutput{session: s}}
+	if s.recorder != nil {
+		recorders = append(recorders, s.recorder)
+	}
+	if terminal.ScrollbackSize > 0 {
+		s.scrollback = newScrollback(terminal.ScrollbackSize)
+		recorders = append(recorders, s.scrollback)
+	}
+	s.shell.SetOutputRecorder(recorders)
 	s.shell.Start()
 
 	s.shellPid = pid
@@ -338,6 +562,57 @@ func (s *MenderShellSession) StartShell(sessionId string, terminal MenderShellTe
 	return nil
 }
 
+// startRecording prunes the old recordings and starts the one of the
+// session
+func (s *MenderShellSession) startRecording(
+	terminal MenderShellTerminalSettings,
+) (*recording.Recorder, error) {
+	conf := terminal.Recording
+	removed, err := recording.Prune(conf.Dir, int64(conf.MaxTotalSizeMB)*1024*1024,
+		time.Duration(conf.RetentionDays)*24*time.Hour)
+	for _, path := range removed {
+		s.logger().Infof("removed the recording %s", path)
+	}
+	if err != nil {
+		s.logger().Warnf("failed to remove the old recordings: %s", err.Error())
+	}
+	return recording.Start(recording.Settings{
+		Dir:       conf.Dir,
+		SessionID: s.id,
+		UserID:    s.userId,
+		Width:     terminal.Width,
+		Height:    terminal.Height,
+		Env: map[string]string{
+			"TERM":  terminal.TerminalString,
+			"SHELL": terminal.Shell,
+		},
+		MaxSize: int64(conf.MaxFileSizeMB) * 1024 * 1024,
+	})
+}
+
+// stopRecording closes the recording of the session, if any
+func (s *MenderShellSession) stopRecording() {
+	if s.recorder == nil {
+		return
+	}
+	if err := s.recorder.Close(); err != nil {
+		s.logger().Errorf("failed to close the recording %s: %s",
+			s.recorder.Path(), err.Error())
+	}
+	s.recorder = nil
+}
+
+// discardRecording closes and removes the recording of a shell which
+// failed to start
+func (s *MenderShellSession) discardRecording() {
+	if s.recorder == nil {
+		return
+	}
+	path := s.recorder.Path()
+	s.stopRecording()
+	os.Remove(path)
+}
+
 func (s *MenderShellSession) GetId() string {
 	return s.id
 }
@@ -347,8 +622,11 @@ func (s *MenderShellSession) GetShellPid() int {
 }
 
 func (s *MenderShellSession) IsExpired(setStatus bool) bool {
-	if defaultSessionIdleExpiredTimeout != NoExpirationTimeout {
-		idleTimeoutReached := s.activeAt.Add(defaultSessionIdleExpiredTimeout)
+	s.sessions.mutex.Lock()
+	idleExpiredTimeout := s.sessions.idleTimeout
+	s.sessions.mutex.Unlock()
+	if idleExpiredTimeout != NoExpirationTimeout {
+		idleTimeoutReached := s.activeAt.Add(idleExpiredTimeout)
 		return timeNow().After(idleTimeoutReached)
 	}
 	e := timeNow().After(s.expiresAt)
@@ -368,9 +646,17 @@ func (s *MenderShellSession) healthcheck() {
 			return
 		case <-s.pong:
 			s.healthcheckTimeout = time.Now().Add(healthcheckInterval + healthcheckTimeout)
+			s.attach()
 		case <-time.After(time.Until(s.healthcheckTimeout)):
 			if s.healthcheckTimeout.Before(time.Now()) {
-				log.Errorf("session %s, health check failed, connection with the client lost", s.id)
+				if s.terminal.ReattachGracePeriod > 0 {
+					s.logger().Warnf("session %s, health check failed, connection with the client lost; "+
+						"keeping the shell for %s to be reattached to", s.id, s.terminal.ReattachGracePeriod)
+					s.Detach()
+					s.healthcheckTimeout = time.Now().Add(healthcheckInterval + healthcheckTimeout)
+					break
+				}
+				s.logger().Errorf("session %s, health check failed, connection with the client lost", s.id)
 				s.expiresAt = time.Now()
 				return
 			}
@@ -394,63 +680,176 @@ func (s *MenderShellSession) healthcheckPing() {
 		},
 		Body: nil,
 	}
-	log.Debugf("session %s healthcheck ping", s.id)
-	err := connectionmanager.Write(ws.ProtoTypeShell, msg)
+	s.logger().Debugf("session %s healthcheck ping", s.id)
+	err := s.manager.Write(ws.ProtoTypeShell, msg)
 	if err != nil {
-		log.Debugf("error on write: %s", err.Error())
+		s.logger().Debugf("error on write: %s", err.Error())
 	}
 }
 
 func (s *MenderShellSession) HealthcheckPong() {
+	if s.IsPeer() {
+		// the shared shell checks the health of its own client
+		return
+	}
 	s.pong <- struct{}{}
 }
 
+// Detach marks the session as having lost its client, unless already
+// detached; the shell keeps running for the reattach grace period
+func (s *MenderShellSession) Detach() {
+	s.attachMutex.Lock()
+	defer s.attachMutex.Unlock()
+	if s.detachedAt.IsZero() {
+		s.detachedAt = timeNow()
+	}
+}
+
+func (s *MenderShellSession) attach() {
+	s.attachMutex.Lock()
+	defer s.attachMutex.Unlock()
+	s.detachedAt = time.Time{}
+}
+
+// DetachedAt returns the time the session lost its client, zero if
+// attached
+func (s *MenderShellSession) DetachedAt() time.Time {
+	s.attachMutex.Lock()
+	defer s.attachMutex.Unlock()
+	return s.detachedAt
+}
+
+// IsDetachedExpired tells if the session has been detached for longer
+// than its reattach grace period
+func (s *MenderShellSession) IsDetachedExpired() bool {
+	detachedAt := s.DetachedAt()
+	return !detachedAt.IsZero() && s.terminal.ReattachGracePeriod > 0 &&
+		timeNow().After(detachedAt.Add(s.terminal.ReattachGracePeriod))
+}
+
+// Reattach attaches the user back to the running shell of the session
+func (s *MenderShellSession) Reattach(userId string) (err error) {
+	if s.status != ActiveSession {
+		return ErrSessionShellNotRunning
+	} else if s.terminal.ReattachGracePeriod <= 0 {
+		return ErrSessionReattachDisabled
+	} else if userId != s.userId {
+		return ErrSessionUserMismatch
+	}
+	s.attach()
+	s.activeAt = timeNow()
+	s.sessions.audit.Record(audit.Event{
+		Type:      audit.EventShellReattach,
+		SessionID: s.id,
+		UserID:    s.userId,
+	})
+	s.logger().Infof("session %s reattached", s.id)
+	return nil
+}
+
+// ReplayScrollback sends the recent output of the shell, or of the shared
+// shell the session is attached to, to the client
+func (s *MenderShellSession) ReplayScrollback() error {
+	source := s
+	if shared, _ := s.sharedShell(); shared != nil {
+		source = shared
+	}
+	if source.scrollback == nil {
+		return nil
+	}
+	data := source.scrollback.Bytes()
+	chunkSize := ChunkSize(s.manager.GetMaxOutboundMessageSize())
+	for len(data) > 0 {
+		n := len(data)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		err := s.send(wsshell.MessageTypeShellCommand, wsshell.NormalMessage, data[:n], nil)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
 func (s *MenderShellSession) ShellCommand(m *ws.ProtoMsg) error {
 	s.activeAt = timeNow()
+	if shared, writer := s.sharedShell(); shared != nil {
+		if !writer {
+			return ErrSessionReadOnly
+		}
+		return shared.ShellCommand(m)
+	}
 	data := m.Body
 	commandLine := string(data)
 	n, err := s.writer.Write(data)
+	if s.recorder != nil && s.terminal.Recording.RecordInput {
+		s.recorder.Input(data[:n])
+	}
 	if err != nil && n != len(data) {
 		err = shell.ErrExecWriteBytesShort
 	}
 	if err != nil {
-		log.Debugf("error: '%s' while running '%s'.", err.Error(), commandLine)
+		s.logger().Debugf("error: '%s' while running '%s'.", err.Error(), commandLine)
 	} else {
-		log.Debugf("executed: '%s'", commandLine)
+		s.logger().Debugf("executed: '%s'", commandLine)
 	}
 	return err
 }
 
 func (s *MenderShellSession) ResizeShell(height, width uint16) {
+	if s.IsPeer() {
+		// the terminal of a shared shell has the size of its owner's
+		return
+	}
 	shell.ResizeShell(s.pseudoTTY, height, width)
+	if s.recorder != nil {
+		s.recorder.Resize(width, height)
+	}
 }
 
 func (s *MenderShellSession) StopShell() (err error) {
-	log.Infof("session %s status:%d stopping shell", s.id, s.status)
+	s.logger().Infof("session %s status:%d stopping shell", s.id, s.status)
+	if s.detachPeer() {
+		// the shared shell keeps running
+		return nil
+	}
 	if s.status != ActiveSession && s.status != HangedSession {
 		return ErrSessionShellNotRunning
 	}
+	defer func() {
+		s.sessions.audit.Record(audit.Event{
+			Type:      audit.EventShellStop,
+			SessionID: s.id,
+			UserID:    s.userId,
+		}.WithResult(err))
+	}()
 
 	close(s.stop)
 	s.shell.Stop()
+	s.closePeers()
+	s.stopRecording()
+	s.scrollback = nil
 	s.terminal = MenderShellTerminalSettings{}
 	s.status = EmptySession
 
 	p, err := os.FindProcess(s.shellPid)
 	if err != nil {
-		log.Errorf("session %s, shell pid %d, find process error: %s", s.id, s.shellPid, err.Error())
+		s.logger().Errorf("session %s, shell pid %d, find process error: %s", s.id, s.shellPid, err.Error())
 		return err
 	}
 	err = p.Signal(syscall.SIGINT)
 	if err != nil {
-		log.Errorf("session %s, shell pid %d, signal error: %s", s.id, s.shellPid, err.Error())
+		s.logger().Errorf("session %s, shell pid %d, signal error: %s", s.id, s.shellPid, err.Error())
 		return err
 	}
 	s.pseudoTTY.Close()
 
-	err = procps.TerminateAndWait(s.shellPid, s.command, 2*time.Second)
+	// the shell leads its own process group, terminate its children too
+	err = procps.TerminateGroupAndWait(s.shellPid, s.command, 2*time.Second, 2*time.Second)
 	if err != nil {
-		log.Errorf("session %s, shell pid %d, termination error: %s", s.id, s.shellPid, err.Error())
+		s.logger().Errorf("session %s, shell pid %d, termination error: %s", s.id, s.shellPid, err.Error())
 		return err
 	}
 
@@ -17,6 +17,7 @@ import (
 	"bufio"
 	"errors"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
@@ -32,19 +33,28 @@ var (
 
 const pipStdoutBufferSize = 255
 
+// OutputRecorder records the output of the shell
+type OutputRecorder interface {
+	Output(data []byte)
+}
+
 type MenderShell struct {
+	manager   *connectionmanager.Manager
 	sessionId string
 	r         io.Reader
 	w         io.Writer
+	mutex     sync.Mutex
 	running   bool
+	recorder  OutputRecorder
 }
 
 //Create a new shell, note that we assume that r Reader and w Writer
 //are already connected to the i/o of the shell process and ws websocket
 //is connected and ws.SetReadDeadline(time.Now().Add(defaultPingWait))
 //was already called and ping-pong was established
-func NewMenderShell(sessionId string, r io.Reader, w io.Writer) *MenderShell {
+func NewMenderShell(manager *connectionmanager.Manager, sessionId string, r io.Reader, w io.Writer) *MenderShell {
 	shell := MenderShell{
+		manager:   manager,
 		sessionId: sessionId,
 		r:         r,
 		w:         w,
@@ -54,19 +64,31 @@ func NewMenderShell(sessionId string, r io.Reader, w io.Writer) *MenderShell {
 }
 
 func (s *MenderShell) GetWriteTimeout() time.Duration {
-	return connectionmanager.GetWriteTimeout()
+	return s.manager.GetWriteTimeout()
+}
+
+// SetOutputRecorder sets the recorder of the output; it must be called
+// before Start
+func (s *MenderShell) SetOutputRecorder(recorder OutputRecorder) {
+	s.recorder = recorder
 }
 
 func (s *MenderShell) Start() {
-	go s.pipeStdout()
+	s.mutex.Lock()
 	s.running = true
+	s.mutex.Unlock()
+	go s.pipeStdout()
 }
 
 func (s *MenderShell) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.running = false
 }
 
 func (s *MenderShell) IsRunning() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return s.running
 }
 
@@ -88,7 +110,7 @@ func (s *MenderShell) sendStopMessage(err error) {
 		},
 		Body: body,
 	}
-	err = connectionmanager.Write(ws.ProtoTypeShell, msg)
+	err = s.manager.Write(ws.ProtoTypeShell, msg)
 	if err != nil {
 		log.Debugf("error on write: %s", err.Error())
 	}
@@ -109,6 +131,9 @@ func (s *MenderShell) pipeStdout() {
 		} else if !s.IsRunning() {
 			return
 		}
+		if s.recorder != nil {
+			s.recorder.Output(raw[:n])
+		}
 
 		msg := &ws.ProtoMsg{
 			Header: ws.ProtoHdr{
@@ -119,10 +144,11 @@ func (s *MenderShell) pipeStdout() {
 					"status": wsshell.NormalMessage,
 				},
 			},
-			Body: raw[:n],
+			// the message is written asynchronously, while raw is reused
+			Body: append([]byte(nil), raw[:n]...),
 		}
 
-		err = connectionmanager.Write(ws.ProtoTypeShell, msg)
+		err = s.manager.Write(ws.ProtoTypeShell, msg)
 		if err != nil {
 			log.Debugf("error on write: %s", err.Error())
 		}
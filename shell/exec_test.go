@@ -21,6 +21,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -33,14 +34,18 @@ import (
 	"github.com/vmihailenco/msgpack/v5"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/mender-connect/client/https"
 	"github.com/mendersoftware/mender-connect/connection"
 	"github.com/mendersoftware/mender-connect/connectionmanager"
 )
 
-var messages []string
+var (
+	messages      []string
+	messagesMutex sync.Mutex
+)
 
 func TestNewMenderShell(t *testing.T) {
-	s := NewMenderShell("", nil, nil)
+	s := NewMenderShell(connectionmanager.NewManager(0), "", nil, nil)
 	assert.NotNil(t, s)
 }
 
@@ -71,23 +76,25 @@ func echoMainServerLoop(w http.ResponseWriter, r *http.Request) {
 		m, err := readMessage(c)
 		if err == nil {
 			lines := strings.Split(string(m.Body), "\r\n")
-			for _, l := range lines {
-				messages = append(messages, l)
-			}
+			messagesMutex.Lock()
+			messages = append(messages, lines...)
+			messagesMutex.Unlock()
 		}
 		time.Sleep(1 * time.Second)
 		m, err = readMessage(c)
 		if err == nil {
 			lines := strings.Split(string(m.Body), "\r\n")
-			for _, l := range lines {
-				messages = append(messages, l)
-			}
+			messagesMutex.Lock()
+			messages = append(messages, lines...)
+			messagesMutex.Unlock()
 		}
 	}
 }
 
 func TestNewMenderShellReadStdIn(t *testing.T) {
+	messagesMutex.Lock()
 	messages = []string{}
+	messagesMutex.Unlock()
 	cmd := exec.Command("/bin/sh")
 	if cmd == nil {
 		t.Fatal("cant execute shell")
@@ -114,14 +121,15 @@ func TestNewMenderShellReadStdIn(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	err = connectionmanager.Connect(ws.ProtoTypeShell, u, "/", "token", true, "", 8, nil)
+	manager := connectionmanager.NewManager(0)
+	err = manager.Connect(ws.ProtoTypeShell, u, "/", "token", https.Config{NoVerify: true}, 8, nil)
 	assert.NoError(t, err)
 
-	webSock, err := connection.NewConnection(*urlString, "token", time.Second, 526, time.Second, false, "")
+	webSock, err := connection.NewConnection(*urlString, "token", time.Second, 526, time.Second, https.Config{})
 	assert.NoError(t, err)
 	assert.NotNil(t, webSock)
 
-	s := NewMenderShell(uuid.NewV4().String(), pseudoTTY, pseudoTTY)
+	s := NewMenderShell(manager, uuid.NewV4().String(), pseudoTTY, pseudoTTY)
 	assert.NotNil(t, s)
 
 	timeout := s.GetWriteTimeout()
@@ -135,10 +143,12 @@ func TestNewMenderShellReadStdIn(t *testing.T) {
 
 	time.Sleep(8 * time.Second)
 
-	connectionmanager.Close(ws.ProtoTypeShell)
+	manager.Close(ws.ProtoTypeShell)
 	s.Stop()
 	assert.False(t, s.IsRunning())
 
+	messagesMutex.Lock()
+	defer messagesMutex.Unlock()
 	assert.Contains(t, messages, message)
 }
 
@@ -162,11 +172,12 @@ func TestPipeStdout(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, urlString)
 
-	webSock, err := connection.NewConnection(*urlString, "token", time.Second, 526, time.Second, true, "")
+	webSock, err := connection.NewConnection(*urlString, "token", time.Second, 526, time.Second, https.Config{NoVerify: true})
 	assert.NoError(t, err)
 	assert.NotNil(t, webSock)
 
 	shell := &MenderShell{
+		manager:   connectionmanager.NewManager(0),
 		sessionId: "unit-tests-sessions-id",
 		r:         reader,
 		w:         writer,
@@ -191,7 +202,7 @@ func TestPipeStdout(t *testing.T) {
 	reader.Close()
 	writer.Close()
 
-	shell.running = false
+	shell.Stop()
 	time.Sleep(4 * time.Second)
 	rc = shell.IsRunning()
 	assert.False(t, rc)
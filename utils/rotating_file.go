@@ -0,0 +1,125 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is an append-only file rotated once it reaches its maximum
+// size: the file is renamed with the suffix .1, the previous .1 to .2 and so
+// on, up to the maximum number of backups
+type RotatingFile struct {
+	mutex      sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	perm       os.FileMode
+	file       *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens the file for appending, creating it with the given
+// permissions if it does not exist
+func OpenRotatingFile(
+	path string,
+	maxSize int64,
+	maxBackups int,
+	perm os.FileMode,
+) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		perm:       perm,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, f.perm)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// RotatedFilePath returns the path of the n-th backup of the file at path
+func RotatedFilePath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+func (f *RotatingFile) backupPath(n int) string {
+	return RotatedFilePath(f.path, n)
+}
+
+// rotate renames the file and the backups, removing the oldest one, and
+// opens a new file; the file is reopened even if renaming failed, so that
+// the next write tries again
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+	err := f.renameBackups()
+	if errOpen := f.open(); errOpen != nil {
+		return errOpen
+	}
+	return err
+}
+
+func (f *RotatingFile) renameBackups() error {
+	if f.maxBackups == 0 {
+		return os.Remove(f.path)
+	}
+	for n := f.maxBackups - 1; n > 0; n-- {
+		err := os.Rename(f.backupPath(n), f.backupPath(n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.backupPath(1))
+}
+
+// Write writes the entry to the file, rotating it first if the entry
+// would exceed the maximum size
+func (f *RotatingFile) Write(b []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the file
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingFile(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "utils")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	logPath := path.Join(tdir, "mender-connect.log")
+	err = ioutil.WriteFile(logPath, []byte("0123\n"), 0640)
+	assert.NoError(t, err)
+
+	file, err := OpenRotatingFile(logPath, 10, 2, 0640)
+	assert.NoError(t, err)
+	for _, entry := range []string{"abcd\n", "efgh\n", "ijkl\n", "mnop\n"} {
+		n, err := file.Write([]byte(entry))
+		assert.NoError(t, err)
+		assert.Equal(t, len(entry), n)
+	}
+	// an entry larger than the maximum size goes to a file of its own
+	_, err = file.Write([]byte(strings.Repeat("x", 20) + "\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	for name, expected := range map[string]string{
+		"mender-connect.log":   strings.Repeat("x", 20) + "\n",
+		"mender-connect.log.1": "mnop\n",
+		"mender-connect.log.2": "efgh\nijkl\n",
+	} {
+		b, err := ioutil.ReadFile(path.Join(tdir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(b), name)
+	}
+	_, err = os.Stat(path.Join(tdir, "mender-connect.log.3"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,49 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package wstest provides helpers for the tests exchanging protocol
+// messages with a websocket server
+package wstest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+)
+
+// Timeout is the time WaitForMessage waits for a matching message
+var Timeout = 5 * time.Second
+
+// WaitForMessage returns the first message received which matches, skipping
+// the ones received before it; the test fails if none is received in time
+func WaitForMessage(
+	t testing.TB,
+	received <-chan *ws.ProtoMsg,
+	match func(msg *ws.ProtoMsg) bool,
+) *ws.ProtoMsg {
+	t.Helper()
+	timeout := time.After(Timeout)
+	for {
+		select {
+		case msg := <-received:
+			if match(msg) {
+				return msg
+			}
+		case <-timeout:
+			t.Fatal("timeout waiting for a message")
+			return nil
+		}
+	}
+}
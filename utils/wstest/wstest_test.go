@@ -0,0 +1,36 @@
+// Copyright 2021 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wstest
+
+import (
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitForMessage(t *testing.T) {
+	received := make(chan *ws.ProtoMsg, 3)
+	for _, id := range []string{"1", "2", "3"} {
+		received <- &ws.ProtoMsg{Header: ws.ProtoHdr{SessionID: id}}
+	}
+
+	msg := WaitForMessage(t, received, func(msg *ws.ProtoMsg) bool {
+		return msg.Header.SessionID == "2"
+	})
+	assert.Equal(t, "2", msg.Header.SessionID)
+	// the messages before the matching one are skipped
+	assert.Len(t, received, 1)
+}